@@ -0,0 +1,356 @@
+// Package activitypub has what the site needs to federate as a single
+// ActivityPub actor: the JSON documents, HTTP Signatures, and a client for
+// fetching remote actors and delivering activities to their inboxes.
+//
+// See https://www.w3.org/TR/activitypub/ and, for how Mastodon and similar
+// servers use it, https://docs.joinmastodon.org/spec/activitypub/.
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/dubJay/safehttp"
+)
+
+const (
+	// ContentType is the media type of ActivityPub documents.
+	ContentType = "application/activity+json"
+	// Public is the collection addressing an activity to everyone.
+	Public = "https://www.w3.org/ns/activitystreams#Public"
+
+	// Largest document read from a remote server or an inbox.
+	MaxDocument = 1 << 20
+	keyBits     = 2048
+)
+
+// Context is the JSON-LD context of every document the site serves.
+var Context = []string{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"}
+
+// ErrNotActivityPub is returned for remote documents that aren't ActivityPub.
+var ErrNotActivityPub = errors.New("activitypub: not an ActivityPub document")
+
+// Actor is a person, service or the like that can follow and be followed.
+type Actor struct {
+	Context           interface{} `json:"@context,omitempty"`
+	ID                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername,omitempty"`
+	Name              string      `json:"name,omitempty"`
+	Summary           string      `json:"summary,omitempty"`
+	URL               string      `json:"url,omitempty"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox,omitempty"`
+	Followers         string      `json:"followers,omitempty"`
+	Endpoints         *Endpoints  `json:"endpoints,omitempty"`
+	PublicKey         PublicKey   `json:"publicKey"`
+}
+
+// Endpoints are an actor's server-wide endpoints.
+type Endpoints struct {
+	// Takes activities for every actor on the server at once.
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+// PublicKey is the key an actor's requests are signed with.
+type PublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+// DeliveryInbox is where to deliver activities for a, preferring the shared
+// inbox so a server with many followers gets each activity once.
+func (a Actor) DeliveryInbox() string {
+	if a.Endpoints != nil && a.Endpoints.SharedInbox != "" {
+		return a.Endpoints.SharedInbox
+	}
+	return a.Inbox
+}
+
+// Activity is something an actor did. Object is an id or an embedded object.
+type Activity struct {
+	Context   interface{} `json:"@context,omitempty"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Object    interface{} `json:"object"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+	Published string      `json:"published,omitempty"`
+}
+
+// ObjectID is the id of the activity's object, whether it's embedded or not.
+func (a Activity) ObjectID() string {
+	switch o := a.Object.(type) {
+	case string:
+		return o
+	case map[string]interface{}:
+		id, _ := o["id"].(string)
+		return id
+	}
+	return ""
+}
+
+// ObjectType is the type of an embedded object, or empty.
+func (a Activity) ObjectType() string {
+	if o, ok := a.Object.(map[string]interface{}); ok {
+		typ, _ := o["type"].(string)
+		return typ
+	}
+	return ""
+}
+
+// ObjectActor is the actor of an embedded activity, or empty.
+func (a Activity) ObjectActor() string {
+	if o, ok := a.Object.(map[string]interface{}); ok {
+		actor, _ := o["actor"].(string)
+		return actor
+	}
+	return ""
+}
+
+// Object is a post.
+type Object struct {
+	Context      interface{} `json:"@context,omitempty"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	Name         string      `json:"name,omitempty"`
+	Content      string      `json:"content"`
+	URL          string      `json:"url,omitempty"`
+	AttributedTo string      `json:"attributedTo"`
+	To           []string    `json:"to,omitempty"`
+	Cc           []string    `json:"cc,omitempty"`
+	Published    string      `json:"published,omitempty"`
+	Updated      string      `json:"updated,omitempty"`
+}
+
+// OrderedCollection is a list, such as an outbox, newest first.
+type OrderedCollection struct {
+	Context      interface{} `json:"@context,omitempty"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	TotalItems   int         `json:"totalItems"`
+	OrderedItems interface{} `json:"orderedItems,omitempty"`
+}
+
+// JRD is a WebFinger response.
+type JRD struct {
+	Subject string    `json:"subject"`
+	Aliases []string  `json:"aliases,omitempty"`
+	Links   []JRDLink `json:"links"`
+}
+
+type JRDLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+// IsActivityPub reports whether a media type, such as from an Accept header,
+// is one ActivityPub documents are served as.
+func IsActivityPub(mediaType string) bool {
+	t, params, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return false
+	}
+	return t == ContentType ||
+		(t == "application/ld+json" && params["profile"] == "https://www.w3.org/ns/activitystreams")
+}
+
+// LoadKey reads the PEM private key at path, making one if there isn't a
+// file there yet.
+func LoadKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return createKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("activitypub: no PEM data in %s", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("activitypub: invalid key in %s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("activitypub: key in %s is not RSA", path)
+	}
+	return key, nil
+}
+
+func createKey(path string) (*rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	// O_EXCL so a key another process just made isn't replaced.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+// PublicKeyPEM encodes the public half of key for an actor document.
+func PublicKeyPEM(key *rsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// ParsePublicKey decodes an actor's PEM public key.
+func ParsePublicKey(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("activitypub: no PEM data in public key")
+	}
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("activitypub: invalid public key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("activitypub: public key is not RSA")
+	}
+	return key, nil
+}
+
+// Config is safehttp.Config.
+type Config = safehttp.Config
+
+// Client signs its requests as the actor whose key is keyID.
+type Client struct {
+	http      *http.Client
+	keyID     string
+	key       *rsa.PrivateKey
+	userAgent string
+}
+
+// NewClient returns a Client that signs requests with key, published at keyID.
+func NewClient(keyID string, key *rsa.PrivateKey, cfg Config) *Client {
+	return &Client{
+		http:      safehttp.NewClient(cfg),
+		keyID:     keyID,
+		key:       key,
+		userAgent: cfg.UserAgent,
+	}
+}
+
+func (c *Client) do(req *http.Request, body []byte) (*http.Response, error) {
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	// Servers in authorized fetch mode want even GETs signed.
+	if err := Sign(req, body, c.keyID, c.key); err != nil {
+		return nil, err
+	}
+	return c.http.Do(req)
+}
+
+// FetchActor gets the actor document at id. The document must name id as
+// its own, or any server could answer for actors on another.
+func (c *Client) FetchActor(ctx context.Context, id string) (Actor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, id, nil)
+	if err != nil {
+		return Actor{}, err
+	}
+	req.Header.Set("Accept", ContentType)
+	resp, err := c.do(req, nil)
+	if err != nil {
+		return Actor{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Actor{}, fmt.Errorf("activitypub: fetching %s: %s", id, resp.Status)
+	}
+	if !IsActivityPub(resp.Header.Get("Content-Type")) {
+		return Actor{}, fmt.Errorf("%w: %s is %q", ErrNotActivityPub, id, resp.Header.Get("Content-Type"))
+	}
+	var actor Actor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxDocument)).Decode(&actor); err != nil {
+		return Actor{}, fmt.Errorf("activitypub: invalid actor at %s: %v", id, err)
+	}
+	if actor.ID == "" || actor.Inbox == "" {
+		return Actor{}, fmt.Errorf("%w: %s has no id or inbox", ErrNotActivityPub, id)
+	}
+	if actor.ID != id {
+		return Actor{}, fmt.Errorf("activitypub: %s claims to be %s", id, actor.ID)
+	}
+	return actor, nil
+}
+
+// FetchKey gets the actor that owns the public key keyID, and the key.
+func (c *Client) FetchKey(ctx context.Context, keyID string) (Actor, *rsa.PublicKey, error) {
+	// Keys are usually a fragment of their owner's document.
+	id, _, _ := strings.Cut(keyID, "#")
+	actor, err := c.FetchActor(ctx, id)
+	if err != nil {
+		return Actor{}, nil, err
+	}
+	if actor.PublicKey.ID != keyID || actor.PublicKey.Owner != actor.ID {
+		return Actor{}, nil, fmt.Errorf("activitypub: %s does not own key %s", actor.ID, keyID)
+	}
+	key, err := ParsePublicKey(actor.PublicKey.PublicKeyPem)
+	if err != nil {
+		return Actor{}, nil, err
+	}
+	return actor, key, nil
+}
+
+// Deliver posts activity to inbox.
+func (c *Client) Deliver(ctx context.Context, inbox string, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	resp, err := c.do(req, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, MaxDocument))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("activitypub: delivering to %s: %s", inbox, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+func testKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := LoadKey(filepath.Join(t.TempDir(), "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestLoadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	key, err := LoadKey(path)
+	if err != nil {
+		t.Fatalf("LoadKey of a new file failed: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file = %v, %v, want mode 0600", info, err)
+	}
+	again, err := LoadKey(path)
+	if err != nil || !again.Equal(key) {
+		t.Errorf("LoadKey of the existing file = %v, want the key it made", err)
+	}
+
+	if err := os.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKey(path); err == nil {
+		t.Error("LoadKey of a file without a key succeeded")
+	}
+}
+
+func TestPublicKeyPEM(t *testing.T) {
+	key := testKey(t)
+	s, err := PublicKeyPEM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParsePublicKey(s)
+	if err != nil || !pub.Equal(&key.PublicKey) {
+		t.Errorf("ParsePublicKey(PublicKeyPEM(key)) = %v, want the public key", err)
+	}
+	if _, err := ParsePublicKey("junk"); err == nil {
+		t.Error("ParsePublicKey of junk succeeded")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	key := testKey(t)
+	other := testKey(t)
+	body := []byte(`{"type":"Follow"}`)
+	signed := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "https://example.com/inbox?x=1", bytes.NewReader(body))
+		if err := Sign(req, body, "https://remote.example/actor#main-key", key); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	req := signed()
+	if err := Verify(req, body, &key.PublicKey); err != nil {
+		t.Errorf("Verify of a signed request failed: %v", err)
+	}
+	if id, err := KeyID(req); err != nil || id != "https://remote.example/actor#main-key" {
+		t.Errorf("KeyID = %q, %v, want the signing key", id, err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*http.Request) ([]byte, *rsa.PublicKey)
+	}{
+		{name: "other key", change: func(r *http.Request) ([]byte, *rsa.PublicKey) { return body, &other.PublicKey }},
+		{name: "other body", change: func(r *http.Request) ([]byte, *rsa.PublicKey) {
+			return []byte(`{"type":"Undo"}`), &key.PublicKey
+		}},
+		{name: "other path", change: func(r *http.Request) ([]byte, *rsa.PublicKey) {
+			r.URL.Path = "/other"
+			return body, &key.PublicKey
+		}},
+		{name: "other host", change: func(r *http.Request) ([]byte, *rsa.PublicKey) {
+			r.Host = "evil.example"
+			return body, &key.PublicKey
+		}},
+		{name: "unsigned", change: func(r *http.Request) ([]byte, *rsa.PublicKey) {
+			r.Header.Del("Signature")
+			return body, &key.PublicKey
+		}},
+		{name: "digest not signed", change: func(r *http.Request) ([]byte, *rsa.PublicKey) {
+			r.Header.Set("Signature", strings.Replace(r.Header.Get("Signature"), " digest", "", 1))
+			return body, &key.PublicKey
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := signed()
+			body, pub := tc.change(req)
+			if err := Verify(req, body, pub); !errors.Is(err, ErrSignature) {
+				t.Errorf("Verify = %v, want %v", err, ErrSignature)
+			}
+		})
+	}
+
+	t.Run("stale", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "https://example.com/inbox", bytes.NewReader(body))
+		req.Header.Set("Date", time.Now().Add(-MaxSkew-time.Hour).UTC().Format(http.TimeFormat))
+		if err := Sign(req, body, "k", key); err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(req, body, &key.PublicKey); !errors.Is(err, ErrSignature) {
+			t.Errorf("Verify of an old request = %v, want %v", err, ErrSignature)
+		}
+	})
+}
+
+func TestActivityObject(t *testing.T) {
+	var a Activity
+	if err := json.Unmarshal([]byte(`{"type":"Undo","object":{"id":"https://r.example/f/1","type":"Follow","actor":"https://r.example/u"}}`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.ObjectID() != "https://r.example/f/1" || a.ObjectType() != "Follow" || a.ObjectActor() != "https://r.example/u" {
+		t.Errorf("embedded object = %q %q %q", a.ObjectID(), a.ObjectType(), a.ObjectActor())
+	}
+	if err := json.Unmarshal([]byte(`{"type":"Follow","object":"https://site.example/actor"}`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.ObjectID() != "https://site.example/actor" || a.ObjectType() != "" {
+		t.Errorf("object id = %q %q, want the id only", a.ObjectID(), a.ObjectType())
+	}
+}
+
+func TestIsActivityPub(t *testing.T) {
+	for typ, want := range map[string]bool{
+		ContentType:                     true,
+		ContentType + "; charset=utf-8": true,
+		`application/ld+json; profile="https://www.w3.org/ns/activitystreams"`: true,
+		"application/ld+json": false,
+		"application/json":    false,
+		"text/html":           false,
+		"":                    false,
+	} {
+		if got := IsActivityPub(typ); got != want {
+			t.Errorf("IsActivityPub(%q) = %t, want %t", typ, got, want)
+		}
+	}
+}
+
+// remote serves an actor with key, and records the activities delivered to
+// its inbox after checking they are signed with ours.
+type remote struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	ours      *rsa.PublicKey
+	contentTy string
+	delivered []Activity
+}
+
+func newRemote(t *testing.T, ours *rsa.PublicKey) *remote {
+	r := &remote{key: testKey(t), ours: ours, contentTy: ContentType}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/actor", func(w http.ResponseWriter, req *http.Request) {
+		if err := Verify(req, nil, r.ours); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		pem, _ := PublicKeyPEM(r.key)
+		w.Header().Set("Content-Type", r.contentTy)
+		json.NewEncoder(w).Encode(Actor{
+			ID: r.URL + "/actor", Type: "Person", Inbox: r.URL + "/inbox",
+			Endpoints: &Endpoints{SharedInbox: r.URL + "/shared"},
+			PublicKey: PublicKey{ID: r.URL + "/actor#main-key", Owner: r.URL + "/actor", PublicKeyPem: pem},
+		})
+	})
+	// impostor signs with its own key but claims to be an actor elsewhere.
+	mux.HandleFunc("/impostor", func(w http.ResponseWriter, req *http.Request) {
+		pem, _ := PublicKeyPEM(r.key)
+		w.Header().Set("Content-Type", r.contentTy)
+		json.NewEncoder(w).Encode(Actor{
+			ID: "https://mastodon.social/users/alice", Type: "Person", Inbox: r.URL + "/inbox",
+			PublicKey: PublicKey{ID: r.URL + "/impostor#main-key", Owner: "https://mastodon.social/users/alice", PublicKeyPem: pem},
+		})
+	})
+	mux.HandleFunc("/shared", func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if err := Verify(req, body, r.ours); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var a Activity
+		json.Unmarshal(body, &a)
+		r.delivered = append(r.delivered, a)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	r.Server = httptest.NewServer(mux)
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestClient(t *testing.T) {
+	key := testKey(t)
+	r := newRemote(t, &key.PublicKey)
+	c := NewClient("https://site.example/actor#main-key", key, Config{AllowPrivate: true})
+
+	actor, pub, err := c.FetchKey(ctx, r.URL+"/actor#main-key")
+	if err != nil {
+		t.Fatalf("FetchKey failed: %v", err)
+	}
+	if !pub.Equal(&r.key.PublicKey) || actor.DeliveryInbox() != r.URL+"/shared" {
+		t.Errorf("FetchKey = %+v, want the remote actor and its key", actor)
+	}
+	if _, _, err := c.FetchKey(ctx, r.URL+"/actor#other-key"); err == nil {
+		t.Error("FetchKey of a key the actor doesn't have succeeded")
+	}
+	if actor, _, err := c.FetchKey(ctx, r.URL+"/impostor#main-key"); err == nil {
+		t.Errorf("FetchKey of an actor claiming another's id = %s, want an error", actor.ID)
+	}
+
+	follow := Activity{ID: "https://site.example/follow", Type: "Follow", Actor: "https://site.example/actor", Object: actor.ID}
+	if err := c.Deliver(ctx, actor.DeliveryInbox(), follow); err != nil {
+		t.Fatalf("Deliver failed: %v", err)
+	}
+	if len(r.delivered) != 1 || r.delivered[0].ObjectID() != actor.ID {
+		t.Errorf("delivered %+v, want the follow", r.delivered)
+	}
+	if err := c.Deliver(ctx, r.URL+"/missing", follow); err == nil {
+		t.Error("Deliver to a missing inbox succeeded")
+	}
+
+	r.contentTy = "text/html"
+	if _, err := c.FetchActor(ctx, r.URL+"/actor"); !errors.Is(err, ErrNotActivityPub) {
+		t.Errorf("FetchActor of HTML = %v, want %v", err, ErrNotActivityPub)
+	}
+	if _, err := NewClient("k", key, Config{}).FetchActor(ctx, r.URL+"/actor"); err == nil {
+		t.Error("FetchActor of a private address succeeded")
+	}
+}
@@ -0,0 +1,160 @@
+package activitypub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTP Signatures as servers on the fediverse use them: draft-cavage-http-signatures
+// with rsa-sha256, over the request target, host, date and body digest.
+// https://datatracker.ietf.org/doc/html/draft-cavage-http-signatures-12
+
+// MaxSkew is how far a signed request's Date may be from now.
+const MaxSkew = 12 * time.Hour
+
+// ErrSignature is returned for requests without a valid signature.
+var ErrSignature = errors.New("activitypub: invalid signature")
+
+// Digest is the Digest header for body.
+func Digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Sign adds a Signature header to req, made with key and naming keyID as
+// the key to check it with. body is what req will send, if anything.
+func Sign(req *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	if req.Header.Get("Date") == "" {
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		req.Header.Set("Digest", Digest(body))
+		headers = append(headers, "digest")
+	}
+	sum := sha256.Sum256([]byte(signingString(req, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// KeyID returns the id of the key req says it is signed with, so the key
+// can be fetched for Verify.
+func KeyID(req *http.Request) (string, error) {
+	params, err := signatureParams(req)
+	if err != nil {
+		return "", err
+	}
+	return params["keyId"], nil
+}
+
+// Verify checks that req, which sent body, was signed with key, that the
+// signature covers the headers that matter, and that it is recent.
+func Verify(req *http.Request, body []byte, key *rsa.PublicKey) error {
+	params, err := signatureParams(req)
+	if err != nil {
+		return err
+	}
+	if alg := params["algorithm"]; alg != "" && alg != "rsa-sha256" && alg != "hs2019" {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrSignature, alg)
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	signed := map[string]bool{}
+	for _, h := range headers {
+		signed[h] = true
+	}
+	for _, h := range []string{"(request-target)", "host", "date"} {
+		if !signed[h] {
+			return fmt.Errorf("%w: %s is not signed", ErrSignature, h)
+		}
+	}
+
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return fmt.Errorf("%w: invalid date %q", ErrSignature, req.Header.Get("Date"))
+	}
+	if skew := time.Since(date); skew > MaxSkew || skew < -MaxSkew {
+		return fmt.Errorf("%w: date %s is too far from now", ErrSignature, date)
+	}
+	if body != nil {
+		if !signed["digest"] {
+			return fmt.Errorf("%w: digest is not signed", ErrSignature)
+		}
+		if req.Header.Get("Digest") != Digest(body) {
+			return fmt.Errorf("%w: digest does not match the body", ErrSignature)
+		}
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+	sum := sha256.Sum256([]byte(signingString(req, headers)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+	return nil
+}
+
+func signingString(req *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		var value string
+		switch h {
+		case "(request-target)":
+			value = strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		default:
+			value = strings.Join(req.Header.Values(h), ", ")
+		}
+		lines[i] = h + ": " + value
+	}
+	return strings.Join(lines, "\n")
+}
+
+// signatureParams parses the Signature header, which is a list of key="value"
+// pairs.
+func signatureParams(req *http.Request) (map[string]string, error) {
+	header := req.Header.Get("Signature")
+	if header == "" {
+		return nil, fmt.Errorf("%w: no Signature header", ErrSignature)
+	}
+	params := map[string]string{}
+	for header != "" {
+		var pair string
+		// Values are quoted and can't contain quotes, but can contain commas.
+		key, rest, ok := strings.Cut(header, "=")
+		if !ok || !strings.HasPrefix(rest, `"`) {
+			return nil, fmt.Errorf("%w: malformed Signature header", ErrSignature)
+		}
+		pair, rest, ok = strings.Cut(rest[1:], `"`)
+		if !ok {
+			return nil, fmt.Errorf("%w: malformed Signature header", ErrSignature)
+		}
+		params[strings.TrimSpace(key)] = pair
+		header = strings.TrimLeft(rest, ", ")
+	}
+	if params["keyId"] == "" || params["signature"] == "" {
+		return nil, fmt.Errorf("%w: no keyId or signature", ErrSignature)
+	}
+	return params, nil
+}
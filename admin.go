@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/serving"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+)
+
+const (
+	kCawdAdminPage = "kcawd_admin.html"
+	kCawdAdminPath = "/admin/kcawd"
+
+	// Room for the form fields around an uploaded PDF.
+	formOverhead = 1 << 20
+)
+
+// Every PDF starts with this, followed by the version.
+var pdfMagic = []byte("%PDF-")
+
+// adminEnabled reports whether the admin pages are served at all.
+func (s *server) adminEnabled() bool {
+	return s.cfg.adminPassword != ""
+}
+
+// newCSRFKey returns a key for signing CSRF tokens. It is not persisted, so
+// forms loaded before a restart have to be reloaded.
+func newCSRFKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate CSRF key: %v", err)
+	}
+	return key, nil
+}
+
+// adminRoutes registers the admin pages on router behind Basic auth and CSRF
+// protection.
+func (s *server) adminRoutes(router *mux.Router) {
+	protect := csrf.Protect(s.csrfKey,
+		csrf.Path("/admin"),
+		csrf.Secure(s.cfg.secureCookies),
+		csrf.ErrorHandler(http.HandlerFunc(s.csrfFailure)))
+
+	admin := router.PathPrefix("/admin").Subrouter()
+	// The CSRF check parses the form, so the body has to be limited first.
+	admin.Use(s.requireAdmin, s.limitUploads, plaintextRequests, protect)
+	admin.Handle("/kcawd", s.handle(s.buildKCawdAdmin)).Methods("GET")
+	admin.Handle("/kcawd", s.handle(s.createArticle)).Methods("POST")
+	admin.Handle("/kcawd/{id:[0-9]+}", s.handle(s.updateArticle)).Methods("POST")
+	admin.Handle("/kcawd/{id:[0-9]+}/delete", s.handle(s.deleteArticle)).Methods("POST")
+	admin.Handle("/comments", s.handle(s.buildCommentsAdmin)).Methods("GET")
+	admin.Handle("/comments/{id:[0-9]+}/{action:approve|reject|spam}", s.handle(s.moderateComment)).Methods("POST")
+}
+
+// csrfFailure is served in place of a form submission without a valid CSRF
+// token.
+func (s *server) csrfFailure(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s: %d: %v", r.Method, r.URL.Path, http.StatusForbidden, csrf.FailureReason(r))
+	s.writeError(w, r, http.StatusForbidden, "the form has expired, please reload the page and try again")
+}
+
+// requireAdmin asks for the admin credentials with HTTP Basic auth.
+func (s *server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.cfg.adminUser)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.adminPassword)) == 1
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+			s.writeError(w, r, http.StatusUnauthorized, "you need to log in to see this page")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitUploads rejects request bodies bigger than the largest allowed PDF plus
+// the rest of its form.
+func (s *server) limitUploads(next http.Handler) http.Handler {
+	limit := s.cfg.maxArticleSize + formOverhead
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			s.writeError(w, r, http.StatusRequestEntityTooLarge, tooLargeMessage(s.cfg.maxArticleSize))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// plaintextRequests tells the CSRF middleware which requests came in over
+// plain HTTP, where it can't insist on a same-origin Referer.
+func plaintextRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			r = csrf.PlaintextHTTPRequest(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) buildKCawdAdmin(w http.ResponseWriter, r *http.Request) error {
+	articles, err := s.articleStore.GetArticleMeta(r.Context())
+	if err != nil {
+		return storeError("failed to retrieve katy's articles from archive",
+			fmt.Errorf("unable to retrieve kcawd article metadata: %w", err))
+	}
+
+	return s.render(w, kCawdAdminPage, serving.ArticleAdminToServing(articles, csrf.TemplateField(r)))
+}
+
+func (s *server) createArticle(w http.ResponseWriter, r *http.Request) error {
+	meta, err := s.articleForm(r)
+	if err != nil {
+		return err
+	}
+	file, err := s.articleFile(r, true)
+	if err != nil {
+		return err
+	}
+
+	if err := s.articleStore.CreateArticle(r.Context(), meta, *file); err != nil {
+		return storeError("failed to save article", fmt.Errorf("unable to create article %d: %w", meta.EntryId, err))
+	}
+	log.Printf("created kcawd article %d (%q)", meta.EntryId, meta.Title)
+	s.extractor.request()
+	http.Redirect(w, r, kCawdAdminPath, http.StatusSeeOther)
+	return nil
+}
+
+func (s *server) updateArticle(w http.ResponseWriter, r *http.Request) error {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	meta, err := s.articleForm(r)
+	if err != nil {
+		return err
+	}
+	// Leaving the file input empty keeps the current PDF.
+	file, err := s.articleFile(r, false)
+	if err != nil {
+		return err
+	}
+
+	if err := s.articleStore.UpdateArticle(r.Context(), id, meta, file); err != nil {
+		return storeError("failed to save article", fmt.Errorf("unable to update article %d: %w", id, err))
+	}
+	log.Printf("updated kcawd article %d (now %d, %q)", id, meta.EntryId, meta.Title)
+	if file != nil {
+		s.extractor.request()
+	}
+	http.Redirect(w, r, kCawdAdminPath, http.StatusSeeOther)
+	return nil
+}
+
+func (s *server) deleteArticle(w http.ResponseWriter, r *http.Request) error {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if err := s.articleStore.DeleteArticle(r.Context(), id); err != nil {
+		return storeError("failed to delete article", fmt.Errorf("unable to delete article %d: %w", id, err))
+	}
+	log.Printf("deleted kcawd article %d", id)
+	http.Redirect(w, r, kCawdAdminPath, http.StatusSeeOther)
+	return nil
+}
+
+// articleForm parses an upload or edit form and returns the metadata in it.
+func (s *server) articleForm(r *http.Request) (db.ArticleMeta, error) {
+	if err := r.ParseMultipartForm(formOverhead); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return db.ArticleMeta{}, statusError(http.StatusRequestEntityTooLarge, tooLargeMessage(s.cfg.maxArticleSize), err)
+		}
+		return db.ArticleMeta{}, statusError(http.StatusBadRequest, "the form could not be read", err)
+	}
+
+	meta := db.ArticleMeta{
+		Title:        strings.TrimSpace(r.PostFormValue("title")),
+		Organization: strings.TrimSpace(r.PostFormValue("organization")),
+		Hyperlink:    strings.TrimSpace(r.PostFormValue("hyperlink")),
+	}
+	if meta.Title == "" {
+		return meta, statusError(http.StatusBadRequest, "a title is required", errors.New("missing title"))
+	}
+	if meta.Hyperlink != "" {
+		if u, err := url.Parse(meta.Hyperlink); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return meta, statusError(http.StatusBadRequest, "the link must be an http or https URL",
+				fmt.Errorf("invalid hyperlink %q", meta.Hyperlink))
+		}
+	}
+	date, err := time.ParseInLocation(serving.ArticleDateLayout, r.PostFormValue("date"), time.Local)
+	if err != nil {
+		return meta, statusError(http.StatusBadRequest, "the date must look like 2006-01-02", err)
+	}
+	// Articles are identified by their date.
+	meta.EntryId = int(date.Unix())
+	return meta, nil
+}
+
+// articleFile checks the uploaded PDF and stores it in the article storage,
+// or reads it for the database if there isn't any. It returns nil if no file
+// was uploaded and one isn't required.
+func (s *server) articleFile(r *http.Request, required bool) (*db.ArticleFile, error) {
+	upload, header, err := r.FormFile("pdf")
+	if errors.Is(err, http.ErrMissingFile) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, statusError(http.StatusBadRequest, "a PDF is required", err)
+	}
+	defer upload.Close()
+
+	if header.Size > s.cfg.maxArticleSize {
+		return nil, statusError(http.StatusRequestEntityTooLarge, tooLargeMessage(s.cfg.maxArticleSize),
+			fmt.Errorf("upload %s is %d bytes", header.Filename, header.Size))
+	}
+	if err := checkPDF(upload); err != nil {
+		return nil, statusError(http.StatusUnsupportedMediaType, "the file is not a PDF",
+			fmt.Errorf("upload %s: %v", header.Filename, err))
+	}
+
+	if s.articles == nil {
+		pdf, err := io.ReadAll(upload)
+		if err != nil {
+			return nil, serverError("failed to read upload", err)
+		}
+		return &db.ArticleFile{PDF: pdf}, nil
+	}
+	h := sha256.New()
+	key, size, err := s.articles.Put(io.TeeReader(upload, h))
+	if err != nil {
+		return nil, serverError("failed to store upload", fmt.Errorf("unable to store %s: %v", header.Filename, err))
+	}
+	return &db.ArticleFile{Location: key, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// checkPDF reports whether f starts like a PDF and rewinds it.
+func checkPDF(f multipart.File) error {
+	head := make([]byte, len(pdfMagic))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return fmt.Errorf("reading header: %v", err)
+	}
+	if !bytes.Equal(head, pdfMagic) {
+		return fmt.Errorf("header %q is not %q", head, pdfMagic)
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+func tooLargeMessage(limit int64) string {
+	return fmt.Sprintf("the PDF must be smaller than %d MB", limit>>20)
+}
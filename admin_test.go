@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dubJay/storage"
+)
+
+const testPassword = "secret"
+
+// adminClient drives the admin pages the way a browser would, carrying the
+// CSRF cookie and token from page to form.
+type adminClient struct {
+	t      *testing.T
+	router http.Handler
+	cookie string
+	token  string
+}
+
+func newAdminClient(t *testing.T, opts ...func(*config)) (*adminClient, *server) {
+	t.Helper()
+	opts = append([]func(*config){func(cfg *config) {
+		cfg.articles = ""
+		cfg.adminUser = "admin"
+		cfg.adminPassword = testPassword
+		cfg.maxArticleSize = 1 << 10
+	}}, opts...)
+	s := newTestServer(t, opts...)
+	return &adminClient{t: t, router: s.routes()}, s
+}
+
+var tokenField = regexp.MustCompile(`name="gorilla.csrf.Token" value="([^"]+)"`)
+
+// load fetches the admin page, keeping its CSRF token, and returns the body.
+func (c *adminClient) load() string {
+	c.t.Helper()
+	return c.loadPage(kCawdAdminPath)
+}
+
+// loadPage fetches the admin page at path, keeping its CSRF token, and
+// returns the body.
+func (c *adminClient) loadPage(path string) string {
+	c.t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.SetBasicAuth("admin", testPassword)
+	rec := httptest.NewRecorder()
+	c.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		c.t.Fatalf("GET %s = %d, want 200", path, rec.Code)
+	}
+	m := tokenField.FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		c.t.Fatalf("no CSRF token in %q", rec.Body.String())
+	}
+	c.token = m[1]
+	c.cookie = strings.Split(rec.Header().Get("Set-Cookie"), ";")[0]
+	return rec.Body.String()
+}
+
+// post submits a multipart form to path. A "pdf" field is sent as a file.
+func (c *adminClient) post(path string, fields map[string]string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if k == "pdf" {
+			fw, _ := mw.CreateFormFile(k, "upload.pdf")
+			fw.Write([]byte(v))
+			continue
+		}
+		mw.WriteField(k, v)
+	}
+	if c.token != "" {
+		mw.WriteField("gorilla.csrf.Token", c.token)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Cookie", c.cookie)
+	req.SetBasicAuth("admin", testPassword)
+	rec := httptest.NewRecorder()
+	c.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func (c *adminClient) get(path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	c.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+// articlePath returns the PDF path of the article dated date.
+func articlePath(date string) string {
+	d, _ := time.ParseInLocation("2006-01-02", date, time.Local)
+	return "/kcawd/" + strconv.FormatInt(d.Unix(), 10)
+}
+
+func TestAdminAuth(t *testing.T) {
+	c, _ := newAdminClient(t)
+
+	tests := []struct {
+		name       string
+		user, pass string
+		wantStatus int
+	}{
+		{name: "no credentials", wantStatus: http.StatusUnauthorized},
+		{name: "wrong password", user: "admin", pass: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "wrong user", user: "root", pass: testPassword, wantStatus: http.StatusUnauthorized},
+		{name: "ok", user: "admin", pass: testPassword, wantStatus: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, kCawdAdminPath, nil)
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.pass)
+			}
+			rec := httptest.NewRecorder()
+			c.router.ServeHTTP(rec, req)
+			if rec.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	router := newTestServer(t).routes()
+	req := httptest.NewRequest(http.MethodGet, kCawdAdminPath, nil)
+	req.SetBasicAuth("", "")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 without an admin password", rec.Code)
+	}
+}
+
+func TestAdminCSRF(t *testing.T) {
+	c, _ := newAdminClient(t)
+	c.load()
+	c.token = ""
+	rec := c.post(kCawdAdminPath, map[string]string{"title": "T", "date": "2021-05-01", "pdf": "%PDF-1.4 new"})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("upload without token = %d, want 403", rec.Code)
+	}
+}
+
+func TestAdminUpload(t *testing.T) {
+	valid := map[string]string{"title": "New", "organization": "Org", "hyperlink": "https://example.com/new", "date": "2021-05-01",
+		"pdf": "%PDF-1.4 new"}
+	with := func(k, v string) map[string]string {
+		fields := map[string]string{}
+		for key, value := range valid {
+			fields[key] = value
+		}
+		if v == "" {
+			delete(fields, k)
+		} else {
+			fields[k] = v
+		}
+		return fields
+	}
+
+	tests := []struct {
+		name       string
+		fields     map[string]string
+		wantStatus int
+	}{
+		{name: "ok", fields: valid, wantStatus: http.StatusSeeOther},
+		{name: "missing title", fields: with("title", ""), wantStatus: http.StatusBadRequest},
+		{name: "bad date", fields: with("date", "May 1st"), wantStatus: http.StatusBadRequest},
+		{name: "bad link", fields: with("hyperlink", "javascript:alert(1)"), wantStatus: http.StatusBadRequest},
+		{name: "missing pdf", fields: with("pdf", ""), wantStatus: http.StatusBadRequest},
+		{name: "not a pdf", fields: with("pdf", "<html>not a pdf</html>"), wantStatus: http.StatusUnsupportedMediaType},
+		{name: "too large", fields: with("pdf", "%PDF-"+strings.Repeat("x", 2<<10)), wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := newAdminClient(t)
+			c.load()
+			rec := c.post(kCawdAdminPath, tc.fields)
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tc.wantStatus, rec.Body.String())
+			}
+			if rec.Code != http.StatusSeeOther {
+				return
+			}
+			if loc := rec.Header().Get("Location"); loc != kCawdAdminPath {
+				t.Errorf("Location = %q, want %q", loc, kCawdAdminPath)
+			}
+			if body := c.load(); !strings.Contains(body, ":New:Org:2021-05-01|") {
+				t.Errorf("admin page = %q, want the new article", body)
+			}
+			if pdf := c.get(articlePath("2021-05-01")); pdf.Code != http.StatusOK || pdf.Body.String() != "%PDF-1.4 new" {
+				t.Errorf("GET new pdf = %d %q", pdf.Code, pdf.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminUploadDateTaken(t *testing.T) {
+	c, _ := newAdminClient(t)
+	c.load()
+	fields := map[string]string{"title": "New", "date": "2021-05-01", "pdf": "%PDF-1.4 new"}
+	if rec := c.post(kCawdAdminPath, fields); rec.Code != http.StatusSeeOther {
+		t.Fatalf("first upload = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := c.post(kCawdAdminPath, fields); rec.Code != http.StatusConflict {
+		t.Errorf("second upload on the same date = %d, want 409", rec.Code)
+	}
+}
+
+func TestAdminUploadToStorage(t *testing.T) {
+	dir := t.TempDir()
+	c, s := newAdminClient(t, func(cfg *config) { cfg.articles = "cas:" + dir })
+	c.load()
+	if rec := c.post(kCawdAdminPath, map[string]string{"title": "Stored", "date": "2021-05-01", "pdf": "%PDF-1.4 new"}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("upload = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	d, _ := time.ParseInLocation("2006-01-02", "2021-05-01", time.Local)
+	article, err := s.articleStore.GetArticle(context.Background(), int(d.Unix()))
+	if err != nil || article.Location == "" || article.Location != article.SHA256 || article.Size != 12 {
+		t.Fatalf("GetArticle = %+v, %v, want it in storage", article, err)
+	}
+	if f, err := storage.CAS(dir).Open(article.Location); err != nil {
+		t.Errorf("stored file missing: %v", err)
+	} else {
+		f.Close()
+	}
+	if pdf := c.get(articlePath("2021-05-01")); pdf.Code != http.StatusOK || pdf.Body.String() != "%PDF-1.4 new" {
+		t.Errorf("GET stored pdf = %d %q", pdf.Code, pdf.Body.String())
+	}
+}
+
+func TestAdminEditAndDelete(t *testing.T) {
+	c, _ := newAdminClient(t)
+	c.load()
+	const path = kCawdAdminPath + "/1600000000"
+
+	// Keeps the PDF when no file is sent.
+	rec := c.post(path, map[string]string{"title": "Renamed", "organization": "Org", "date": "2021-05-01"})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("edit = %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := c.load(); !strings.Contains(body, ":Renamed:Org:2021-05-01|") || strings.Contains(body, "An Article") {
+		t.Errorf("admin page after edit = %q", body)
+	}
+	if pdf := c.get(articlePath("2021-05-01")); pdf.Body.String() != "%PDF-1.4 fixture" {
+		t.Errorf("pdf after edit = %q, want the original", pdf.Body.String())
+	}
+	if old := c.get("/kcawd/1600000000"); old.Code != http.StatusNotFound {
+		t.Errorf("old pdf path = %d, want 404", old.Code)
+	}
+
+	newPath := kCawdAdminPath + articlePath("2021-05-01")[len("/kcawd"):]
+	rec = c.post(newPath, map[string]string{"title": "Renamed", "date": "2021-05-01", "pdf": "%PDF-1.7 replaced"})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("replace = %d: %s", rec.Code, rec.Body.String())
+	}
+	if pdf := c.get(articlePath("2021-05-01")); pdf.Body.String() != "%PDF-1.7 replaced" {
+		t.Errorf("pdf after replace = %q", pdf.Body.String())
+	}
+
+	if rec := c.post(newPath+"/delete", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("delete = %d: %s", rec.Code, rec.Body.String())
+	}
+	if pdf := c.get(articlePath("2021-05-01")); pdf.Code != http.StatusNotFound {
+		t.Errorf("pdf after delete = %d, want 404", pdf.Code)
+	}
+	if rec := c.post(newPath+"/delete", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("second delete = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/serving"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+)
+
+const (
+	commentPage       = "comment.html"
+	commentsAdminPage = "comments_admin.html"
+	commentsAdminPath = "/admin/comments"
+
+	// Form field hidden from people by the comment template. Only bots fill it in.
+	honeypotField = "website"
+
+	maxAuthorLength  = 100
+	maxCommentLength = 5000
+	// Largest comment form accepted, with room for the CSRF token and
+	// multi-byte text.
+	maxCommentForm = 64 << 10
+)
+
+// commentsEnabled reports whether readers can post comments. They need
+// moderating, so only when the admin pages are on.
+func (s *server) commentsEnabled() bool {
+	return s.adminEnabled()
+}
+
+// commentForms returns middleware adding CSRF protection to the comment form
+// and the endpoint it posts to. The entry pages only link to the form, so the
+// CSRF cookie isn't handed to everyone who reads an entry.
+func (s *server) commentForms() func(http.Handler) http.Handler {
+	protect := csrf.Protect(s.csrfKey,
+		csrf.Path("/entry"),
+		csrf.Secure(s.cfg.secureCookies),
+		csrf.ErrorHandler(http.HandlerFunc(s.csrfFailure)))
+	return func(next http.Handler) http.Handler {
+		// The CSRF check parses the form, so the body has to be limited first.
+		return s.limitComments(plaintextRequests(protect(next)))
+	}
+}
+
+// limitComments rejects request bodies bigger than a comment form.
+func (s *server) limitComments(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxCommentForm {
+			s.writeError(w, r, http.StatusRequestEntityTooLarge, "the comment is too long")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxCommentForm)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter allows each key limit events in any window. A limit of zero or
+// less allows everything.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu     sync.Mutex
+	events map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, now: time.Now, events: make(map[string][]time.Time)}
+}
+
+// allow records an event for key and reports whether it is within the limit.
+// Events that were refused don't count against later ones.
+func (l *rateLimiter) allow(key string) bool {
+	if l.limit <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	cutoff := now.Add(-l.window)
+	// Forget keys that have gone quiet now and then, so the map doesn't grow
+	// with every address that has ever posted.
+	if len(l.events) > 1000 {
+		for k, times := range l.events {
+			if !times[len(times)-1].After(cutoff) {
+				delete(l.events, k)
+			}
+		}
+	}
+
+	recent := l.events[key][:0]
+	for _, t := range l.events[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.limit {
+		l.events[key] = recent
+		return false
+	}
+	l.events[key] = append(recent, now)
+	return true
+}
+
+// clientIP is the address r came from, without its port. Requests from
+// trusted proxies are taken to come from the last address in their
+// X-Forwarded-For that isn't a trusted proxy too. Other requests' headers
+// are ignored, as anyone can send them.
+func (s *server) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !s.trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// Nothing further along can be believed.
+			break
+		}
+		ip = hop
+		if !s.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// trustedProxy reports whether ip is one of cfg.trustedProxies.
+func (s *server) trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, proxy := range s.proxies {
+		if addr != nil && proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxies reads a comma separated list of addresses and CIDR ranges.
+func parseProxies(list string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			p = ip.String() + "/128"
+			if ip.To4() != nil {
+				p = ip.String() + "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", p, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (s *server) buildCommentPage(w http.ResponseWriter, r *http.Request) error {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if id <= 0 {
+		return notFoundError(fmt.Errorf("comment form for entry %d", id))
+	}
+	entry, err := s.entryStore.GetEntry(r.Context(), id)
+	if err != nil {
+		return storeError("failed to retrieve content from database",
+			fmt.Errorf("unable to get entry %d to comment on: %w", id, err))
+	}
+
+	return s.render(w, commentPage, serving.CommentFormToServing(entry, csrf.TemplateField(r)))
+}
+
+func (s *server) postComment(w http.ResponseWriter, r *http.Request) error {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	ip := s.clientIP(r)
+	if !s.commentLimiter.allow(ip) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.cfg.commentWindow.Seconds())))
+		return statusError(http.StatusTooManyRequests, "you have posted a lot of comments recently, please try again later",
+			fmt.Errorf("too many comments from %s", ip))
+	}
+	comment, err := commentForm(r)
+	if err != nil {
+		return err
+	}
+	if id <= 0 {
+		return notFoundError(fmt.Errorf("comment on entry %d", id))
+	}
+	entry, err := s.entryStore.GetEntry(r.Context(), id)
+	if err != nil {
+		return storeError("failed to save comment", fmt.Errorf("unable to get entry %d to comment on: %w", id, err))
+	}
+	pending := serving.EntryPath(entry.Id, entry.Slug, entry.Published) + "?comment=pending#comments"
+
+	// Look as though it worked so the bot doesn't try something else.
+	if r.PostFormValue(honeypotField) != "" {
+		log.Printf("dropped comment on entry %d from %s: honeypot filled in", id, ip)
+		http.Redirect(w, r, pending, http.StatusSeeOther)
+		return nil
+	}
+
+	comment.EntryId, comment.IP = id, ip
+	saved, err := s.commentStore.AddComment(r.Context(), comment)
+	if err != nil {
+		return storeError("failed to save comment", fmt.Errorf("unable to add comment on entry %d: %w", id, err))
+	}
+	log.Printf("comment %d on entry %d from %s is %s", saved.Id, id, ip, saved.Status)
+	http.Redirect(w, r, pending, http.StatusSeeOther)
+	return nil
+}
+
+// commentForm parses a posted comment and checks its fields.
+func commentForm(r *http.Request) (db.Comment, error) {
+	if err := r.ParseForm(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return db.Comment{}, statusError(http.StatusRequestEntityTooLarge, "the comment is too long", err)
+		}
+		return db.Comment{}, statusError(http.StatusBadRequest, "the form could not be read", err)
+	}
+
+	comment := db.Comment{
+		Author: strings.TrimSpace(r.PostFormValue("author")),
+		URL:    strings.TrimSpace(r.PostFormValue("url")),
+		Body:   strings.TrimSpace(r.PostFormValue("body")),
+	}
+	switch {
+	case comment.Author == "":
+		return comment, statusError(http.StatusBadRequest, "a name is required", errors.New("missing author"))
+	case utf8.RuneCountInString(comment.Author) > maxAuthorLength:
+		return comment, statusError(http.StatusBadRequest,
+			fmt.Sprintf("the name must be at most %d characters", maxAuthorLength), errors.New("author too long"))
+	case comment.Body == "":
+		return comment, statusError(http.StatusBadRequest, "the comment is empty", errors.New("missing body"))
+	case utf8.RuneCountInString(comment.Body) > maxCommentLength:
+		return comment, statusError(http.StatusBadRequest,
+			fmt.Sprintf("the comment must be at most %d characters", maxCommentLength), errors.New("body too long"))
+	}
+	if comment.URL != "" {
+		if u, err := url.Parse(comment.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return comment, statusError(http.StatusBadRequest, "the website must be an http or https URL",
+				fmt.Errorf("invalid url %q", comment.URL))
+		}
+	}
+	return comment, nil
+}
+
+func (s *server) buildCommentsAdmin(w http.ResponseWriter, r *http.Request) error {
+	comments, err := s.commentStore.GetPendingComments(r.Context())
+	if err != nil {
+		return storeError("failed to retrieve comments", fmt.Errorf("unable to get pending comments: %w", err))
+	}
+
+	return s.render(w, commentsAdminPage, serving.CommentAdminToServing(comments, csrf.TemplateField(r)))
+}
+
+// Moderation actions to the status they give a comment.
+var moderationActions = map[string]db.CommentStatus{
+	"approve": db.CommentApproved,
+	"reject":  db.CommentRejected,
+	"spam":    db.CommentSpam,
+}
+
+func (s *server) moderateComment(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	status := moderationActions[vars["action"]]
+	if err := s.commentStore.ModerateComment(r.Context(), id, status); err != nil {
+		return storeError("failed to moderate comment", fmt.Errorf("unable to mark comment %d %s: %w", id, status, err))
+	}
+	log.Printf("marked comment %d %s", id, status)
+	http.Redirect(w, r, commentsAdminPath, http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	secondPostPath     = "/entry/2017/second-post"
+	secondPostComments = "/entry/2/comments"
+)
+
+// commenter posts comments from the comment form the way a browser would,
+// carrying the CSRF cookie and token from the page to the form.
+type commenter struct {
+	t      *testing.T
+	router http.Handler
+	cookie string
+	token  string
+}
+
+// load fetches the page at path, keeping any CSRF token, and returns the
+// body.
+func (c *commenter) load(path string) string {
+	c.t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if c.cookie != "" {
+		req.Header.Set("Cookie", c.cookie)
+	}
+	c.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		c.t.Fatalf("GET %s = %d, want 200", path, rec.Code)
+	}
+	if m := tokenField.FindStringSubmatch(rec.Body.String()); m != nil {
+		c.token = m[1]
+	}
+	if cookie := rec.Header().Get("Set-Cookie"); cookie != "" {
+		c.cookie = strings.Split(cookie, ";")[0]
+	}
+	return rec.Body.String()
+}
+
+// post submits a comment on the entry with path from ip.
+func (c *commenter) post(path, ip string, form url.Values) *httptest.ResponseRecorder {
+	c.t.Helper()
+	form = cloneValues(form)
+	if c.token != "" {
+		form.Set("gorilla.csrf.Token", c.token)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", c.cookie)
+	req.RemoteAddr = ip + ":1234"
+	rec := httptest.NewRecorder()
+	c.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func cloneValues(v url.Values) url.Values {
+	out := url.Values{}
+	for k, vs := range v {
+		out[k] = append([]string(nil), vs...)
+	}
+	return out
+}
+
+func newCommenter(t *testing.T, opts ...func(*config)) (*commenter, *adminClient) {
+	t.Helper()
+	admin, _ := newAdminClient(t, opts...)
+	c := &commenter{t: t, router: admin.router}
+	c.load(secondPostComments)
+	return c, admin
+}
+
+var goodComment = url.Values{"author": {"Dee"}, "url": {"https://dee.example.com"}, "body": {"Great\n\npost"}}
+
+func TestPostComment(t *testing.T) {
+	c, admin := newCommenter(t)
+
+	page := c.load(secondPostPath)
+	if !strings.Contains(page, "|/entry/2/comments|") {
+		t.Errorf("entry page = %q, want a link to the comment form", page)
+	}
+	if !strings.Contains(page, "|Ann:<p>Nice post</p>|") || strings.Contains(page, "Bob") {
+		t.Errorf("entry page = %q, want only the approved comment", page)
+	}
+	if page := c.load(secondPostComments); !strings.Contains(page, "comment|Second Post|"+secondPostPath+"|/entry/2/comments|") || c.token == "" {
+		t.Errorf("comment page = %q, want the form with a token", page)
+	}
+
+	rec := c.post("/entry/2/comments", "192.0.2.4", goodComment)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != secondPostPath+"?comment=pending#comments" {
+		t.Fatalf("POST = %d to %q, want 303 back to the entry", rec.Code, rec.Header().Get("Location"))
+	}
+	if page := c.load(secondPostPath + "?comment=pending"); !strings.Contains(page, "|pending|") || strings.Contains(page, "Dee") {
+		t.Errorf("entry page after posting = %q, want a pending notice and no unmoderated comment", page)
+	}
+
+	queue := admin.loadPage(commentsAdminPath)
+	if !strings.Contains(queue, ":Second Post:Dee:Great\n\npost:192.0.2.4|") {
+		t.Fatalf("moderation queue = %q, want the new comment", queue)
+	}
+	id := strings.Split(strings.SplitN(queue, ":Second Post:Dee:", 2)[0], "|")
+	rec = admin.post(commentsAdminPath+"/"+id[len(id)-1]+"/approve", nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != commentsAdminPath {
+		t.Fatalf("approve = %d to %q, want 303 back to the queue", rec.Code, rec.Header().Get("Location"))
+	}
+	if page := c.load(secondPostPath); !strings.Contains(page, "|Ann:<p>Nice post</p>|Dee:<p>Great</p><p>post</p>|") {
+		t.Errorf("entry page after approving = %q, want both comments in order", page)
+	}
+}
+
+func TestPostCommentRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		form       url.Values
+		noToken    bool
+		wantStatus int
+	}{
+		{name: "no token", path: "/entry/2/comments", form: goodComment, noToken: true, wantStatus: http.StatusForbidden},
+		{name: "no author", path: "/entry/2/comments", form: url.Values{"body": {"Hi"}}, wantStatus: http.StatusBadRequest},
+		{name: "no body", path: "/entry/2/comments", form: url.Values{"author": {"Dee"}, "body": {"  "}}, wantStatus: http.StatusBadRequest},
+		{name: "long author", path: "/entry/2/comments", form: url.Values{"author": {strings.Repeat("é", 101)}, "body": {"Hi"}},
+			wantStatus: http.StatusBadRequest},
+		{name: "long body", path: "/entry/2/comments", form: url.Values{"author": {"Dee"}, "body": {strings.Repeat("a", 5001)}},
+			wantStatus: http.StatusBadRequest},
+		{name: "script url", path: "/entry/2/comments", form: url.Values{"author": {"Dee"}, "url": {"javascript:alert(1)"}, "body": {"Hi"}},
+			wantStatus: http.StatusBadRequest},
+		{name: "huge form", path: "/entry/2/comments", form: url.Values{"author": {"Dee"}, "body": {strings.Repeat("a", 100<<10)}},
+			wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "draft", path: "/entry/4/comments", form: goodComment, wantStatus: http.StatusNotFound},
+		{name: "missing entry", path: "/entry/100/comments", form: goodComment, wantStatus: http.StatusNotFound},
+		{name: "entry zero", path: "/entry/0/comments", form: goodComment, wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, admin := newCommenter(t)
+			if tc.noToken {
+				c.token = ""
+			}
+			if rec := c.post(tc.path, "192.0.2.4", tc.form); rec.Code != tc.wantStatus {
+				t.Errorf("POST %s = %d, want %d", tc.path, rec.Code, tc.wantStatus)
+			}
+			if queue := admin.loadPage(commentsAdminPath); strings.Contains(queue, "192.0.2.4") {
+				t.Errorf("moderation queue = %q, want nothing added", queue)
+			}
+		})
+	}
+}
+
+func TestCommentHoneypot(t *testing.T) {
+	c, admin := newCommenter(t)
+	form := cloneValues(goodComment)
+	form.Set(honeypotField, "https://buy.example.com")
+	if rec := c.post("/entry/2/comments", "192.0.2.4", form); rec.Code != http.StatusSeeOther {
+		t.Errorf("POST with the honeypot filled in = %d, want 303 as if it worked", rec.Code)
+	}
+	if queue := admin.loadPage(commentsAdminPath); strings.Contains(queue, "Dee") {
+		t.Errorf("moderation queue = %q, want the bot's comment dropped", queue)
+	}
+}
+
+func TestCommentRateLimit(t *testing.T) {
+	c, _ := newCommenter(t, func(cfg *config) {
+		cfg.commentLimit = 2
+		cfg.commentWindow = time.Hour
+	})
+	for i := 0; i < 2; i++ {
+		if rec := c.post("/entry/2/comments", "192.0.2.4", goodComment); rec.Code != http.StatusSeeOther {
+			t.Fatalf("comment %d = %d, want 303", i+1, rec.Code)
+		}
+	}
+	rec := c.post("/entry/2/comments", "192.0.2.4", goodComment)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "3600" {
+		t.Errorf("third comment = %d with Retry-After %q, want 429 with 3600", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := c.post("/entry/2/comments", "192.0.2.5", goodComment); rec.Code != http.StatusSeeOther {
+		t.Errorf("comment from another address = %d, want 303", rec.Code)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	l := newRateLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow("a"); got != want {
+			t.Errorf("allow #%d = %v, want %v", i+1, got, want)
+		}
+	}
+	if !l.allow("b") {
+		t.Error("allow for another key = false, want true")
+	}
+	now = now.Add(time.Minute)
+	if !l.allow("a") {
+		t.Error("allow after the window = false, want true")
+	}
+
+	if !newRateLimiter(0, time.Minute).allow("a") {
+		t.Error("allow with no limit = false, want true")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) {
+		cfg.trustedProxies = "10.0.0.1, 172.16.0.0/12"
+	})
+	tests := []struct {
+		name, remote, forwarded, want string
+	}{
+		{"direct", "192.0.2.4:1234", "", "192.0.2.4"},
+		{"direct spoofing", "192.0.2.4:1234", "198.51.100.7", "192.0.2.4"},
+		{"through proxy", "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"through two proxies", "10.0.0.1:1234", "198.51.100.7, 172.16.3.4", "198.51.100.7"},
+		{"client spoofing", "10.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"proxy without header", "10.0.0.1:1234", "", "10.0.0.1"},
+		{"garbage", "10.0.0.1:1234", "nonsense", "10.0.0.1"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := s.clientIP(r); got != tc.want {
+			t.Errorf("%s: clientIP = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := parseProxies("10.0.0.1, not-an-address"); err == nil {
+		t.Error("parseProxies accepted a bad address")
+	}
+}
+
+func TestModerateComment(t *testing.T) {
+	c, admin := newCommenter(t)
+
+	if queue := admin.loadPage(commentsAdminPath); !strings.Contains(queue, "|2:Second Post:Bob:First!:192.0.2.2|") {
+		t.Fatalf("moderation queue = %q, want the fixture's pending comment", queue)
+	}
+	if rec := admin.post(commentsAdminPath+"/2/spam", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("spam = %d, want 303", rec.Code)
+	}
+	// Everything else from a spammer's address skips the queue.
+	if rec := c.post("/entry/2/comments", "192.0.2.2", goodComment); rec.Code != http.StatusSeeOther {
+		t.Fatalf("POST = %d, want 303", rec.Code)
+	}
+	if queue := admin.loadPage(commentsAdminPath); strings.Contains(queue, "192.0.2.2") {
+		t.Errorf("moderation queue = %q, want nothing from the spammer", queue)
+	}
+	if page := c.load(secondPostPath); strings.Contains(page, "Bob") || strings.Contains(page, "Dee") {
+		t.Errorf("entry page = %q, want no spam", page)
+	}
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{path: commentsAdminPath + "/100/approve", wantStatus: http.StatusNotFound},
+		{path: commentsAdminPath + "/1/delete", wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if rec := admin.post(tc.path, nil); rec.Code != tc.wantStatus {
+			t.Errorf("POST %s = %d, want %d", tc.path, rec.Code, tc.wantStatus)
+		}
+	}
+	admin.token = ""
+	if rec := admin.post(commentsAdminPath+"/1/reject", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("reject without a token = %d, want 403", rec.Code)
+	}
+}
+
+func TestCommentPage(t *testing.T) {
+	admin, _ := newAdminClient(t)
+	c := &commenter{t: t, router: admin.router}
+
+	// Reading entries shouldn't hand out CSRF cookies, only the form should.
+	c.load(secondPostPath)
+	if c.cookie != "" {
+		t.Errorf("entry page set cookie %q, want none", c.cookie)
+	}
+	c.load(secondPostComments)
+	if c.cookie == "" || c.token == "" {
+		t.Errorf("comment page gave cookie %q and token %q, want both", c.cookie, c.token)
+	}
+
+	for _, path := range []string{"/entry/4/comments", "/entry/100/comments", "/entry/0/comments"} {
+		rec := httptest.NewRecorder()
+		admin.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestCommentsDisabled(t *testing.T) {
+	router := newTestServer(t).routes()
+	c := &commenter{t: t, router: router}
+
+	page := c.load(secondPostPath)
+	if !strings.Contains(page, "|||Ann:<p>Nice post</p>|") || c.token != "" || c.cookie != "" {
+		t.Errorf("entry page = %q, want approved comments without a form", page)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, secondPostComments, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET %s = %d, want 404 with comments off", secondPostComments, rec.Code)
+	}
+	if rec := c.post(secondPostComments, "192.0.2.4", goodComment); rec.Code != http.StatusNotFound {
+		t.Errorf("POST = %d, want 404 with comments off", rec.Code)
+	}
+}
@@ -0,0 +1,424 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Largest piece of a PDF kept in a single article_chunk row.
+const maxArticleChunk = 256 << 10
+
+var (
+	articleQuery = `SELECT timestamp, COALESCE(size, 0), COALESCE(sha256, ''), COALESCE(modified, timestamp), location
+		FROM articlemeta WHERE timestamp = ?`
+	articleBlobSizeQuery = `SELECT size FROM articlemeta
+		WHERE timestamp = ?1 AND location = '' AND EXISTS (SELECT 1 FROM article_chunk WHERE article = ?1)`
+	// The chunk holding the byte at an offset.
+	articleChunkQuery = `SELECT start, data FROM article_chunk WHERE article = ? AND start <= ? ORDER BY start DESC LIMIT 1`
+	unchunkedQuery    = `SELECT timestamp FROM articlemeta WHERE pdf IS NOT NULL`
+	unchunkedPDFQuery = `SELECT pdf FROM articlemeta WHERE timestamp = ?`
+	setSumQuery       = `UPDATE articlemeta SET pdf = NULL, size = ?, sha256 = ?, modified = COALESCE(modified, timestamp), location = ''
+		WHERE timestamp = ?`
+
+	insertArticleQuery = `INSERT INTO articlemeta (timestamp, title, organization, hyperlink, size, sha256, modified, location)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	updateArticleMetaQuery = `UPDATE articlemeta SET timestamp = ?, title = ?, organization = ?, hyperlink = ? WHERE timestamp = ?`
+	// A new PDF needs a new preview.
+	updateArticleFileQuery = `UPDATE articlemeta SET pdf = NULL, size = ?, sha256 = ?, modified = ?, location = ?,
+		text = NULL, excerpt = NULL, thumbnail = NULL, extracted = NULL WHERE timestamp = ?`
+	deleteArticleQuery = `DELETE FROM articlemeta WHERE timestamp = ?`
+	insertChunkQuery   = `INSERT INTO article_chunk (article, start, data) VALUES (?, ?, ?)`
+	deleteChunksQuery  = `DELETE FROM article_chunk WHERE article = ?`
+	moveChunksQuery    = `UPDATE article_chunk SET article = ? WHERE article = ?`
+
+	articleSearchQuery = `SELECT ` + articleMetaColumns + ` FROM articlemeta
+		WHERE title LIKE ?1 ESCAPE '\' OR organization LIKE ?1 ESCAPE '\' OR text LIKE ?1 ESCAPE '\'
+		ORDER BY timestamp DESC`
+	articleThumbnailQuery = `SELECT thumbnail FROM articlemeta WHERE timestamp = ? AND thumbnail IS NOT NULL`
+	unextractedQuery      = `SELECT timestamp, COALESCE(size, 0), sha256, COALESCE(modified, timestamp), location
+		FROM articlemeta WHERE sha256 IS NOT NULL AND (extracted IS NULL OR extracted != sha256) ORDER BY timestamp`
+	setPreviewQuery = `UPDATE articlemeta SET text = ?, excerpt = ?, thumbnail = ?, extracted = ?
+		WHERE timestamp = ? AND sha256 = ?`
+)
+
+// Article describes a stored kcawd PDF. An empty Location means the PDF is
+// kept in the database; otherwise it names the file in external storage.
+type Article struct {
+	Id       int
+	Size     int64
+	SHA256   string
+	Modified time.Time
+	Location string
+}
+
+// ArticleFile is a PDF to store with an article. PDF holds the file when it is
+// kept in the database, in which case Size and SHA256 are worked out from it.
+// Otherwise Location is its key in external storage.
+type ArticleFile struct {
+	PDF      []byte
+	Location string
+	Size     int64
+	SHA256   string
+}
+
+// args returns the size, sha256, modified and location column values. The
+// PDF itself goes in article_chunk, see writeChunks.
+func (f ArticleFile) args(modified time.Time) []interface{} {
+	if f.PDF != nil {
+		sum := sha256.Sum256(f.PDF)
+		return []interface{}{len(f.PDF), hex.EncodeToString(sum[:]), modified.Unix(), ""}
+	}
+	return []interface{}{f.Size, f.SHA256, modified.Unix(), f.Location}
+}
+
+// ArticlePreview is what was extracted from the PDF whose hash is SHA256.
+type ArticlePreview struct {
+	SHA256  string
+	Text    string
+	Excerpt string
+	// PNG of the first page. Nil if it couldn't be rendered.
+	Thumbnail []byte
+}
+
+// GetArticle returns what is known about the PDF for the article with id.
+func (s *SQLite) GetArticle(ctx context.Context, id int) (Article, error) {
+	if id <= 0 {
+		return Article{}, fmt.Errorf("%w: %d", ErrInvalidID, id)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	article := Article{}
+	var modified int64
+	err := s.stmt(articleQuery).QueryRowContext(ctx, id).Scan(&article.Id, &article.Size, &article.SHA256, &modified, &article.Location)
+	if err != nil {
+		return Article{}, queryErr(ctx, err)
+	}
+	article.Modified = time.Unix(modified, 0)
+	return article, nil
+}
+
+// OpenArticleBlob opens the PDF kept in the database for the article with id.
+// The PDF is read a chunk at a time as the caller reads, each chunk under its
+// own query timeout, so no more than one chunk of it is held in memory.
+func (s *SQLite) OpenArticleBlob(ctx context.Context, id int) (io.ReadSeekCloser, error) {
+	if id <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidID, id)
+	}
+	qctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var size int64
+	if err := s.stmt(articleBlobSizeQuery).QueryRowContext(qctx, id).Scan(&size); err != nil {
+		return nil, queryErr(qctx, err)
+	}
+	return &blobReader{s: s, ctx: ctx, id: id, size: size}, nil
+}
+
+// CreateArticle adds an article dated meta.EntryId along with its PDF. It
+// fails with ErrExists if there is already an article with that date.
+func (s *SQLite) CreateArticle(ctx context.Context, meta ArticleMeta, file ArticleFile) error {
+	if meta.EntryId <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidID, meta.EntryId)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.rw.BeginTx(ctx, nil)
+	if err != nil {
+		return queryErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	args := append([]interface{}{meta.EntryId, meta.Title, meta.Organization, meta.Hyperlink}, file.args(time.Now())...)
+	if _, err := tx.ExecContext(ctx, insertArticleQuery, args...); err != nil {
+		return queryErr(ctx, err)
+	}
+	if err := writeChunks(ctx, tx, meta.EntryId, file.PDF); err != nil {
+		return queryErr(ctx, err)
+	}
+	return queryErr(ctx, tx.Commit())
+}
+
+// UpdateArticle replaces the metadata of the article with id, which may move
+// it to a new date. Its PDF is replaced too unless file is nil.
+func (s *SQLite) UpdateArticle(ctx context.Context, id int, meta ArticleMeta, file *ArticleFile) error {
+	if id <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidID, id)
+	}
+	if meta.EntryId <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidID, meta.EntryId)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.rw.BeginTx(ctx, nil)
+	if err != nil {
+		return queryErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	if file != nil {
+		if err := execOne(ctx, tx, updateArticleFileQuery, append(file.args(time.Now()), id)...); err != nil {
+			return queryErr(ctx, err)
+		}
+		if err := writeChunks(ctx, tx, id, file.PDF); err != nil {
+			return queryErr(ctx, err)
+		}
+	}
+	err = execOne(ctx, tx, updateArticleMetaQuery, meta.EntryId, meta.Title, meta.Organization, meta.Hyperlink, id)
+	if err != nil {
+		return queryErr(ctx, err)
+	}
+	if meta.EntryId != id {
+		// Anything already at the new date belonged to no article.
+		if _, err := tx.ExecContext(ctx, deleteChunksQuery, meta.EntryId); err != nil {
+			return queryErr(ctx, err)
+		}
+		if _, err := tx.ExecContext(ctx, moveChunksQuery, meta.EntryId, id); err != nil {
+			return queryErr(ctx, err)
+		}
+	}
+	return queryErr(ctx, tx.Commit())
+}
+
+// DeleteArticle removes the article with id. A PDF in external storage is
+// left in place; the caller decides whether anything else still uses it.
+func (s *SQLite) DeleteArticle(ctx context.Context, id int) error {
+	if id <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidID, id)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.rw.BeginTx(ctx, nil)
+	if err != nil {
+		return queryErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	if err := execOne(ctx, tx, deleteArticleQuery, id); err != nil {
+		return queryErr(ctx, err)
+	}
+	if _, err := tx.ExecContext(ctx, deleteChunksQuery, id); err != nil {
+		return queryErr(ctx, err)
+	}
+	return queryErr(ctx, tx.Commit())
+}
+
+// SearchArticles returns the articles whose title, organization or text
+// contains query, ignoring ASCII case, newest first.
+func (s *SQLite) SearchArticles(ctx context.Context, query string) ([]ArticleMeta, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query)
+	articles, err := s.queryArticleMeta(ctx, articleSearchQuery, "%"+escaped+"%")
+	return articles, queryErr(ctx, err)
+}
+
+// GetArticleThumbnail returns the PNG thumbnail of the article with id.
+func (s *SQLite) GetArticleThumbnail(ctx context.Context, id int) ([]byte, error) {
+	if id <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidID, id)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var thumbnail []byte
+	err := s.stmt(articleThumbnailQuery).QueryRowContext(ctx, id).Scan(&thumbnail)
+	return thumbnail, queryErr(ctx, err)
+}
+
+// GetUnextractedArticles returns the articles whose PDF has no preview yet,
+// or a preview of a PDF that has since been replaced.
+func (s *SQLite) GetUnextractedArticles(ctx context.Context) ([]Article, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.stmt(unextractedQuery).QueryContext(ctx)
+	if err != nil {
+		return nil, queryErr(ctx, err)
+	}
+	defer rows.Close()
+
+	var articles []Article
+	for rows.Next() {
+		article := Article{}
+		var modified int64
+		if err := rows.Scan(&article.Id, &article.Size, &article.SHA256, &modified, &article.Location); err != nil {
+			return nil, queryErr(ctx, err)
+		}
+		article.Modified = time.Unix(modified, 0)
+		articles = append(articles, article)
+	}
+	return articles, queryErr(ctx, rows.Err())
+}
+
+// SetArticlePreview stores the preview of the article with id. It returns
+// ErrNotFound if the article is gone or its PDF is no longer p.SHA256.
+func (s *SQLite) SetArticlePreview(ctx context.Context, id int, p ArticlePreview) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	err := execOne(ctx, s.rw, setPreviewQuery, p.Text, p.Excerpt, p.Thumbnail, p.SHA256, id, p.SHA256)
+	return queryErr(ctx, err)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// execOne runs a statement that should change exactly one row and returns
+// sql.ErrNoRows if it changed none.
+func execOne(ctx context.Context, e execer, query string, args ...interface{}) error {
+	res, err := e.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// writeChunks replaces the PDF kept for the article with id by pdf, split
+// into rows of maxArticleChunk bytes. A nil pdf just removes it.
+func writeChunks(ctx context.Context, e execer, id int, pdf []byte) error {
+	if _, err := e.ExecContext(ctx, deleteChunksQuery, id); err != nil {
+		return err
+	}
+	if pdf == nil {
+		return nil
+	}
+	// An empty PDF still gets a row, so it can be told apart from none.
+	for start := 0; start == 0 || start < len(pdf); start += maxArticleChunk {
+		end := start + maxArticleChunk
+		if end > len(pdf) {
+			end = len(pdf)
+		}
+		if _, err := e.ExecContext(ctx, insertChunkQuery, id, start, pdf[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobReader reads a PDF from article_chunk, holding on to the last chunk
+// it read.
+type blobReader struct {
+	s      *SQLite
+	ctx    context.Context
+	id     int
+	size   int64
+	offset int64
+	// chunk is the PDF from start.
+	start int64
+	chunk []byte
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.chunk == nil || b.offset < b.start || b.offset >= b.start+int64(len(b.chunk)) {
+		ctx, cancel := b.s.withTimeout(b.ctx)
+		defer cancel()
+		var start int64
+		var chunk []byte
+		err := b.s.stmt(articleChunkQuery).QueryRowContext(ctx, b.id, b.offset).Scan(&start, &chunk)
+		if err == sql.ErrNoRows || err == nil && b.offset >= start+int64(len(chunk)) {
+			// The PDF shrank or was removed since it was opened.
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, queryErr(ctx, err)
+		}
+		b.start, b.chunk = start, chunk
+	}
+	copied := copy(p, b.chunk[b.offset-b.start:])
+	b.offset += int64(copied)
+	return copied, nil
+}
+func (b *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("db: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("db: negative position")
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *blobReader) Close() error {
+	return nil
+}
+
+// chunkArticles moves every PDF in the articlemeta.pdf column into
+// article_chunk, recording its size and hash. Articles can still be inserted
+// by hand so, like assignSlugs, this runs at every Open. Each PDF is read
+// whole, once.
+func chunkArticles(db *sql.DB) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(unchunkedQuery)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		// PDFs inserted as TEXT scan as their bytes.
+		var pdf []byte
+		if err := tx.QueryRow(unchunkedPDFQuery, id).Scan(&pdf); err != nil {
+			return err
+		}
+		if pdf == nil {
+			pdf = []byte{}
+		}
+		if err := writeChunks(ctx, tx, id, pdf); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(pdf)
+		if _, err := tx.Exec(setSumQuery, len(pdf), hex.EncodeToString(sum[:]), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Block is one piece of an entry's content. Entries are an ordered list of
+// them, stored as a JSON array in the blocks column, for example:
+//
+//	[{"type": "paragraph", "text": "Hello"},
+//	 {"type": "image", "src": "/images/a.jpg", "alt": "A"}]
+//
+// Type picks the renderer; the rest of the object is for that renderer to
+// decode, so new kinds of block need no schema change.
+type Block struct {
+	Type string
+	// The whole JSON object, type included.
+	JSON json.RawMessage
+}
+
+// NewBlock returns a block of type typ holding the fields of v, which must
+// marshal to a JSON object.
+func NewBlock(typ string, v interface{}) (Block, error) {
+	fields := map[string]interface{}{}
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return Block{}, err
+		}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return Block{}, fmt.Errorf("block fields must be an object: %v", err)
+		}
+	}
+	fields["type"] = typ
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return Block{}, err
+	}
+	return Block{Type: typ, JSON: data}, nil
+}
+
+func (b *Block) UnmarshalJSON(data []byte) error {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return err
+	}
+	if head.Type == "" {
+		return errors.New("block has no type")
+	}
+	b.Type = head.Type
+	b.JSON = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+func (b Block) MarshalJSON() ([]byte, error) {
+	if len(b.JSON) == 0 {
+		return json.Marshal(map[string]string{"type": b.Type})
+	}
+	return b.JSON, nil
+}
+
+// Decode unmarshals the block's fields into v.
+func (b Block) Decode(v interface{}) error {
+	if err := json.Unmarshal(b.JSON, v); err != nil {
+		return fmt.Errorf("invalid %s block: %v", b.Type, err)
+	}
+	return nil
+}
+
+const (
+	legacyEntriesQuery   = `SELECT rowid, paragraph, image, image_meta FROM entry WHERE blocks = ''`
+	legacyOneoffsQuery   = `SELECT rowid, paragraph, image, image_meta FROM oneoff WHERE blocks = ''`
+	setEntryBlocksQuery  = `UPDATE entry SET blocks = ? WHERE rowid = ?`
+	setOneoffBlocksQuery = `UPDATE oneoff SET blocks = ? WHERE rowid = ?`
+
+	// Setting blocks sets off entry_touch, but converting isn't editing, so
+	// updated is put back afterwards.
+	saveUpdatedQuery    = `CREATE TEMP TABLE entry_updated AS SELECT rowid AS entry_rowid, updated FROM entry`
+	restoreUpdatedQuery = `UPDATE entry SET updated = (SELECT updated FROM entry_updated WHERE entry_rowid = entry.rowid)`
+	dropUpdatedQuery    = `DROP TABLE entry_updated`
+)
+
+// parseBlocks returns the blocks of a row. Rows inserted by hand since the
+// conversion may still only have the older columns, so those are converted
+// as they're read.
+func parseBlocks(blocks, paragraph, image, imageMeta string) ([]Block, error) {
+	if blocks == "" {
+		return legacyBlocks(paragraph, image, imageMeta)
+	}
+	var parsed []Block
+	if err := json.Unmarshal([]byte(blocks), &parsed); err != nil {
+		return nil, fmt.Errorf("invalid blocks: %v", err)
+	}
+	return parsed, nil
+}
+
+// legacyBlocks converts the older content columns: paragraphs and image
+// sources each joined with a literal \n, lined up index for index, and
+// image_meta, a JSON array of {src, alt, caption} or null per paragraph that
+// takes the place of image when set. A paragraph without a matching image is
+// just a paragraph.
+func legacyBlocks(paragraph, image, imageMeta string) ([]Block, error) {
+	type legacyImage struct {
+		Src     string `json:"src"`
+		Alt     string `json:"alt,omitempty"`
+		Caption string `json:"caption,omitempty"`
+	}
+	var images []*legacyImage
+	if imageMeta != "" {
+		if err := json.Unmarshal([]byte(imageMeta), &images); err != nil {
+			return nil, fmt.Errorf("invalid image metadata: %v", err)
+		}
+	} else if image != "" {
+		for _, src := range strings.Split(image, `\n`) {
+			images = append(images, &legacyImage{Src: src})
+		}
+	}
+
+	var blocks []Block
+	add := func(typ string, v interface{}) error {
+		b, err := NewBlock(typ, v)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, b)
+		return nil
+	}
+	var paragraphs []string
+	if paragraph != "" {
+		paragraphs = strings.Split(paragraph, `\n`)
+	}
+	for i, p := range paragraphs {
+		if err := add("paragraph", struct {
+			Text string `json:"text"`
+		}{p}); err != nil {
+			return nil, err
+		}
+		if i < len(images) && images[i] != nil && images[i].Src != "" {
+			if err := add("image", images[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// convertBlocks fills in the blocks column of every entry and oneoff from
+// their older content columns, leaving when entries were updated alone.
+func convertBlocks(tx *sql.Tx) error {
+	if _, err := tx.Exec(saveUpdatedQuery); err != nil {
+		return err
+	}
+	for _, q := range []struct{ query, set string }{
+		{legacyEntriesQuery, setEntryBlocksQuery},
+		{legacyOneoffsQuery, setOneoffBlocksQuery},
+	} {
+		rows, err := tx.Query(q.query)
+		if err != nil {
+			return err
+		}
+		type converted struct {
+			rowid  int64
+			blocks string
+		}
+		var pending []converted
+		for rows.Next() {
+			var rowid int64
+			var paragraph, image, imageMeta string
+			if err := rows.Scan(&rowid, &paragraph, &image, &imageMeta); err != nil {
+				rows.Close()
+				return err
+			}
+			blocks, err := legacyBlocks(paragraph, image, imageMeta)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("row %d: %v", rowid, err)
+			}
+			if blocks == nil {
+				blocks = []Block{}
+			}
+			data, err := json.Marshal(blocks)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			pending = append(pending, converted{rowid, string(data)})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, c := range pending {
+			if _, err := tx.Exec(q.set, c.blocks, c.rowid); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(restoreUpdatedQuery); err != nil {
+		return err
+	}
+	_, err := tx.Exec(dropUpdatedQuery)
+	return err
+}
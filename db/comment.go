@@ -0,0 +1,155 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CommentStatus is where a comment is in moderation.
+type CommentStatus string
+
+const (
+	// CommentPending comments are waiting in the moderation queue.
+	CommentPending CommentStatus = "pending"
+	// CommentApproved comments are shown under their entry.
+	CommentApproved CommentStatus = "approved"
+	// CommentRejected comments are hidden.
+	CommentRejected CommentStatus = "rejected"
+	// CommentSpam comments are hidden, and anything else from the same
+	// address skips the queue and is marked spam too.
+	CommentSpam CommentStatus = "spam"
+)
+
+func (s CommentStatus) valid() bool {
+	switch s {
+	case CommentPending, CommentApproved, CommentRejected, CommentSpam:
+		return true
+	}
+	return false
+}
+
+var (
+	// Comments are only taken on published entries. Addresses with comments
+	// marked as spam have the rest of theirs marked too.
+	insertCommentQuery = `INSERT INTO comment (entry_id, author, url, body, ip, created, status)
+		SELECT ?1, ?2, ?3, ?4, ?5, ?6,
+			CASE WHEN EXISTS (SELECT 1 FROM comment WHERE ip = ?5 AND ip != '' AND status = 'spam') THEN 'spam' ELSE 'pending' END
+		WHERE EXISTS (SELECT 1 FROM entry WHERE id = ?1 AND ` + isPublished + `)`
+	commentQuery          = `SELECT ` + commentColumns + ` FROM comment JOIN entry ON entry.id = comment.entry_id WHERE comment.id = ?`
+	approvedCommentsQuery = `SELECT ` + commentColumns + ` FROM comment JOIN entry ON entry.id = comment.entry_id
+		WHERE comment.entry_id = ? AND comment.status = 'approved' ORDER BY comment.created, comment.id`
+	pendingCommentsQuery = `SELECT ` + commentColumns + ` FROM comment JOIN entry ON entry.id = comment.entry_id
+		WHERE comment.status = 'pending' ORDER BY comment.created, comment.id`
+	moderateCommentQuery = `UPDATE comment SET status = ?, moderated = ? WHERE id = ?`
+)
+
+const commentColumns = `comment.id, comment.entry_id, entry.title, comment.author, comment.url, comment.body,
+	comment.status, comment.ip, comment.created`
+
+// Comment is a reader's comment on an entry.
+type Comment struct {
+	Id      int
+	EntryId int
+	// Title of the entry, filled in when comments are read.
+	EntryTitle string
+	Author     string
+	// The author's site, or empty.
+	URL    string
+	Body   string
+	Status CommentStatus
+	// Address the comment was posted from, for spotting spam.
+	IP      string
+	Created time.Time
+}
+
+// AddComment saves c, which waits for moderation unless its address has
+// posted spam before, and returns it as saved. It returns ErrNotFound if
+// c.EntryId isn't a published entry.
+func (s *SQLite) AddComment(ctx context.Context, c Comment) (Comment, error) {
+	if c.EntryId <= 0 {
+		return Comment{}, fmt.Errorf("%w: %d", ErrInvalidID, c.EntryId)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.rw.ExecContext(ctx, insertCommentQuery, c.EntryId, c.Author, c.URL, c.Body, c.IP, time.Now().Unix())
+	if err != nil {
+		return Comment{}, queryErr(ctx, err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return Comment{}, ErrNotFound
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Comment{}, queryErr(ctx, err)
+	}
+	// Read it back on the write connection; the pool may not see it yet.
+	saved, err := scanComment(s.rw.QueryRowContext(ctx, commentQuery, id))
+	return saved, queryErr(ctx, err)
+}
+
+// GetComments returns the approved comments on the entry with entryID,
+// oldest first.
+func (s *SQLite) GetComments(ctx context.Context, entryID int) ([]Comment, error) {
+	if entryID <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidID, entryID)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	comments, err := s.queryComments(ctx, approvedCommentsQuery, entryID)
+	return comments, queryErr(ctx, err)
+}
+
+// GetPendingComments returns the moderation queue, oldest first.
+func (s *SQLite) GetPendingComments(ctx context.Context) ([]Comment, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	comments, err := s.queryComments(ctx, pendingCommentsQuery)
+	return comments, queryErr(ctx, err)
+}
+
+// ModerateComment sets the status of the comment with id.
+func (s *SQLite) ModerateComment(ctx context.Context, id int, status CommentStatus) error {
+	if id <= 0 || !status.valid() {
+		return fmt.Errorf("%w: comment %d status %q", ErrInvalidID, id, status)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, moderateCommentQuery, string(status), time.Now().Unix(), id))
+}
+
+func (s *SQLite) queryComments(ctx context.Context, query string, args ...interface{}) ([]Comment, error) {
+	rows, err := s.stmt(query).QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+// scanComment reads a row selected with commentColumns.
+func scanComment(s scanner) (Comment, error) {
+	c := Comment{}
+	var status string
+	var created int64
+	err := s.Scan(&c.Id, &c.EntryId, &c.EntryTitle, &c.Author, &c.URL, &c.Body, &status, &c.IP, &created)
+	if err != nil {
+		return Comment{}, err
+	}
+	c.Status = CommentStatus(status)
+	c.Created = time.Unix(created, 0)
+	return c, nil
+}
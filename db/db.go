@@ -1,63 +1,377 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	
-	_ "github.com/mattn/go-sqlite3"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 // Queries for db actions.
 var (
-	entryQuery       = `SELECT timestamp, title, next, previous, paragraph, image FROM entry WHERE timestamp = ?`
-	historyQuery     = `SELECT timestamp, title FROM entry ORDER BY timestamp DESC`
-	landingQuery     = `SELECT timestamp, title, next, previous, paragraph, image FROM entry ORDER BY timestamp DESC LIMIT ?`
-	oneoffQuery      = `SELECT uid, paragraph, image from oneoff WHERE uid = ?`
-	articleMetaQuery = `SELECT timestamp, title, organization, hyperlink FROM articlemeta ORDER BY timestamp DESC`
-	articleQuery     = `SELECT pdf FROM articlemeta where timestamp = ?`
+	entryQuery          = `SELECT ` + entryColumns + ` FROM entry WHERE id = ? AND ` + isPublished
+	entryTimestampQuery = `SELECT ` + entryColumns + ` FROM entry WHERE timestamp = ? AND ` + isPublished
+	historyQuery        = `SELECT id, title, COALESCE(slug, ''), published FROM entry WHERE ` + isPublished + ` ORDER BY published DESC`
+	landingQuery        = `SELECT ` + entryColumns + ` FROM entry WHERE ` + isPublished + ` ORDER BY published DESC LIMIT ?`
+	oneoffQuery         = `SELECT uid, paragraph, image, image_meta, blocks from oneoff WHERE uid = ?`
+	articleMetaQuery    = `SELECT ` + articleMetaColumns + ` FROM articlemeta ORDER BY timestamp DESC`
+)
+
+// preparedQueries are prepared on the read pool at Open. Every query the
+// Store runs must be listed here.
+var preparedQueries = []string{
+	entryQuery, entryTimestampQuery, historyQuery, landingQuery, oneoffQuery, articleMetaQuery,
+	articleQuery, articleBlobSizeQuery, articleChunkQuery, articleSearchQuery, articleThumbnailQuery, unextractedQuery,
+	historyRangeQuery, historyCountQuery, yearCountQuery,
+	nextQuery, previousQuery, sameYearQuery, relatedQuery, tagsQuery,
+	slugQuery,
+	approvedCommentsQuery, pendingCommentsQuery,
+	mentionsQuery, pendingMentionsQuery, unmentionedQuery,
+	followersQuery, unfederatedQuery,
+	subscribersQuery, unmailedQuery, publishedBetweenQuery,
+	hubSubscriptionsQuery, unpushedQueries[BuiltinHub], unpushedQueries[ExternalHub],
+}
+
+const (
+	entryColumns       = `id, timestamp, title, paragraph, image, image_meta, blocks, created, updated, published, COALESCE(slug, '')`
+	articleMetaColumns = `timestamp, title, organization, hyperlink, COALESCE(excerpt, ''), thumbnail IS NOT NULL`
+	// Entries without a publication time are drafts and ones in the future are scheduled.
+	isPublished = `published > 0 AND published <= strftime('%s', 'now')`
+)
+
+// Store is everything the site reads from and writes to its database. Every
+// query gives up when ctx is done or its own timeout passes, whichever is first.
+// Code that only needs one feature should take the narrower interface for it.
+type Store interface {
+	EntryStore
+	ArticleStore
+	CommentStore
+	MentionStore
+	FollowerStore
+	SubscriberStore
+	HubStore
+	Close() error
+}
+
+// EntryStore reads the published entries and oneoffs.
+type EntryStore interface {
+	GetEntry(ctx context.Context, id int) (Entry, error)
+	GetEntryByTimestamp(ctx context.Context, timestamp int) (Entry, error)
+	GetEntryBySlug(ctx context.Context, slug string) (Entry, error)
+	GetNavigation(ctx context.Context, e Entry, limit int) (Navigation, error)
+	GetHistory(ctx context.Context) ([]History, error)
+	GetHistoryPage(ctx context.Context, f HistoryFilter, limit, offset int) ([]History, error)
+	CountHistory(ctx context.Context, f HistoryFilter) (int, error)
+	GetYearCounts(ctx context.Context) ([]YearCount, error)
+	GetRecentEntries(ctx context.Context, limit int) ([]Entry, error)
+	GetOneOff(ctx context.Context, id string) (Oneoff, error)
+}
+
+// ArticleStore holds the kcawd articles, their PDFs and previews.
+type ArticleStore interface {
+	GetArticleMeta(ctx context.Context) ([]ArticleMeta, error)
+	SearchArticles(ctx context.Context, query string) ([]ArticleMeta, error)
+	GetArticle(ctx context.Context, id int) (Article, error)
+	OpenArticleBlob(ctx context.Context, id int) (io.ReadSeekCloser, error)
+	CreateArticle(ctx context.Context, meta ArticleMeta, file ArticleFile) error
+	UpdateArticle(ctx context.Context, id int, meta ArticleMeta, file *ArticleFile) error
+	DeleteArticle(ctx context.Context, id int) error
+	GetUnextractedArticles(ctx context.Context) ([]Article, error)
+	SetArticlePreview(ctx context.Context, id int, p ArticlePreview) error
+	GetArticleThumbnail(ctx context.Context, id int) ([]byte, error)
+}
+
+// CommentStore holds readers' comments and their moderation.
+type CommentStore interface {
+	AddComment(ctx context.Context, c Comment) (Comment, error)
+	GetComments(ctx context.Context, entryID int) ([]Comment, error)
+	GetPendingComments(ctx context.Context) ([]Comment, error)
+	ModerateComment(ctx context.Context, id int, status CommentStatus) error
+}
+
+// MentionStore holds the Webmentions and Pingbacks received, and which
+// entries have had theirs sent.
+type MentionStore interface {
+	AddMention(ctx context.Context, entryID int, source, target string) error
+	GetMentions(ctx context.Context, entryID int) ([]Mention, error)
+	GetPendingMentions(ctx context.Context) ([]Mention, error)
+	VerifyMention(ctx context.Context, id int, title string) error
+	DeleteMention(ctx context.Context, id int) error
+	GetUnmentionedEntries(ctx context.Context) ([]Entry, error)
+	SetEntryMentioned(ctx context.Context, e Entry) error
+}
+
+// FollowerStore holds the ActivityPub followers, and which entries they
+// have been sent.
+type FollowerStore interface {
+	AddFollower(ctx context.Context, f Follower) error
+	RemoveFollower(ctx context.Context, actor string) error
+	GetFollowers(ctx context.Context) ([]Follower, error)
+	AcceptFollower(ctx context.Context, id int) error
+	GetUnfederatedEntries(ctx context.Context) ([]UnfederatedEntry, error)
+	SetEntryFederated(ctx context.Context, e Entry) error
+}
+
+// SubscriberStore holds the newsletter's subscribers, and which entries have
+// been mailed.
+type SubscriberStore interface {
+	AddSubscriber(ctx context.Context, sub Subscriber) error
+	GetSubscribers(ctx context.Context) ([]Subscriber, error)
+	SetConfirmationSent(ctx context.Context, id int) error
+	ConfirmSubscriber(ctx context.Context, token string) error
+	RemoveSubscriber(ctx context.Context, token string) error
+	SetDigestSent(ctx context.Context, id int, t time.Time) error
+	GetUnmailedEntries(ctx context.Context) ([]Entry, error)
+	SetEntryMailed(ctx context.Context, id int) error
+	GetEntriesPublished(ctx context.Context, after, before time.Time) ([]Entry, error)
+}
+
+// HubStore holds the built-in WebSub hub's subscriptions, and which entries
+// each hub has been told about.
+type HubStore interface {
+	RequestHubSubscription(ctx context.Context, sub HubSubscription) error
+	GetHubSubscriptions(ctx context.Context) ([]HubSubscription, error)
+	ConfirmHubSubscription(ctx context.Context, sub HubSubscription) error
+	CancelHubRequest(ctx context.Context, sub HubSubscription) error
+	RemoveHubSubscription(ctx context.Context, sub HubSubscription) error
+	GetUnpushedEntries(ctx context.Context, hub Hub) ([]Entry, error)
+	SetEntryPushed(ctx context.Context, hub Hub, e Entry) error
+}
+
+var (
+	// ErrNotFound is returned when nothing published matches a lookup.
+	ErrNotFound = errors.New("db: not found")
+	// ErrInvalidID is returned for ids that can never match anything.
+	ErrInvalidID = errors.New("db: invalid id")
+	// ErrExists is returned when a write would duplicate an existing row.
+	ErrExists = errors.New("db: already exists")
+	// ErrTimeout is returned when a query runs past its deadline.
+	ErrTimeout = errors.New("db: query timed out")
+	// ErrUnavailable is returned when the database is locked by another process.
+	ErrUnavailable = errors.New("db: database is busy")
 )
 
-var globalDB *sql.DB
+// DefaultQueryTimeout bounds each Store call unless Open is told otherwise.
+const DefaultQueryTimeout = 5 * time.Second
+
+const (
+	// How long a connection waits on another's lock before giving up with SQLITE_BUSY.
+	busyTimeout = time.Second
+	// Readers don't block each other in WAL mode, so allow a few at once.
+	maxReaders = 8
+)
+
+var _ Store = (*SQLite)(nil)
+
+// SQLite is the Store backed by a SQLite database file.
+type SQLite struct {
+	// db is a read-only pool that every query goes through.
+	db *sql.DB
+	// rw is a single read-write connection for migrations and the few writes.
+	rw      *sql.DB
+	stmts   map[string]*sql.Stmt
+	timeout time.Duration
+}
 
 type Entry struct {
-	// Timestamp, UID.
-	Entry_id  int
+	// Stable UID. Independent of any of the entry's dates.
+	Id int
+	// URL path segment generated from Title. Empty until assigned at Open.
+	Slug string
+	// Legacy timestamp UID. Only kept to redirect old URLs and keep feed ids stable.
+	Timestamp int
 	Title     string
-	Next      int
-	Previous  int
-	Content   string
-	Image     string
+	Blocks    []Block
+	Created   time.Time
+	Updated   time.Time
+	Published time.Time
 }
 
 type Oneoff struct {
-	Uid       string
-	Paragraph string
-	Image     string
+	Uid    string
+	Blocks []Block
 }
 
 type History struct {
-	Entry_id int
-	Title    string
+	Id        int
+	Slug      string
+	Title     string
+	Published time.Time
 }
 
 type ArticleMeta struct {
-	EntryId int
-	Title string
+	EntryId      int
+	Title        string
 	Organization string
-	Hyperlink string
+	Hyperlink    string
+	// Empty until the article's preview has been extracted.
+	Excerpt      string
+	HasThumbnail bool
 }
 
-func Init(dbPath string) error {
-	var err error
-	globalDB, err = sql.Open("sqlite3", dbPath)
+// Open opens the database at dbPath and brings its schema up to date. Each
+// query is limited to queryTimeout, or DefaultQueryTimeout if that is zero.
+//
+// dbPath is a file path or a "file:" URI. In-memory databases must be named
+// and use a shared cache, since the store holds more than one connection.
+func Open(dbPath string, queryTimeout time.Duration) (*SQLite, error) {
+	memory := isMemory(dbPath)
+
+	rwParams := url.Values{"_busy_timeout": {strconv.FormatInt(busyTimeout.Milliseconds(), 10)}}
+	if !memory {
+		rwParams.Set("_journal_mode", "WAL")
+	}
+	rw, err := sql.Open("sqlite3", dsn(dbPath, rwParams))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open db (path: %s): %v", dbPath, err)
+	}
+	rw.SetMaxOpenConns(1)
+	if err := migrate(rw); err != nil {
+		rw.Close()
+		return nil, fmt.Errorf("Failed to migrate db (path: %s): %v", dbPath, err)
+	}
+	if err := assignSlugs(rw); err != nil {
+		rw.Close()
+		return nil, fmt.Errorf("Failed to assign entry slugs (path: %s): %v", dbPath, err)
+	}
+	if err := chunkArticles(rw); err != nil {
+		rw.Close()
+		return nil, fmt.Errorf("Failed to store article PDFs (path: %s): %v", dbPath, err)
+	}
+
+	roParams := url.Values{"_busy_timeout": rwParams["_busy_timeout"]}
+	if memory {
+		// mode=ro would replace mode=memory, so ask for read-only another way.
+		roParams.Set("_query_only", "true")
+	} else {
+		roParams.Set("mode", "ro")
+	}
+	conn, err := sql.Open("sqlite3", dsn(dbPath, roParams))
 	if err != nil {
-		err = fmt.Errorf("Failed to init db (path: %s): %v", dbPath, err)
+		rw.Close()
+		return nil, fmt.Errorf("Failed to open read-only db (path: %s): %v", dbPath, err)
+	}
+	conn.SetMaxOpenConns(maxReaders)
+	conn.SetMaxIdleConns(maxReaders)
+
+	if queryTimeout == 0 {
+		queryTimeout = DefaultQueryTimeout
+	}
+	s := &SQLite{db: conn, rw: rw, stmts: make(map[string]*sql.Stmt), timeout: queryTimeout}
+	for _, query := range preparedQueries {
+		stmt, err := conn.Prepare(query)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Failed to prepare query %q: %v", query, err)
+		}
+		s.stmts[query] = stmt
+	}
+	return s, nil
+}
+
+// isMemory reports whether dbPath names an in-memory database.
+func isMemory(dbPath string) bool {
+	return dbPath == ":memory:" || strings.Contains(dbPath, "mode=memory")
+}
+
+// dsn turns dbPath into a "file:" URI with params appended to any it already has.
+func dsn(dbPath string, params url.Values) string {
+	if !strings.HasPrefix(dbPath, "file:") {
+		dbPath = "file:" + dbPath
+	}
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return dbPath + sep + params.Encode()
+}
+
+func (s *SQLite) Close() error {
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+	err := s.db.Close()
+	if rwErr := s.rw.Close(); err == nil {
+		err = rwErr
 	}
 	return err
 }
 
-func GetArticleMeta() ([]ArticleMeta, error) {
-	rows, err := globalDB.Query(articleMetaQuery)
+// stmt returns the prepared statement for query.
+func (s *SQLite) stmt(query string) *sql.Stmt {
+	return s.stmts[query]
+}
+
+func (s *SQLite) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// queryErr translates empty results, deadline, locking and uniqueness
+// failures into ErrNotFound, ErrTimeout, ErrUnavailable and ErrExists.
+// Anything else, other constraint failures included, is returned as is.
+func queryErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	// NOT NULL, CHECK and foreign key failures are bugs, not conflicts.
+	if errors.As(err, &sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey) {
+		return fmt.Errorf("%w: %v", ErrExists, err)
+	}
+	return err
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanEntry reads a row selected with entryColumns.
+func scanEntry(s scanner, extra ...interface{}) (Entry, error) {
+	entry := Entry{}
+	var created, updated, published int64
+	var paragraph, image, imageMeta, blocks string
+	dest := []interface{}{&entry.Id, &entry.Timestamp, &entry.Title, &paragraph, &image, &imageMeta, &blocks, &created, &updated, &published, &entry.Slug}
+	err := s.Scan(append(dest, extra...)...)
+	if err != nil {
+		return entry, err
+	}
+	if entry.Blocks, err = parseBlocks(blocks, paragraph, image, imageMeta); err != nil {
+		return entry, fmt.Errorf("entry %d: %v", entry.Id, err)
+	}
+	entry.Created = time.Unix(created, 0)
+	entry.Updated = time.Unix(updated, 0)
+	entry.Published = time.Unix(published, 0)
+	return entry, nil
+}
+
+func (s *SQLite) GetArticleMeta(ctx context.Context) ([]ArticleMeta, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	articles, err := s.queryArticleMeta(ctx, articleMetaQuery)
+	return articles, queryErr(ctx, err)
+}
+
+func (s *SQLite) queryArticleMeta(ctx context.Context, query string, args ...interface{}) ([]ArticleMeta, error) {
+	rows, err := s.stmt(query).QueryContext(ctx, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -66,80 +380,106 @@ func GetArticleMeta() ([]ArticleMeta, error) {
 	var articles []ArticleMeta
 	for rows.Next() {
 		article := ArticleMeta{}
-		err := rows.Scan(&article.EntryId, &article.Title, &article.Organization, &article.Hyperlink)
+		err := rows.Scan(&article.EntryId, &article.Title, &article.Organization, &article.Hyperlink, &article.Excerpt, &article.HasThumbnail)
 		if err != nil {
 			return nil, err
 		}
 		articles = append(articles, article)
 	}
-	return articles, nil
+	return articles, rows.Err()
 }
 
-func GetArticle(id int) (string, error) {
-	if id == 0 {
-		return "", fmt.Errorf("%d is not a valid id", id)
-	}
-
-	var pdf string
-	err := globalDB.QueryRow(articleQuery, id).Scan(&pdf)
-	return pdf, err
-}
+func (s *SQLite) GetRecentEntries(ctx context.Context, limit int) ([]Entry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 
-func GetRecentEntries(limit int) ([]Entry, error) {
-	rows, err := globalDB.Query(landingQuery, limit)
+	rows, err := s.stmt(landingQuery).QueryContext(ctx, limit)
 	if err != nil {
-		return nil, err
+		return nil, queryErr(ctx, err)
 	}
 	defer rows.Close()
 
 	var entries []Entry
 	for rows.Next() {
-		entry := Entry{}
-		err := rows.Scan(&entry.Entry_id, &entry.Title, &entry.Next, &entry.Previous, &entry.Content, &entry.Image)
+		entry, err := scanEntry(rows)
 		if err != nil {
-			return nil, err
+			return nil, queryErr(ctx, err)
 		}
 		entries = append(entries, entry)
 	}
-	return entries, nil
+	return entries, queryErr(ctx, rows.Err())
 }
 
-func GetOneOff(id string) (Oneoff, error) {
+func (s *SQLite) GetOneOff(ctx context.Context, id string) (Oneoff, error) {
+	if id == "" {
+		return Oneoff{}, fmt.Errorf("%w: empty oneoff id", ErrInvalidID)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	oneoff := Oneoff{}
-	err := globalDB.QueryRow(oneoffQuery, id).Scan(&oneoff.Uid, &oneoff.Paragraph, &oneoff.Image)
-	return oneoff, err
+	var paragraph, image, imageMeta, blocks string
+	err := s.stmt(oneoffQuery).QueryRowContext(ctx, id).Scan(&oneoff.Uid, &paragraph, &image, &imageMeta, &blocks)
+	if err != nil {
+		return oneoff, queryErr(ctx, err)
+	}
+	if oneoff.Blocks, err = parseBlocks(blocks, paragraph, image, imageMeta); err != nil {
+		return oneoff, fmt.Errorf("oneoff %s: %v", id, err)
+	}
+	return oneoff, nil
 }
 
-func GetEntry(id int) (Entry, error) {
+func (s *SQLite) GetEntry(ctx context.Context, id int) (Entry, error) {
+	if id < 0 {
+		return Entry{}, fmt.Errorf("%w: %d", ErrInvalidID, id)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	// Get entry at id. If id is empty get most recent entry.
-	page := Entry{}
-	if id == 0 {
-		rows, err := globalDB.Query(landingQuery, 1)
-		if err != nil {
-			return page, err
-		}
-		defer rows.Close()
-
-		for rows.Next() {
-			err := rows.Scan(
-				&page.Entry_id, &page.Title, &page.Next, &page.Previous, &page.Content, &page.Image)
-			if err != nil {
-				return page, err
-			}
-			break
-		}
-	} else {
-		err := globalDB.QueryRow(entryQuery, id).Scan(
-			&page.Entry_id, &page.Title, &page.Next, &page.Previous, &page.Content, &page.Image)
-		if err != nil {
-			return page, err
-		}
+	if id != 0 {
+		entry, err := scanEntry(s.stmt(entryQuery).QueryRowContext(ctx, id))
+		return entry, queryErr(ctx, err)
 	}
-	return page, nil
+
+	rows, err := s.stmt(landingQuery).QueryContext(ctx, 1)
+	if err != nil {
+		return Entry{}, queryErr(ctx, err)
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		entry, err := scanEntry(rows)
+		return entry, queryErr(ctx, err)
+	}
+	if err := rows.Err(); err != nil {
+		return Entry{}, queryErr(ctx, err)
+	}
+	return Entry{}, ErrNotFound
+}
+
+// GetEntryByTimestamp looks up an entry by the timestamp that used to be its id.
+func (s *SQLite) GetEntryByTimestamp(ctx context.Context, timestamp int) (Entry, error) {
+	if timestamp <= 0 {
+		return Entry{}, fmt.Errorf("%w: timestamp %d", ErrInvalidID, timestamp)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	entry, err := scanEntry(s.stmt(entryTimestampQuery).QueryRowContext(ctx, timestamp))
+	return entry, queryErr(ctx, err)
+}
+
+func (s *SQLite) GetHistory(ctx context.Context) ([]History, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	history, err := s.queryHistory(ctx, historyQuery)
+	return history, queryErr(ctx, err)
 }
 
-func GetHistory() ([]History, error) {
-	rows, err := globalDB.Query(historyQuery)
+func (s *SQLite) queryHistory(ctx context.Context, query string, args ...interface{}) ([]History, error) {
+	rows, err := s.stmt(query).QueryContext(ctx, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -148,11 +488,13 @@ func GetHistory() ([]History, error) {
 	var entries []History
 	for rows.Next() {
 		entry := History{}
-		err := rows.Scan(&entry.Entry_id, &entry.Title)
+		var published int64
+		err := rows.Scan(&entry.Id, &entry.Title, &entry.Slug, &published)
 		if err != nil {
 			return nil, err
 		}
+		entry.Published = time.Unix(published, 0)
 		entries = append(entries, entry)
 	}
-	return entries, nil
+	return entries, rows.Err()
 }
@@ -0,0 +1,1137 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/db/dbtest"
+)
+
+var ctx = context.Background()
+
+func TestGetEntry(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	tests := []struct {
+		name    string
+		id      int
+		wantId  int
+		wantErr error
+	}{
+		{name: "latest", id: 0, wantId: 3},
+		{name: "by id", id: 1, wantId: 1},
+		{name: "missing", id: 100, wantErr: db.ErrNotFound},
+		{name: "draft", id: 4, wantErr: db.ErrNotFound},
+		{name: "scheduled", id: 5, wantErr: db.ErrNotFound},
+		{name: "negative", id: -1, wantErr: db.ErrInvalidID},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			entry, err := store.GetEntry(ctx, tc.id)
+			if !errors.Is(err, tc.wantErr) || (err != nil && tc.wantErr == nil) {
+				t.Fatalf("GetEntry(%d) error = %v, want %v", tc.id, err, tc.wantErr)
+			}
+			if err == nil && entry.Id != tc.wantId {
+				t.Errorf("GetEntry(%d) = entry %d, want %d", tc.id, entry.Id, tc.wantId)
+			}
+		})
+	}
+}
+
+func TestGetEntryFields(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	entry, err := store.GetEntry(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetEntry(1) failed: %v", err)
+	}
+	want := db.Entry{
+		Id:        1,
+		Slug:      "first-post",
+		Timestamp: 1489554739,
+		Title:     "First Post",
+		Blocks: []db.Block{
+			mustBlock(t, "paragraph", map[string]string{"text": "Hello"}),
+			mustBlock(t, "paragraph", map[string]string{"text": "World"}),
+			mustBlock(t, "image", map[string]string{"src": "/images/a.jpg"}),
+		},
+		Created:   time.Unix(1489554739, 0),
+		Updated:   time.Unix(1489554739, 0),
+		Published: time.Unix(1489554739, 0),
+	}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("GetEntry(1) = %+v, want %+v", entry, want)
+	}
+}
+
+func mustBlock(t *testing.T, typ string, fields interface{}) db.Block {
+	t.Helper()
+	b, err := db.NewBlock(typ, fields)
+	if err != nil {
+		t.Fatalf("NewBlock(%s) failed: %v", typ, err)
+	}
+	return b
+}
+
+func TestBlockJSON(t *testing.T) {
+	var blocks []db.Block
+	in := `[{"type": "heading", "text": "Hi", "level": 3}, {"type": "code", "text": "x := 1"}]`
+	if err := json.Unmarshal([]byte(in), &blocks); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(blocks) != 2 || blocks[0].Type != "heading" || blocks[1].Type != "code" {
+		t.Fatalf("Unmarshal = %+v, want a heading and a code block", blocks)
+	}
+	var heading struct {
+		Text  string `json:"text"`
+		Level int    `json:"level"`
+	}
+	if err := blocks[0].Decode(&heading); err != nil || heading.Text != "Hi" || heading.Level != 3 {
+		t.Errorf("Decode = %+v, %v, want Hi at level 3", heading, err)
+	}
+
+	out, err := json.Marshal(blocks)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var got, want []map[string]interface{}
+	json.Unmarshal(out, &got)
+	json.Unmarshal([]byte(in), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Marshal = %s, want the fields of %s", out, in)
+	}
+
+	if err := json.Unmarshal([]byte(`[{"text": "untyped"}]`), &blocks); err == nil {
+		t.Error("Unmarshal of a block without a type succeeded")
+	}
+}
+
+// TestConvertBlocks opens a database from before migrations, with content only
+// in the paragraph and image columns, and checks it is converted to blocks.
+func TestConvertBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	_, err = raw.Exec(`
+		CREATE TABLE entry (timestamp INTEGER PRIMARY KEY, title TEXT NOT NULL, next INTEGER NOT NULL DEFAULT 0, previous INTEGER NOT NULL DEFAULT 0, paragraph TEXT NOT NULL DEFAULT '', image TEXT NOT NULL DEFAULT '');
+		CREATE TABLE oneoff (uid TEXT PRIMARY KEY, paragraph TEXT NOT NULL DEFAULT '', image TEXT NOT NULL DEFAULT '');
+		INSERT INTO entry (timestamp, title, paragraph, image) VALUES
+			(1400000000, 'Matched', 'One\nTwo', '/images/1.jpg\n'),
+			(1400000100, 'More paragraphs than images', 'One\nTwo\nThree', '/images/1.jpg'),
+			(1400000200, 'Empty', '', '');
+		INSERT INTO oneoff (uid, paragraph, image) VALUES ('about', 'About', '');`)
+	if err != nil {
+		t.Fatalf("failed to create legacy tables: %v", err)
+	}
+
+	store, err := db.Open(path, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	tests := []struct {
+		timestamp int
+		want      string
+	}{
+		{1400000000, `[{"text":"One","type":"paragraph"},{"src":"/images/1.jpg","type":"image"},{"text":"Two","type":"paragraph"}]`},
+		{1400000100, `[{"text":"One","type":"paragraph"},{"src":"/images/1.jpg","type":"image"},{"text":"Two","type":"paragraph"},{"text":"Three","type":"paragraph"}]`},
+		{1400000200, `[]`},
+	}
+	for _, tc := range tests {
+		var blocks string
+		if err := raw.QueryRow(`SELECT blocks FROM entry WHERE timestamp = ?`, tc.timestamp).Scan(&blocks); err != nil {
+			t.Fatal(err)
+		}
+		if blocks != tc.want {
+			t.Errorf("blocks of %d = %s, want %s", tc.timestamp, blocks, tc.want)
+		}
+	}
+	var blocks string
+	if err := raw.QueryRow(`SELECT blocks FROM oneoff WHERE uid = 'about'`).Scan(&blocks); err != nil || blocks != `[{"text":"About","type":"paragraph"}]` {
+		t.Errorf("oneoff blocks = %s, %v", blocks, err)
+	}
+
+	entry, err := store.GetEntryByTimestamp(ctx, 1400000100)
+	if err != nil || len(entry.Blocks) != 4 || entry.Blocks[1].Type != "image" {
+		t.Errorf("GetEntryByTimestamp = %+v, %v, want 4 blocks", entry.Blocks, err)
+	}
+	// Converting isn't an edit.
+	if want := time.Unix(1400000100, 0); !entry.Updated.Equal(want) {
+		t.Errorf("Updated = %v after migrating, want %v", entry.Updated, want)
+	}
+}
+
+func TestGetEntryByTimestampAndSlug(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	if entry, err := store.GetEntryByTimestamp(ctx, 1500000000); err != nil || entry.Id != 2 {
+		t.Errorf("GetEntryByTimestamp(1500000000) = %d, %v, want 2", entry.Id, err)
+	}
+	if entry, err := store.GetEntryBySlug(ctx, "third-post"); err != nil || entry.Id != 3 {
+		t.Errorf("GetEntryBySlug(third-post) = %d, %v, want 3", entry.Id, err)
+	}
+	if _, err := store.GetEntryBySlug(ctx, "draft"); err != db.ErrNotFound {
+		t.Errorf("GetEntryBySlug(draft) error = %v, want %v", err, db.ErrNotFound)
+	}
+	if _, err := store.GetEntryBySlug(ctx, ""); !errors.Is(err, db.ErrInvalidID) {
+		t.Errorf("GetEntryBySlug(\"\") error = %v, want %v", err, db.ErrInvalidID)
+	}
+	if _, err := store.GetEntryByTimestamp(ctx, 1); err != db.ErrNotFound {
+		t.Errorf("GetEntryByTimestamp(1) error = %v, want %v", err, db.ErrNotFound)
+	}
+}
+
+func TestInsertDefaults(t *testing.T) {
+	store, conn := dbtest.Open(t)
+
+	// Entries are inserted by hand with only the legacy columns.
+	if _, err := conn.Exec(`INSERT INTO entry (timestamp, title) VALUES (1530000001, 'Hand Made')`); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	entry, err := store.GetEntryByTimestamp(ctx, 1530000001)
+	if err != nil {
+		t.Fatalf("GetEntryByTimestamp failed: %v", err)
+	}
+	if entry.Id != 6 || !entry.Published.Equal(time.Unix(1530000001, 0)) {
+		t.Errorf("inserted entry = %+v, want id 6 published at its timestamp", entry)
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Hello, World!", "hello-world"},
+		{"  Don't Panic  ", "dont-panic"},
+		{"2019: A Year", "2019-a-year"},
+		{"¡¿?!", "entry"},
+		{"Café au lait", "cafe-au-lait"},
+		{"Ærøskøbing, Straße", "aeroskobing-strasse"},
+		{"Ｆｕｌｌｗｉｄｔｈ ﬁnds", "fullwidth-finds"},
+		{"Привет, мир", "привет-мир"},
+		{"東京タワー", "東京タワー"},
+		{"ガイド", "ガイド"},
+		{strings.Repeat("é", 70), strings.Repeat("e", 60)},
+		{strings.Repeat("жж ", 30), strings.TrimSuffix(strings.Repeat("жж-", 19), "-")},
+		{"a very long title that keeps going and going well past the sixty character limit", "a-very-long-title-that-keeps-going-and-going-well-past-the"},
+	}
+	for _, tc := range tests {
+		if got := db.Slugify(tc.title); got != tc.want {
+			t.Errorf("Slugify(%q) = %q, want %q", tc.title, got, tc.want)
+		}
+	}
+}
+
+func TestGetNavigation(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	entry, err := store.GetEntry(ctx, 2)
+	if err != nil {
+		t.Fatalf("GetEntry(2) failed: %v", err)
+	}
+	nav, err := store.GetNavigation(ctx, entry, 5)
+	if err != nil {
+		t.Fatalf("GetNavigation failed: %v", err)
+	}
+	if nav.Next == nil || nav.Next.Id != 3 {
+		t.Errorf("Next = %+v, want entry 3", nav.Next)
+	}
+	if nav.Previous == nil || nav.Previous.Id != 1 {
+		t.Errorf("Previous = %+v, want entry 1", nav.Previous)
+	}
+	if !reflect.DeepEqual(nav.Tags, []string{"go"}) {
+		t.Errorf("Tags = %v, want [go]", nav.Tags)
+	}
+	if len(nav.SameYear) != 1 || nav.SameYear[0].Id != 1 {
+		t.Errorf("SameYear = %+v, want entry 1", nav.SameYear)
+	}
+	if len(nav.Related) != 1 || nav.Related[0].Id != 3 {
+		t.Errorf("Related = %+v, want entry 3", nav.Related)
+	}
+
+	// The newest published entry has no next, even with a scheduled one after it.
+	latest, _ := store.GetEntry(ctx, 0)
+	nav, err = store.GetNavigation(ctx, latest, 5)
+	if err != nil {
+		t.Fatalf("GetNavigation failed: %v", err)
+	}
+	if nav.Next != nil {
+		t.Errorf("Next of latest = %+v, want nil", nav.Next)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	history, err := store.GetHistory(ctx)
+	if err != nil {
+		t.Fatalf("GetHistory failed: %v", err)
+	}
+	if len(history) != 3 || history[0].Id != 3 {
+		t.Errorf("GetHistory = %+v, want the three published entries newest first", history)
+	}
+
+	tests := []struct {
+		filter    db.HistoryFilter
+		limit     int
+		offset    int
+		wantIds   []int
+		wantTotal int
+	}{
+		{db.HistoryFilter{}, 2, 0, []int{3, 2}, 3},
+		{db.HistoryFilter{}, 2, 2, []int{1}, 3},
+		{db.HistoryFilter{Year: 2017}, 10, 0, []int{2, 1}, 2},
+		{db.HistoryFilter{Year: 2017, Month: time.March}, 10, 0, []int{1}, 1},
+		{db.HistoryFilter{Year: 2016}, 10, 0, nil, 0},
+	}
+	for _, tc := range tests {
+		page, err := store.GetHistoryPage(ctx, tc.filter, tc.limit, tc.offset)
+		if err != nil {
+			t.Fatalf("GetHistoryPage(%+v) failed: %v", tc.filter, err)
+		}
+		var ids []int
+		for _, h := range page {
+			ids = append(ids, h.Id)
+		}
+		if !reflect.DeepEqual(ids, tc.wantIds) {
+			t.Errorf("GetHistoryPage(%+v, %d, %d) = %v, want %v", tc.filter, tc.limit, tc.offset, ids, tc.wantIds)
+		}
+		if total, err := store.CountHistory(ctx, tc.filter); err != nil || total != tc.wantTotal {
+			t.Errorf("CountHistory(%+v) = %d, %v, want %d", tc.filter, total, err, tc.wantTotal)
+		}
+	}
+
+	counts, err := store.GetYearCounts(ctx)
+	if err != nil {
+		t.Fatalf("GetYearCounts failed: %v", err)
+	}
+	want := []db.YearCount{{Year: 2018, Count: 1}, {Year: 2017, Count: 2}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("GetYearCounts = %+v, want %+v", counts, want)
+	}
+}
+
+func TestArticles(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	articles, err := store.GetArticleMeta(ctx)
+	if err != nil || len(articles) != 2 || articles[0].Title != "An Article" {
+		t.Fatalf("GetArticleMeta = %+v, %v", articles, err)
+	}
+	article, err := store.GetArticle(ctx, articles[0].EntryId)
+	want := db.Article{
+		Id:       1600000000,
+		Size:     16,
+		SHA256:   "c5c2e8be6ad0825a56ded1f1a153ceaf11dc060ab44b120a94406a08207babc2",
+		Modified: time.Unix(1600000100, 0),
+	}
+	if err != nil || !reflect.DeepEqual(article, want) {
+		t.Errorf("GetArticle = %+v, %v, want %+v", article, err, want)
+	}
+	if article, err := store.GetArticle(ctx, 1590000000); err != nil || article.Location != "stored.pdf" {
+		t.Errorf("GetArticle(stored) = %+v, %v, want location stored.pdf", article, err)
+	}
+	if _, err := store.GetArticle(ctx, 0); !errors.Is(err, db.ErrInvalidID) {
+		t.Errorf("GetArticle(0) error = %v, want %v", err, db.ErrInvalidID)
+	}
+	if _, err := store.GetArticle(ctx, 1); err != db.ErrNotFound {
+		t.Errorf("GetArticle(1) error = %v, want %v", err, db.ErrNotFound)
+	}
+	if _, err := store.OpenArticleBlob(ctx, 1590000000); err != db.ErrNotFound {
+		t.Errorf("OpenArticleBlob(stored) error = %v, want %v", err, db.ErrNotFound)
+	}
+}
+
+func TestOpenArticleBlob(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	pdf, err := store.OpenArticleBlob(ctx, 1600000000)
+	if err != nil {
+		t.Fatalf("OpenArticleBlob failed: %v", err)
+	}
+	defer pdf.Close()
+
+	if all, err := io.ReadAll(pdf); err != nil || string(all) != "%PDF-1.4 fixture" {
+		t.Errorf("ReadAll = %q, %v", all, err)
+	}
+	if end, err := pdf.Seek(0, io.SeekEnd); err != nil || end != 16 {
+		t.Errorf("Seek to end = %d, %v, want 16", end, err)
+	}
+	if _, err := pdf.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if n, err := pdf.Read(buf); err != nil || string(buf[:n]) != "1.4" {
+		t.Errorf("Read after seek = %q, %v, want 1.4", buf[:n], err)
+	}
+	if _, err := pdf.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := pdf.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("Read at end = %d, %v, want EOF", n, err)
+	}
+}
+
+func TestChunkArticles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entries.db")
+	store, err := db.Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Articles have always been inserted by hand with the PDF as TEXT.
+	if _, err := conn.Exec(`INSERT INTO articlemeta (timestamp, title, pdf) VALUES (1600000000, 'Hand', '%PDF-1.4 fixture')`); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = db.Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	article, err := store.GetArticle(ctx, 1600000000)
+	want := db.Article{
+		Id:       1600000000,
+		Size:     16,
+		SHA256:   "c5c2e8be6ad0825a56ded1f1a153ceaf11dc060ab44b120a94406a08207babc2",
+		Modified: time.Unix(1600000000, 0),
+	}
+	if err != nil || !reflect.DeepEqual(article, want) {
+		t.Errorf("GetArticle = %+v, %v, want %+v", article, err, want)
+	}
+	r, err := store.OpenArticleBlob(ctx, 1600000000)
+	if err != nil {
+		t.Fatalf("OpenArticleBlob failed: %v", err)
+	}
+	defer r.Close()
+	if all, err := io.ReadAll(r); err != nil || string(all) != "%PDF-1.4 fixture" {
+		t.Errorf("ReadAll = %q, %v", all, err)
+	}
+	var left int
+	if err := conn.QueryRow(`SELECT count(*) FROM articlemeta WHERE pdf IS NOT NULL`).Scan(&left); err != nil || left != 0 {
+		t.Errorf("%d PDFs left in articlemeta, %v, want 0", left, err)
+	}
+}
+
+func TestGetOneOff(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	oneoff, err := store.GetOneOff(ctx, "about")
+	want := []db.Block{
+		mustBlock(t, "paragraph", map[string]string{"text": "About this site"}),
+		mustBlock(t, "image", map[string]string{"src": "/images/photos/gradient.png", "alt": "A gradient"}),
+	}
+	if err != nil || oneoff.Uid != "about" || !reflect.DeepEqual(oneoff.Blocks, want) {
+		t.Errorf("GetOneOff(about) = %+v, %v, want %+v", oneoff, err, want)
+	}
+	if _, err := store.GetOneOff(ctx, "missing"); err != db.ErrNotFound {
+		t.Errorf("GetOneOff(missing) error = %v, want %v", err, db.ErrNotFound)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := store.GetEntry(expired, 1); !errors.Is(err, db.ErrTimeout) {
+		t.Errorf("GetEntry with expired deadline: err = %v, want %v", err, db.ErrTimeout)
+	}
+	if _, err := store.GetHistory(expired); !errors.Is(err, db.ErrTimeout) {
+		t.Errorf("GetHistory with expired deadline: err = %v, want %v", err, db.ErrTimeout)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.GetEntry(canceled, 1); !errors.Is(err, context.Canceled) || errors.Is(err, db.ErrTimeout) {
+		t.Errorf("GetEntry with canceled context: err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func BenchmarkGetEntry(b *testing.B) {
+	store, _ := dbtest.Open(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.GetEntry(ctx, 2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetHistory(b *testing.B) {
+	store, _ := dbtest.Open(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.GetHistory(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entries.db")
+	store, err := db.Open(path, 0)
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", path, err)
+	}
+	defer store.Close()
+
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var mode string
+	if err := conn.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal_mode = %q (err %v), want wal", mode, err)
+	}
+	if _, err := conn.Exec(`INSERT INTO entry (timestamp, title) VALUES (1500000000, 'Written')`); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	if _, err := store.GetEntry(ctx, 1); err != nil {
+		t.Errorf("GetEntry after insert: %v", err)
+	}
+}
+
+func TestWriteArticles(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	meta := db.ArticleMeta{EntryId: 1700000000, Title: "New", Organization: "Org", Hyperlink: "https://example.com"}
+	if err := store.CreateArticle(ctx, meta, db.ArticleFile{PDF: []byte("%PDF-1.4 fixture")}); err != nil {
+		t.Fatalf("CreateArticle failed: %v", err)
+	}
+	if err := store.CreateArticle(ctx, meta, db.ArticleFile{PDF: []byte("%PDF-1.4 again")}); !errors.Is(err, db.ErrExists) {
+		t.Errorf("CreateArticle on a taken date error = %v, want %v", err, db.ErrExists)
+	}
+	article, err := store.GetArticle(ctx, 1700000000)
+	if err != nil || article.Size != 16 || article.SHA256 != "c5c2e8be6ad0825a56ded1f1a153ceaf11dc060ab44b120a94406a08207babc2" {
+		t.Errorf("GetArticle after create = %+v, %v", article, err)
+	}
+
+	meta.EntryId, meta.Title = 1700000001, "Moved"
+	file := &db.ArticleFile{Location: "moved.pdf", Size: 3, SHA256: "abc"}
+	if err := store.UpdateArticle(ctx, 1700000000, meta, file); err != nil {
+		t.Fatalf("UpdateArticle failed: %v", err)
+	}
+	if article, err := store.GetArticle(ctx, 1700000001); err != nil || article.Location != "moved.pdf" {
+		t.Errorf("GetArticle after update = %+v, %v", article, err)
+	}
+	if _, err := store.OpenArticleBlob(ctx, 1700000001); err != db.ErrNotFound {
+		t.Errorf("OpenArticleBlob after moving to storage error = %v, want %v", err, db.ErrNotFound)
+	}
+	if err := store.UpdateArticle(ctx, 1700000000, meta, nil); err != db.ErrNotFound {
+		t.Errorf("UpdateArticle of the old id error = %v, want %v", err, db.ErrNotFound)
+	}
+	meta.EntryId = 1600000000
+	if err := store.UpdateArticle(ctx, 1700000001, meta, nil); !errors.Is(err, db.ErrExists) {
+		t.Errorf("UpdateArticle onto a taken date error = %v, want %v", err, db.ErrExists)
+	}
+	meta.EntryId = -5
+	if err := store.UpdateArticle(ctx, 1700000001, meta, nil); !errors.Is(err, db.ErrInvalidID) || !strings.Contains(err.Error(), "-5") {
+		t.Errorf("UpdateArticle onto an invalid date error = %v, want %v naming -5", err, db.ErrInvalidID)
+	}
+
+	if err := store.DeleteArticle(ctx, 1700000001); err != nil {
+		t.Fatalf("DeleteArticle failed: %v", err)
+	}
+	if err := store.DeleteArticle(ctx, 1700000001); err != db.ErrNotFound {
+		t.Errorf("second DeleteArticle error = %v, want %v", err, db.ErrNotFound)
+	}
+}
+
+func TestConstraintErrors(t *testing.T) {
+	store, conn := dbtest.Open(t)
+
+	meta := db.ArticleMeta{EntryId: 1600000000, Title: "Taken"}
+	if err := store.CreateArticle(ctx, meta, db.ArticleFile{}); !errors.Is(err, db.ErrExists) {
+		t.Errorf("CreateArticle on a taken date error = %v, want %v", err, db.ErrExists)
+	}
+	// Any other constraint failure is a bug, not a conflict.
+	if _, err := conn.Exec(`CREATE TRIGGER refuse BEFORE INSERT ON articlemeta BEGIN SELECT RAISE(ABORT, 'refused'); END`); err != nil {
+		t.Fatal(err)
+	}
+	meta.EntryId = 1700000000
+	if err := store.CreateArticle(ctx, meta, db.ArticleFile{}); err == nil || errors.Is(err, db.ErrExists) {
+		t.Errorf("CreateArticle refused by a trigger error = %v, want something other than %v", err, db.ErrExists)
+	}
+}
+
+func TestLargeArticle(t *testing.T) {
+	store, conn := dbtest.Open(t)
+
+	pdf := []byte(strings.Repeat("%PDF-1.4 large ", 40000))
+	meta := db.ArticleMeta{EntryId: 1700000000, Title: "Large"}
+	if err := store.CreateArticle(ctx, meta, db.ArticleFile{PDF: pdf}); err != nil {
+		t.Fatalf("CreateArticle failed: %v", err)
+	}
+	// Moving the article to a new date takes its PDF along.
+	meta.EntryId = 1700000001
+	if err := store.UpdateArticle(ctx, 1700000000, meta, nil); err != nil {
+		t.Fatalf("UpdateArticle failed: %v", err)
+	}
+	var chunks int
+	if err := conn.QueryRow(`SELECT count(*) FROM article_chunk WHERE article = 1700000001`).Scan(&chunks); err != nil || chunks < 2 {
+		t.Errorf("%d chunks, %v, want the PDF split into several", chunks, err)
+	}
+
+	r, err := store.OpenArticleBlob(ctx, 1700000001)
+	if err != nil {
+		t.Fatalf("OpenArticleBlob failed: %v", err)
+	}
+	defer r.Close()
+	if all, err := io.ReadAll(r); err != nil || string(all) != string(pdf) {
+		t.Errorf("ReadAll = %d bytes, %v, want %d", len(all), err, len(pdf))
+	}
+	// Reads across a chunk boundary and back again.
+	for _, offset := range []int64{262000, 1000, 599000} {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1000)
+		if _, err := io.ReadFull(r, buf); err != nil || string(buf) != string(pdf[offset:offset+1000]) {
+			t.Errorf("ReadFull at %d = %q, %v", offset, buf, err)
+		}
+	}
+
+	if err := store.DeleteArticle(ctx, 1700000001); err != nil {
+		t.Fatalf("DeleteArticle failed: %v", err)
+	}
+	if err := conn.QueryRow(`SELECT count(*) FROM article_chunk`).Scan(&chunks); err != nil || chunks != 2 {
+		t.Errorf("%d chunks after DeleteArticle, %v, want only the fixture's", chunks, err)
+	}
+}
+
+func TestArticlePreviews(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	unextracted, err := store.GetUnextractedArticles(ctx)
+	if err != nil || len(unextracted) != 2 {
+		t.Fatalf("GetUnextractedArticles = %+v, %v, want both fixtures", unextracted, err)
+	}
+	p := db.ArticlePreview{SHA256: unextracted[1].SHA256, Text: "All about 100% of things", Excerpt: "All about", Thumbnail: []byte("png")}
+	if err := store.SetArticlePreview(ctx, unextracted[1].Id, p); err != nil {
+		t.Fatalf("SetArticlePreview failed: %v", err)
+	}
+	stale := p
+	stale.SHA256 = "0000"
+	if err := store.SetArticlePreview(ctx, unextracted[0].Id, stale); err != db.ErrNotFound {
+		t.Errorf("SetArticlePreview for a replaced pdf error = %v, want %v", err, db.ErrNotFound)
+	}
+	if thumb, err := store.GetArticleThumbnail(ctx, unextracted[1].Id); err != nil || string(thumb) != "png" {
+		t.Errorf("GetArticleThumbnail = %q, %v", thumb, err)
+	}
+	if _, err := store.GetArticleThumbnail(ctx, unextracted[0].Id); err != db.ErrNotFound {
+		t.Errorf("GetArticleThumbnail without one error = %v, want %v", err, db.ErrNotFound)
+	}
+	if left, err := store.GetUnextractedArticles(ctx); err != nil || len(left) != 1 {
+		t.Errorf("GetUnextractedArticles after one preview = %+v, %v", left, err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"ARTICLE", []string{"An Article", "A Stored Article"}},
+		{"magazine", []string{"A Stored Article"}},
+		{"100%", []string{"An Article"}},
+		{"%", []string{"An Article"}},
+		{"_", nil},
+		{"nothing", nil},
+	}
+	for _, tc := range tests {
+		articles, err := store.SearchArticles(ctx, tc.query)
+		var titles []string
+		for _, a := range articles {
+			titles = append(titles, a.Title)
+		}
+		if err != nil || !reflect.DeepEqual(titles, tc.want) {
+			t.Errorf("SearchArticles(%q) = %q, %v, want %q", tc.query, titles, err, tc.want)
+		}
+	}
+}
+
+func commentIds(comments []db.Comment) []int {
+	var ids []int
+	for _, c := range comments {
+		ids = append(ids, c.Id)
+	}
+	return ids
+}
+
+func TestComments(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	comments, err := store.GetComments(ctx, 2)
+	if err != nil || !reflect.DeepEqual(commentIds(comments), []int{1}) {
+		t.Fatalf("GetComments(2) = %v, %v, want [1]", commentIds(comments), err)
+	}
+	if c := comments[0]; c.Author != "Ann" || c.EntryTitle != "Second Post" || c.Status != db.CommentApproved ||
+		c.Created.Unix() != 1500000100 {
+		t.Errorf("GetComments(2)[0] = %+v", c)
+	}
+	if _, err := store.GetComments(ctx, 0); !errors.Is(err, db.ErrInvalidID) {
+		t.Errorf("GetComments(0) error = %v, want %v", err, db.ErrInvalidID)
+	}
+
+	added, err := store.AddComment(ctx, db.Comment{EntryId: 3, Author: "Dee", Body: "Hi", IP: "192.0.2.4"})
+	if err != nil {
+		t.Fatalf("AddComment failed: %v", err)
+	}
+	if added.Id == 0 || added.Status != db.CommentPending || added.EntryTitle != "Third Post" || added.Created.IsZero() {
+		t.Errorf("AddComment = %+v, want a pending comment on the third post", added)
+	}
+	spam, err := store.AddComment(ctx, db.Comment{EntryId: 3, Author: "Buy", Body: "Again", IP: "192.0.2.9"})
+	if err != nil || spam.Status != db.CommentSpam {
+		t.Errorf("AddComment from a spam address = %+v, %v, want status %q", spam, err, db.CommentSpam)
+	}
+	for _, id := range []int{4, 5, 100} {
+		if _, err := store.AddComment(ctx, db.Comment{EntryId: id, Author: "Dee", Body: "Hi"}); err != db.ErrNotFound {
+			t.Errorf("AddComment on entry %d error = %v, want %v", id, err, db.ErrNotFound)
+		}
+	}
+
+	pending, err := store.GetPendingComments(ctx)
+	if err != nil || !reflect.DeepEqual(commentIds(pending), []int{2, added.Id}) {
+		t.Fatalf("GetPendingComments = %v, %v, want [2 %d]", commentIds(pending), err, added.Id)
+	}
+
+	if err := store.ModerateComment(ctx, 2, db.CommentApproved); err != nil {
+		t.Fatalf("ModerateComment failed: %v", err)
+	}
+	if err := store.ModerateComment(ctx, added.Id, db.CommentRejected); err != nil {
+		t.Fatalf("ModerateComment failed: %v", err)
+	}
+	if comments, err := store.GetComments(ctx, 2); err != nil || !reflect.DeepEqual(commentIds(comments), []int{1, 2}) {
+		t.Errorf("GetComments(2) after approving = %v, %v, want [1 2]", commentIds(comments), err)
+	}
+	if comments, err := store.GetComments(ctx, 3); err != nil || len(comments) != 0 {
+		t.Errorf("GetComments(3) after rejecting = %v, %v, want none", commentIds(comments), err)
+	}
+	if pending, err := store.GetPendingComments(ctx); err != nil || len(pending) != 0 {
+		t.Errorf("GetPendingComments after moderating = %v, %v, want none", commentIds(pending), err)
+	}
+
+	if err := store.ModerateComment(ctx, 100, db.CommentSpam); err != db.ErrNotFound {
+		t.Errorf("ModerateComment(100) error = %v, want %v", err, db.ErrNotFound)
+	}
+	if err := store.ModerateComment(ctx, 1, "deleted"); !errors.Is(err, db.ErrInvalidID) {
+		t.Errorf("ModerateComment with a bad status error = %v, want %v", err, db.ErrInvalidID)
+	}
+}
+
+func TestMentions(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	mentions, err := store.GetMentions(ctx, 2)
+	if err != nil || len(mentions) != 1 {
+		t.Fatalf("GetMentions(2) = %+v, %v, want the verified mention", mentions, err)
+	}
+	if m := mentions[0]; m.Source != "https://blog.example.com/reply" || m.Title != "A reply" || m.Verified.Unix() != 1500000600 {
+		t.Errorf("GetMentions(2)[0] = %+v", m)
+	}
+	if _, err := store.GetMentions(ctx, 0); !errors.Is(err, db.ErrInvalidID) {
+		t.Errorf("GetMentions(0) error = %v, want %v", err, db.ErrInvalidID)
+	}
+
+	const source, target = "https://third.example.com/", "https://christopher.cawdrey.name/entry/2018/third-post"
+	if err := store.AddMention(ctx, 3, source, target); err != nil {
+		t.Fatalf("AddMention failed: %v", err)
+	}
+	// Receiving the verified mention again queues it without hiding it.
+	if err := store.AddMention(ctx, 2, "https://blog.example.com/reply", "https://christopher.cawdrey.name/entry/2"); err != nil {
+		t.Fatalf("AddMention again failed: %v", err)
+	}
+	for _, id := range []int{4, 5, 100} {
+		if err := store.AddMention(ctx, id, source, target); err != db.ErrNotFound {
+			t.Errorf("AddMention on entry %d error = %v, want %v", id, err, db.ErrNotFound)
+		}
+	}
+
+	pending, err := store.GetPendingMentions(ctx)
+	if err != nil || len(pending) != 3 {
+		t.Fatalf("GetPendingMentions = %+v, %v, want 3", pending, err)
+	}
+	bySource := map[string]db.Mention{}
+	for _, m := range pending {
+		bySource[m.Source] = m
+	}
+	if pending[0].Source != "https://other.example.com/post" || len(bySource) != 3 {
+		t.Errorf("GetPendingMentions = %+v, want the oldest first", pending)
+	}
+	again := bySource["https://blog.example.com/reply"]
+	if again.Target != "https://christopher.cawdrey.name/entry/2" || again.Verified.IsZero() {
+		t.Errorf("re-received mention = %+v, want the new target and still verified", again)
+	}
+	if mentions, err := store.GetMentions(ctx, 2); err != nil || len(mentions) != 1 {
+		t.Errorf("GetMentions(2) while re-checking = %+v, %v, want it still shown", mentions, err)
+	}
+
+	if err := store.VerifyMention(ctx, bySource[source].Id, "Third"); err != nil {
+		t.Fatalf("VerifyMention failed: %v", err)
+	}
+	if err := store.DeleteMention(ctx, pending[0].Id); err != nil {
+		t.Fatalf("DeleteMention failed: %v", err)
+	}
+	if err := store.DeleteMention(ctx, pending[0].Id); err != db.ErrNotFound {
+		t.Errorf("second DeleteMention error = %v, want %v", err, db.ErrNotFound)
+	}
+	if err := store.VerifyMention(ctx, 100, ""); err != db.ErrNotFound {
+		t.Errorf("VerifyMention(100) error = %v, want %v", err, db.ErrNotFound)
+	}
+	if mentions, err := store.GetMentions(ctx, 3); err != nil || len(mentions) != 1 || mentions[0].Title != "Third" {
+		t.Errorf("GetMentions(3) = %+v, %v, want the verified mention", mentions, err)
+	}
+	if pending, err := store.GetPendingMentions(ctx); err != nil || len(pending) != 1 {
+		t.Errorf("GetPendingMentions after checking = %+v, %v, want 1", pending, err)
+	}
+}
+
+func TestUnmentionedEntries(t *testing.T) {
+	store, raw := dbtest.Open(t)
+
+	ids := func() []int {
+		t.Helper()
+		entries, err := store.GetUnmentionedEntries(ctx)
+		if err != nil {
+			t.Fatalf("GetUnmentionedEntries failed: %v", err)
+		}
+		var ids []int
+		for _, e := range entries {
+			ids = append(ids, e.Id)
+		}
+		return ids
+	}
+	if got := ids(); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Fatalf("GetUnmentionedEntries = %v, want the published entries", got)
+	}
+
+	entry, err := store.GetEntry(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetEntryMentioned(ctx, entry); err != nil {
+		t.Fatalf("SetEntryMentioned failed: %v", err)
+	}
+	if got := ids(); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("GetUnmentionedEntries after sending = %v, want [1 3]", got)
+	}
+
+	// Editing an entry sends its mentions again.
+	if _, err := raw.Exec(`UPDATE entry SET updated = updated + 1 WHERE id = 2`); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("GetUnmentionedEntries after editing = %v, want [1 2 3]", got)
+	}
+	if err := store.SetEntryMentioned(ctx, entry); err != db.ErrNotFound {
+		t.Errorf("SetEntryMentioned of a stale entry error = %v, want %v", err, db.ErrNotFound)
+	}
+}
+
+func TestFollowers(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	followers, err := store.GetFollowers(ctx)
+	if err != nil || len(followers) != 2 {
+		t.Fatalf("GetFollowers = %+v, %v, want the fixtures", followers, err)
+	}
+	if f := followers[0]; f.Actor != "https://social.example/users/ann" || !f.Accepted || f.Created.Unix() != 1500000800 {
+		t.Errorf("GetFollowers[0] = %+v", f)
+	}
+
+	if err := store.AddFollower(ctx, db.Follower{Actor: "https://new.example/c", Inbox: "https://new.example/inbox",
+		FollowId: "https://new.example/f/1"}); err != nil {
+		t.Fatalf("AddFollower failed: %v", err)
+	}
+	// Following again replaces the follow, and it needs accepting again.
+	if err := store.AddFollower(ctx, db.Follower{Actor: "https://social.example/users/ann", Inbox: "https://social.example/shared",
+		FollowId: "https://social.example/follows/9"}); err != nil {
+		t.Fatalf("AddFollower again failed: %v", err)
+	}
+	followers, err = store.GetFollowers(ctx)
+	if err != nil || len(followers) != 3 {
+		t.Fatalf("GetFollowers after adding = %+v, %v, want 3", followers, err)
+	}
+	if f := followers[0]; f.Inbox != "https://social.example/shared" || f.FollowId != "https://social.example/follows/9" || f.Accepted {
+		t.Errorf("re-followed follower = %+v, want the new follow waiting for an Accept", f)
+	}
+
+	if err := store.AcceptFollower(ctx, followers[2].Id); err != nil {
+		t.Fatalf("AcceptFollower failed: %v", err)
+	}
+	if err := store.AcceptFollower(ctx, 100); err != db.ErrNotFound {
+		t.Errorf("AcceptFollower(100) error = %v, want %v", err, db.ErrNotFound)
+	}
+	if err := store.RemoveFollower(ctx, "https://other.example/bob"); err != nil {
+		t.Fatalf("RemoveFollower failed: %v", err)
+	}
+	if err := store.RemoveFollower(ctx, "https://other.example/bob"); err != db.ErrNotFound {
+		t.Errorf("second RemoveFollower error = %v, want %v", err, db.ErrNotFound)
+	}
+	followers, err = store.GetFollowers(ctx)
+	if err != nil || len(followers) != 2 || followers[1].Actor != "https://new.example/c" || !followers[1].Accepted {
+		t.Errorf("GetFollowers after accepting and removing = %+v, %v", followers, err)
+	}
+}
+
+func TestUnfederatedEntries(t *testing.T) {
+	store, raw := dbtest.Open(t)
+
+	entries := func() map[int]bool {
+		t.Helper()
+		entries, err := store.GetUnfederatedEntries(ctx)
+		if err != nil {
+			t.Fatalf("GetUnfederatedEntries failed: %v", err)
+		}
+		federated := map[int]bool{}
+		for _, e := range entries {
+			federated[e.Id] = e.Federated
+		}
+		return federated
+	}
+	if got := entries(); !reflect.DeepEqual(got, map[int]bool{1: true, 3: false}) {
+		t.Fatalf("GetUnfederatedEntries = %v, want the edited first entry and the new third", got)
+	}
+
+	entry, err := store.GetEntry(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetEntryFederated(ctx, entry); err != nil {
+		t.Fatalf("SetEntryFederated failed: %v", err)
+	}
+	if got := entries(); !reflect.DeepEqual(got, map[int]bool{1: true}) {
+		t.Errorf("GetUnfederatedEntries after delivering = %v, want only the first", got)
+	}
+
+	if _, err := raw.Exec(`UPDATE entry SET updated = updated + 1 WHERE id = 3`); err != nil {
+		t.Fatal(err)
+	}
+	if got := entries(); !reflect.DeepEqual(got, map[int]bool{1: true, 3: true}) {
+		t.Errorf("GetUnfederatedEntries after editing = %v, want the third again as an edit", got)
+	}
+	if err := store.SetEntryFederated(ctx, entry); err != db.ErrNotFound {
+		t.Errorf("SetEntryFederated of a stale entry error = %v, want %v", err, db.ErrNotFound)
+	}
+}
+
+func TestSubscribers(t *testing.T) {
+	store, conn := dbtest.Open(t)
+
+	subscribers, err := store.GetSubscribers(ctx)
+	if err != nil || len(subscribers) != 3 {
+		t.Fatalf("GetSubscribers = %+v, %v, want the fixtures", subscribers, err)
+	}
+	if sub := subscribers[1]; sub.Email != "digest@example.org" || !sub.Digest || sub.Confirmed.Unix() != 1510000100 ||
+		sub.DigestSent.Unix() != 1510000100 || !sub.ConfirmationSent {
+		t.Errorf("GetSubscribers[1] = %+v", sub)
+	}
+	if sub := subscribers[2]; !sub.Confirmed.IsZero() || sub.ConfirmationSent || !sub.DigestSent.IsZero() {
+		t.Errorf("GetSubscribers[2] = %+v, want unconfirmed", sub)
+	}
+
+	// Signing up again right after a confirmation has gone out changes
+	// nothing.
+	if err := store.SetConfirmationSent(ctx, 3); err != nil {
+		t.Fatalf("SetConfirmationSent failed: %v", err)
+	}
+	if err := store.AddSubscriber(ctx, db.Subscriber{Email: "new@example.org", Token: "newest-token"}); err != db.ErrNotFound {
+		t.Errorf("AddSubscriber within the cooldown error = %v, want %v", err, db.ErrNotFound)
+	}
+	// Once it has passed, signing up again before confirming starts over.
+	if _, err := conn.Exec(`UPDATE subscriber SET created = created - ? WHERE id = 3`, int64(db.ConfirmationCooldown/time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddSubscriber(ctx, db.Subscriber{Email: "NEW@example.org", Token: "newer-token", Digest: true}); err != nil {
+		t.Fatalf("AddSubscriber again failed: %v", err)
+	}
+	// But a confirmed address can't be changed.
+	if err := store.AddSubscriber(ctx, db.Subscriber{Email: "post@example.org", Token: "other", Digest: true}); err != db.ErrNotFound {
+		t.Errorf("AddSubscriber of a confirmed address error = %v, want %v", err, db.ErrNotFound)
+	}
+	if err := store.AddSubscriber(ctx, db.Subscriber{Email: "more@example.org", Token: "post-token"}); !errors.Is(err, db.ErrExists) {
+		t.Errorf("AddSubscriber with a token in use error = %v, want %v", err, db.ErrExists)
+	}
+	subscribers, err = store.GetSubscribers(ctx)
+	if err != nil || len(subscribers) != 3 {
+		t.Fatalf("GetSubscribers after adding = %+v, %v, want 3", subscribers, err)
+	}
+	if sub := subscribers[2]; sub.Token != "newer-token" || !sub.Digest || sub.ConfirmationSent {
+		t.Errorf("signed up again = %+v, want the new token and mode, to be sent a confirmation", sub)
+	}
+	if sub := subscribers[0]; sub.Token != "post-token" || sub.Digest {
+		t.Errorf("confirmed subscriber = %+v, want unchanged", sub)
+	}
+
+	for _, token := range []string{"newer-token", "newer-token"} {
+		if err := store.ConfirmSubscriber(ctx, token); err != nil {
+			t.Fatalf("ConfirmSubscriber failed: %v", err)
+		}
+	}
+	for _, token := range []string{"new-token", ""} {
+		if err := store.ConfirmSubscriber(ctx, token); err != db.ErrNotFound {
+			t.Errorf("ConfirmSubscriber(%q) error = %v, want %v", token, err, db.ErrNotFound)
+		}
+	}
+	sent := time.Unix(1600000000, 0)
+	if err := store.SetDigestSent(ctx, 3, sent); err != nil {
+		t.Fatalf("SetDigestSent failed: %v", err)
+	}
+	subscribers, _ = store.GetSubscribers(ctx)
+	if sub := subscribers[2]; sub.Confirmed.IsZero() || !sub.DigestSent.Equal(sent) {
+		t.Errorf("confirmed subscriber = %+v, want confirmed with a digest sent", sub)
+	}
+
+	if err := store.RemoveSubscriber(ctx, "post-token"); err != nil {
+		t.Fatalf("RemoveSubscriber failed: %v", err)
+	}
+	if err := store.RemoveSubscriber(ctx, "post-token"); err != db.ErrNotFound {
+		t.Errorf("second RemoveSubscriber error = %v, want %v", err, db.ErrNotFound)
+	}
+	if subscribers, err := store.GetSubscribers(ctx); err != nil || len(subscribers) != 2 {
+		t.Errorf("GetSubscribers after removing = %+v, %v, want 2", subscribers, err)
+	}
+}
+
+func TestUnmailedEntries(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	entries, err := store.GetUnmailedEntries(ctx)
+	if err != nil || len(entries) != 1 || entries[0].Id != 3 {
+		t.Fatalf("GetUnmailedEntries = %+v, %v, want the third entry", entries, err)
+	}
+	if err := store.SetEntryMailed(ctx, 3); err != nil {
+		t.Fatalf("SetEntryMailed failed: %v", err)
+	}
+	if entries, err := store.GetUnmailedEntries(ctx); err != nil || len(entries) != 0 {
+		t.Errorf("GetUnmailedEntries after mailing = %+v, %v, want none", entries, err)
+	}
+
+	ids := func(after, before int64) []int {
+		t.Helper()
+		entries, err := store.GetEntriesPublished(ctx, time.Unix(after, 0), time.Unix(before, 0))
+		if err != nil {
+			t.Fatalf("GetEntriesPublished failed: %v", err)
+		}
+		var ids []int
+		for _, e := range entries {
+			ids = append(ids, e.Id)
+		}
+		return ids
+	}
+	if got := ids(1489554739, 1521000000); !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Errorf("GetEntriesPublished = %v, want [2 3]", got)
+	}
+	// Neither drafts nor scheduled entries count.
+	if got := ids(1521000000, 4200000000); got != nil {
+		t.Errorf("GetEntriesPublished after the last entry = %v, want none", got)
+	}
+}
+
+func TestHubSubscriptions(t *testing.T) {
+	store, _ := dbtest.Open(t)
+
+	subs, err := store.GetHubSubscriptions(ctx)
+	if err != nil || len(subs) != 3 {
+		t.Fatalf("GetHubSubscriptions = %+v, %v, want the fixtures", subs, err)
+	}
+	if sub := subs[0]; sub.Secret != "fixture-secret" || sub.Expires.Unix() != 4200000000 || sub.Pending != "" {
+		t.Errorf("GetHubSubscriptions[0] = %+v", sub)
+	}
+	if sub := subs[2]; !sub.Expires.IsZero() || sub.Pending != "subscribe" || sub.PendingSecret != "json-secret" ||
+		sub.PendingLease != time.Hour || sub.Requested.Unix() != 1510000000 {
+		t.Errorf("GetHubSubscriptions[2] = %+v, want a pending request", sub)
+	}
+
+	// Renewing waits for verification without touching the subscription.
+	renew := db.HubSubscription{Topic: subs[0].Topic, Callback: subs[0].Callback, Pending: "subscribe",
+		PendingSecret: "new-secret", PendingLease: 24 * time.Hour}
+	if err := store.RequestHubSubscription(ctx, renew); err != nil {
+		t.Fatalf("RequestHubSubscription failed: %v", err)
+	}
+	subs, _ = store.GetHubSubscriptions(ctx)
+	if len(subs) != 3 || subs[0].Secret != "fixture-secret" || subs[0].Pending != "subscribe" {
+		t.Fatalf("after renewing, GetHubSubscriptions = %+v, want the first waiting on the renewal", subs)
+	}
+	// A request read before the renewal came in is stale.
+	stale := subs[0]
+	stale.Requested = time.Unix(1500000000, 0)
+	if err := store.ConfirmHubSubscription(ctx, stale); err != db.ErrNotFound {
+		t.Errorf("ConfirmHubSubscription of a stale request error = %v, want %v", err, db.ErrNotFound)
+	}
+	if err := store.ConfirmHubSubscription(ctx, subs[0]); err != nil {
+		t.Fatalf("ConfirmHubSubscription failed: %v", err)
+	}
+	subs, _ = store.GetHubSubscriptions(ctx)
+	if sub := subs[0]; sub.Secret != "new-secret" || sub.Pending != "" || time.Until(sub.Expires) < 23*time.Hour {
+		t.Errorf("renewed subscription = %+v, want the new secret for a day", sub)
+	}
+
+	if err := store.CancelHubRequest(ctx, subs[2]); err != nil {
+		t.Fatalf("CancelHubRequest failed: %v", err)
+	}
+	if err := store.RemoveHubSubscription(ctx, subs[1]); err != nil {
+		t.Fatalf("RemoveHubSubscription failed: %v", err)
+	}
+	if err := store.RemoveHubSubscription(ctx, subs[1]); err != db.ErrNotFound {
+		t.Errorf("second RemoveHubSubscription error = %v, want %v", err, db.ErrNotFound)
+	}
+	subs, _ = store.GetHubSubscriptions(ctx)
+	if len(subs) != 2 || subs[1].Id != 3 || subs[1].Pending != "" || !subs[1].Expires.IsZero() {
+		t.Errorf("GetHubSubscriptions = %+v, want the second removed and the third's request dropped", subs)
+	}
+}
+
+func TestUnpushedEntries(t *testing.T) {
+	store, raw := dbtest.Open(t)
+
+	entries, err := store.GetUnpushedEntries(ctx, db.BuiltinHub)
+	if err != nil || len(entries) != 1 || entries[0].Id != 3 {
+		t.Fatalf("GetUnpushedEntries = %+v, %v, want the third entry", entries, err)
+	}
+	if err := store.SetEntryPushed(ctx, db.BuiltinHub, entries[0]); err != nil {
+		t.Fatalf("SetEntryPushed failed: %v", err)
+	}
+	if entries, err := store.GetUnpushedEntries(ctx, db.BuiltinHub); err != nil || len(entries) != 0 {
+		t.Errorf("GetUnpushedEntries after pushing = %+v, %v, want none", entries, err)
+	}
+	// Each hub keeps its own record.
+	if entries, err := store.GetUnpushedEntries(ctx, db.ExternalHub); err != nil || len(entries) != 1 || entries[0].Id != 3 {
+		t.Errorf("GetUnpushedEntries(ExternalHub) = %+v, %v, want the third entry still", entries, err)
+	}
+
+	if _, err := raw.Exec(`UPDATE entry SET updated = updated + 1 WHERE id = 1`); err != nil {
+		t.Fatal(err)
+	}
+	edited, err := store.GetUnpushedEntries(ctx, db.BuiltinHub)
+	if err != nil || len(edited) != 1 || edited[0].Id != 1 {
+		t.Fatalf("GetUnpushedEntries after editing = %+v, %v, want the first entry", edited, err)
+	}
+	stale := edited[0]
+	stale.Updated = stale.Updated.Add(-time.Second)
+	if err := store.SetEntryPushed(ctx, db.BuiltinHub, stale); err != db.ErrNotFound {
+		t.Errorf("SetEntryPushed of a stale entry error = %v, want %v", err, db.ErrNotFound)
+	}
+}
@@ -0,0 +1,47 @@
+// Package dbtest opens db stores against seeded in-memory SQLite databases.
+package dbtest
+
+import (
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dubJay/db"
+)
+
+//go:embed fixtures.sql
+var fixtures string
+
+var databases int64
+
+// Open returns a store for a fresh, migrated in-memory database seeded with
+// fixtures.sql, along with a raw handle for any further setup a test needs.
+// The database is discarded when the test ends.
+func Open(tb testing.TB) (*db.SQLite, *sql.DB) {
+	tb.Helper()
+
+	// Every connection to a shared-cache memory database of the same name sees
+	// the same data. It is deleted when the last connection closes, so keep
+	// one open for the life of the test.
+	dsn := fmt.Sprintf("file:dbtest%d?mode=memory&cache=shared", atomic.AddInt64(&databases, 1))
+	keep, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		tb.Fatalf("failed to open %s: %v", dsn, err)
+	}
+	tb.Cleanup(func() { keep.Close() })
+	if err := keep.Ping(); err != nil {
+		tb.Fatalf("failed to connect to %s: %v", dsn, err)
+	}
+
+	store, err := db.Open(dsn, 0)
+	if err != nil {
+		tb.Fatalf("failed to open db: %v", err)
+	}
+	tb.Cleanup(func() { store.Close() })
+	if _, err := keep.Exec(fixtures); err != nil {
+		tb.Fatalf("failed to load fixtures: %v", err)
+	}
+	return store, keep
+}
@@ -0,0 +1,74 @@
+-- Fixtures loaded by dbtest.Init. Published times are mid-month so archive
+-- tests don't depend on the local time zone.
+INSERT INTO entry (id, timestamp, title, slug, paragraph, image, created, updated, published) VALUES
+	(1, 1489554739, 'First Post', 'first-post', 'Hello\nWorld', '\n/images/a.jpg', 1489554739, 1489554739, 1489554739),
+	(2, 1500000000, 'Second Post', 'second-post', 'Second', '', 1500000000, 1500000000, 1500000000),
+	(3, 1520000000, 'Third Post', 'third-post', 'Third', '', 1520000000, 1520000000, 1521000000),
+	(4, 1530000000, 'Draft', 'draft', 'Not yet', '', 1530000000, 1530000000, 0),
+	(5, 1540000000, 'Scheduled', 'scheduled', 'Later', '', 1540000000, 1540000000, 4102444800);
+
+INSERT INTO tag (entry_id, name) VALUES
+	(1, 'life'),
+	(2, 'go'),
+	(3, 'go'),
+	(3, 'life');
+
+-- One comment of each status on the second post.
+INSERT INTO comment (id, entry_id, author, url, body, status, ip, created) VALUES
+	(1, 2, 'Ann', 'https://ann.example.com', 'Nice post', 'approved', '192.0.2.1', 1500000100),
+	(2, 2, 'Bob', '', 'First!', 'pending', '192.0.2.2', 1500000200),
+	(3, 2, 'Buy', 'https://spam.example.com', 'Cheap watches', 'spam', '192.0.2.9', 1500000300),
+	(4, 2, 'Cat', '', 'Rude', 'rejected', '192.0.2.3', 1500000400);
+
+-- A mention of the second post that has been checked and one that hasn't.
+INSERT INTO mention (id, entry_id, source, target, title, received, verified, pending) VALUES
+	(1, 2, 'https://blog.example.com/reply', 'https://christopher.cawdrey.name/entry/2017/second-post', 'A reply',
+		1500000500, 1500000600, 0),
+	(2, 2, 'https://other.example.com/post', 'https://christopher.cawdrey.name/entry/2', '', 1500000700, NULL, 1);
+
+-- An accepted follower and one waiting for its Accept. Entry 2 has been
+-- delivered to them, and entry 1 only before its last edit.
+INSERT INTO follower (id, actor, inbox, follow_id, created, accepted) VALUES
+	(1, 'https://social.example/users/ann', 'https://social.example/inbox', 'https://social.example/follows/1', 1500000800, 1),
+	(2, 'https://other.example/bob', 'https://other.example/bob/inbox', 'https://other.example/follows/2', 1500000900, 0);
+UPDATE entry SET federated = updated WHERE id = 2;
+UPDATE entry SET federated = updated - 1 WHERE id = 1;
+
+-- A subscriber to each entry, one to digests whose last went out before the
+-- third post, and one who signed up just now and hasn't confirmed. Only the
+-- third post is left to mail.
+INSERT INTO subscriber (id, email, token, digest, created, confirmed, confirmation_sent, digest_sent) VALUES
+	(1, 'post@example.org', 'post-token', 0, 1500000000, 1500000100, 1, NULL),
+	(2, 'digest@example.org', 'digest-token', 1, 1510000000, 1510000100, 1, 1510000100),
+	(3, 'new@example.org', 'new-token', 0, strftime('%s', 'now'), NULL, 0, NULL);
+UPDATE entry SET mailed = 1 WHERE id IN (1, 2);
+
+-- A verified subscriber to the Atom feed, one whose subscription to the RSS
+-- feed has run out, and one asking for the JSON feed. The hub has been told
+-- about all but the third post.
+INSERT INTO hub_subscription (id, topic, callback, secret, expires, pending, pending_secret, pending_lease, requested) VALUES
+	(1, 'https://christopher.cawdrey.name/feeds/atom.xml', 'https://reader.example/websub/1', 'fixture-secret',
+		4200000000, '', '', 0, 1500000000),
+	(2, 'https://christopher.cawdrey.name/feeds/rss.xml', 'https://reader.example/websub/2', '', 1500000000, '', '', 0,
+		1490000000),
+	(3, 'https://christopher.cawdrey.name/feeds/jsonfeed.json', 'https://other.example/push', '', 0, 'subscribe',
+		'json-secret', 3600, 1510000000);
+UPDATE entry SET pushed = updated, notified = updated WHERE id IN (1, 2);
+
+INSERT INTO oneoff (uid, paragraph, image, image_meta) VALUES
+	('about', 'About this site', '', '[{"src": "/images/photos/gradient.png", "alt": "A gradient"}]');
+
+-- Embeds the album in testdata/resources/photos, and one that doesn't exist.
+INSERT INTO oneoff (uid, paragraph, image, blocks) VALUES
+	('photos', '', '', '[{"type": "gallery", "album": "photos"}, {"type": "gallery", "album": "missing"}]');
+
+-- The second article's PDF lives in testdata/articles rather than the database.
+-- The first's is split into two chunks.
+INSERT INTO articlemeta (timestamp, title, organization, hyperlink, pdf, size, sha256, modified, location) VALUES
+	(1600000000, 'An Article', 'A Newspaper', 'https://example.com/article', NULL,
+		16, 'c5c2e8be6ad0825a56ded1f1a153ceaf11dc060ab44b120a94406a08207babc2', 1600000100, ''),
+	(1590000000, 'A Stored Article', 'A Magazine', 'https://example.com/stored', NULL,
+		15, 'ca61e2a2a41a2ff544c7532074b82db85afa03641e450d0f0aacac1fe9df3ffd', 1590000100, 'stored.pdf');
+INSERT INTO article_chunk (article, start, data) VALUES
+	(1600000000, 0, CAST('%PDF-1.4 ' AS BLOB)),
+	(1600000000, 9, CAST('fixture' AS BLOB));
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+var (
+	// Following again replaces the old follow, which needs accepting again.
+	addFollowerQuery = `INSERT INTO follower (actor, inbox, follow_id, created) VALUES (?, ?, ?, ?)
+		ON CONFLICT (actor) DO UPDATE SET inbox = excluded.inbox, follow_id = excluded.follow_id, accepted = 0`
+	removeFollowerQuery = `DELETE FROM follower WHERE actor = ?`
+	followersQuery      = `SELECT id, actor, inbox, follow_id, created, accepted FROM follower ORDER BY id`
+	acceptFollowerQuery = `UPDATE follower SET accepted = 1 WHERE id = ?`
+
+	unfederatedQuery = `SELECT ` + entryColumns + `, federated FROM entry
+		WHERE ` + isPublished + ` AND federated < updated ORDER BY published`
+	// Only if the entry hasn't been edited since it was read.
+	setFederatedQuery = `UPDATE entry SET federated = updated WHERE id = ? AND updated = ?`
+)
+
+// Follower is an ActivityPub actor on another server that follows the site.
+type Follower struct {
+	Id int
+	// The id of the remote actor.
+	Actor string
+	// Where to deliver activities for the actor.
+	Inbox string
+	// The id of the Follow activity, which the Accept refers to.
+	FollowId string
+	Created  time.Time
+	// Whether the follow has been accepted.
+	Accepted bool
+}
+
+// UnfederatedEntry is a published entry that followers haven't been sent
+// since it was last updated.
+type UnfederatedEntry struct {
+	Entry
+	// Whether followers have been sent any version of the entry, so whether
+	// this is an edit.
+	Federated bool
+}
+
+// AddFollower records that f.Actor follows the site, to be accepted.
+func (s *SQLite) AddFollower(ctx context.Context, f Follower) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, addFollowerQuery, f.Actor, f.Inbox, f.FollowId, time.Now().Unix()))
+}
+
+// RemoveFollower forgets the follower with the actor id. It returns
+// ErrNotFound if there is no such follower.
+func (s *SQLite) RemoveFollower(ctx context.Context, actor string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, removeFollowerQuery, actor))
+}
+
+// GetFollowers returns every follower, accepted or not, oldest first.
+func (s *SQLite) GetFollowers(ctx context.Context) ([]Follower, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.stmt(followersQuery).QueryContext(ctx)
+	if err != nil {
+		return nil, queryErr(ctx, err)
+	}
+	defer rows.Close()
+
+	var followers []Follower
+	for rows.Next() {
+		var f Follower
+		var created int64
+		if err := rows.Scan(&f.Id, &f.Actor, &f.Inbox, &f.FollowId, &created, &f.Accepted); err != nil {
+			return nil, queryErr(ctx, err)
+		}
+		f.Created = time.Unix(created, 0)
+		followers = append(followers, f)
+	}
+	return followers, queryErr(ctx, rows.Err())
+}
+
+// AcceptFollower records that the follower with id has been sent an Accept.
+func (s *SQLite) AcceptFollower(ctx context.Context, id int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, acceptFollowerQuery, id))
+}
+
+// GetUnfederatedEntries returns the published entries that followers haven't
+// been sent since they were last updated, oldest first.
+func (s *SQLite) GetUnfederatedEntries(ctx context.Context) ([]UnfederatedEntry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.stmt(unfederatedQuery).QueryContext(ctx)
+	if err != nil {
+		return nil, queryErr(ctx, err)
+	}
+	defer rows.Close()
+
+	var entries []UnfederatedEntry
+	for rows.Next() {
+		var federated int64
+		entry, err := scanEntry(rows, &federated)
+		if err != nil {
+			return nil, queryErr(ctx, err)
+		}
+		entries = append(entries, UnfederatedEntry{Entry: entry, Federated: federated != 0})
+	}
+	return entries, queryErr(ctx, rows.Err())
+}
+
+// SetEntryFederated records that followers were sent e. It returns
+// ErrNotFound if e has been updated since it was read, so the new version
+// gets its turn.
+func (s *SQLite) SetEntryFederated(ctx context.Context, e Entry) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, setFederatedQuery, e.Id, e.Updated.Unix()))
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Queries for the paginated archive. Every query is bounded to [start, end).
+var (
+	historyRangeQuery = `SELECT id, title, COALESCE(slug, ''), published FROM entry WHERE ` + isPublished + `
+		AND published >= ? AND published < ? ORDER BY published DESC, id DESC LIMIT ? OFFSET ?`
+	historyCountQuery = `SELECT COUNT(*) FROM entry WHERE ` + isPublished + ` AND published >= ? AND published < ?`
+	yearCountQuery    = `SELECT CAST(strftime('%Y', published, 'unixepoch', 'localtime') AS INTEGER) AS year, COUNT(*)
+		FROM entry WHERE ` + isPublished + ` GROUP BY year ORDER BY year DESC`
+)
+
+// HistoryFilter narrows the archive to a year or a month of a year. The zero
+// value matches every entry.
+type HistoryFilter struct {
+	Year  int
+	Month time.Month
+}
+
+type YearCount struct {
+	Year  int
+	Count int
+}
+
+// bounds converts the filter into a [start, end) range of unix times.
+func (f HistoryFilter) bounds() (int64, int64) {
+	switch {
+	case f.Year == 0:
+		return 0, 1<<63 - 1
+	case f.Month == 0:
+		start := time.Date(f.Year, time.January, 1, 0, 0, 0, 0, time.Local)
+		return start.Unix(), start.AddDate(1, 0, 0).Unix()
+	default:
+		start := time.Date(f.Year, f.Month, 1, 0, 0, 0, 0, time.Local)
+		return start.Unix(), start.AddDate(0, 1, 0).Unix()
+	}
+}
+
+// GetHistoryPage returns at most limit entries matching f, newest first,
+// skipping the first offset.
+func (s *SQLite) GetHistoryPage(ctx context.Context, f HistoryFilter, limit, offset int) ([]History, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	start, end := f.bounds()
+	history, err := s.queryHistory(ctx, historyRangeQuery, start, end, limit, offset)
+	return history, queryErr(ctx, err)
+}
+
+// CountHistory returns the number of entries matching f.
+func (s *SQLite) CountHistory(ctx context.Context, f HistoryFilter) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	start, end := f.bounds()
+	var count int
+	err := s.stmt(historyCountQuery).QueryRowContext(ctx, start, end).Scan(&count)
+	return count, queryErr(ctx, err)
+}
+
+// GetYearCounts returns the number of published entries per year, newest year first.
+func (s *SQLite) GetYearCounts(ctx context.Context) ([]YearCount, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.stmt(yearCountQuery).QueryContext(ctx)
+	if err != nil {
+		return nil, queryErr(ctx, err)
+	}
+	defer rows.Close()
+
+	var counts []YearCount
+	for rows.Next() {
+		count := YearCount{}
+		if err := rows.Scan(&count.Year, &count.Count); err != nil {
+			return nil, queryErr(ctx, err)
+		}
+		counts = append(counts, count)
+	}
+	return counts, queryErr(ctx, rows.Err())
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var (
+	// Asking again replaces any request still waiting, but leaves a
+	// verified subscription as it is until the new request is verified.
+	requestHubSubscriptionQuery = `INSERT INTO hub_subscription (topic, callback, pending, pending_secret, pending_lease, requested)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (topic, callback) DO UPDATE SET pending = excluded.pending, pending_secret = excluded.pending_secret,
+			pending_lease = excluded.pending_lease, requested = excluded.requested`
+	hubSubscriptionsQuery = `SELECT id, topic, callback, secret, expires, pending, pending_secret, pending_lease, requested
+		FROM hub_subscription ORDER BY id`
+	// The rest only if nothing has been asked for since the subscription was
+	// read.
+	confirmHubSubscriptionQuery = `UPDATE hub_subscription SET secret = pending_secret, expires = ? + pending_lease,
+		pending = '', pending_secret = '', pending_lease = 0 WHERE id = ? AND requested = ?`
+	cancelHubRequestQuery = `UPDATE hub_subscription SET pending = '', pending_secret = '', pending_lease = 0
+		WHERE id = ? AND requested = ?`
+	removeHubSubscriptionQuery = `DELETE FROM hub_subscription WHERE id = ? AND requested = ?`
+
+	unpushedQueries = map[Hub]string{
+		BuiltinHub:  `SELECT ` + entryColumns + ` FROM entry WHERE ` + isPublished + ` AND pushed < updated ORDER BY published`,
+		ExternalHub: `SELECT ` + entryColumns + ` FROM entry WHERE ` + isPublished + ` AND notified < updated ORDER BY published`,
+	}
+	// Only if the entry hasn't been edited since it was read.
+	setPushedQueries = map[Hub]string{
+		BuiltinHub:  `UPDATE entry SET pushed = updated WHERE id = ? AND updated = ?`,
+		ExternalHub: `UPDATE entry SET notified = updated WHERE id = ? AND updated = ?`,
+	}
+)
+
+// Hub is a WebSub hub told about the site's feeds. Each keeps its own
+// record of the entries it has been told about.
+type Hub int
+
+const (
+	// BuiltinHub is the site's own hub, which pushes the feeds to its
+	// subscribers.
+	BuiltinHub Hub = iota
+	// ExternalHub is a hub elsewhere, which is asked to fetch the feeds.
+	ExternalHub
+)
+
+// HubSubscription is a subscriber to one of the site's feeds on its WebSub
+// hub, or a request to become or stop being one.
+type HubSubscription struct {
+	Id int
+	// The feed subscribed to.
+	Topic string
+	// Where the feed is pushed to.
+	Callback string
+	// Signs what's pushed; empty to not sign it.
+	Secret string
+	// When the subscription runs out; zero until it has been verified.
+	Expires time.Time
+	// The mode of a request waiting to be verified, "subscribe" or
+	// "unsubscribe", or empty if there is none. A subscription that is
+	// verified replaces Secret and Expires with PendingSecret and
+	// PendingLease.
+	Pending       string
+	PendingSecret string
+	PendingLease  time.Duration
+	// When the latest request came in, to the second.
+	Requested time.Time
+}
+
+// RequestHubSubscription records a request in sub.Pending for sub.Callback
+// to subscribe to or unsubscribe from sub.Topic, to be verified.
+func (s *SQLite) RequestHubSubscription(ctx context.Context, sub HubSubscription) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, requestHubSubscriptionQuery, sub.Topic, sub.Callback, sub.Pending,
+		sub.PendingSecret, int64(sub.PendingLease/time.Second), time.Now().Unix()))
+}
+
+// GetHubSubscriptions returns every hub subscription, verified, expired or
+// waiting, oldest first.
+func (s *SQLite) GetHubSubscriptions(ctx context.Context) ([]HubSubscription, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.stmt(hubSubscriptionsQuery).QueryContext(ctx)
+	if err != nil {
+		return nil, queryErr(ctx, err)
+	}
+	defer rows.Close()
+
+	var subs []HubSubscription
+	for rows.Next() {
+		var sub HubSubscription
+		var expires, lease, requested int64
+		err := rows.Scan(&sub.Id, &sub.Topic, &sub.Callback, &sub.Secret, &expires, &sub.Pending, &sub.PendingSecret,
+			&lease, &requested)
+		if err != nil {
+			return nil, queryErr(ctx, err)
+		}
+		if expires != 0 {
+			sub.Expires = time.Unix(expires, 0)
+		}
+		sub.PendingLease = time.Duration(lease) * time.Second
+		sub.Requested = time.Unix(requested, 0)
+		subs = append(subs, sub)
+	}
+	return subs, queryErr(ctx, rows.Err())
+}
+
+// ConfirmHubSubscription starts or renews sub once its subscriber has
+// verified the request, for its PendingLease from now. It returns
+// ErrNotFound if another request has come in since sub was read, so that one
+// gets verified instead.
+func (s *SQLite) ConfirmHubSubscription(ctx context.Context, sub HubSubscription) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, confirmHubSubscriptionQuery, time.Now().Unix(), sub.Id, sub.Requested.Unix()))
+}
+
+// CancelHubRequest drops the request waiting on sub, leaving any verified
+// subscription as it was. It returns ErrNotFound if another request has come
+// in since sub was read.
+func (s *SQLite) CancelHubRequest(ctx context.Context, sub HubSubscription) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, cancelHubRequestQuery, sub.Id, sub.Requested.Unix()))
+}
+
+// RemoveHubSubscription forgets sub. It returns ErrNotFound if another
+// request has come in since sub was read.
+func (s *SQLite) RemoveHubSubscription(ctx context.Context, sub HubSubscription) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, removeHubSubscriptionQuery, sub.Id, sub.Requested.Unix()))
+}
+
+// GetUnpushedEntries returns the published entries that hub hasn't been
+// told about since they were last updated, oldest first.
+func (s *SQLite) GetUnpushedEntries(ctx context.Context, hub Hub) ([]Entry, error) {
+	query, ok := unpushedQueries[hub]
+	if !ok {
+		return nil, fmt.Errorf("db: unknown hub %d", hub)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	entries, err := s.queryEntries(ctx, query)
+	return entries, queryErr(ctx, err)
+}
+
+// SetEntryPushed records that hub was told about e. It returns ErrNotFound
+// if e has been updated since it was read, so the new version gets its turn.
+func (s *SQLite) SetEntryPushed(ctx context.Context, hub Hub, e Entry) error {
+	query, ok := setPushedQueries[hub]
+	if !ok {
+		return fmt.Errorf("db: unknown hub %d", hub)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, query, e.Id, e.Updated.Unix()))
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var (
+	// Mentions are only taken for published entries. Receiving one again
+	// queues it to be checked again; it stays shown until then.
+	addMentionQuery = `INSERT INTO mention (entry_id, source, target, received)
+		SELECT ?1, ?2, ?3, ?4 WHERE EXISTS (SELECT 1 FROM entry WHERE id = ?1 AND ` + isPublished + `)
+		ON CONFLICT (entry_id, source) DO UPDATE SET target = excluded.target, received = excluded.received, pending = 1`
+	mentionsQuery = `SELECT ` + mentionColumns + ` FROM mention
+		WHERE entry_id = ? AND verified IS NOT NULL ORDER BY verified, id`
+	pendingMentionsQuery = `SELECT ` + mentionColumns + ` FROM mention WHERE pending = 1 ORDER BY received, id`
+	verifyMentionQuery   = `UPDATE mention SET title = ?, verified = ?, pending = 0 WHERE id = ?`
+	deleteMentionQuery   = `DELETE FROM mention WHERE id = ?`
+
+	unmentionedQuery = `SELECT ` + entryColumns + ` FROM entry WHERE ` + isPublished + ` AND mentioned < updated ORDER BY published`
+	// Only if the entry hasn't been edited since it was read.
+	setMentionedQuery = `UPDATE entry SET mentioned = updated WHERE id = ? AND updated = ?`
+)
+
+const mentionColumns = `id, entry_id, source, target, title, received, COALESCE(verified, 0)`
+
+// Mention is a Webmention or Pingback of an entry from another site.
+type Mention struct {
+	Id      int
+	EntryId int
+	// The page that links to the entry.
+	Source string
+	// The URL of the entry that it links to.
+	Target string
+	// Title of the source, filled in when it has been verified.
+	Title    string
+	Received time.Time
+	// Zero until the source has been seen to link to the entry.
+	Verified time.Time
+}
+
+// AddMention queues a mention of the entry with entryID from source for
+// verification. It returns ErrNotFound if entryID isn't a published entry.
+func (s *SQLite) AddMention(ctx context.Context, entryID int, source, target string) error {
+	if entryID <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidID, entryID)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, addMentionQuery, entryID, source, target, time.Now().Unix()))
+}
+
+// GetMentions returns the verified mentions of the entry with entryID,
+// oldest first.
+func (s *SQLite) GetMentions(ctx context.Context, entryID int) ([]Mention, error) {
+	if entryID <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidID, entryID)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	mentions, err := s.queryMentions(ctx, mentionsQuery, entryID)
+	return mentions, queryErr(ctx, err)
+}
+
+// GetPendingMentions returns the mentions waiting to be verified, oldest
+// first.
+func (s *SQLite) GetPendingMentions(ctx context.Context) ([]Mention, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	mentions, err := s.queryMentions(ctx, pendingMentionsQuery)
+	return mentions, queryErr(ctx, err)
+}
+
+// VerifyMention marks the mention with id as checked, with the title of its
+// source.
+func (s *SQLite) VerifyMention(ctx context.Context, id int, title string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, verifyMentionQuery, title, time.Now().Unix(), id))
+}
+
+// DeleteMention removes the mention with id, for sources that turned out not
+// to link to the entry or have gone.
+func (s *SQLite) DeleteMention(ctx context.Context, id int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, deleteMentionQuery, id))
+}
+
+// GetUnmentionedEntries returns the published entries that mentions haven't
+// been sent for since they were last updated, oldest first.
+func (s *SQLite) GetUnmentionedEntries(ctx context.Context) ([]Entry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.stmt(unmentionedQuery).QueryContext(ctx)
+	if err != nil {
+		return nil, queryErr(ctx, err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, queryErr(ctx, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, queryErr(ctx, rows.Err())
+}
+
+// SetEntryMentioned records that mentions were sent for e. It returns
+// ErrNotFound if e has been updated since it was read, so the new version
+// gets its turn.
+func (s *SQLite) SetEntryMentioned(ctx context.Context, e Entry) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, setMentionedQuery, e.Id, e.Updated.Unix()))
+}
+
+func (s *SQLite) queryMentions(ctx context.Context, query string, args ...interface{}) ([]Mention, error) {
+	rows, err := s.stmt(query).QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentions []Mention
+	for rows.Next() {
+		mention, err := scanMention(rows)
+		if err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+	return mentions, rows.Err()
+}
+
+// scanMention reads a row selected with mentionColumns.
+func scanMention(s scanner) (Mention, error) {
+	m := Mention{}
+	var received, verified int64
+	if err := s.Scan(&m.Id, &m.EntryId, &m.Source, &m.Target, &m.Title, &received, &verified); err != nil {
+		return Mention{}, err
+	}
+	m.Received = time.Unix(received, 0)
+	if verified != 0 {
+		m.Verified = time.Unix(verified, 0)
+	}
+	return m, nil
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Schema migrations. Each entry is applied once, in order, inside a single
+// transaction. The number of applied migrations is tracked in PRAGMA user_version.
+var migrations = [][]string{
+	// 1: Baseline schema. These tables predate migrations so only create them if missing.
+	{
+		`CREATE TABLE IF NOT EXISTS entry (timestamp INTEGER PRIMARY KEY, title TEXT NOT NULL, next INTEGER NOT NULL DEFAULT 0, previous INTEGER NOT NULL DEFAULT 0, paragraph TEXT NOT NULL DEFAULT '', image TEXT NOT NULL DEFAULT '')`,
+		`CREATE TABLE IF NOT EXISTS oneoff (uid TEXT PRIMARY KEY, paragraph TEXT NOT NULL DEFAULT '', image TEXT NOT NULL DEFAULT '')`,
+		`CREATE TABLE IF NOT EXISTS articlemeta (timestamp INTEGER PRIMARY KEY, title TEXT NOT NULL, organization TEXT NOT NULL DEFAULT '', hyperlink TEXT NOT NULL DEFAULT '', pdf TEXT)`,
+	},
+	// 2: Decouple entry identity from its publication timestamp. The old
+	// timestamp column is kept so legacy URLs can be redirected.
+	{
+		`ALTER TABLE entry ADD COLUMN id INTEGER`,
+		`ALTER TABLE entry ADD COLUMN created INTEGER`,
+		`ALTER TABLE entry ADD COLUMN updated INTEGER`,
+		`ALTER TABLE entry ADD COLUMN published INTEGER`,
+		`UPDATE entry SET
+			id = (SELECT COUNT(*) FROM entry AS e WHERE e.timestamp <= entry.timestamp),
+			created = timestamp,
+			updated = timestamp,
+			published = timestamp`,
+		// next/previous pointed at timestamps; point them at the new ids.
+		`UPDATE entry SET
+			next = COALESCE((SELECT e.id FROM entry AS e WHERE e.timestamp = entry.next), 0),
+			previous = COALESCE((SELECT e.id FROM entry AS e WHERE e.timestamp = entry.previous), 0)`,
+		`CREATE UNIQUE INDEX entry_id ON entry (id)`,
+		`CREATE INDEX entry_published ON entry (published)`,
+		// Entries are still inserted by hand. Fill in whatever was left out so
+		// an insert with only a timestamp keeps working as it used to.
+		`CREATE TRIGGER entry_defaults AFTER INSERT ON entry
+		BEGIN
+			UPDATE entry SET
+				id = COALESCE(NEW.id, (SELECT COALESCE(MAX(id), 0) + 1 FROM entry)),
+				created = COALESCE(NEW.created, NEW.timestamp, strftime('%s', 'now')),
+				updated = COALESCE(NEW.updated, NEW.created, NEW.timestamp, strftime('%s', 'now')),
+				published = COALESCE(NEW.published, NEW.timestamp)
+			WHERE rowid = NEW.rowid;
+		END`,
+		`CREATE TRIGGER entry_touch AFTER UPDATE OF title, paragraph, image ON entry
+		BEGIN
+			UPDATE entry SET updated = strftime('%s', 'now') WHERE rowid = NEW.rowid;
+		END`,
+	},
+	// 3: Human readable URLs. Slugs are filled in by assignSlugs.
+	{
+		`ALTER TABLE entry ADD COLUMN slug TEXT`,
+		`CREATE UNIQUE INDEX entry_slug ON entry (slug)`,
+	},
+	// 4: Tags, and navigation computed from publication order instead of
+	// hand-maintained next/previous pointers.
+	{
+		`CREATE TABLE tag (entry_id INTEGER NOT NULL, name TEXT NOT NULL, PRIMARY KEY (entry_id, name))`,
+		`CREATE INDEX tag_name ON tag (name)`,
+		`ALTER TABLE entry DROP COLUMN next`,
+		`ALTER TABLE entry DROP COLUMN previous`,
+	},
+	// 5: kcawd PDFs as BLOBs that can be read a chunk at a time, or files kept
+	// outside the database at location. sha256 is filled in by chunkArticles.
+	{
+		`ALTER TABLE articlemeta ADD COLUMN size INTEGER`,
+		`ALTER TABLE articlemeta ADD COLUMN sha256 TEXT`,
+		`ALTER TABLE articlemeta ADD COLUMN modified INTEGER`,
+		`ALTER TABLE articlemeta ADD COLUMN location TEXT NOT NULL DEFAULT ''`,
+		// length and substr count characters in TEXT but bytes in a BLOB.
+		`UPDATE articlemeta SET pdf = CAST(pdf AS BLOB) WHERE typeof(pdf) = 'text'`,
+	},
+	// 6: Article previews. extracted is the sha256 of the PDF they were
+	// made from, so a replaced PDF is picked up again.
+	{
+		`ALTER TABLE articlemeta ADD COLUMN text TEXT`,
+		`ALTER TABLE articlemeta ADD COLUMN excerpt TEXT`,
+		`ALTER TABLE articlemeta ADD COLUMN thumbnail BLOB`,
+		`ALTER TABLE articlemeta ADD COLUMN extracted TEXT`,
+	},
+	// 7: Image alt text and captions, as a JSON array with an element per
+	// paragraph. Rows where it's empty keep using the image column.
+	{
+		`ALTER TABLE entry ADD COLUMN image_meta TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE oneoff ADD COLUMN image_meta TEXT NOT NULL DEFAULT ''`,
+		`DROP TRIGGER entry_touch`,
+		`CREATE TRIGGER entry_touch AFTER UPDATE OF title, paragraph, image, image_meta ON entry
+		BEGIN
+			UPDATE entry SET updated = strftime('%s', 'now') WHERE rowid = NEW.rowid;
+		END`,
+	},
+	// 8: Content as an ordered list of blocks, see Block. Existing rows are
+	// converted by convertBlocks; from then on paragraph, image and
+	// image_meta are only read for rows whose blocks is empty.
+	{
+		`ALTER TABLE entry ADD COLUMN blocks TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE oneoff ADD COLUMN blocks TEXT NOT NULL DEFAULT ''`,
+		`DROP TRIGGER entry_touch`,
+		`CREATE TRIGGER entry_touch AFTER UPDATE OF title, paragraph, image, image_meta, blocks ON entry
+		BEGIN
+			UPDATE entry SET updated = strftime('%s', 'now') WHERE rowid = NEW.rowid;
+		END`,
+	},
+	// 9: Readers' comments and their moderation, see Comment.
+	{
+		`CREATE TABLE comment (
+			id INTEGER PRIMARY KEY,
+			entry_id INTEGER NOT NULL,
+			author TEXT NOT NULL,
+			url TEXT NOT NULL DEFAULT '',
+			body TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			ip TEXT NOT NULL DEFAULT '',
+			created INTEGER NOT NULL,
+			moderated INTEGER
+		)`,
+		`CREATE INDEX comment_entry ON comment (entry_id, status, created)`,
+		`CREATE INDEX comment_status ON comment (status, created)`,
+		`CREATE INDEX comment_ip ON comment (ip, status)`,
+	},
+	// 10: Webmentions and Pingbacks, received and sent. mentioned is the
+	// updated time of the version of an entry mentions were last sent for.
+	// Entries already out are taken as sent so upgrading doesn't ping every
+	// link ever written.
+	{
+		`CREATE TABLE mention (
+			id INTEGER PRIMARY KEY,
+			entry_id INTEGER NOT NULL,
+			source TEXT NOT NULL,
+			target TEXT NOT NULL,
+			title TEXT NOT NULL DEFAULT '',
+			received INTEGER NOT NULL,
+			verified INTEGER,
+			pending INTEGER NOT NULL DEFAULT 1,
+			UNIQUE (entry_id, source)
+		)`,
+		`CREATE INDEX mention_pending ON mention (pending, received)`,
+		`ALTER TABLE entry ADD COLUMN mentioned INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE entry SET mentioned = updated WHERE ` + isPublished,
+	},
+	// 11: ActivityPub followers. federated is the updated time of the
+	// version of an entry last delivered to them, and as with mentioned,
+	// entries already out count as delivered.
+	{
+		`CREATE TABLE follower (
+			id INTEGER PRIMARY KEY,
+			actor TEXT NOT NULL UNIQUE,
+			inbox TEXT NOT NULL,
+			follow_id TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			accepted INTEGER NOT NULL DEFAULT 0
+		)`,
+		`ALTER TABLE entry ADD COLUMN federated INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE entry SET federated = updated WHERE ` + isPublished,
+	},
+	// 12: Email subscribers, see Subscriber. mailed is set once an entry has
+	// gone out to them, and is set for entries already out.
+	{
+		`CREATE TABLE subscriber (
+			id INTEGER PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			token TEXT NOT NULL UNIQUE,
+			digest INTEGER NOT NULL DEFAULT 0,
+			created INTEGER NOT NULL,
+			confirmed INTEGER,
+			confirmation_sent INTEGER NOT NULL DEFAULT 0,
+			digest_sent INTEGER
+		)`,
+		`ALTER TABLE entry ADD COLUMN mailed INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE entry SET mailed = 1 WHERE ` + isPublished,
+	},
+	// 13: Subscriptions to the built-in WebSub hub, see HubSubscription.
+	// pushed is the updated time of the version of an entry the hub was last
+	// told about, like federated.
+	{
+		`CREATE TABLE hub_subscription (
+			id INTEGER PRIMARY KEY,
+			topic TEXT NOT NULL,
+			callback TEXT NOT NULL,
+			secret TEXT NOT NULL DEFAULT '',
+			expires INTEGER NOT NULL DEFAULT 0,
+			pending TEXT NOT NULL DEFAULT '',
+			pending_secret TEXT NOT NULL DEFAULT '',
+			pending_lease INTEGER NOT NULL DEFAULT 0,
+			requested INTEGER NOT NULL,
+			UNIQUE (topic, callback)
+		)`,
+		`ALTER TABLE entry ADD COLUMN pushed INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE entry SET pushed = updated WHERE ` + isPublished,
+	},
+	// 14: PDFs kept in the database, as pieces of at most maxArticleChunk
+	// bytes starting at start. SQLite reads all of a BLOB value to substr
+	// it, so serving the pdf column a piece at a time read it over and over.
+	// chunkArticles moves PDFs out of the pdf column.
+	{
+		`CREATE TABLE article_chunk (
+			article INTEGER NOT NULL,
+			start INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			PRIMARY KEY (article, start)
+		)`,
+	},
+	// 15: What a hub elsewhere has been asked to fetch, kept apart from what
+	// the built-in hub pushed so neither holds the other back.
+	{
+		`ALTER TABLE entry ADD COLUMN notified INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE entry SET notified = pushed`,
+	},
+}
+
+// migrationFuncs run after the statements of the migration they're keyed by,
+// in the same transaction, for changes too fiddly to write in SQL.
+var migrationFuncs = map[int]func(*sql.Tx) error{
+	8: convertBlocks,
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	for v := version; v < len(migrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range migrations[v] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d failed: %v", v+1, err)
+			}
+		}
+		if f := migrationFuncs[v+1]; f != nil {
+			if err := f(tx); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d failed: %v", v+1, err)
+			}
+		}
+		// PRAGMA does not accept bound parameters.
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, v+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed to record version: %v", v+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d failed to commit: %v", v+1, err)
+		}
+	}
+	return nil
+}
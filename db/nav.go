@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+const linkColumns = `entry.id, COALESCE(entry.slug, ''), entry.title, entry.published`
+
+// Queries for computing an entry's neighbors. Ties on published are broken by id
+// so every entry has exactly one next and one previous.
+var (
+	nextQuery = `SELECT ` + linkColumns + ` FROM entry WHERE ` + isPublished + `
+		AND (published > ? OR (published = ? AND id > ?)) ORDER BY published ASC, id ASC LIMIT 1`
+	previousQuery = `SELECT ` + linkColumns + ` FROM entry WHERE ` + isPublished + `
+		AND (published < ? OR (published = ? AND id < ?)) ORDER BY published DESC, id DESC LIMIT 1`
+	sameYearQuery = `SELECT ` + linkColumns + ` FROM entry WHERE ` + isPublished + `
+		AND published >= ? AND published < ? AND id != ? ORDER BY published DESC LIMIT ?`
+	relatedQuery = `SELECT ` + linkColumns + ` FROM tag
+		JOIN tag AS mine ON mine.name = tag.name AND mine.entry_id = ?
+		JOIN entry ON entry.id = tag.entry_id
+		WHERE tag.entry_id != ? AND ` + isPublished + `
+		GROUP BY entry.id ORDER BY COUNT(*) DESC, entry.published DESC LIMIT ?`
+	tagsQuery = `SELECT name FROM tag WHERE entry_id = ? ORDER BY name`
+)
+
+// Link is the minimum needed to point at an entry.
+type Link struct {
+	Id        int
+	Slug      string
+	Title     string
+	Published time.Time
+}
+
+// Navigation is everything an entry page links to besides itself.
+type Navigation struct {
+	// Next is the newer neighbor and Previous the older. Nil at either end.
+	Next     *Link
+	Previous *Link
+	Tags     []string
+	// Other entries published the same year, newest first.
+	SameYear []Link
+	// Entries sharing the most tags with this one.
+	Related []Link
+}
+
+func scanLink(s scanner) (Link, error) {
+	link := Link{}
+	var published int64
+	if err := s.Scan(&link.Id, &link.Slug, &link.Title, &published); err != nil {
+		return link, err
+	}
+	link.Published = time.Unix(published, 0)
+	return link, nil
+}
+
+func (s *SQLite) queryLinks(ctx context.Context, query string, args ...interface{}) ([]Link, error) {
+	rows, err := s.stmt(query).QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []Link
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// neighbor returns the single link selected by query or nil if there is none.
+func (s *SQLite) neighbor(ctx context.Context, query string, e Entry) (*Link, error) {
+	published := e.Published.Unix()
+	links, err := s.queryLinks(ctx, query, published, published, e.Id)
+	if err != nil || len(links) == 0 {
+		return nil, err
+	}
+	return &links[0], nil
+}
+
+func (s *SQLite) getTags(ctx context.Context, id int) ([]string, error) {
+	rows, err := s.stmt(tagsQuery).QueryContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// GetNavigation computes the neighbors of e from the publication order. limit
+// caps the SameYear and Related lists.
+func (s *SQLite) GetNavigation(ctx context.Context, e Entry, limit int) (Navigation, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	nav := Navigation{}
+	var err error
+	if nav.Next, err = s.neighbor(ctx, nextQuery, e); err != nil {
+		return nav, queryErr(ctx, err)
+	}
+	if nav.Previous, err = s.neighbor(ctx, previousQuery, e); err != nil {
+		return nav, queryErr(ctx, err)
+	}
+	if nav.Tags, err = s.getTags(ctx, e.Id); err != nil {
+		return nav, queryErr(ctx, err)
+	}
+
+	year := time.Date(e.Published.Year(), time.January, 1, 0, 0, 0, 0, e.Published.Location())
+	nav.SameYear, err = s.queryLinks(ctx, sameYearQuery, year.Unix(), year.AddDate(1, 0, 0).Unix(), e.Id, limit)
+	if err != nil {
+		return nav, queryErr(ctx, err)
+	}
+	nav.Related, err = s.queryLinks(ctx, relatedQuery, e.Id, e.Id, limit)
+	return nav, queryErr(ctx, err)
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const maxSlugLength = 60
+
+var (
+	slugQuery        = `SELECT ` + entryColumns + ` FROM entry WHERE slug = ? AND ` + isPublished
+	slugTakenQuery   = `SELECT COUNT(*) FROM entry WHERE slug = ?`
+	missingSlugQuery = `SELECT id, title FROM entry WHERE slug IS NULL OR slug = '' ORDER BY id`
+	setSlugQuery     = `UPDATE entry SET slug = ? WHERE id = ?`
+)
+
+// Letters that NFKD leaves whole but that have a usual spelling in ASCII.
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'ł': "l", 'þ': "th", 'ı': "i",
+}
+
+// Slugify turns a title into a lowercase, hyphen separated URL path segment.
+// Accented Latin letters lose their accents, "Café" becoming "cafe", and
+// letters of other scripts are kept as they are.
+func Slugify(title string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(title) {
+		for _, c := range fold(r) {
+			switch {
+			case unicode.IsLetter(c) || unicode.IsDigit(c):
+				if hyphen && b.Len() > 0 {
+					b.WriteByte('-')
+				}
+				hyphen = false
+				b.WriteRune(c)
+			case c == '\'' || c == '’':
+				// Keep contractions together: "don't" -> "dont".
+			default:
+				hyphen = true
+			}
+		}
+	}
+
+	slug := []rune(b.String())
+	if len(slug) > maxSlugLength {
+		slug = []rune(strings.TrimRight(string(slug[:maxSlugLength]), "-"))
+		for i := len(slug) - 1; i > maxSlugLength/2; i-- {
+			if slug[i] == '-' {
+				slug = slug[:i]
+				break
+			}
+		}
+	}
+	if len(slug) == 0 {
+		return "entry"
+	}
+	return string(slug)
+}
+
+// fold spells r in ASCII if it is a Latin letter with marks or a
+// compatibility form of ASCII, such as "é" or "ﬁ", and leaves it as it is
+// otherwise.
+func fold(r rune) string {
+	if r < utf8.RuneSelf {
+		return string(r)
+	}
+	if t, ok := transliterations[r]; ok {
+		return t
+	}
+	var b strings.Builder
+	for _, d := range norm.NFKD.String(string(r)) {
+		if unicode.Is(unicode.Mn, d) {
+			continue
+		}
+		if d >= utf8.RuneSelf {
+			return string(r)
+		}
+		b.WriteRune(d)
+	}
+	return b.String()
+}
+
+// GetEntryBySlug returns the published entry with the given slug.
+func (s *SQLite) GetEntryBySlug(ctx context.Context, slug string) (Entry, error) {
+	if slug == "" {
+		return Entry{}, fmt.Errorf("%w: empty slug", ErrInvalidID)
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	entry, err := scanEntry(s.stmt(slugQuery).QueryRowContext(ctx, slug))
+	return entry, queryErr(ctx, err)
+}
+
+// uniqueSlug returns the slug for title, suffixed with a counter if an entry already uses it.
+func uniqueSlug(tx *sql.Tx, title string) (string, error) {
+	base := Slugify(title)
+	slug := base
+	for i := 2; ; i++ {
+		var count int
+		if err := tx.QueryRow(slugTakenQuery, slug).Scan(&count); err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return slug, nil
+		}
+		slug = base + "-" + strconv.Itoa(i)
+	}
+}
+
+// assignSlugs generates slugs for every entry that lacks one. Entries are
+// inserted by hand so this runs at every Open rather than once as a migration.
+func assignSlugs(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(missingSlugQuery)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id    int
+		title string
+	}
+	var missing []pending
+	for rows.Next() {
+		p := pending{}
+		if err := rows.Scan(&p.id, &p.title); err != nil {
+			rows.Close()
+			return err
+		}
+		missing = append(missing, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range missing {
+		slug, err := uniqueSlug(tx, p.title)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(setSlugQuery, slug, p.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
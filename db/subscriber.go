@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// ConfirmationCooldown is how long after a confirmation link goes out that
+// signing the same address up again changes nothing, so the form can't be
+// used to flood someone with confirmation emails.
+const ConfirmationCooldown = 24 * time.Hour
+
+var (
+	// Signing up again before confirming starts over with a new token, once
+	// any confirmation sent is ConfirmationCooldown old. Once confirmed,
+	// nothing changes, so a stranger can't switch someone's mode.
+	addSubscriberQuery = `INSERT INTO subscriber (email, token, digest, created) VALUES (?, ?, ?, ?)
+		ON CONFLICT (email) DO UPDATE SET token = excluded.token, digest = excluded.digest,
+			created = excluded.created, confirmation_sent = 0
+		WHERE confirmed IS NULL AND (confirmation_sent = 0 OR created <= ?)`
+	subscribersQuery = `SELECT id, email, token, digest, created, COALESCE(confirmed, 0), confirmation_sent,
+		COALESCE(digest_sent, 0) FROM subscriber ORDER BY id`
+	confirmationSentQuery = `UPDATE subscriber SET confirmation_sent = 1 WHERE id = ?`
+	// Confirming again keeps the first time.
+	confirmSubscriberQuery = `UPDATE subscriber SET confirmed = COALESCE(confirmed, ?) WHERE token = ?`
+	removeSubscriberQuery  = `DELETE FROM subscriber WHERE token = ?`
+	digestSentQuery        = `UPDATE subscriber SET digest_sent = ? WHERE id = ?`
+
+	unmailedQuery         = `SELECT ` + entryColumns + ` FROM entry WHERE ` + isPublished + ` AND mailed = 0 ORDER BY published`
+	setMailedQuery        = `UPDATE entry SET mailed = 1 WHERE id = ?`
+	publishedBetweenQuery = `SELECT ` + entryColumns + ` FROM entry
+		WHERE ` + isPublished + ` AND published > ? AND published <= ? ORDER BY published`
+)
+
+// Subscriber is an email address that gets new entries.
+type Subscriber struct {
+	Id    int
+	Email string
+	// Secret in the subscriber's confirmation and unsubscribe links.
+	Token string
+	// Whether to send a digest now and then rather than each entry.
+	Digest  bool
+	Created time.Time
+	// Zero until the address has been confirmed.
+	Confirmed        time.Time
+	ConfirmationSent bool
+	// When the last digest went out; zero if none has.
+	DigestSent time.Time
+}
+
+// AddSubscriber signs up sub.Email, to be confirmed with sub.Token. It
+// returns ErrNotFound if the address is already confirmed, or was sent a
+// confirmation link within ConfirmationCooldown.
+func (s *SQLite) AddSubscriber(ctx context.Context, sub Subscriber) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+	return queryErr(ctx, execOne(ctx, s.rw, addSubscriberQuery, sub.Email, sub.Token, sub.Digest, now.Unix(),
+		now.Add(-ConfirmationCooldown).Unix()))
+}
+
+// GetSubscribers returns every subscriber, confirmed or not, oldest first.
+func (s *SQLite) GetSubscribers(ctx context.Context) ([]Subscriber, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.stmt(subscribersQuery).QueryContext(ctx)
+	if err != nil {
+		return nil, queryErr(ctx, err)
+	}
+	defer rows.Close()
+
+	var subscribers []Subscriber
+	for rows.Next() {
+		var sub Subscriber
+		var created, confirmed, digestSent int64
+		err := rows.Scan(&sub.Id, &sub.Email, &sub.Token, &sub.Digest, &created, &confirmed, &sub.ConfirmationSent, &digestSent)
+		if err != nil {
+			return nil, queryErr(ctx, err)
+		}
+		sub.Created = time.Unix(created, 0)
+		if confirmed != 0 {
+			sub.Confirmed = time.Unix(confirmed, 0)
+		}
+		if digestSent != 0 {
+			sub.DigestSent = time.Unix(digestSent, 0)
+		}
+		subscribers = append(subscribers, sub)
+	}
+	return subscribers, queryErr(ctx, rows.Err())
+}
+
+// SetConfirmationSent records that the subscriber with id was sent their
+// confirmation link.
+func (s *SQLite) SetConfirmationSent(ctx context.Context, id int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, confirmationSentQuery, id))
+}
+
+// ConfirmSubscriber confirms the subscriber with token. It returns
+// ErrNotFound if there is no such subscriber.
+func (s *SQLite) ConfirmSubscriber(ctx context.Context, token string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, confirmSubscriberQuery, time.Now().Unix(), token))
+}
+
+// RemoveSubscriber unsubscribes the subscriber with token. It returns
+// ErrNotFound if there is no such subscriber.
+func (s *SQLite) RemoveSubscriber(ctx context.Context, token string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, removeSubscriberQuery, token))
+}
+
+// SetDigestSent records that the subscriber with id was sent a digest of the
+// entries published up to t.
+func (s *SQLite) SetDigestSent(ctx context.Context, id int, t time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, digestSentQuery, t.Unix(), id))
+}
+
+// GetUnmailedEntries returns the published entries that haven't been sent to
+// subscribers, oldest first. Unlike mentions, edits aren't sent again.
+func (s *SQLite) GetUnmailedEntries(ctx context.Context) ([]Entry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	entries, err := s.queryEntries(ctx, unmailedQuery)
+	return entries, queryErr(ctx, err)
+}
+
+// SetEntryMailed records that the entry with id was sent to subscribers.
+func (s *SQLite) SetEntryMailed(ctx context.Context, id int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return queryErr(ctx, execOne(ctx, s.rw, setMailedQuery, id))
+}
+
+// GetEntriesPublished returns the entries published after after and up to
+// and including before, oldest first.
+func (s *SQLite) GetEntriesPublished(ctx context.Context, after, before time.Time) ([]Entry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	entries, err := s.queryEntries(ctx, publishedBetweenQuery, after.Unix(), before.Unix())
+	return entries, queryErr(ctx, err)
+}
+
+func (s *SQLite) queryEntries(ctx context.Context, query string, args ...interface{}) ([]Entry, error) {
+	rows, err := s.stmt(query).QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/serving"
+)
+
+// httpError is returned by handlers to pick the response status and the
+// message shown to the user. Err is only ever logged.
+type httpError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *httpError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
+
+func (e *httpError) Unwrap() error {
+	return e.Err
+}
+
+func statusError(status int, message string, err error) error {
+	return &httpError{Status: status, Message: message, Err: err}
+}
+
+func serverError(message string, err error) error {
+	return statusError(http.StatusInternalServerError, message, err)
+}
+
+// storeError picks the status for a failed store call. Lookups of things that
+// don't exist are the client's fault; timeouts and a busy database are ours
+// but worth retrying, so say so.
+func storeError(message string, err error) error {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return notFoundError(err)
+	case errors.Is(err, db.ErrInvalidID):
+		return statusError(http.StatusBadRequest, "invalid request", err)
+	case errors.Is(err, db.ErrExists):
+		return statusError(http.StatusConflict, "that conflicts with something that already exists", err)
+	case errors.Is(err, db.ErrTimeout):
+		return statusError(http.StatusGatewayTimeout, "the database took too long to respond, please try again", err)
+	case errors.Is(err, db.ErrUnavailable):
+		return statusError(http.StatusServiceUnavailable, "the database is busy, please try again", err)
+	}
+	return serverError(message, err)
+}
+
+func notFoundError(err error) error {
+	return statusError(http.StatusNotFound, notFoundMessage, err)
+}
+
+const (
+	notFoundMessage    = "the page you requested does not exist"
+	serverErrorMessage = "something went wrong building this page"
+)
+
+// appHandler is a handler that leaves error responses to server.handle.
+type appHandler func(http.ResponseWriter, *http.Request) error
+
+// handle adapts h to an http.Handler that logs any error it returns and
+// renders it as an error page. Errors that aren't an *httpError are treated
+// as internal errors.
+func (s *server) handle(h appHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := h(w, r)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+			// The client went away; there's nobody to write an error page to.
+			log.Printf("%s %s: canceled: %v", r.Method, r.URL.Path, err)
+			return
+		}
+
+		var httpErr *httpError
+		if !errors.As(err, &httpErr) {
+			httpErr = &httpError{Status: http.StatusInternalServerError, Message: serverErrorMessage, Err: err}
+		}
+		log.Printf("%s %s: %d: %v", r.Method, r.URL.Path, httpErr.Status, err)
+		s.writeError(w, r, httpErr.Status, httpErr.Message)
+	})
+}
+
+// recoverer logs the stack of a panicking handler and serves the 500 page
+// instead of dropping the connection.
+func (s *server) recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate abort; let net/http handle it quietly.
+				panic(v)
+			}
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+			s.writeError(w, r, http.StatusInternalServerError, serverErrorMessage)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wantsJSON reports whether the client ranks application/json above text/html
+// in its Accept header. Browsers and clients that don't say get HTML.
+func wantsJSON(r *http.Request) bool {
+	best := map[string]float64{}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > best[mediaType] {
+			best[mediaType] = q
+		}
+	}
+	html := best["text/html"]
+	if best["text/*"] > html {
+		html = best["text/*"]
+	}
+	return best["application/json"] > html
+}
+
+// writeError responds with status using the error page templates, or JSON if
+// the client asked for it. message is shown to the user so keep it free of
+// internal details.
+func (s *server) writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	serving := serving.ErrorToServing(status, message)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(serving); err != nil {
+			log.Printf("error encoding error response: %v", err)
+		}
+		return
+	}
+
+	page := notFoundPage
+	if status >= http.StatusInternalServerError {
+		page = serverErrorPage
+	}
+	tmpl, ok := s.tmpls[page]
+	if !ok {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, serving); err != nil {
+		log.Printf("error executing template %s: %v", page, err)
+	}
+}
+
+func (s *server) notFound(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, r, http.StatusNotFound, notFoundMessage)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/preview"
+)
+
+const (
+	// How often to look for articles inserted behind the server's back.
+	// Uploads through the admin pages are picked up right away.
+	extractInterval = time.Hour
+	thumbnailWidth  = 320
+	// Longest a single thumbnail may take to render.
+	thumbnailTimeout = 30 * time.Second
+)
+
+// runExtractor extracts article previews until ctx is done, once at start,
+// then every extractInterval or when the extractor is woken.
+func (s *server) runExtractor(ctx context.Context) {
+	s.extractor.run(ctx, pass{"article preview extraction", s.extractPreviews})
+}
+
+// extractPreviews makes a preview for every article that lacks one. A PDF
+// that can't be read still gets an empty preview so it isn't retried forever.
+func (s *server) extractPreviews(ctx context.Context) error {
+	articles, err := s.articleStore.GetUnextractedArticles(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list articles: %w", err)
+	}
+	for _, article := range articles {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p, err := s.extractPreview(ctx, article)
+		if err != nil {
+			// Most likely the storage is unavailable; try again next pass.
+			log.Printf("unable to read pdf for article %d: %v", article.Id, err)
+			continue
+		}
+		err = s.articleStore.SetArticlePreview(ctx, article.Id, p)
+		if err == db.ErrNotFound {
+			// Deleted or replaced while we worked; the next pass has it.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to save preview for article %d: %w", article.Id, err)
+		}
+		log.Printf("extracted preview for article %d (thumbnail: %t)", article.Id, p.Thumbnail != nil)
+	}
+	return nil
+}
+
+func (s *server) extractPreview(ctx context.Context, article db.Article) (db.ArticlePreview, error) {
+	f, err := s.openArticle(ctx, article)
+	if err != nil {
+		return db.ArticlePreview{}, err
+	}
+	defer f.Close()
+	pdf, err := io.ReadAll(f)
+	if err != nil {
+		return db.ArticlePreview{}, err
+	}
+
+	p := db.ArticlePreview{SHA256: article.SHA256}
+	if p.Text, err = preview.Text(pdf); err != nil {
+		log.Printf("unable to extract text from article %d: %v", article.Id, err)
+	}
+	p.Excerpt = preview.Excerpt(p.Text, preview.ExcerptLength)
+
+	rctx, cancel := context.WithTimeout(ctx, thumbnailTimeout)
+	defer cancel()
+	if p.Thumbnail, err = s.renderer.Thumbnail(rctx, pdf); err != nil {
+		log.Printf("unable to render thumbnail for article %d: %v", article.Id, err)
+	}
+	return p, nil
+}
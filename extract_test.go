@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/db/dbtest"
+)
+
+// fakeRenderer "renders" every PDF to the same bytes.
+type fakeRenderer struct {
+	calls int
+}
+
+func (f *fakeRenderer) Thumbnail(ctx context.Context, pdf []byte) ([]byte, error) {
+	f.calls++
+	return []byte("\x89PNG thumbnail"), nil
+}
+
+func TestExtractPreviews(t *testing.T) {
+	s := newTestServer(t)
+	renderer := &fakeRenderer{}
+	s.renderer = renderer
+	ctx := context.Background()
+
+	hello, err := os.ReadFile("preview/testdata/hello.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := db.ArticleMeta{EntryId: 1610000000, Title: "Hello", Organization: "Org"}
+	if err := s.articleStore.CreateArticle(ctx, meta, db.ArticleFile{PDF: hello}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.extractPreviews(ctx); err != nil {
+		t.Fatalf("extractPreviews failed: %v", err)
+	}
+	// The two fixtures and the new article.
+	if renderer.calls != 3 {
+		t.Errorf("rendered %d thumbnails, want 3", renderer.calls)
+	}
+	if err := s.extractPreviews(ctx); err != nil || renderer.calls != 3 {
+		t.Errorf("second pass rendered %d more thumbnails (err %v), want none", renderer.calls-3, err)
+	}
+
+	router := s.routes()
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	want := "Hello|/kcawd/1610000000/thumbnail.png|Hello kcawd readers|"
+	if body := get("/kcawd").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("GET /kcawd = %q, want it to contain %q", body, want)
+	}
+	if body := get("/kcawd?q=READERS").Body.String(); !strings.HasPrefix(body, "kcawd|READERS|"+want) || strings.Contains(body, "An Article") {
+		t.Errorf("search by text = %q, want only the new article", body)
+	}
+	rec := get("/kcawd/1610000000/thumbnail.png")
+	if rec.Code != http.StatusOK || rec.Body.String() != "\x89PNG thumbnail" || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("GET thumbnail = %d %q %q", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	if rec.Header().Get("ETag") == "" {
+		t.Error("thumbnail served without an ETag")
+	}
+
+	// Replacing the PDF drops the preview until the next pass.
+	if err := s.articleStore.UpdateArticle(ctx, 1610000000, meta, &db.ArticleFile{PDF: []byte("%PDF-1.4 replaced")}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("/kcawd/1610000000/thumbnail.png"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET thumbnail after replace = %d, want 404", rec.Code)
+	}
+	if err := s.extractPreviews(ctx); err != nil || renderer.calls != 4 {
+		t.Errorf("pass after replace rendered %d thumbnails (err %v), want 1", renderer.calls-3, err)
+	}
+}
+
+func TestMissingPdftoppm(t *testing.T) {
+	store, _ := dbtest.Open(t)
+	cfg := config{rootDir: "testdata", templates: "templates", resources: "resources", static: "static", pdftoppm: "/nonexistent/pdftoppm"}
+	if _, err := newServer(store, cfg); err == nil {
+		t.Error("newServer with a missing pdftoppm succeeded")
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dubJay/activitypub"
+	"github.com/dubJay/db"
+	"github.com/dubJay/serving"
+)
+
+const (
+	webfingerPath = "/.well-known/webfinger"
+	actorPath     = "/activitypub/actor"
+	outboxPath    = "/activitypub/outbox"
+	followersPath = "/activitypub/followers"
+	inboxPath     = "/activitypub/inbox"
+
+	// The site's handle is @blog@christopher.cawdrey.name.
+	actorName    = "blog"
+	actorAccount = "acct:" + actorName + "@christopher.cawdrey.name"
+	actorID      = siteURL + actorPath
+	actorKeyID   = actorID + "#main-key"
+
+	// How often to look for newly published entries to deliver. New
+	// followers are accepted right away.
+	federationInterval = 15 * time.Minute
+	// How long an Accept that can't be delivered is retried before the
+	// follower is dropped.
+	federationRetry = 24 * time.Hour
+	// Entries in the outbox.
+	outboxSize = 20
+	// Activities one address may post to the inbox per hour.
+	inboxLimit = 60
+)
+
+// federationEnabled reports whether the site is an ActivityPub actor, which
+// it is once it has a key to sign with.
+func (s *server) federationEnabled() bool {
+	return s.federationKey != nil
+}
+
+// runFederation accepts new followers and delivers newly published entries
+// to followers until ctx is done, once at start, then every
+// federationInterval or when the federation worker is woken.
+func (s *server) runFederation(ctx context.Context) {
+	s.federationWorker.run(ctx,
+		pass{"accepting followers", s.acceptFollowers},
+		pass{"delivering entries", s.federateEntries},
+	)
+}
+
+// acceptFollowers sends an Accept for every follow that hasn't had one.
+func (s *server) acceptFollowers(ctx context.Context) error {
+	followers, err := s.followerStore.GetFollowers(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list followers: %w", err)
+	}
+	for _, f := range followers {
+		if f.Accepted {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		accept := activitypub.Activity{
+			Context: activitypub.Context,
+			ID:      actorID + "#accepts/" + strconv.Itoa(f.Id),
+			Type:    "Accept",
+			Actor:   actorID,
+			Object:  activitypub.Activity{ID: f.FollowId, Type: "Follow", Actor: f.Actor, Object: actorID},
+		}
+		switch err := s.federation.Deliver(ctx, f.Inbox, accept); {
+		case err == nil:
+			err = s.followerStore.AcceptFollower(ctx, f.Id)
+			if err == nil {
+				log.Printf("accepted follow from %s", f.Actor)
+			}
+		case time.Since(f.Created) > federationRetry:
+			log.Printf("dropping follower %s: %v", f.Actor, err)
+			err = s.followerStore.RemoveFollower(ctx, f.Actor)
+		default:
+			// Most likely their server is down; try again next pass.
+			log.Printf("unable to accept follow from %s: %v", f.Actor, err)
+			continue
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			// Unfollowed while we worked.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to save follower %s: %w", f.Actor, err)
+		}
+	}
+	return nil
+}
+
+// federateEntries delivers every entry published or edited since it was last
+// delivered to each accepted follower's inbox, once per shared inbox.
+// Failures aren't retried.
+func (s *server) federateEntries(ctx context.Context) error {
+	entries, err := s.followerStore.GetUnfederatedEntries(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list entries: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	followers, err := s.followerStore.GetFollowers(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list followers: %w", err)
+	}
+	var inboxes []string
+	seen := map[string]bool{}
+	for _, f := range followers {
+		if f.Accepted && !seen[f.Inbox] {
+			seen[f.Inbox] = true
+			inboxes = append(inboxes, f.Inbox)
+		}
+	}
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.deliverEntry(ctx, entry, inboxes)
+		err := s.followerStore.SetEntryFederated(ctx, entry.Entry)
+		if err == db.ErrNotFound {
+			// Edited while we worked; the next pass has it.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to record delivery of entry %d: %w", entry.Id, err)
+		}
+	}
+	return nil
+}
+
+func (s *server) deliverEntry(ctx context.Context, entry db.UnfederatedEntry, inboxes []string) {
+	article, err := s.article(entry.Entry)
+	if err != nil {
+		// It can't be shown either, so there's nothing to deliver.
+		log.Printf("unable to render entry %d to deliver: %v", entry.Id, err)
+		return
+	}
+	activity := createActivity(article)
+	if entry.Federated {
+		activity.Type = "Update"
+		activity.ID = article.ID + "#updates/" + strconv.FormatInt(entry.Updated.Unix(), 10)
+	}
+	activity.Context = activitypub.Context
+	for _, inbox := range inboxes {
+		if err := s.federation.Deliver(ctx, inbox, activity); err != nil {
+			log.Printf("unable to deliver entry %d to %s: %v", entry.Id, inbox, err)
+		}
+	}
+}
+
+// article is the ActivityPub object for entry.
+func (s *server) article(entry db.Entry) (activitypub.Object, error) {
+	content, err := serving.EntryToServing(entry, db.Navigation{}, s.site())
+	if err != nil {
+		return activitypub.Object{}, err
+	}
+	article := activitypub.Object{
+		ID:           siteURL + content.Path,
+		Type:         "Article",
+		Name:         entry.Title,
+		Content:      string(content.HTML),
+		URL:          siteURL + content.Path,
+		AttributedTo: actorID,
+		To:           []string{activitypub.Public},
+		Cc:           []string{siteURL + followersPath},
+		Published:    entry.Published.UTC().Format(time.RFC3339),
+	}
+	if entry.Updated.After(entry.Published) {
+		article.Updated = entry.Updated.UTC().Format(time.RFC3339)
+	}
+	return article, nil
+}
+
+// createActivity is the activity announcing article.
+func createActivity(article activitypub.Object) activitypub.Activity {
+	return activitypub.Activity{
+		ID:        article.ID + "#create",
+		Type:      "Create",
+		Actor:     actorID,
+		Object:    article,
+		To:        article.To,
+		Cc:        article.Cc,
+		Published: article.Published,
+	}
+}
+
+// writeActivityPub writes v as an ActivityPub document.
+func writeActivityPub(w http.ResponseWriter, contentType string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return serverError("failed to build document", err)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+	return nil
+}
+
+func (s *server) serveWebFinger(w http.ResponseWriter, r *http.Request) error {
+	if resource := r.URL.Query().Get("resource"); resource != actorAccount && resource != actorID {
+		return notFoundError(fmt.Errorf("webfinger for unknown resource %q", resource))
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	return writeActivityPub(w, "application/jrd+json", activitypub.JRD{
+		Subject: actorAccount,
+		Aliases: []string{actorID},
+		Links: []activitypub.JRDLink{
+			{Rel: "self", Type: activitypub.ContentType, Href: actorID},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: siteURL},
+		},
+	})
+}
+
+func (s *server) serveActor(w http.ResponseWriter, r *http.Request) error {
+	key, err := activitypub.PublicKeyPEM(s.federationKey)
+	if err != nil {
+		return serverError("failed to build actor", fmt.Errorf("unable to encode public key: %v", err))
+	}
+	return writeActivityPub(w, activitypub.ContentType, activitypub.Actor{
+		Context:           activitypub.Context,
+		ID:                actorID,
+		Type:              "Person",
+		PreferredUsername: actorName,
+		Name:              siteTitle,
+		Summary:           siteDescription,
+		URL:               siteURL,
+		Inbox:             siteURL + inboxPath,
+		Outbox:            siteURL + outboxPath,
+		Followers:         siteURL + followersPath,
+		PublicKey:         activitypub.PublicKey{ID: actorKeyID, Owner: actorID, PublicKeyPem: key},
+	})
+}
+
+func (s *server) serveOutbox(w http.ResponseWriter, r *http.Request) error {
+	entries, err := s.entryStore.GetRecentEntries(r.Context(), outboxSize)
+	if err != nil {
+		return storeError("failed to retrieve recent entries", fmt.Errorf("unable to get recent entries: %w", err))
+	}
+	items := []activitypub.Activity{}
+	for _, entry := range entries {
+		article, err := s.article(entry)
+		if err != nil {
+			return serverError("failed to generate content", fmt.Errorf("failed to generate article for entry %d: %v", entry.Id, err))
+		}
+		items = append(items, createActivity(article))
+	}
+	return writeActivityPub(w, activitypub.ContentType, activitypub.OrderedCollection{
+		Context:      activitypub.Context,
+		ID:           siteURL + outboxPath,
+		Type:         "OrderedCollection",
+		TotalItems:   len(items),
+		OrderedItems: items,
+	})
+}
+
+// serveFollowers gives the number of followers but not who they are.
+func (s *server) serveFollowers(w http.ResponseWriter, r *http.Request) error {
+	followers, err := s.followerStore.GetFollowers(r.Context())
+	if err != nil {
+		return storeError("failed to retrieve followers", fmt.Errorf("unable to get followers: %w", err))
+	}
+	count := 0
+	for _, f := range followers {
+		if f.Accepted {
+			count++
+		}
+	}
+	return writeActivityPub(w, activitypub.ContentType, activitypub.OrderedCollection{
+		Context:    activitypub.Context,
+		ID:         siteURL + followersPath,
+		Type:       "OrderedCollection",
+		TotalItems: count,
+	})
+}
+
+// postInbox takes follows and unfollows of the site. Anything else is
+// acknowledged and dropped.
+func (s *server) postInbox(w http.ResponseWriter, r *http.Request) error {
+	ip := s.clientIP(r)
+	if !s.inboxLimiter.allow(ip) {
+		return statusError(http.StatusTooManyRequests, "too many activities, please try again later",
+			fmt.Errorf("too many activities from %s", ip))
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, activitypub.MaxDocument))
+	if err != nil {
+		return statusError(http.StatusBadRequest, "the activity could not be read", err)
+	}
+	var activity activitypub.Activity
+	if err := json.Unmarshal(body, &activity); err != nil {
+		return statusError(http.StatusBadRequest, "the activity is not valid JSON", err)
+	}
+	if activity.Type != "Follow" && activity.Type != "Undo" {
+		// Servers tell everyone they know about deletions and the like, and
+		// checking their signatures would only cost requests.
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+
+	keyID, err := activitypub.KeyID(r)
+	if err != nil {
+		return statusError(http.StatusUnauthorized, "the activity must be signed", err)
+	}
+	actor, key, err := s.federation.FetchKey(r.Context(), keyID)
+	if err != nil {
+		return statusError(http.StatusUnauthorized, "the signing key could not be fetched",
+			fmt.Errorf("unable to fetch key %s: %w", keyID, err))
+	}
+	if err := activitypub.Verify(r, body, key); err != nil {
+		return statusError(http.StatusUnauthorized, "the signature is not valid", err)
+	}
+	if activity.Actor != actor.ID {
+		return statusError(http.StatusForbidden, "the activity must be signed by its actor",
+			fmt.Errorf("%s signed an activity by %s", actor.ID, activity.Actor))
+	}
+
+	switch {
+	case activity.Type == "Follow":
+		if activity.ObjectID() != actorID {
+			return statusError(http.StatusBadRequest, "only "+actorID+" can be followed",
+				fmt.Errorf("follow of %q", activity.ObjectID()))
+		}
+		err := s.followerStore.AddFollower(r.Context(), db.Follower{Actor: actor.ID, Inbox: actor.DeliveryInbox(), FollowId: activity.ID})
+		if err != nil {
+			return storeError("failed to save follower", fmt.Errorf("unable to add follower %s: %w", actor.ID, err))
+		}
+		log.Printf("followed by %s", actor.ID)
+		s.federationWorker.request()
+	case activity.ObjectType() == "Follow" && activity.ObjectActor() == actor.ID:
+		err := s.followerStore.RemoveFollower(r.Context(), actor.ID)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return storeError("failed to remove follower", fmt.Errorf("unable to remove follower %s: %w", actor.ID, err))
+		}
+		log.Printf("unfollowed by %s", actor.ID)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dubJay/activitypub"
+)
+
+func withFederation(t *testing.T) func(*config) {
+	dir := t.TempDir()
+	return func(cfg *config) {
+		cfg.activityPubKey = filepath.Join(dir, "activitypub.pem")
+		cfg.allowPrivateNetwork = true
+	}
+}
+
+// remoteActor is an actor on a stub server. Its inbox records activities
+// signed by the site.
+type remoteActor struct {
+	*httptest.Server
+	key  *rsa.PrivateKey
+	site *rsa.PublicKey
+
+	mu        sync.Mutex
+	delivered []activitypub.Activity
+}
+
+func newRemoteActor(t *testing.T, site *rsa.PublicKey) *remoteActor {
+	t.Helper()
+	key, err := activitypub.LoadKey(filepath.Join(t.TempDir(), "remote.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &remoteActor{key: key, site: site}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/actor", func(w http.ResponseWriter, r *http.Request) {
+		pem, _ := activitypub.PublicKeyPEM(a.key)
+		w.Header().Set("Content-Type", activitypub.ContentType)
+		json.NewEncoder(w).Encode(activitypub.Actor{
+			ID: a.id(), Type: "Person", Inbox: a.URL + "/inbox",
+			Endpoints: &activitypub.Endpoints{SharedInbox: a.URL + "/shared"},
+			PublicKey: activitypub.PublicKey{ID: a.id() + "#main-key", Owner: a.id(), PublicKeyPem: pem},
+		})
+	})
+	mux.HandleFunc("/shared", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := activitypub.Verify(r, body, a.site); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var activity activitypub.Activity
+		json.Unmarshal(body, &activity)
+		a.mu.Lock()
+		a.delivered = append(a.delivered, activity)
+		a.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	a.Server = httptest.NewServer(mux)
+	t.Cleanup(a.Close)
+	return a
+}
+
+func (a *remoteActor) id() string {
+	return a.URL + "/actor"
+}
+
+// post sends activity to the site's inbox, signed with a's key.
+func (a *remoteActor) post(t *testing.T, router http.Handler, activity interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(activity)
+	req := httptest.NewRequest(http.MethodPost, siteURL+inboxPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", activitypub.ContentType)
+	if err := activitypub.Sign(req, body, a.id()+"#main-key", a.key); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func getJSON(t *testing.T, router http.Handler, path string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("GET %s returned invalid JSON: %v", path, err)
+		}
+	}
+	return rec
+}
+
+func TestFederationDisabled(t *testing.T) {
+	router := newTestServer(t).routes()
+	for _, path := range []string{webfingerPath + "?resource=" + actorAccount, actorPath, outboxPath} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d with federation off, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestFederationDocuments(t *testing.T) {
+	s := newTestServer(t, withFederation(t))
+	router := s.routes()
+
+	var jrd activitypub.JRD
+	if rec := getJSON(t, router, webfingerPath+"?resource="+actorAccount, &jrd); rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d, want 200", webfingerPath, rec.Code)
+	}
+	if jrd.Subject != actorAccount || len(jrd.Links) == 0 || jrd.Links[0].Href != actorID {
+		t.Errorf("webfinger = %+v, want a self link to the actor", jrd)
+	}
+	if rec := getJSON(t, router, webfingerPath+"?resource=acct:someone@christopher.cawdrey.name", &jrd); rec.Code != http.StatusNotFound {
+		t.Errorf("webfinger of someone else = %d, want 404", rec.Code)
+	}
+
+	var actor activitypub.Actor
+	rec := getJSON(t, router, actorPath, &actor)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != activitypub.ContentType {
+		t.Fatalf("GET %s = %d %q, want an ActivityPub document", actorPath, rec.Code, rec.Header().Get("Content-Type"))
+	}
+	key, err := activitypub.ParsePublicKey(actor.PublicKey.PublicKeyPem)
+	if err != nil || !key.Equal(&s.federationKey.PublicKey) || actor.PublicKey.ID != actorKeyID {
+		t.Errorf("actor key = %+v, %v, want the site's", actor.PublicKey, err)
+	}
+	if actor.ID != actorID || actor.Inbox != siteURL+inboxPath || actor.PreferredUsername != actorName {
+		t.Errorf("actor = %+v", actor)
+	}
+
+	var outbox struct {
+		TotalItems   int
+		OrderedItems []struct {
+			Type   string
+			Object activitypub.Object
+		}
+	}
+	if rec := getJSON(t, router, outboxPath, &outbox); rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d, want 200", outboxPath, rec.Code)
+	}
+	if outbox.TotalItems != 3 || len(outbox.OrderedItems) != 3 {
+		t.Fatalf("outbox = %+v, want the published entries", outbox)
+	}
+	if item := outbox.OrderedItems[0]; item.Type != "Create" || item.Object.ID != siteURL+"/entry/2018/third-post" ||
+		item.Object.Name != "Third Post" || item.Object.Published != "2018-03-14T04:00:00Z" {
+		t.Errorf("outbox[0] = %+v, want the third post", item)
+	}
+
+	var followers activitypub.OrderedCollection
+	if rec := getJSON(t, router, followersPath, &followers); rec.Code != http.StatusOK || followers.TotalItems != 1 {
+		t.Errorf("GET %s = %d %+v, want the accepted follower counted", followersPath, rec.Code, followers)
+	}
+}
+
+func TestInbox(t *testing.T) {
+	s := newTestServer(t, withFederation(t))
+	router := s.routes()
+	remote := newRemoteActor(t, &s.federationKey.PublicKey)
+	follow := activitypub.Activity{ID: remote.URL + "/follows/1", Type: "Follow", Actor: remote.id(), Object: actorID}
+
+	followers := func() map[string]string {
+		t.Helper()
+		followers, err := s.followerStore.GetFollowers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		inboxes := map[string]string{}
+		for _, f := range followers {
+			inboxes[f.Actor] = f.Inbox
+		}
+		return inboxes
+	}
+
+	unsigned := httptest.NewRecorder()
+	body, _ := json.Marshal(follow)
+	router.ServeHTTP(unsigned, httptest.NewRequest(http.MethodPost, siteURL+inboxPath, bytes.NewReader(body)))
+	if unsigned.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned follow = %d, want 401", unsigned.Code)
+	}
+	impostor := follow
+	impostor.Actor = "https://social.example/users/ann"
+	if rec := remote.post(t, router, impostor); rec.Code != http.StatusForbidden {
+		t.Errorf("follow signed by another actor = %d, want 403", rec.Code)
+	}
+	other := follow
+	other.Object = siteURL + "/someone"
+	if rec := remote.post(t, router, other); rec.Code != http.StatusBadRequest {
+		t.Errorf("follow of another actor = %d, want 400", rec.Code)
+	}
+	if rec := remote.post(t, router, activitypub.Activity{Type: "Delete", Actor: "https://gone.example/u"}); rec.Code != http.StatusAccepted {
+		t.Errorf("delete = %d, want 202", rec.Code)
+	}
+	if got := followers(); len(got) != 2 {
+		t.Fatalf("followers after rejected activities = %v, want only the fixtures", got)
+	}
+
+	if rec := remote.post(t, router, follow); rec.Code != http.StatusAccepted {
+		t.Fatalf("follow = %d %q, want 202", rec.Code, rec.Body.String())
+	}
+	if got := followers()[remote.id()]; got != remote.URL+"/shared" {
+		t.Errorf("follower inbox = %q, want the shared inbox", got)
+	}
+	if rec := remote.post(t, router, activitypub.Activity{ID: remote.URL + "/undo/1", Type: "Undo", Actor: remote.id(),
+		Object: follow}); rec.Code != http.StatusAccepted {
+		t.Fatalf("undo = %d %q, want 202", rec.Code, rec.Body.String())
+	}
+	if got := followers(); len(got) != 2 || got[remote.id()] != "" {
+		t.Errorf("followers after undo = %v, want the follower gone", got)
+	}
+}
+
+func TestFederateEntries(t *testing.T) {
+	s, raw := newTestServerDB(t, withFederation(t))
+	remote := newRemoteActor(t, &s.federationKey.PublicKey)
+	if _, err := raw.Exec(`UPDATE follower SET inbox = ?`, remote.URL+"/shared"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := s.acceptFollowers(ctx); err != nil {
+		t.Fatalf("acceptFollowers failed: %v", err)
+	}
+	if len(remote.delivered) != 1 || remote.delivered[0].Type != "Accept" || remote.delivered[0].ObjectID() != "https://other.example/follows/2" {
+		t.Fatalf("delivered %+v, want an Accept of the waiting follow", remote.delivered)
+	}
+	followers, err := s.followerStore.GetFollowers(ctx)
+	if err != nil || !followers[0].Accepted || !followers[1].Accepted {
+		t.Errorf("GetFollowers after accepting = %+v, %v, want all accepted", followers, err)
+	}
+
+	remote.delivered = nil
+	if err := s.federateEntries(ctx); err != nil {
+		t.Fatalf("federateEntries failed: %v", err)
+	}
+	// Both followers share the inbox, so each entry arrives once.
+	var got []string
+	for _, a := range remote.delivered {
+		got = append(got, a.Type+" "+a.ObjectID())
+	}
+	want := []string{"Update " + siteURL + "/entry/2017/first-post", "Create " + siteURL + "/entry/2018/third-post"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+
+	remote.delivered = nil
+	if err := s.federateEntries(ctx); err != nil || len(remote.delivered) != 0 {
+		t.Errorf("second federateEntries delivered %+v, %v, want nothing", remote.delivered, err)
+	}
+}
@@ -0,0 +1,198 @@
+// Package gallery describes the albums of photos kept as directories under
+// the resources directory, with the captions, dates and orientation found in
+// their EXIF data.
+package gallery
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	_ "golang.org/x/image/webp"
+)
+
+// ErrNotFound is returned for album names that aren't a directory of photos.
+var ErrNotFound = errors.New("gallery: no such album")
+
+// Photo is one image in an album.
+type Photo struct {
+	// File name within the album.
+	Name string
+	// Size in pixels as displayed, after any EXIF rotation.
+	Width  int
+	Height int
+	// The EXIF image description, or empty.
+	Caption string
+	// When the photo was taken according to EXIF, or zero if it doesn't say.
+	// EXIF has no time zone so this is in the server's.
+	Taken time.Time
+}
+
+// Album is a directory of photos.
+type Album struct {
+	Name string
+	// Oldest first. Photos without a date follow, by name.
+	Photos []Photo
+}
+
+// photoExts are the files considered photos. Anything else in an album
+// directory is ignored.
+var photoExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+
+// Library reads the albums under a directory. Photos are only read again
+// once they change.
+type Library struct {
+	root string
+
+	mu     sync.Mutex
+	photos map[string]cachedPhoto
+}
+
+type cachedPhoto struct {
+	size    int64
+	modTime time.Time
+	photo   Photo
+}
+
+// New returns a Library of the albums under root.
+func New(root string) *Library {
+	return &Library{root: root, photos: make(map[string]cachedPhoto)}
+}
+
+// Albums returns every album with at least one photo, by name.
+func (l *Library) Albums() ([]Album, error) {
+	entries, err := os.ReadDir(l.root)
+	if err != nil {
+		return nil, err
+	}
+	var albums []Album
+	for _, e := range entries {
+		if !e.IsDir() || !validName(e.Name()) {
+			continue
+		}
+		album, err := l.Album(e.Name())
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		albums = append(albums, album)
+	}
+	return albums, nil
+}
+
+// Album returns the album in the directory name directly under the root.
+func (l *Library) Album(name string) (Album, error) {
+	if !validName(name) {
+		return Album{}, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	dir := filepath.Join(l.root, name)
+	if info, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return Album{}, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return Album{}, err
+	}
+
+	album := Album{Name: name}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !photoExts[strings.ToLower(filepath.Ext(e.Name()))] {
+			continue
+		}
+		photo, ok, err := l.photo(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return Album{}, err
+		}
+		if ok {
+			album.Photos = append(album.Photos, photo)
+		}
+	}
+	if len(album.Photos) == 0 {
+		return Album{}, fmt.Errorf("%w: %q has no photos", ErrNotFound, name)
+	}
+	sort.SliceStable(album.Photos, func(i, j int) bool {
+		a, b := album.Photos[i], album.Photos[j]
+		if a.Taken.IsZero() != b.Taken.IsZero() {
+			return !a.Taken.IsZero()
+		}
+		if !a.Taken.Equal(b.Taken) {
+			return a.Taken.Before(b.Taken)
+		}
+		return a.Name < b.Name
+	})
+	return album, nil
+}
+
+// validName reports whether name is a single, visible path element.
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// photo describes the photo at path. ok is false if it isn't an image after all.
+func (l *Library) photo(path string) (photo Photo, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Photo{}, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Photo{}, false, err
+	}
+
+	l.mu.Lock()
+	cached, hit := l.photos[path]
+	l.mu.Unlock()
+	if hit && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.photo, true, nil
+	}
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return Photo{}, false, nil
+	}
+	photo = Photo{Name: filepath.Base(path), Width: config.Width, Height: config.Height}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Photo{}, false, err
+	}
+	if x, err := exif.Decode(f); err == nil {
+		describe(&photo, x)
+	}
+
+	l.mu.Lock()
+	l.photos[path] = cachedPhoto{size: info.Size(), modTime: info.ModTime(), photo: photo}
+	l.mu.Unlock()
+	return photo, true, nil
+}
+
+// describe fills in what x says about photo. Missing or malformed fields are
+// left alone; plenty of cameras write odd EXIF.
+func describe(photo *Photo, x *exif.Exif) {
+	if tag, err := x.Get(exif.ImageDescription); err == nil {
+		if s, err := tag.StringVal(); err == nil {
+			photo.Caption = strings.TrimSpace(strings.TrimRight(s, "\x00"))
+		}
+	}
+	if taken, err := x.DateTime(); err == nil {
+		photo.Taken = taken
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		// 5 through 8 are turned a quarter, so the stored sides are swapped.
+		if o, err := tag.Int(0); err == nil && o >= 5 && o <= 8 {
+			photo.Width, photo.Height = photo.Height, photo.Width
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package gallery
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAlbum(t *testing.T) {
+	l := New("testdata")
+
+	album, err := l.Album("album")
+	if err != nil {
+		t.Fatalf("Album failed: %v", err)
+	}
+	want := Album{
+		Name: "album",
+		Photos: []Photo{
+			{Name: "rotated.jpg", Width: 20, Height: 40, Taken: time.Date(2018, time.January, 2, 3, 4, 5, 0, time.Local)},
+			{Name: "dusk.jpg", Width: 40, Height: 20, Caption: "Dusk over the ridge", Taken: time.Date(2019, time.June, 1, 18, 30, 0, 0, time.Local)},
+			{Name: "plain.png", Width: 40, Height: 20},
+		},
+	}
+	if !reflect.DeepEqual(album, want) {
+		t.Errorf("Album = %+v, want %+v", album, want)
+	}
+
+	for _, name := range []string{"", "missing", "..", "../testdata", ".hidden", "album/dusk.jpg", "album/notes.txt"} {
+		if _, err := l.Album(name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Album(%q) error = %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestAlbums(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"b", "a", "empty", ".hidden"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile("testdata/album/plain.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/one.png", "b/two.png", ".hidden/three.png", "top.png"} {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "empty", "notes.txt"), []byte("no photos"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	albums, err := New(root).Albums()
+	if err != nil {
+		t.Fatalf("Albums failed: %v", err)
+	}
+	var names []string
+	for _, a := range albums {
+		names = append(names, a.Name)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Albums = %v, want %v", names, want)
+	}
+}
+
+func TestPhotoChanged(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "album"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "album", "photo.jpg")
+	copyFile := func(src string) {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := New(root)
+	copyFile("testdata/album/dusk.jpg")
+	if album, err := l.Album("album"); err != nil || album.Photos[0].Caption != "Dusk over the ridge" {
+		t.Fatalf("Album = %+v, %v", album, err)
+	}
+	copyFile("testdata/album/rotated.jpg")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if album, err := l.Album("album"); err != nil || album.Photos[0].Caption != "" || album.Photos[0].Width != 20 {
+		t.Errorf("Album after the photo changed = %+v, %v, want the new photo", album, err)
+	}
+}
@@ -0,0 +1,204 @@
+package imageproxy
+
+import (
+	"container/list"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryCache is an LRU of encoded images bounded by their total size.
+// Entries older than ttl are treated as missing.
+type memoryCache struct {
+	maxBytes int64
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	bytes int64
+	order *list.List // Of *memoryEntry, most recently used first.
+	items map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key   string
+	image cachedImage
+	added time.Time
+}
+
+func newMemoryCache(maxBytes int64, ttl time.Duration) *memoryCache {
+	return &memoryCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		now:      time.Now,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *memoryCache) get(key string) (cachedImage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return cachedImage{}, false
+	}
+	entry := el.Value.(*memoryEntry)
+	if c.ttl > 0 && c.now().Sub(entry.added) > c.ttl {
+		c.remove(el)
+		return cachedImage{}, false
+	}
+	c.order.MoveToFront(el)
+	return entry.image, true
+}
+
+func (c *memoryCache) add(key string, img cachedImage) {
+	size := int64(len(img.data))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.order.PushFront(&memoryEntry{key: key, image: img, added: c.now()})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops el. c.mu must be held.
+func (c *memoryCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*memoryEntry)
+	delete(c.items, entry.key)
+	c.bytes -= int64(len(entry.image.data))
+}
+
+// diskCache keeps encoded images as files under dir, sharded by the first two
+// characters of their key. When the files add up to more than maxBytes the
+// least recently used are deleted.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+}
+
+// newDiskCache creates dir if needed and counts what is already in it.
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &diskCache{dir: dir, maxBytes: maxBytes}
+	files, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		c.bytes += f.size
+	}
+	return c, nil
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+func (c *diskCache) get(key string) ([]byte, bool) {
+	p := c.path(key)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	// The modtime doubles as the last use for eviction.
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return data, true
+}
+
+func (c *diskCache) add(key string, data []byte) error {
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bytes += int64(len(data))
+	if c.bytes > c.maxBytes {
+		return c.evict()
+	}
+	return nil
+}
+
+type diskFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (c *diskCache) files() ([]diskFile, error) {
+	var files []diskFile
+	err := filepath.WalkDir(c.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Removed by a concurrent eviction.
+			return nil
+		}
+		files = append(files, diskFile{path: p, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// evict deletes the least recently used files until the cache is back to
+// three quarters of maxBytes, so it isn't walked again on every add. c.mu
+// must be held.
+func (c *diskCache) evict() error {
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	c.bytes = 0
+	for _, f := range files {
+		c.bytes += f.size
+	}
+	for _, f := range files {
+		if c.bytes <= c.maxBytes/4*3 {
+			break
+		}
+		if err := os.Remove(f.path); err == nil {
+			c.bytes -= f.size
+		}
+	}
+	return nil
+}
@@ -0,0 +1,498 @@
+// Package imageproxy serves images from a directory, resized and re-encoded
+// as requested in the query string. Originals are served with their location
+// and device metadata stripped. Results are cached in a bounded memory LRU
+// first and on disk second, keyed by a hash of the source file's contents so
+// an edited image is never served stale.
+package imageproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	// ErrNotFound is returned for names that aren't a file under the root.
+	ErrNotFound = errors.New("imageproxy: no such image")
+	// ErrBadOptions is returned for query parameters that can't be honored.
+	ErrBadOptions = errors.New("imageproxy: invalid options")
+	// ErrNotImage is returned when a transform is asked of something that
+	// can't be decoded as an image.
+	ErrNotImage = errors.New("imageproxy: not an image")
+)
+
+const (
+	// DefaultQuality is the JPEG quality used unless another is asked for.
+	DefaultQuality = 85
+	// Sources with more pixels than this are served as they are but never
+	// decoded to be resized or re-encoded.
+	maxSourcePixels = 50 << 20
+)
+
+// Only a few variants of each image can be asked for, so a client can't
+// make the proxy decode it over and over for widths no page uses.
+var (
+	// Widths are the widths images can be resized to, narrowest first.
+	Widths = []int{320, 640, 1024, 1600}
+	// Qualities are the JPEG qualities that can be asked for.
+	Qualities = []int{60, 75, DefaultQuality, 95}
+)
+
+// Options is a requested transform. The zero value serves the original,
+// stripped of metadata.
+type Options struct {
+	// Width in pixels, one of Widths, keeping the aspect ratio. 0 keeps
+	// the source width. Images are never enlarged.
+	Width int
+	// Format is "jpeg" or "png". Empty keeps the source format, except
+	// that formats which can't be encoded become PNG.
+	Format string
+	// Quality of JPEG output, one of Qualities. 0 means DefaultQuality.
+	Quality int
+}
+
+// ParseOptions reads the width, format and quality query parameters.
+func ParseOptions(q url.Values) (Options, error) {
+	opts := Options{Format: q.Get("format")}
+	if v := q.Get("width"); v != "" {
+		w, err := strconv.Atoi(v)
+		if err != nil || !allowed(Widths, w) {
+			return opts, fmt.Errorf("%w: width must be one of %v, got %q", ErrBadOptions, Widths, v)
+		}
+		opts.Width = w
+	}
+	switch opts.Format {
+	case "", "jpeg", "png":
+	case "jpg":
+		opts.Format = "jpeg"
+	default:
+		return opts, fmt.Errorf("%w: unsupported format %q", ErrBadOptions, opts.Format)
+	}
+	if v := q.Get("quality"); v != "" {
+		quality, err := strconv.Atoi(v)
+		if err != nil || !allowed(Qualities, quality) {
+			return opts, fmt.Errorf("%w: quality must be one of %v, got %q", ErrBadOptions, Qualities, v)
+		}
+		opts.Quality = quality
+	}
+	return opts, nil
+}
+
+func allowed(set []int, v int) bool {
+	for _, s := range set {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// IsZero reports whether opts asks for no transform at all.
+func (o Options) IsZero() bool {
+	return o == Options{}
+}
+
+// Config sizes the caches.
+type Config struct {
+	MemoryBytes int64
+	// Memory entries older than this are dropped. Zero keeps them until evicted.
+	MemoryTTL time.Duration
+	// CacheDir holds the disk tier. Empty disables it.
+	CacheDir  string
+	DiskBytes int64
+	// KeepMetadata serves originals byte for byte, EXIF and all.
+	KeepMetadata bool
+	// MaxDecodes is how many images may be decoded at once. Zero means one
+	// per CPU.
+	MaxDecodes int
+}
+
+// Proxy serves the images under a directory.
+type Proxy struct {
+	root         http.Dir
+	memory       *memoryCache
+	disk         *diskCache
+	keepMetadata bool
+
+	// Requests for an image already being made wait for it rather than
+	// making it again.
+	inflight singleflight.Group
+	// Holds a slot for each image being decoded.
+	decodes chan struct{}
+
+	// What has been learned about each source, kept until the file's size or
+	// modtime changes.
+	mu      sync.Mutex
+	sources map[string]source
+}
+
+type source struct {
+	size    int64
+	modTime time.Time
+	// Empty until the file is first transformed.
+	sum string
+	// Empty until first asked for. The size is as stored, before orientation.
+	format        string
+	width, height int
+	orientation   int
+}
+
+// displaySize is the size of the image once turned the way its orientation says.
+func (s source) displaySize() (width, height int) {
+	if s.orientation >= 5 {
+		return s.height, s.width
+	}
+	return s.width, s.height
+}
+
+// cachedImage is an encoded transform.
+type cachedImage struct {
+	data        []byte
+	contentType string
+}
+
+// New returns a Proxy for the images under root.
+func New(root string, cfg Config) (*Proxy, error) {
+	if cfg.MaxDecodes <= 0 {
+		cfg.MaxDecodes = runtime.NumCPU()
+	}
+	p := &Proxy{
+		root:         http.Dir(root),
+		memory:       newMemoryCache(cfg.MemoryBytes, cfg.MemoryTTL),
+		keepMetadata: cfg.KeepMetadata,
+		decodes:      make(chan struct{}, cfg.MaxDecodes),
+		sources:      make(map[string]source),
+	}
+	if cfg.CacheDir != "" {
+		disk, err := newDiskCache(cfg.CacheDir, cfg.DiskBytes)
+		if err != nil {
+			return nil, fmt.Errorf("imageproxy: unable to use cache directory: %v", err)
+		}
+		p.disk = disk
+	}
+	return p, nil
+}
+
+// Serve writes the image at name, a slash separated path under the root,
+// transformed by the options in r's query string.
+func (p *Proxy) Serve(w http.ResponseWriter, r *http.Request, name string) error {
+	f, info, err := p.open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	opts, err := ParseOptions(r.URL.Query())
+	if err != nil {
+		return err
+	}
+	if opts.IsZero() && p.keepMetadata {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return nil
+	}
+
+	src, err := p.describe(name, f, info)
+	if errors.Is(err, ErrNotImage) && opts.IsZero() {
+		// Files that aren't images have no EXIF to strip. Ones that only
+		// look like images are refused rather than served with theirs.
+		if sniffed, serr := sniffImage(f); serr != nil || sniffed {
+			return err
+		}
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if opts.IsZero() && !strippable[src.format] {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return nil
+	}
+	// Stripping the original works on its bytes; only transforms decode it.
+	if !opts.IsZero() && src.width*src.height > maxSourcePixels {
+		return fmt.Errorf("%w: %s is %dx%d", ErrNotImage, name, src.width, src.height)
+	}
+
+	sum, err := p.sourceSum(name, f, info)
+	if err != nil {
+		return err
+	}
+	render := func() ([]byte, error) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		p.decodes <- struct{}{}
+		defer func() { <-p.decodes }()
+		return transform(f, opts, src.orientation)
+	}
+	contentType := "image/" + src.format
+	if opts.IsZero() {
+		render = func() ([]byte, error) {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(f)
+			if err != nil {
+				return nil, err
+			}
+			return strip(data, src.format)
+		}
+	} else {
+		opts = opts.resolve(src.format)
+		contentType = "image/" + opts.Format
+	}
+	// Resolved options always have a format, so the zero options key the
+	// stripped original.
+	key := cacheKey(sum, opts)
+	img, err := p.cached(key, contentType, render)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	w.Header().Set("Content-Type", img.contentType)
+	w.Header().Set("ETag", `"`+key+`"`)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(img.data))
+	return nil
+}
+
+// Size returns the width and height in pixels of the image at name, as
+// shown after any EXIF orientation is applied.
+func (p *Proxy) Size(name string) (width, height int, err error) {
+	f, info, err := p.open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	src, err := p.describe(name, f, info)
+	if err != nil {
+		return 0, 0, err
+	}
+	width, height = src.displaySize()
+	return width, height, nil
+}
+
+// describe returns the format, size and orientation of the image in f,
+// reading them only if it changed since they were last read.
+func (p *Proxy) describe(name string, f http.File, info os.FileInfo) (source, error) {
+	if src, ok := p.source(name, info); ok && src.format != "" {
+		return src, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return source{}, err
+	}
+	config, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return source{}, fmt.Errorf("%w: %s: %v", ErrNotImage, name, err)
+	}
+	o := orientation(decodeExif(f, format))
+	var described source
+	p.update(name, info, func(src *source) {
+		src.format, src.width, src.height, src.orientation = format, config.Width, config.Height, o
+		described = *src
+	})
+	return described, nil
+}
+
+// sniffImage reports whether f starts like one of the formats strip cleans.
+func sniffImage(f http.File) (bool, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	switch http.DetectContentType(head[:n]) {
+	case "image/jpeg", "image/png", "image/webp":
+		return true, nil
+	}
+	return false, nil
+}
+
+// open opens the file at name, which must not be a directory.
+func (p *Proxy) open(name string) (http.File, os.FileInfo, error) {
+	f, err := p.root.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, nil, fmt.Errorf("%w: %s is a directory", ErrNotFound, name)
+	}
+	return f, info, nil
+}
+
+// source returns what is known about name if it hasn't changed since.
+func (p *Proxy) source(name string, info os.FileInfo) (source, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	src, ok := p.sources[name]
+	if !ok || src.size != info.Size() || !src.modTime.Equal(info.ModTime()) {
+		return source{}, false
+	}
+	return src, true
+}
+
+// update records something learned about name, forgetting what was known
+// about earlier versions of it.
+func (p *Proxy) update(name string, info os.FileInfo, f func(*source)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	src, ok := p.sources[name]
+	if !ok || src.size != info.Size() || !src.modTime.Equal(info.ModTime()) {
+		src = source{size: info.Size(), modTime: info.ModTime()}
+	}
+	f(&src)
+	p.sources[name] = src
+}
+
+// resolve fills in the defaults for a source image in format.
+func (o Options) resolve(format string) Options {
+	if o.Format == "" {
+		o.Format = format
+		if format != "jpeg" && format != "png" {
+			o.Format = "png"
+		}
+	}
+	if o.Format == "jpeg" && o.Quality == 0 {
+		o.Quality = DefaultQuality
+	}
+	if o.Format == "png" {
+		o.Quality = 0
+	}
+	return o
+}
+
+func cacheKey(sum string, opts Options) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%s|%d", sum, opts.Width, opts.Format, opts.Quality)))
+	return hex.EncodeToString(h[:])
+}
+
+// cached returns the image for key from the memory tier, then the disk tier,
+// and otherwise renders it and stores it in both. Concurrent calls for the
+// same key share one render.
+func (p *Proxy) cached(key, contentType string, render func() ([]byte, error)) (cachedImage, error) {
+	if img, ok := p.memory.get(key); ok {
+		return img, nil
+	}
+	v, err, _ := p.inflight.Do(key, func() (interface{}, error) {
+		return p.load(key, contentType, render)
+	})
+	if err != nil {
+		return cachedImage{}, err
+	}
+	return v.(cachedImage), nil
+}
+
+// load is cached past the memory tier.
+func (p *Proxy) load(key, contentType string, render func() ([]byte, error)) (cachedImage, error) {
+	img := cachedImage{contentType: contentType}
+	if p.disk != nil {
+		if data, ok := p.disk.get(key); ok {
+			img.data = data
+			p.memory.add(key, img)
+			return img, nil
+		}
+	}
+
+	data, err := render()
+	if err != nil {
+		return cachedImage{}, err
+	}
+	img.data = data
+	p.memory.add(key, img)
+	if p.disk != nil {
+		if err := p.disk.add(key, data); err != nil {
+			// Still servable; it'll just be made again next time.
+			log.Printf("imageproxy: unable to write disk cache: %v", err)
+		}
+	}
+	return img, nil
+}
+
+// sourceSum returns the hex SHA-256 of f, hashing it only if it changed
+// since it was last seen.
+func (p *Proxy) sourceSum(name string, f http.File, info os.FileInfo) (string, error) {
+	if src, ok := p.source(name, info); ok && src.sum != "" {
+		return src.sum, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	p.update(name, info, func(src *source) { src.sum = sum })
+	return sum, nil
+}
+
+// transform decodes the image in r, turns it the way its EXIF orientation o
+// says, scales it down to opts.Width and encodes it as opts.Format. The
+// encoders write no metadata, hence turning it here.
+func transform(r io.Reader, opts Options, o int) ([]byte, error) {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotImage, err)
+	}
+	src = orient(src, o)
+
+	img := src
+	if b := src.Bounds(); opts.Width != 0 && opts.Width < b.Dx() {
+		height := (b.Dy()*opts.Width + b.Dx()/2) / b.Dx()
+		if height < 1 {
+			height = 1
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, opts.Width, height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+		img = dst
+	}
+
+	var buf bytes.Buffer
+	switch opts.Format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: opts.Quality})
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,615 @@
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+	"golang.org/x/image/webp"
+)
+
+// writePNG writes a w by h PNG of a single color to dir/name.
+func writePNG(t *testing.T, dir, name string, w, h int, c color.Color) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, p *Proxy, name, query string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/"+name+"?"+query, nil)
+	rec := httptest.NewRecorder()
+	return rec, p.Serve(rec, req, name)
+}
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    Options
+		wantErr bool
+	}{
+		{query: "", want: Options{}},
+		{query: "width=640&format=png", want: Options{Width: 640, Format: "png"}},
+		{query: "format=jpg&quality=60", want: Options{Format: "jpeg", Quality: 60}},
+		{query: "width=0", wantErr: true},
+		{query: "width=200", wantErr: true},
+		{query: "width=4096", wantErr: true},
+		{query: "width=abc", wantErr: true},
+		{query: "format=bmp", wantErr: true},
+		{query: "quality=61", wantErr: true},
+		{query: "quality=101", wantErr: true},
+	}
+	for _, tc := range tests {
+		q, _ := url.ParseQuery(tc.query)
+		got, err := ParseOptions(q)
+		if tc.wantErr {
+			if !errors.Is(err, ErrBadOptions) {
+				t.Errorf("ParseOptions(%q) error = %v, want ErrBadOptions", tc.query, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("ParseOptions(%q) = %+v, %v, want %+v", tc.query, got, err, tc.want)
+		}
+	}
+}
+
+func TestServeHuge(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Claim to be 8000x8000 in the frame header, which is all that is read
+	// before deciding whether to decode.
+	data := buf.Bytes()
+	sof := bytes.Index(data, []byte{0xff, 0xc0})
+	binary.BigEndian.PutUint16(data[sof+5:], 8000)
+	binary.BigEndian.PutUint16(data[sof+7:], 8000)
+	if err := os.WriteFile(filepath.Join(dir, "huge.jpg"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(dir, Config{MemoryBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := get(t, p, "huge.jpg", "")
+	if err != nil || rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Serve of the original = %d %v, %v, want it served", rec.Code, rec.Header(), err)
+	}
+	if _, err := get(t, p, "huge.jpg", "width=320"); !errors.Is(err, ErrNotImage) {
+		t.Errorf("Serve resized error = %v, want %v", err, ErrNotImage)
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, dir, "wide.png", 800, 400, color.White)
+	if err := os.WriteFile(filepath.Join(dir, "note.txt"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(dir, Config{MemoryBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := get(t, p, "wide.png", "width=320&format=jpeg")
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("Content-Type = %q, want image/jpeg", ct)
+	}
+	img, err := jpeg.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("response is not a JPEG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 320 || b.Dy() != 160 {
+		t.Errorf("resized to %dx%d, want 320x160", b.Dx(), b.Dy())
+	}
+
+	// Never enlarged, and the source format is kept.
+	rec, err = get(t, p, "wide.png", "width=1024")
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	img, err = png.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("response is not a PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 800 {
+		t.Errorf("width = %d, want the original 800", b.Dx())
+	}
+
+	// No options serves the file untouched, images or not.
+	rec, err = get(t, p, "note.txt", "")
+	if err != nil || rec.Body.String() != "not an image" {
+		t.Errorf("Serve(note.txt) = %q, %v, want the file", rec.Body.String(), err)
+	}
+
+	if _, err := get(t, p, "note.txt", "width=320"); !errors.Is(err, ErrNotImage) {
+		t.Errorf("resizing a text file: error = %v, want ErrNotImage", err)
+	}
+	if _, err := get(t, p, "missing.png", "width=320"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing file: error = %v, want ErrNotFound", err)
+	}
+	writePNG(t, filepath.Dir(dir), "outside.png", 10, 10, color.White)
+	if _, err := get(t, p, "../outside.png", "width=320"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("escaping the root: error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSize(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, dir, "photo.png", 30, 20, color.White)
+	p, err := New(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h, err := p.Size("photo.png"); err != nil || w != 30 || h != 20 {
+		t.Errorf("Size = %d, %d, %v, want 30, 20", w, h, err)
+	}
+
+	writePNG(t, dir, "photo.png", 60, 10, color.White)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "photo.png"), later, later)
+	if w, h, err := p.Size("photo.png"); err != nil || w != 60 || h != 10 {
+		t.Errorf("Size after a change = %d, %d, %v, want 60, 10", w, h, err)
+	}
+	if _, _, err := p.Size("missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Size of a missing file: error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestServeSourceChanged(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, dir, "photo.png", 400, 400, color.White)
+	p, err := New(dir, Config{MemoryBytes: 1 << 20, CacheDir: t.TempDir(), DiskBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := get(t, p, "photo.png", "width=320")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := get(t, p, "photo.png", "width=320")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Header().Get("ETag") != again.Header().Get("ETag") || !bytes.Equal(first.Body.Bytes(), again.Body.Bytes()) {
+		t.Error("the same request served different images")
+	}
+
+	writePNG(t, dir, "photo.png", 400, 200, color.Black)
+	// Make sure the modtime moves even on coarse filesystems.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "photo.png"), later, later)
+	changed, err := get(t, p, "photo.png", "width=320")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Header().Get("ETag") == first.Header().Get("ETag") {
+		t.Error("ETag unchanged after the source changed")
+	}
+	img, err := png.Decode(changed.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dy() != 160 {
+		t.Errorf("height = %d, want 160 from the new source", b.Dy())
+	}
+}
+
+func TestServeFromDisk(t *testing.T) {
+	dir, cacheDir := t.TempDir(), t.TempDir()
+	writePNG(t, dir, "photo.png", 400, 400, color.White)
+	p, err := New(dir, Config{MemoryBytes: 1 << 20, CacheDir: cacheDir, DiskBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := get(t, p, "photo.png", "width=320")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh proxy has an empty memory tier but the same disk tier.
+	p, err = New(dir, Config{MemoryBytes: 1 << 20, CacheDir: cacheDir, DiskBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := want.Header().Get("ETag")
+	key = key[1 : len(key)-1]
+	if _, ok := p.disk.get(key); !ok {
+		t.Fatal("rendered image was not written to disk")
+	}
+	got, err := get(t, p, "photo.png", "width=320")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Body.Bytes(), want.Body.Bytes()) || got.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("disk hit served %d bytes of %q, want the %d cached bytes", got.Body.Len(), got.Header().Get("Content-Type"), want.Body.Len())
+	}
+	if _, ok := p.memory.get(key); !ok {
+		t.Error("disk hit was not promoted to memory")
+	}
+}
+
+func TestCachedSharesRenders(t *testing.T) {
+	p, err := New(t.TempDir(), Config{MemoryBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	var renders int32
+	render := func() ([]byte, error) {
+		atomic.AddInt32(&renders, 1)
+		<-release
+		return []byte("image"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if img, err := p.cached("key", "image/png", render); err != nil || string(img.data) != "image" {
+				t.Errorf("cached = %q, %v, want the rendered image", img.data, err)
+			}
+		}()
+	}
+	// Let the callers pile up behind the first render.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if renders != 1 {
+		t.Errorf("rendered %d times, want once", renders)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	c := newMemoryCache(10, time.Hour)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time { return now }
+
+	c.add("a", cachedImage{data: []byte("aaaa")})
+	c.add("b", cachedImage{data: []byte("bbbb")})
+	c.get("a") // b is now the least recently used.
+	c.add("c", cachedImage{data: []byte("cccc")})
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("recently used entry was evicted")
+	}
+	if c.bytes != 8 {
+		t.Errorf("bytes = %d, want 8", c.bytes)
+	}
+
+	c.add("big", cachedImage{data: make([]byte, 11)})
+	if _, ok := c.get("big"); ok {
+		t.Error("entry larger than the cache was kept")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, ok := c.get("a"); ok {
+		t.Error("expired entry was served")
+	}
+	if c.bytes != 4 {
+		t.Errorf("bytes after expiry = %d, want 4", c.bytes)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	c, err := newDiskCache(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for i, key := range []string{"aa1", "bb2", "cc3"} {
+		if err := c.add(key, make([]byte, 30)); err != nil {
+			t.Fatal(err)
+		}
+		// Oldest first, a minute apart.
+		at := old.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(c.path(key), at, at)
+	}
+	if _, ok := c.get("aa1"); !ok {
+		t.Fatal("aa1 missing before the cache was full")
+	}
+	// aa1 was just used, so bb2 then cc3 are the oldest.
+	if err := c.add("dd4", make([]byte, 30)); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"aa1": true, "bb2": false, "cc3": false, "dd4": true} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("after eviction, %s cached = %t, want %t", key, ok, want)
+		}
+	}
+	if c.bytes > 75 {
+		t.Errorf("bytes = %d, want at most 75", c.bytes)
+	}
+}
+
+// checkStripped fails unless x, the EXIF of data, has only the kept fields
+// with the values testdata/dusk.jpg has for them.
+func checkStripped(t *testing.T, data []byte, x *exif.Exif) {
+	t.Helper()
+	if x == nil {
+		t.Fatal("no EXIF left, want the capture date and orientation")
+	}
+	x.Walk(walkFunc(func(name exif.FieldName, _ *tiff.Tag) error {
+		if name != exif.Orientation && name != exif.DateTimeOriginal && name != exif.ExifIFDPointer {
+			t.Errorf("%s was served", name)
+		}
+		return nil
+	}))
+	// The camera's serial number, which goexif doesn't know the tag of.
+	if bytes.Contains(data, []byte("1234567")) {
+		t.Error("serial number was served")
+	}
+	if tag, err := x.Get(exif.DateTimeOriginal); err != nil {
+		t.Errorf("capture date stripped: %v", err)
+	} else if s, _ := tag.StringVal(); s != "2019:06:01 18:30:00" {
+		t.Errorf("capture date = %q, want 2019:06:01 18:30:00", s)
+	}
+	if o := orientation(x); o != 1 {
+		t.Errorf("orientation = %d, want 1", o)
+	}
+}
+
+type walkFunc func(exif.FieldName, *tiff.Tag) error
+
+func (f walkFunc) Walk(name exif.FieldName, tag *tiff.Tag) error { return f(name, tag) }
+
+func TestServeStripsMetadata(t *testing.T) {
+	original, err := os.ReadFile("testdata/dusk.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New("testdata", Config{MemoryBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := get(t, p, "dusk.jpg", "")
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("Content-Type = %q, want image/jpeg", ct)
+	}
+	x, err := exif.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("served JPEG has no readable EXIF: %v", err)
+	}
+	checkStripped(t, rec.Body.Bytes(), x)
+
+	// The image itself is copied, not re-encoded.
+	want, err := jpeg.Decode(bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := jpeg.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("served file is not a JPEG: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Error("stripping changed the image")
+	}
+
+	keep, err := New("testdata", Config{KeepMetadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := get(t, keep, "dusk.jpg", ""); err != nil || !bytes.Equal(rec.Body.Bytes(), original) {
+		t.Errorf("Serve with KeepMetadata = %d bytes, %v, want the original %d", rec.Body.Len(), err, len(original))
+	}
+
+	// Something that looks like a JPEG but can't be parsed isn't served at all.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "broken.jpg"), original[:len(original)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	broken, err := New(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(t, broken, "broken.jpg", ""); !errors.Is(err, ErrNotImage) {
+		t.Errorf("Serve(broken.jpg) error = %v, want ErrNotImage", err)
+	}
+}
+
+// duskExif is the TIFF structure of testdata/dusk.jpg's EXIF.
+func duskExif(t *testing.T) []byte {
+	t.Helper()
+	f, err := os.Open("testdata/dusk.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x.Raw
+}
+
+func TestStripPNG(t *testing.T) {
+	var plain bytes.Buffer
+	if err := png.Encode(&plain, image.NewGray(image.Rect(0, 0, 4, 2))); err != nil {
+		t.Fatal(err)
+	}
+	// Insert the metadata after IHDR, which is always 25 bytes.
+	in := append([]byte(nil), plain.Bytes()[:8+25]...)
+	in = appendPNGChunk(in, "eXIf", duskExif(t))
+	in = appendPNGChunk(in, "tEXt", []byte("Comment\x00at the cabin"))
+	in = appendPNGChunk(in, "iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))
+	in = append(in, plain.Bytes()[8+25:]...)
+
+	out, err := strip(in, "png")
+	if err != nil {
+		t.Fatalf("strip failed: %v", err)
+	}
+	var types []string
+	if err := pngChunks(out, func(typ string, _, _ []byte) { types = append(types, typ) }); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"IHDR", "eXIf", "IDAT", "IEND"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("chunks = %v, want %v", types, want)
+	}
+	raw, _ := pngExif(out)
+	checkStripped(t, out, parseExif(raw))
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped PNG doesn't decode: %v", err)
+	}
+}
+
+func TestStripWebP(t *testing.T) {
+	simple, err := os.ReadFile("testdata/simple.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := webp.DecodeConfig(bytes.NewReader(simple))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(fourcc string, body []byte) []byte {
+		out := append([]byte(fourcc), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(out[4:], uint32(len(body)))
+		out = append(out, body...)
+		if len(body)%2 == 1 {
+			out = append(out, 0)
+		}
+		return out
+	}
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpExifFlag | webpXMPFlag
+	vp8x[4], vp8x[5] = byte(config.Width-1), byte((config.Width-1)>>8)
+	vp8x[7], vp8x[8] = byte(config.Height-1), byte((config.Height-1)>>8)
+	body := append([]byte("WEBP"), chunk("VP8X", vp8x)...)
+	body = append(body, simple[12:]...)
+	body = append(body, chunk("EXIF", duskExif(t))...)
+	body = append(body, chunk("XMP ", []byte("<x:xmpmeta/>"))...)
+	in := append([]byte("RIFF\x00\x00\x00\x00"), body...)
+	binary.LittleEndian.PutUint32(in[4:], uint32(len(body)))
+
+	out, err := strip(in, "webp")
+	if err != nil {
+		t.Fatalf("strip failed: %v", err)
+	}
+	var fourccs []string
+	if err := webpChunks(out, func(fourcc string, _ []byte) { fourccs = append(fourccs, fourcc) }); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"VP8X", "VP8L", "EXIF"}; !reflect.DeepEqual(fourccs, want) {
+		t.Errorf("chunks = %v, want %v", fourccs, want)
+	}
+	if flags := out[20]; flags != webpExifFlag {
+		t.Errorf("VP8X flags = %#x, want only EXIF", flags)
+	}
+	if size := binary.LittleEndian.Uint32(out[4:]); int(size) != len(out)-8 {
+		t.Errorf("RIFF size = %d, want %d", size, len(out)-8)
+	}
+	raw, _ := webpExif(out)
+	checkStripped(t, out, parseExif(raw))
+	if _, err := webp.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped WebP doesn't decode: %v", err)
+	}
+
+	// Simple files are left alone.
+	if out, err := strip(simple, "webp"); err != nil || !bytes.Equal(out, simple) {
+		t.Errorf("strip(simple) = %d bytes, %v, want it unchanged", len(out), err)
+	}
+}
+
+func TestServeOrientation(t *testing.T) {
+	p, err := New("testdata", Config{MemoryBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// testdata/rotated.jpg is stored 40x20 and tagged to be turned a quarter.
+	if w, h, err := p.Size("rotated.jpg"); err != nil || w != 20 || h != 40 {
+		t.Errorf("Size = %d, %d, %v, want 20, 40", w, h, err)
+	}
+
+	// Converted images carry no EXIF so are turned before they're encoded.
+	rec, err := get(t, p, "rotated.jpg", "format=png")
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Errorf("converted to %dx%d, want 20x40", b.Dx(), b.Dy())
+	}
+
+	// Originals keep the tag for the browser to apply.
+	rec, err = get(t, p, "rotated.jpg", "")
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	x, err := exif.Decode(rec.Body)
+	if err != nil || orientation(x) != 6 {
+		t.Errorf("served orientation = %d, %v, want 6", orientation(x), err)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// A 3x2 image with its top left pixel marked, and where each
+	// orientation moves that pixel.
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	src.SetGray(0, 0, color.Gray{Y: 255})
+	tests := []struct {
+		o          int
+		x, y, w, h int
+	}{
+		{1, 0, 0, 3, 2},
+		{2, 2, 0, 3, 2},
+		{3, 2, 1, 3, 2},
+		{4, 0, 1, 3, 2},
+		{5, 0, 0, 2, 3},
+		{6, 1, 0, 2, 3},
+		{7, 1, 2, 2, 3},
+		{8, 0, 2, 2, 3},
+	}
+	for _, tc := range tests {
+		img := orient(src, tc.o)
+		if b := img.Bounds(); b.Dx() != tc.w || b.Dy() != tc.h {
+			t.Errorf("orient(%d) is %dx%d, want %dx%d", tc.o, b.Dx(), b.Dy(), tc.w, tc.h)
+			continue
+		}
+		if r, _, _, _ := img.At(tc.x, tc.y).RGBA(); r != 0xffff {
+			t.Errorf("orient(%d) moved the marked pixel away from (%d, %d)", tc.o, tc.x, tc.y)
+		}
+	}
+}
@@ -0,0 +1,506 @@
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"sort"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Photos are served without their metadata: EXIF records where a photo was
+// taken and the serial number of the camera that took it, and XMP and IPTC
+// can carry the same and more. Only the EXIF fields below survive, rewritten
+// into a fresh EXIF block. Everything else that isn't needed to show the
+// image, comments included, is dropped. Color profiles are kept.
+//
+// The segments and chunks that make up the file are copied rather than the
+// image being re-encoded, so originals keep their quality. JPEG, PNG and
+// WebP are stripped; GIF has no EXIF and is served as is.
+
+// EXIF tag numbers.
+const (
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+// keptFields are the EXIF fields left in served images: which way up the
+// photo goes and when it was taken.
+var keptFields = []struct {
+	name exif.FieldName
+	tag  uint16
+	// Whether the field lives in the Exif sub-IFD rather than IFD0.
+	exifIFD bool
+}{
+	{exif.Orientation, tagOrientation, false},
+	{exif.DateTimeOriginal, tagDateTimeOriginal, true},
+}
+
+// TIFF field types used by the kept fields.
+const (
+	typeASCII = 2
+	typeShort = 3
+	typeLong  = 4
+)
+
+// strippable are the formats strip knows how to clean.
+var strippable = map[string]bool{"jpeg": true, "png": true, "webp": true}
+
+// strip returns data, an image in format, without metadata other than the
+// keptFields.
+func strip(data []byte, format string) ([]byte, error) {
+	var out []byte
+	var err error
+	switch format {
+	case "jpeg":
+		out, err = stripJPEG(data)
+	case "png":
+		out, err = stripPNG(data)
+	case "webp":
+		out, err = stripWebP(data)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to strip metadata: %v", ErrNotImage, err)
+	}
+	return out, nil
+}
+
+// decodeExif returns the EXIF data of the image in r, or nil if it has none
+// that can be read.
+func decodeExif(r io.ReadSeeker, format string) *exif.Exif {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	if format == "jpeg" {
+		x, err := exif.Decode(r)
+		if err != nil {
+			return nil
+		}
+		return x
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil
+	}
+	var raw []byte
+	switch format {
+	case "png":
+		raw, _ = pngExif(data)
+	case "webp":
+		raw, _ = webpExif(data)
+	}
+	return parseExif(raw)
+}
+
+// parseExif parses a TIFF structure, optionally preceded by the "Exif\0\0"
+// header, or returns nil.
+func parseExif(raw []byte) *exif.Exif {
+	if len(raw) == 0 {
+		return nil
+	}
+	x, err := exif.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	return x
+}
+
+// orientation is the EXIF orientation of a photo, from 1 to 8, or 1 if it
+// doesn't say.
+func orientation(x *exif.Exif) int {
+	if x == nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// orient turns img the way orientation o says it should be shown.
+func orient(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if o >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // Mirrored.
+				dx, dy = w-1-x, y
+			case 3: // Upside down.
+				dx, dy = w-1-x, h-1-y
+			case 4: // Upside down and mirrored.
+				dx, dy = x, h-1-y
+			case 5: // Mirrored along the diagonal.
+				dx, dy = y, x
+			case 6: // A quarter turn clockwise.
+				dx, dy = h-1-y, x
+			case 7: // Mirrored along the other diagonal.
+				dx, dy = h-1-y, w-1-x
+			case 8: // A quarter turn counterclockwise.
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// The value, little-endian.
+	data []byte
+}
+
+// keptExif returns a little-endian TIFF structure holding only the
+// keptFields of x, or nil if x has none of them.
+func keptExif(x *exif.Exif) []byte {
+	if x == nil {
+		return nil
+	}
+	var ifd0, sub []tiffField
+	for _, k := range keptFields {
+		tag, err := x.Get(k.name)
+		if err != nil {
+			continue
+		}
+		var f tiffField
+		switch k.tag {
+		case tagOrientation:
+			o, err := tag.Int(0)
+			if err != nil || o < 1 || o > 8 {
+				continue
+			}
+			f = tiffField{tag: k.tag, typ: typeShort, count: 1, data: binary.LittleEndian.AppendUint16(nil, uint16(o))}
+		default:
+			s, err := tag.StringVal()
+			if err != nil {
+				continue
+			}
+			s = string(bytes.TrimRight([]byte(s), "\x00"))
+			f = tiffField{tag: k.tag, typ: typeASCII, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+		}
+		if k.exifIFD {
+			sub = append(sub, f)
+		} else {
+			ifd0 = append(ifd0, f)
+		}
+	}
+	if len(ifd0) == 0 && len(sub) == 0 {
+		return nil
+	}
+
+	out := []byte("II*\x00\x08\x00\x00\x00")
+	if len(sub) > 0 {
+		ifd0 = append(ifd0, tiffField{tag: tagExifIFD, typ: typeLong, count: 1})
+	}
+	sort.Slice(ifd0, func(i, j int) bool { return ifd0[i].tag < ifd0[j].tag })
+	if len(sub) > 0 {
+		// The sub-IFD follows IFD0, whose size doesn't depend on where it is.
+		subOffset := len(out) + len(appendIFD(nil, ifd0, 0))
+		for i := range ifd0 {
+			if ifd0[i].tag == tagExifIFD {
+				ifd0[i].data = binary.LittleEndian.AppendUint32(nil, uint32(subOffset))
+			}
+		}
+	}
+	out = appendIFD(out, ifd0, len(out))
+	if len(sub) > 0 {
+		out = appendIFD(out, sub, len(out))
+	}
+	return out
+}
+
+// appendIFD appends an IFD of fields, with any values too big to fit in an
+// entry after it, to out. offset is where in the TIFF structure it starts.
+func appendIFD(out []byte, fields []tiffField, offset int) []byte {
+	le := binary.LittleEndian
+	next := offset + 2 + 12*len(fields) + 4
+	var values []byte
+	out = le.AppendUint16(out, uint16(len(fields)))
+	for _, f := range fields {
+		out = le.AppendUint16(out, f.tag)
+		out = le.AppendUint16(out, f.typ)
+		out = le.AppendUint32(out, f.count)
+		if len(f.data) <= 4 {
+			out = append(out, f.data...)
+			out = append(out, make([]byte, 4-len(f.data))...)
+			continue
+		}
+		out = le.AppendUint32(out, uint32(next+len(values)))
+		values = append(values, f.data...)
+		// Values start on word boundaries.
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	out = le.AppendUint32(out, 0)
+	return append(out, values...)
+}
+
+// stripJPEG drops every APPn segment but JFIF, ICC profiles and Adobe's
+// color transform, along with comments and anything after the end of the
+// image, then adds back the kept EXIF fields.
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("missing JPEG start of image")
+	}
+	var x *exif.Exif
+	var segments []byte
+	i := 2
+	for {
+		// Markers may be padded with any number of 0xff.
+		if i >= len(data) || data[i] != 0xff {
+			return nil, errors.New("JPEG marker expected")
+		}
+		for i < len(data) && data[i] == 0xff {
+			i++
+		}
+		if i >= len(data) {
+			return nil, errors.New("truncated JPEG")
+		}
+		marker := data[i]
+		i++
+		if marker == 0xd9 {
+			break
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			// Standalone markers have no length.
+			segments = append(segments, 0xff, marker)
+			continue
+		}
+		if i+2 > len(data) {
+			return nil, errors.New("truncated JPEG")
+		}
+		end := i + int(binary.BigEndian.Uint16(data[i:]))
+		if end > len(data) || end < i+2 {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		payload := data[i+2 : end]
+		segment := data[i-2 : end]
+		i = end
+
+		switch {
+		case marker == 0xe1:
+			if bytes.HasPrefix(payload, []byte("Exif\x00\x00")) && x == nil {
+				x = parseExif(payload)
+			}
+			continue
+		case marker == 0xe2 && !bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+			continue
+		case marker >= 0xe0 && marker <= 0xef && marker != 0xe0 && marker != 0xe2 && marker != 0xee:
+			continue
+		case marker == 0xfe:
+			continue
+		}
+		segments = append(segments, segment...)
+
+		if marker == 0xda {
+			// Entropy-coded data runs to the next marker that isn't a
+			// stuffed 0xff00 or a restart.
+			j := i
+			for ; j+1 < len(data); j++ {
+				if data[j] == 0xff && data[j+1] != 0 && data[j+1] != 0xff && (data[j+1] < 0xd0 || data[j+1] > 0xd7) {
+					break
+				}
+			}
+			if j+1 >= len(data) {
+				return nil, errors.New("truncated JPEG scan")
+			}
+			segments = append(segments, data[i:j]...)
+			i = j
+		}
+	}
+
+	out := []byte{0xff, 0xd8}
+	// EXIF goes right after the JFIF header, if there is one.
+	if bytes.HasPrefix(segments, []byte{0xff, 0xe0}) {
+		n := 2 + int(binary.BigEndian.Uint16(segments[2:]))
+		out = append(out, segments[:n]...)
+		segments = segments[n:]
+	}
+	if kept := keptExif(x); kept != nil {
+		out = append(out, 0xff, 0xe1)
+		out = binary.BigEndian.AppendUint16(out, uint16(2+6+len(kept)))
+		out = append(out, "Exif\x00\x00"...)
+		out = append(out, kept...)
+	}
+	out = append(out, segments...)
+	return append(out, 0xff, 0xd9), nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// droppedPNGChunks hold metadata: EXIF, text including XMP, and the
+// modification time.
+var droppedPNGChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+// pngChunks calls f with the type and data of each chunk in a PNG.
+func pngChunks(data []byte, f func(typ string, chunk, body []byte)) error {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return errors.New("missing PNG signature")
+	}
+	for i := len(pngSignature); i < len(data); {
+		if i+8 > len(data) {
+			return errors.New("truncated PNG chunk")
+		}
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + n
+		if n < 0 || end > len(data) {
+			return errors.New("truncated PNG chunk")
+		}
+		typ := string(data[i+4 : i+8])
+		f(typ, data[i:end], data[i+8:i+8+n])
+		i = end
+		if typ == "IEND" {
+			break
+		}
+	}
+	return nil
+}
+
+func pngExif(data []byte) ([]byte, error) {
+	var raw []byte
+	err := pngChunks(data, func(typ string, _, body []byte) {
+		if typ == "eXIf" && raw == nil {
+			raw = body
+		}
+	})
+	return raw, err
+}
+
+// stripPNG drops the droppedPNGChunks and adds back the kept EXIF fields
+// before the image data, where eXIf must go.
+func stripPNG(data []byte) ([]byte, error) {
+	raw, err := pngExif(data)
+	if err != nil {
+		return nil, err
+	}
+	kept := keptExif(parseExif(raw))
+	out := append([]byte(nil), pngSignature...)
+	err = pngChunks(data, func(typ string, chunk, _ []byte) {
+		if typ == "IDAT" && kept != nil {
+			out = appendPNGChunk(out, "eXIf", kept)
+			kept = nil
+		}
+		if !droppedPNGChunks[typ] {
+			out = append(out, chunk...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func appendPNGChunk(out []byte, typ string, body []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(body)))
+	start := len(out)
+	out = append(out, typ...)
+	out = append(out, body...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
+
+// VP8X flags for the metadata chunks.
+const (
+	webpExifFlag = 0x08
+	webpXMPFlag  = 0x04
+)
+
+// webpChunks calls f with the fourcc and body of each chunk in a WebP file.
+func webpChunks(data []byte, f func(fourcc string, body []byte)) error {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return errors.New("missing WebP header")
+	}
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return errors.New("truncated WebP chunk")
+		}
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + n
+		if n < 0 || end > len(data) {
+			return errors.New("truncated WebP chunk")
+		}
+		f(string(data[i:i+4]), data[i+8:end])
+		// Chunks are padded to an even length.
+		i = end + n%2
+	}
+	return nil
+}
+
+func webpExif(data []byte) ([]byte, error) {
+	var raw []byte
+	err := webpChunks(data, func(fourcc string, body []byte) {
+		if fourcc == "EXIF" && raw == nil {
+			raw = body
+		}
+	})
+	return raw, err
+}
+
+// stripWebP drops the EXIF and XMP chunks of a WebP file and, if it is an
+// extended one, adds back the kept EXIF fields at the end, where EXIF goes.
+// Simple files aren't meant to have metadata at all.
+func stripWebP(data []byte) ([]byte, error) {
+	raw, err := webpExif(data)
+	if err != nil {
+		return nil, err
+	}
+	kept := keptExif(parseExif(raw))
+
+	out := []byte("RIFF\x00\x00\x00\x00WEBP")
+	appendChunk := func(fourcc string, body []byte) {
+		out = append(out, fourcc...)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(body)))
+		out = append(out, body...)
+		if len(body)%2 == 1 {
+			out = append(out, 0)
+		}
+	}
+	flags := -1
+	err = webpChunks(data, func(fourcc string, body []byte) {
+		switch fourcc {
+		case "EXIF", "XMP ":
+			return
+		case "VP8X":
+			if len(body) > 0 {
+				flags = len(out) + 8
+			}
+		}
+		appendChunk(fourcc, body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if flags >= 0 {
+		out[flags] &^= webpExifFlag | webpXMPFlag
+		if kept != nil {
+			appendChunk("EXIF", kept)
+			out[flags] |= webpExifFlag
+		}
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
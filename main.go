@@ -1,29 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rsa"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/dubJay/activitypub"
 	"github.com/dubJay/db"
+	"github.com/dubJay/gallery"
+	"github.com/dubJay/imageproxy"
+	"github.com/dubJay/newsletter"
+	"github.com/dubJay/preview"
 	"github.com/dubJay/serving"
+	"github.com/dubJay/storage"
+	"github.com/dubJay/webmention"
+	"github.com/dubJay/websub"
 	"github.com/gorilla/feeds"
 	"github.com/gorilla/mux"
 )
 
 var (
-	tmpls map[string]*template.Template
-	logTime time.Time
-
 	dbPath    = flag.String("dbPath", "db/testDB.db", "Datafile to use")
 	logDir   = flag.String("logDir", "logs", "Directory to log to. This path with be joined with rootDir")
 	port      = flag.String("port", ":8080", "Port for server to listen on")
@@ -31,6 +46,31 @@ var (
 	templates = flag.String("templates", "templates", "Templates directory")
 	resources = flag.String("resources", "resources", "Images directory")
 	static    = flag.String("static", "static" , "CSS, HTML, JS, etc...")
+	queryTimeout = flag.Duration("queryTimeout", db.DefaultQueryTimeout, "Longest a single database query may run")
+	articles  = flag.String("articles", "", "Where kcawd PDFs not kept in the database live: dir:PATH or cas:PATH")
+	adminUser = flag.String("adminUser", "admin", "Username for the admin pages")
+	adminPasswordFile = flag.String("adminPasswordFile", "", "File holding the admin password. The admin pages are disabled without one")
+	maxArticleSize = flag.Int64("maxArticleSize", 20<<20, "Largest kcawd PDF that can be uploaded, in bytes")
+	pdftoppm = flag.String("pdftoppm", "", "poppler's pdftoppm, to render sharper kcawd thumbnails than the built-in renderer. Startup fails if it is set and can't be found")
+	secureCookies = flag.Bool("secureCookies", true, "Only send cookies over HTTPS. Turn off to use the admin pages over plain HTTP")
+	imageMemoryCache = flag.Int64("imageMemoryCache", 100<<20, "Bytes of resized images to keep in memory")
+	imageCacheTTL = flag.Duration("imageCacheTTL", 2*time.Hour, "Longest a resized image is kept in memory")
+	imageCacheDir = flag.String("imageCacheDir", "", "Directory to keep resized images in once they leave memory. No disk cache if empty")
+	imageDiskCache = flag.Int64("imageDiskCache", 1<<30, "Bytes of resized images to keep in imageCacheDir")
+	keepImageMetadata = flag.Bool("keepImageMetadata", false, "Serve images with their EXIF and XMP metadata, location and camera included")
+	commentLimit = flag.Int("commentLimit", 5, "Most comments one address may post per commentWindow. No limit if 0. Comments are only taken when the admin pages are on")
+	commentWindow = flag.Duration("commentWindow", time.Hour, "Period commentLimit applies to")
+	trustedProxies = flag.String("trustedProxies", "", "Comma separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is believed. Without them, rate limits count everyone behind a proxy as the proxy")
+	webmentions = flag.Bool("webmentions", false, "Receive Webmentions and Pingbacks, and send them for links in published entries")
+	activityPubKey = flag.String("activityPubKey", "", "Private key the site signs ActivityPub requests with, made if missing. This path will be joined with rootDir unless absolute. ActivityPub is off if empty")
+	smtpAddr = flag.String("smtpAddr", "", "SMTP server to send the newsletter through, as host:port. The newsletter is off if empty")
+	smtpUser = flag.String("smtpUser", "", "Username for the SMTP server, if it needs one")
+	smtpPasswordFile = flag.String("smtpPasswordFile", "", "File holding the SMTP password")
+	newsletterFrom = flag.String("newsletterFrom", "newsletter@christopher.cawdrey.name", "Address the newsletter is sent from")
+	digestInterval = flag.Duration("digestInterval", 7*24*time.Hour, "How often subscribers to the digest get an email")
+	allowPrivateNetwork = flag.Bool("allowPrivateNetwork", false, "Let mentions, ActivityPub and WebSub requests reach loopback and private addresses. Only for testing")
+	websubHub = flag.String("websubHub", "", "WebSub hub to advertise in the feeds and notify when entries change. None if empty, unless websubBuiltinHub is set")
+	websubBuiltinHub = flag.Bool("websubBuiltinHub", false, "Run a WebSub hub at /websub that pushes the feeds to its subscribers. The feeds advertise it unless websubHub names another")
 )
 
 const (
@@ -38,7 +78,11 @@ const (
 	historyPage = "history.html"
 	landingPage = "index.html"
 	kCawdPage   = "kcawd.html"
+	galleryPage = "gallery.html"
+	galleriesPage = "galleries.html"
 	wizardProgrammingPage = "christhewizardprogrammer.html"
+	notFoundPage = "404.html"
+	serverErrorPage = "500.html"
 
 	scpBasePage = "base.html"
 	scpLanding = "landing"
@@ -51,55 +95,257 @@ const (
 
 	scpConst = "scp"
 	htmlSuffix = ".html"
+
+	// Where the site is served from, for links that leave it.
+	siteURL = "https://christopher.cawdrey.name"
+	siteTitle = "Christopher Cawdrey's Blog"
+	siteDescription = "Chris' musings, projects, and dispositions."
+	// Sent with requests the site makes to other sites.
+	userAgent = "childNode (" + siteURL + ")"
+
+	// Cap on the "more from this year" and related entry lists.
+	navLinks = 5
+	historyPageSize = 50
 )
 
-func initDeps() {
-	flag.Parse()	
-	parseTemplates()
-        if err := db.Init(filepath.Join(*rootDir, *dbPath)); err != nil {
-		log.Fatalf("could not open database: %v", err)
-	}
+// config holds the server's paths. Everything but rootDir is relative to rootDir.
+type config struct {
+	rootDir   string
+	logDir    string
+	templates string
+	resources string
+	static    string
+	// Storage spec for kcawd PDFs kept outside the database. Not relative to rootDir.
+	articles  string
+
+	// Path or name of the pdftoppm binary. Empty to use the built-in renderer.
+	pdftoppm  string
+
+	// The admin pages are only served if adminPassword is set.
+	adminUser      string
+	adminPassword  string
+	maxArticleSize int64
+	secureCookies  bool
+
+	// Resized image caches. imageCacheDir is not relative to rootDir and
+	// the disk cache is skipped if it's empty.
+	imageMemoryCache  int64
+	imageCacheTTL     time.Duration
+	imageCacheDir     string
+	imageDiskCache    int64
+	// Serve originals as they are rather than stripping their metadata.
+	keepImageMetadata bool
+
+	// Comments one address may post per commentWindow, or 0 for no limit.
+	commentLimit  int
+	commentWindow time.Duration
+	// Comma separated addresses and ranges of the reverse proxies in front
+	// of the server, whose X-Forwarded-For is believed for rate limits.
+	trustedProxies string
+
+	// Take and send Webmentions and Pingbacks.
+	webmentions bool
+
+	// Key file for ActivityPub, or empty to not federate.
+	activityPubKey string
+
+	// Let requests made on behalf of other sites, such as fetching a
+	// mention's source, reach private addresses. Only for tests.
+	allowPrivateNetwork bool
+
+	// Email subscribers through the SMTP server at smtpAddr, or not at all
+	// if it's empty.
+	smtpAddr       string
+	smtpUser       string
+	smtpPassword   string
+	newsletterFrom string
+	digestInterval time.Duration
+
+	// Advertise and notify the WebSub hub at websubHub, and run one at
+	// hubPath if websubBuiltinHub is set.
+	websubHub        string
+	websubBuiltinHub bool
 }
 
-func parseTemplates() {
-	var err error
-	tmpls = make(map[string]*template.Template)
-	tmpls[landingPage], err = template.New(
-		landingPage).ParseFiles(filepath.Join(*rootDir, *templates, landingPage))
+// server owns everything a request needs so several can coexist in one process.
+type server struct {
+	// The database, split by feature. They're all the db.Store newServer
+	// was given.
+	entryStore      db.EntryStore
+	articleStore    db.ArticleStore
+	commentStore    db.CommentStore
+	mentionStore    db.MentionStore
+	followerStore   db.FollowerStore
+	subscriberStore db.SubscriberStore
+	hubStore        db.HubStore
+
+	articles storage.Store
+	cfg      config
+	tmpls    map[string]*template.Template
+	csrfKey  []byte
+	images   *imageproxy.Proxy
+	gallery  *gallery.Library
+
+	// Parsed from cfg.trustedProxies.
+	proxies []*net.IPNet
+	// Counts comments posted from each address.
+	commentLimiter *rateLimiter
+
+	mentions       *webmention.Client
+	mentionWorker  *worker
+	// Counts mentions sent from each address.
+	mentionLimiter *rateLimiter
+
+	// Signs ActivityPub requests; nil if the site doesn't federate.
+	federationKey    *rsa.PrivateKey
+	federation       *activitypub.Client
+	federationWorker *worker
+	// Counts activities posted to the inbox from each address.
+	inboxLimiter     *rateLimiter
+
+	// Sends the newsletter; nil if there's no SMTP server.
+	mailer           *newsletter.Sender
+	newsletterWorker *worker
+	// Counts newsletter signups from each address.
+	subscribeLimiter *rateLimiter
+
+	websub       *websub.Client
+	websubWorker *worker
+	// Counts hub subscription requests from each address.
+	hubLimiter   *rateLimiter
+
+	// Renders kcawd thumbnails.
+	renderer  preview.Renderer
+	extractor *worker
+
+	// Guards logTime, the day the current log file was opened for.
+	logMu   sync.Mutex
+	logTime time.Time
+}
+
+func newServer(store db.Store, cfg config) (*server, error) {
+	articles, err := storage.Parse(cfg.articles)
 	if err != nil {
-		log.Fatalf("error parsing template %s: %v", landingPage, err)
-	}
-	tmpls[entryPage], err = template.New(
-		entryPage).ParseFiles(filepath.Join(*rootDir, *templates, entryPage))
+		return nil, err
+	}
+	images, err := imageproxy.New(filepath.Join(cfg.rootDir, cfg.resources), imageproxy.Config{
+		MemoryBytes:  cfg.imageMemoryCache,
+		MemoryTTL:    cfg.imageCacheTTL,
+		CacheDir:     cfg.imageCacheDir,
+		DiskBytes:    cfg.imageDiskCache,
+		KeepMetadata: cfg.keepImageMetadata,
+	})
 	if err != nil {
-		log.Fatalf("error parsing template %s: %v", entryPage, err)
+		return nil, err
+	}
+	s := &server{
+		entryStore:      store,
+		articleStore:    store,
+		commentStore:    store,
+		mentionStore:    store,
+		followerStore:   store,
+		subscriberStore: store,
+		hubStore:        store,
+		articles:       articles,
+		images:         images,
+		gallery:        gallery.New(filepath.Join(cfg.rootDir, cfg.resources)),
+		cfg:            cfg,
+		renderer:       preview.Raster{Width: thumbnailWidth},
+		extractor:      newWorker(extractInterval),
+		commentLimiter: newRateLimiter(cfg.commentLimit, cfg.commentWindow),
+		mentions:       webmention.New(webmention.Config{UserAgent: userAgent, AllowPrivate: cfg.allowPrivateNetwork}),
+		mentionWorker:  newWorker(mentionInterval),
+		mentionLimiter: newRateLimiter(mentionLimit, time.Hour),
+		federationWorker: newWorker(federationInterval),
+		inboxLimiter:     newRateLimiter(inboxLimit, time.Hour),
+		newsletterWorker: newWorker(newsletterInterval),
+		subscribeLimiter: newRateLimiter(subscribeLimit, time.Hour),
+		websub:       websub.New(websub.Config{UserAgent: userAgent, AllowPrivate: cfg.allowPrivateNetwork}),
+		websubWorker: newWorker(websubInterval),
+		hubLimiter:   newRateLimiter(hubLimit, time.Hour),
+	}
+	if s.proxies, err = parseProxies(cfg.trustedProxies); err != nil {
+		return nil, err
+	}
+	if cfg.activityPubKey != "" {
+		keyPath := cfg.activityPubKey
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(cfg.rootDir, keyPath)
+		}
+		if s.federationKey, err = activitypub.LoadKey(keyPath); err != nil {
+			return nil, err
+		}
+		s.federation = activitypub.NewClient(actorKeyID, s.federationKey,
+			activitypub.Config{UserAgent: userAgent, AllowPrivate: cfg.allowPrivateNetwork})
+	}
+	if cfg.smtpAddr != "" {
+		if s.mailer, err = newsletter.NewSender(newsletter.Config{
+			Addr:     cfg.smtpAddr,
+			Username: cfg.smtpUser,
+			Password: cfg.smtpPassword,
+		}); err != nil {
+			return nil, err
+		}
 	}
-	tmpls[historyPage], err = template.New(
-		historyPage).ParseFiles(filepath.Join(*rootDir, *templates, historyPage))
-	if err != nil {
-		log.Fatalf("error parsing template %s: %v", historyPage, err)
+	if cfg.pdftoppm != "" {
+		path, err := exec.LookPath(cfg.pdftoppm)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render kcawd thumbnails: %w", err)
+		}
+		s.renderer = preview.Pdftoppm{Path: path, Width: thumbnailWidth}
 	}
-	tmpls[kCawdPage], err = template.New(
-		kCawdPage).ParseFiles(filepath.Join(*rootDir, *templates, kCawdPage))
-	if err != nil {
-		log.Fatalf("error parsing template %s: %v", kCawdPage, err)
+	if err := s.parseTemplates(); err != nil {
+		return nil, err
 	}
-	tmpls[scpBasePage], err = template.New(
-		scpBasePage).ParseFiles(filepath.Join(*rootDir, *templates, scpConst, scpBasePage))
-	if err != nil {
-		log.Fatalf("error parsing template %s: %v", kCawdPage, err)
+	if s.adminEnabled() {
+		if s.csrfKey, err = newCSRFKey(); err != nil {
+			return nil, err
+		}
 	}
+	return s, nil
+}
 
+func (s *server) parseTemplates() error {
+	// Template name to its file under the templates directory.
+	pages := map[string]string{
+		landingPage:     landingPage,
+		entryPage:       entryPage,
+		historyPage:     historyPage,
+		kCawdPage:       kCawdPage,
+		galleryPage:     galleryPage,
+		galleriesPage:   galleriesPage,
+		scpBasePage:     filepath.Join(scpConst, scpBasePage),
+		notFoundPage:    notFoundPage,
+		serverErrorPage: serverErrorPage,
+	}
+	if s.adminEnabled() {
+		pages[kCawdAdminPage] = kCawdAdminPage
+		pages[commentsAdminPage] = commentsAdminPage
+		pages[commentPage] = commentPage
+	}
+	if s.newsletterEnabled() {
+		pages[newsletterPage] = newsletterPage
+	}
+
+	s.tmpls = make(map[string]*template.Template)
+	for name, file := range pages {
+		tmpl, err := template.New(name).ParseFiles(filepath.Join(s.cfg.rootDir, s.cfg.templates, file))
+		if err != nil {
+			return fmt.Errorf("error parsing template %s: %v", name, err)
+		}
+		s.tmpls[name] = tmpl
+	}
 
 	log.Print("Templates successfully initialized");
+	return nil
 }
 
-func setupLogging() (*os.File, error) {
-	if *logDir == "" {
+func (s *server) setupLogging() (*os.File, error) {
+	if s.cfg.logDir == "" {
 		return nil, errors.New("logDir flag must be set")
 	}
 
-	logFile := filepath.Join(*rootDir, *logDir, "general-logs.txt")
+	logFile := filepath.Join(s.cfg.rootDir, s.cfg.logDir, "general-logs.txt")
 
 	if _, err := os.Stat(logFile); os.IsNotExist(err) {
 		return os.Create(logFile)
@@ -107,252 +353,456 @@ func setupLogging() (*os.File, error) {
 	return os.Open(logFile);
 }
 
-func buildSCPHome(w http.ResponseWriter, r *http.Request) {
-	content, err := ioutil.ReadFile(filepath.Join(*rootDir, *templates, scpConst, scpLanding + htmlSuffix))
-	if err != nil {
-		log.Printf("error reading file %s: %v", scpLanding, err)
-		http.Error(w, "failed to build page", http.StatusInternalServerError)
-		return
+// render executes a template into a buffer before writing it so a failure
+// can still be answered with an error page instead of half a page.
+func (s *server) render(w http.ResponseWriter, name string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := s.tmpls[name].Execute(&buf, data); err != nil {
+		return serverError("failed to build page", fmt.Errorf("error executing template %s: %v", name, err))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		// Too late for an error page; the client most likely went away.
+		log.Printf("error writing template %s: %v", name, err)
 	}
+	return nil
+}
 
-	if err := tmpls[scpBasePage].Execute(w, serving.SCPToServing(content)); err != nil {
-		log.Printf("error executing template %s: %v", scpLanding, err)
-		http.Error(w, "failed to build page", http.StatusInternalServerError)
+func (s *server) buildSCPHome(w http.ResponseWriter, r *http.Request) error {
+	content, err := ioutil.ReadFile(filepath.Join(s.cfg.rootDir, s.cfg.templates, scpConst, scpLanding + htmlSuffix))
+	if err != nil {
+		return serverError("failed to build page", fmt.Errorf("error reading file %s: %v", scpLanding, err))
 	}
 
+	return s.render(w, scpBasePage, serving.SCPToServing(content))
 }
 
-func buildSCP(w http.ResponseWriter, r *http.Request) {
+func (s *server) buildSCP(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 
-	if len(vars["optional"]) != 0 {
-		content, err := ioutil.ReadFile(filepath.Join(*rootDir, *templates, scpConst, vars["optional"] + htmlSuffix))
-		if err != nil {
-			log.Printf("error reading file %s: %v", vars["optional"], err)
-			buildSCPHome(w, r)
-			return
-		}
+	content, err := ioutil.ReadFile(filepath.Join(s.cfg.rootDir, s.cfg.templates, scpConst, vars["optional"] + htmlSuffix))
+	if os.IsNotExist(err) {
+		return notFoundError(fmt.Errorf("no scp page named %s", vars["optional"]))
+	}
+	if err != nil {
+		return serverError("failed to build page", fmt.Errorf("error reading file %s: %v", vars["optional"], err))
+	}
 
-		if err := tmpls[scpBasePage].Execute(w, serving.SCPToServing(content)); err != nil {
-			log.Printf("error executing template %s: %v", vars["optional"], err)
-			http.Error(w, "failed to build page", http.StatusInternalServerError)
-		}
+	return s.render(w, scpBasePage, serving.SCPToServing(content))
+}
+
+func (s *server) buildOneOff(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	oneoff, err := s.entryStore.GetOneOff(r.Context(), vars["id"])
+	if err != nil {
+		return storeError("failed to retrieve content from database", fmt.Errorf("unable to find oneoff entry %s: %w", vars["id"], err))
 	}
+	serving, err := serving.OneoffToServing(oneoff, s.site())
+	if err != nil {
+		return serverError("failed to generate content", fmt.Errorf("failed to generate HTML content: %v", err))
+	}
+
+	return s.render(w, entryPage, serving)
 }
 
-func buildOneOff(w http.ResponseWriter, uid string) error {
-	oneoff, err := db.GetOneOff(uid)
+func (s *server) buildLandingPage(w http.ResponseWriter, r *http.Request) error {
+	entry, err := s.entryStore.GetEntry(r.Context(), 0)
 	if err != nil {
-		return fmt.Errorf("unable to find oneoff entry: %v", err)
+		return storeError("failed to retrieve landing page content from db", fmt.Errorf("failed to get entry: %w", err))
 	}
-	serving, err := serving.OneoffToServing(oneoff)
+	nav, err := s.entryStore.GetNavigation(r.Context(), entry, navLinks)
 	if err != nil {
-		return fmt.Errorf("failed to generate HTML content: %v", err)
+		return storeError("failed to retrieve landing page content from db",
+			fmt.Errorf("failed to get navigation for entry %d: %w", entry.Id, err))
 	}
-	
-	return tmpls[entryPage].Execute(w, serving)
+	serving, err := serving.EntryToServing(entry, nav, s.site())
+	if err != nil {
+		return serverError("failed to generate content", fmt.Errorf("failed to generate HTML content: %v", err))
+	}
+
+	return s.render(w, landingPage, serving)
 }
 
-func buildLandingPage(w http.ResponseWriter, r *http.Request) {
+func (s *server) buildPage(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
-	if vars["id"] != "" {
-		if err := buildOneOff(w, vars["id"]); err != nil {
-			// This will fall through to landing page.
-			log.Printf("failed to build oneoff page: %v", err)
-		} else {
-			// If oneoff build was successful we don't need the landing page.
-			// StatusOk is written to headers implicitly.
-			return
-		}
-	} 
-	entry, err := db.GetEntry(0)
+	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		log.Printf("failed to get entry: %v", err)
-		http.Error(w, "failed to retrieve langing page content from db", http.StatusInternalServerError)
-		return
+		return statusError(http.StatusBadRequest, "invalid request", fmt.Errorf("invalid id: %v", err))
+	}
+	entry, err := s.entryStore.GetEntry(r.Context(), id)
+	if errors.Is(err, db.ErrNotFound) {
+		// Entries used to be addressed by their publication timestamp.
+		entry, err = s.entryStore.GetEntryByTimestamp(r.Context(), id)
 	}
-	serving, err := serving.EntryToServing(entry)
 	if err != nil {
-		log.Printf("failed to generate HTML content: %v", err)
-		http.Error(w, "failed to generate content", http.StatusInternalServerError)
-		return
+		return storeError("failed to retrieve content from database", fmt.Errorf("failed to get entry %d: %w", id, err))
 	}
 
-	if err := tmpls[landingPage].Execute(w, serving); err != nil {
-		log.Printf("error executing template %s: %v", landingPage, err)
-		http.Error(w, "failed to build landing page", http.StatusInternalServerError)
+	// Numeric URLs are kept working but the slug URL is canonical.
+	if entry.Slug != "" {
+		http.Redirect(w, r, serving.EntryPath(entry.Id, entry.Slug, entry.Published), http.StatusMovedPermanently)
+		return nil
 	}
+	return s.renderEntry(w, r, entry)
 }
 
-func buildPage(w http.ResponseWriter, r *http.Request) {
+func (s *server) buildSlugPage(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
-	if len(vars["id"]) == 0 {
-		buildLandingPage(w, r)
+	entry, err := s.entryStore.GetEntryBySlug(r.Context(), vars["slug"])
+	if err != nil {
+		return storeError("failed to retrieve content from database",
+			fmt.Errorf("failed to get entry by slug %s: %w", vars["slug"], err))
 	}
-	id, err := strconv.Atoi(vars["id"])
+
+	// Slugs are unique on their own so a wrong year just redirects.
+	if path := serving.EntryPath(entry.Id, entry.Slug, entry.Published); path != r.URL.Path {
+		http.Redirect(w, r, path, http.StatusMovedPermanently)
+		return nil
+	}
+	return s.renderEntry(w, r, entry)
+}
+
+func (s *server) renderEntry(w http.ResponseWriter, r *http.Request, entry db.Entry) error {
+	nav, err := s.entryStore.GetNavigation(r.Context(), entry, navLinks)
 	if err != nil {
-		log.Printf("invalid id: %v", err)
-		http.Error(w, "invalid request", http.StatusBadRequest)
-		return
+		return storeError("failed to retrieve content from database",
+			fmt.Errorf("failed to get navigation for entry %d: %w", entry.Id, err))
 	}
-	entry, err := db.GetEntry(id)
+	comments, err := s.commentStore.GetComments(r.Context(), entry.Id)
 	if err != nil {
-		log.Printf("failed to get entry: %v", err)
-		http.Error(w, "failed to retrieve content from database", http.StatusInternalServerError)
-		return
+		return storeError("failed to retrieve content from database",
+			fmt.Errorf("failed to get comments on entry %d: %w", entry.Id, err))
 	}
-
-	serving, err := serving.EntryToServing(entry)
+	entryServing, err := serving.EntryToServing(entry, nav, s.site())
 	if err != nil {
-		log.Printf("failed to generate HTML content: %v", err)
-		http.Error(w, "failed to generate content", http.StatusInternalServerError)
-		return
+		return serverError("failed to generate content", fmt.Errorf("failed to generate HTML content: %v", err))
 	}
-	
-	if err := tmpls[entryPage].Execute(w, serving); err != nil {
-		log.Printf("error executing template %s: %v", entryPage, err)
-		http.Error(w, "failed to build page", http.StatusInternalServerError)
+	mentions, err := s.mentionStore.GetMentions(r.Context(), entry.Id)
+	if err != nil {
+		return storeError("failed to retrieve content from database",
+			fmt.Errorf("failed to get mentions of entry %d: %w", entry.Id, err))
+	}
+	entryServing.Comments = serving.CommentsToServing(comments)
+	entryServing.Mentions = serving.MentionsToServing(mentions)
+	if s.cfg.webmentions {
+		w.Header().Set("Link", "<"+siteURL+webmentionPath+`>; rel="webmention"`)
+		w.Header().Set("X-Pingback", siteURL+pingbackPath)
 	}
+	if s.commentsEnabled() {
+		entryServing.CommentPath = serving.CommentsPath(entry.Id)
+		entryServing.CommentPending = r.URL.Query().Get("comment") == "pending"
+	}
+
+	return s.render(w, entryPage, entryServing)
 }
 
-func buildNavPage(w http.ResponseWriter, r *http.Request) {
-	entries, err := db.GetHistory()
-	if err != nil {
-		log.Printf("unable to retrieve history entries: %v", err)
-		http.Error(w, "failed to retrieve records from archive", http.StatusInternalServerError)
-		return
+func (s *server) buildNavPage(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	filter := db.HistoryFilter{}
+	// The route patterns guarantee these are digits.
+	if len(vars["year"]) != 0 {
+		filter.Year, _ = strconv.Atoi(vars["year"])
+	}
+	if len(vars["month"]) != 0 {
+		month, _ := strconv.Atoi(vars["month"])
+		if month < 1 || month > 12 {
+			return notFoundError(fmt.Errorf("invalid archive month: %s", vars["month"]))
+		}
+		filter.Month = time.Month(month)
+	}
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		var err error
+		if page, err = strconv.Atoi(p); err != nil || page < 1 {
+			return statusError(http.StatusBadRequest, "invalid page", fmt.Errorf("invalid archive page: %s", p))
+		}
 	}
-	serving := serving.HistoryToServing(entries)
 
-	if err := tmpls[historyPage].Execute(w, serving); err != nil {
-		log.Printf("error executing template %s: %v", historyPage, err)
-		http.Error(w, "failed to build navigation from historical records", http.StatusInternalServerError)
+	total, err := s.entryStore.CountHistory(r.Context(), filter)
+	if err != nil {
+		return storeError("failed to retrieve records from archive", fmt.Errorf("unable to count history entries: %w", err))
+	}
+	if (filter.Year != 0 && total == 0) || (page > 1 && (page-1)*historyPageSize >= total) {
+		return notFoundError(fmt.Errorf("no archive entries for %+v page %d", filter, page))
 	}
+	entries, err := s.entryStore.GetHistoryPage(r.Context(), filter, historyPageSize, (page-1)*historyPageSize)
+	if err != nil {
+		return storeError("failed to retrieve records from archive", fmt.Errorf("unable to retrieve history entries: %w", err))
+	}
+	counts, err := s.entryStore.GetYearCounts(r.Context())
+	if err != nil {
+		return storeError("failed to retrieve records from archive", fmt.Errorf("unable to count entries per year: %w", err))
+	}
+
+	return s.render(w, historyPage, serving.ArchiveToServing(entries, filter, counts, page, historyPageSize, total))
 }
 
-func buildKCawdPage(w http.ResponseWriter, r *http.Request) {
-	articles, err := db.GetArticleMeta()
+func (s *server) buildKCawdPage(w http.ResponseWriter, r *http.Request) error {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	var articles []db.ArticleMeta
+	var err error
+	if query != "" {
+		articles, err = s.articleStore.SearchArticles(r.Context(), query)
+	} else {
+		articles, err = s.articleStore.GetArticleMeta(r.Context())
+	}
 	if err != nil {
-		log.Printf("unable to retrieve kcawd article metadata: %v", err)
-		http.Error(w, "failed to retrieve katy's articles from archive", http.StatusInternalServerError)
-		return
+		return storeError("failed to retrieve katy's articles from archive",
+			fmt.Errorf("unable to retrieve kcawd article metadata: %w", err))
 	}
 
-	if err := tmpls[kCawdPage].Execute(w, articles); err != nil {
-		log.Printf("error executing template %s: %v", kCawdPage, err)
-		http.Error(w, "failed to build katy's landing page", http.StatusInternalServerError)
-	}
+	return s.render(w, kCawdPage, serving.KCawdToServing(articles, query))
 }
 
-func serveKCawdPDF(w http.ResponseWriter, r *http.Request) {
+func (s *server) serveKCawdPDF(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 
 	id := vars["id"]
 	idNumeric, err := strconv.Atoi(id)
 	if err != nil {
-		log.Printf("invalid id for serveKatyCawd %s", id)
-		http.Error(w, "invalid id for article: " + id, http.StatusNotFound)
+		return notFoundError(fmt.Errorf("invalid id for serveKatyCawd %s", id))
 	}
 	
-	article, err := db.GetArticle(idNumeric)
+	article, err := s.articleStore.GetArticle(r.Context(), idNumeric)
+	if err != nil {
+		return storeError("failed to retrieve article: " + id, fmt.Errorf("unable to retrieve article %s: %w", id, err))
+	}
+
+	pdf, err := s.openArticle(r.Context(), article)
+	if err != nil {
+		return err
+	}
+	defer pdf.Close()
+
+	// ServeContent answers conditional and Range requests from these.
+	w.Header().Set("Content-Type", "application/pdf")
+	if article.SHA256 != "" {
+		w.Header().Set("ETag", `"` + article.SHA256 + `"`)
+	}
+	http.ServeContent(w, r, id + ".pdf", article.Modified, pdf)
+	return nil
+}
+
+// openArticle opens the PDF of article from the database or the article storage.
+func (s *server) openArticle(ctx context.Context, article db.Article) (io.ReadSeekCloser, error) {
+	id := article.Id
+	switch {
+	case article.Location == "":
+		pdf, err := s.articleStore.OpenArticleBlob(ctx, id)
+		if err != nil {
+			return nil, storeError(fmt.Sprintf("failed to retrieve article: %d", id), fmt.Errorf("unable to open pdf for article %d: %w", id, err))
+		}
+		return pdf, nil
+	case s.articles == nil:
+		return nil, serverError(fmt.Sprintf("failed to retrieve article: %d", id),
+			fmt.Errorf("article %d is stored at %s but no article storage is configured", id, article.Location))
+	}
+	pdf, err := s.articles.Open(article.Location)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, notFoundError(fmt.Errorf("pdf for article %d missing from storage: %v", id, err))
+	}
+	if err != nil {
+		return nil, serverError(fmt.Sprintf("failed to retrieve article: %d", id), fmt.Errorf("unable to open pdf for article %d: %v", id, err))
+	}
+	return pdf, nil
+}
+
+func (s *server) serveKCawdThumbnail(w http.ResponseWriter, r *http.Request) error {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	article, err := s.articleStore.GetArticle(r.Context(), id)
 	if err != nil {
-		log.Printf("unable to locate pdf for article: %d", id)
-		http.Error(w, "no PDF found for article: " + id, http.StatusNotFound)
+		return storeError("failed to retrieve thumbnail", fmt.Errorf("unable to retrieve article %d: %w", id, err))
 	}
+	thumbnail, err := s.articleStore.GetArticleThumbnail(r.Context(), id)
+	if err != nil {
+		return storeError("failed to retrieve thumbnail", fmt.Errorf("unable to retrieve thumbnail for article %d: %w", id, err))
+	}
+
+	// Thumbnails are dropped whenever the PDF changes, so its hash identifies them too.
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", `"` + article.SHA256 + `-thumbnail"`)
+	http.ServeContent(w, r, "thumbnail.png", article.Modified, bytes.NewReader(thumbnail))
+	return nil
+}
+
+// serveImage serves a file under the resources directory, resized and
+// re-encoded if the query asks for it, e.g. ?width=320&format=png.
+func (s *server) serveImage(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	name := path.Join("/", vars["dir"], vars["item"])
+	err := s.images.Serve(w, r, name)
+	switch {
+	case errors.Is(err, imageproxy.ErrNotFound):
+		return notFoundError(err)
+	case errors.Is(err, imageproxy.ErrBadOptions):
+		return statusError(http.StatusBadRequest, "invalid image options", err)
+	case errors.Is(err, imageproxy.ErrNotImage):
+		return statusError(http.StatusUnsupportedMediaType, "that file can't be resized", err)
+	case err != nil:
+		return serverError("failed to serve image", err)
+	}
+	return nil
+}
+
+// imageSize is the serving.ImageSizer for entries, sizing the images served
+// from /images/.
+func (s *server) imageSize(src string) (int, int, bool) {
+	if !strings.HasPrefix(src, "/images/") {
+		return 0, 0, false
+	}
+	width, height, err := s.images.Size(strings.TrimPrefix(src, "/images"))
+	if err != nil {
+		if !errors.Is(err, imageproxy.ErrNotFound) {
+			log.Printf("unable to size image %s: %v", src, err)
+		}
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// site is what entries' blocks can refer to.
+func (s *server) site() serving.Site {
+	return serving.Site{ImageSize: s.imageSize, Album: s.gallery.Album}
+}
+
+func (s *server) buildGalleriesPage(w http.ResponseWriter, r *http.Request) error {
+	albums, err := s.gallery.Albums()
+	if err != nil {
+		return serverError("failed to list galleries", fmt.Errorf("unable to read albums: %v", err))
+	}
+	return s.render(w, galleriesPage, serving.GalleriesToServing(albums))
+}
 
-	http.ServeContent(w, r, id + ".pdf", time.Unix(0, 0), serving.StringToPDF(article))
+// album looks up the album named in the request.
+func (s *server) album(r *http.Request) (gallery.Album, error) {
+	name := mux.Vars(r)["album"]
+	album, err := s.gallery.Album(name)
+	if errors.Is(err, gallery.ErrNotFound) {
+		return gallery.Album{}, notFoundError(err)
+	}
+	if err != nil {
+		return gallery.Album{}, serverError("failed to retrieve gallery: " + name, fmt.Errorf("unable to read album %s: %v", name, err))
+	}
+	return album, nil
 }
 
-func buildFeedPage(w http.ResponseWriter, r *http.Request) {
-        vars := mux.Vars(r)
-	if len(vars["type"]) == 0 {
-		log.Print("no type requested by user.")
-		http.Error(w, "no feed type specified by user.", http.StatusPreconditionRequired)
-		return
+func (s *server) buildGalleryPage(w http.ResponseWriter, r *http.Request) error {
+	album, err := s.album(r)
+	if err != nil {
+		return err
 	}
-	contains := func(s []string, e string) bool {
-		for _, a := range s {
+	return s.render(w, galleryPage, serving.GalleryToServing(album))
+}
+
+// serveGalleryIndex lists an album's photos as JSON for lightbox scripts.
+func (s *server) serveGalleryIndex(w http.ResponseWriter, r *http.Request) error {
+	album, err := s.album(r)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(serving.GalleryIndexToServing(album))
+	if err != nil {
+		return serverError("failed to build gallery index", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+	return nil
+}
+
+// feedNames are the feeds served under /feeds/.
+var feedNames = []string{"atom.xml", "rss.xml", "jsonfeed.json"}
+
+func feedURL(name string) string {
+	return siteURL + "/feeds/" + name
+}
+
+func (s *server) buildFeedPage(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	contains := func(list []string, e string) bool {
+		for _, a := range list {
 			if a == e {
 				return true
 			}
 		}
 		return false
 	}
-	if !contains([]string{"atom.xml", "rss.xml", "jsonfeed.json"}, vars["type"]) {
-		log.Print("invalid type requested by user.")
-		http.Error(w, "invalid type requested by user.", http.StatusPreconditionFailed)
-		return
+	if !contains(feedNames, vars["type"]) {
+		return notFoundError(fmt.Errorf("invalid feed type requested by user: %s", vars["type"]))
 	}
-	
-	entries, err := db.GetRecentEntries(1000)
+
+	out, contentType, err := s.feed(r.Context(), vars["type"])
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	if hub := s.hubURL(); hub != "" {
+		w.Header().Add("Link", "<"+hub+`>; rel="hub"`)
+		w.Header().Add("Link", "<"+feedURL(vars["type"])+`>; rel="self"`)
+	}
+	w.Write([]byte(out))
+	return nil
+}
+
+// feed builds the feed called name, one of feedNames, and returns it with
+// its content type. Errors are ready for a handler to return.
+func (s *server) feed(ctx context.Context, name string) (string, string, error) {
+	entries, err := s.entryStore.GetRecentEntries(ctx, 1000)
 	if err != nil {
-		log.Printf("unable to retrieve history entries: %v", err)
-		http.Error(w, "failed to retrieve recent entries.", http.StatusInternalServerError)
-		return
+		return "", "", storeError("failed to retrieve recent entries.", fmt.Errorf("unable to retrieve history entries: %w", err))
 	}
 
 	feed := &feeds.Feed{
-		Title:       "Christopher Cawdrey's Blog",
-		Link:        &feeds.Link{Href: "https://christopher.cawdrey.name"},
-		Description: "Chris' musings, projects, and dispositions.",
+		Title:       siteTitle,
+		Link:        &feeds.Link{Href: siteURL},
+		Description: siteDescription,
 		Author:      &feeds.Author{Name: "Christopher Cawdrey", Email: "chris@cawdrey.name"},
 		Created:     time.Unix(1489554739, 0),
 	}
 	for _, entry := range entries {
-		serving, err := serving.EntryToServing(entry)
+		serving, err := serving.EntryToServing(entry, db.Navigation{}, s.site())
 		if err != nil {
-			log.Printf("failed to generate HTML content for feed: %v", err)
-			http.Error(w, "failed to generate content for feed", http.StatusInternalServerError)
-			return
+			return "", "", serverError("failed to generate content for feed", fmt.Errorf("failed to generate HTML content for feed: %v", err))
 		}
 
 		feed.Items = append(feed.Items,
 			&feeds.Item{
 				Title:       entry.Title,
-				Id:          strconv.Itoa(entry.Entry_id),
-				Link:        &feeds.Link{Href: strings.Join([]string{"https://christopher.cawdrey.name/entry/", strconv.Itoa(entry.Entry_id)}, "")},
+				// Readers key on the item id. Keep the legacy timestamp so
+				// subscribers don't see every entry as new again.
+				Id:          strconv.Itoa(entry.Timestamp),
+				Link:        &feeds.Link{Href: siteURL + serving.Path},
 				Description: string(serving.HTML),
-				Created:     time.Unix(int64(entry.Entry_id), 0),
+				Created:     entry.Published,
+				Updated:     entry.Updated,
 			})
 	}
 
-	switch vars["type"] {
+	var out, contentType string
+	switch name {
 	case "atom.xml":
-		atom, err := feed.ToAtom()
-		if err != nil {
-			log.Printf("failed to create atom feed %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Write([]byte(atom))
+		out, err = atomWithHub(feed, s.hubURL(), feedURL(name))
+		contentType = "application/atom+xml"
 	case "rss.xml":
-		rss, err := feed.ToRss()
-		if err != nil {
-			log.Printf("failed to create rss feed %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-
-		}
-		w.Write([]byte(rss))
+		out, err = rssWithHub(feed, s.hubURL(), feedURL(name))
+		contentType = "application/rss+xml"
 	default:
-		json, err := feed.ToJSON()
-		if err != nil {
-			log.Printf("failed to create json feed %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Write([]byte(json))
+		out, err = jsonWithHub(feed, s.hubURL(), feedURL(name))
+		contentType = "application/feed+json"
+	}
+	if err != nil {
+		return "", "", serverError("failed to build feed", fmt.Errorf("failed to create %s feed: %v", name, err))
 	}
+	return out, contentType, nil
 }
 
 // This is packed into the middleware so we crash instead of returning on failure.
-func setLoggingLocation(now time.Time) {
-	if *logDir == "" {
+func (s *server) setLoggingLocation(now time.Time) {
+	if s.cfg.logDir == "" {
 		log.Fatal("logDir flag must be set")
 	}
 
 	nowString := fmt.Sprintf("%d-%02d-%02d", now.Year(), now.Month(), now.Day())
-	logFile := filepath.Join(*rootDir, *logDir, fmt.Sprintf("debug-logs_%s.txt", nowString))
+	logFile := filepath.Join(s.cfg.rootDir, s.cfg.logDir, fmt.Sprintf("debug-logs_%s.txt", nowString))
 
 	var file *os.File
 	if _, err := os.Stat(logFile); os.IsNotExist(err) {
@@ -367,25 +817,155 @@ func setLoggingLocation(now time.Time) {
 		}
 	}
 	// Reset logtime.
-	logTime = now
+	s.logTime = now
 	log.SetOutput(file)
 } 
 
-func logger(next http.Handler) http.Handler {
+func (s *server) logger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		now := time.Now().UTC()
-		if now.Day() != logTime.Day() || now.Month() != logTime.Month() || now.Year() != logTime.Year() {
-			setLoggingLocation(now)
-			logTime = now
+		s.logMu.Lock()
+		if now.Day() != s.logTime.Day() || now.Month() != s.logTime.Month() || now.Year() != s.logTime.Year() {
+			s.setLoggingLocation(now)
 		}
+		s.logMu.Unlock()
 
 		// Call the next handler, which can be another middleware in the chain, or the final handler.
 		next.ServeHTTP(w, r)
 	})
 }
 
+// routes registers every route. Logging middleware is left to main so tests
+// don't write log files.
+func (s *server) routes() *mux.Router {
+	router := mux.NewRouter()
+	router.Handle("/", s.handle(s.buildLandingPage)).Methods("GET")
+	router.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(s.cfg.rootDir, "robots.txt"))})
+
+	// ChrisTheWizardProgrammer route.
+	router.HandleFunc("/wizardprogramming",func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(s.cfg.rootDir, s.cfg.templates, wizardProgrammingPage))})
+
+
+	// Kcawd route.
+	router.Handle("/kcawd", s.handle(s.buildKCawdPage)).Methods("GET")
+	router.Handle("/kcawd/{id:[0-9]+}", s.handle(s.serveKCawdPDF)).Methods("GET")
+	router.Handle("/kcawd/{id:[0-9]+}/thumbnail.png", s.handle(s.serveKCawdThumbnail)).Methods("GET")
+
+	// SCP route.
+	scp := router.PathPrefix("/scp").Subrouter()
+	scp.Handle("/static/{item}", http.StripPrefix("/scp/static", http.FileServer(http.Dir(filepath.Join(s.cfg.rootDir, s.cfg.static))))).Methods("GET")
+	scp.Handle("/images/{dir}/{item}", s.handle(s.serveImage)).Methods("GET")
+	scp.Handle("", s.handle(s.buildSCPHome)).Methods("GET")
+	scp.Handle("/{optional}", s.handle(s.buildSCP)).Methods("GET")
+	
+	// Christopher.cawdrey.name route.
+	router.Handle("/history", s.handle(s.buildNavPage)).Methods("GET")
+	router.Handle("/history/{year:[0-9]{4}}", s.handle(s.buildNavPage)).Methods("GET")
+	router.Handle("/history/{year:[0-9]{4}}/{month:[0-9]{2}}", s.handle(s.buildNavPage)).Methods("GET")
+	router.Handle("/entry/{year:[0-9]{4}}/{slug}", s.handle(s.buildSlugPage)).Methods("GET")
+	router.Handle("/entry/{id:[0-9]+}", s.handle(s.buildPage)).Methods("GET")
+	if s.commentsEnabled() {
+		commentForms := s.commentForms()
+		router.Handle("/entry/{id:[0-9]+}/comments", commentForms(s.handle(s.buildCommentPage))).Methods("GET")
+		router.Handle("/entry/{id:[0-9]+}/comments", commentForms(s.handle(s.postComment))).Methods("POST")
+	}
+	router.Handle("/feeds/{type}", s.handle(s.buildFeedPage)).Methods("GET")
+	router.Handle("/static/{item}", http.StripPrefix("/static", http.FileServer(http.Dir(filepath.Join(s.cfg.rootDir, s.cfg.static))))).Methods("GET")
+	router.Handle("/images/{item}", s.handle(s.serveImage)).Methods("GET")
+	router.Handle("/images/{dir}/{item}", s.handle(s.serveImage)).Methods("GET")
+	router.Handle("/gallery", s.handle(s.buildGalleriesPage)).Methods("GET")
+	router.Handle("/gallery/{album}", s.handle(s.buildGalleryPage)).Methods("GET")
+	router.Handle("/gallery/{album}/index.json", s.handle(s.serveGalleryIndex)).Methods("GET")
+	if s.cfg.webmentions {
+		router.Handle(webmentionPath, s.handle(s.receiveWebmention)).Methods("POST")
+		router.HandleFunc(pingbackPath, s.receivePingback).Methods("POST")
+	}
+	if s.federationEnabled() {
+		router.Handle(webfingerPath, s.handle(s.serveWebFinger)).Methods("GET")
+		router.Handle(actorPath, s.handle(s.serveActor)).Methods("GET")
+		router.Handle(outboxPath, s.handle(s.serveOutbox)).Methods("GET")
+		router.Handle(followersPath, s.handle(s.serveFollowers)).Methods("GET")
+		router.Handle(inboxPath, s.handle(s.postInbox)).Methods("POST")
+	}
+	if s.newsletterEnabled() {
+		router.Handle(newsletterPath, s.handle(s.buildNewsletterPage)).Methods("GET")
+		router.Handle(newsletterPath, s.handle(s.postSubscribe)).Methods("POST")
+		router.Handle(confirmPath, s.handle(s.buildConfirmPage)).Methods("GET")
+		router.Handle(confirmPath, s.handle(s.confirmSubscription)).Methods("POST")
+		router.Handle(unsubscribePath, s.handle(s.buildUnsubscribePage)).Methods("GET")
+		router.Handle(unsubscribePath, s.handle(s.unsubscribe)).Methods("POST")
+	}
+	if s.cfg.websubBuiltinHub {
+		router.Handle(hubPath, s.handle(s.postHub)).Methods("POST")
+	}
+	if s.adminEnabled() {
+		s.adminRoutes(router)
+	}
+	router.Handle("/{id}", s.handle(s.buildOneOff)).Methods("GET")
+	router.NotFoundHandler = http.HandlerFunc(s.notFound)
+	router.Use(s.recoverer)
+	return router
+}
+
 func main() {
-	initDeps()
+	flag.Parse()
+	var adminPassword string
+	if *adminPasswordFile != "" {
+		password, err := ioutil.ReadFile(*adminPasswordFile)
+		if err != nil {
+			log.Fatalf("could not read admin password: %v", err)
+		}
+		adminPassword = strings.TrimSpace(string(password))
+	}
+	var smtpPassword string
+	if *smtpPasswordFile != "" {
+		password, err := ioutil.ReadFile(*smtpPasswordFile)
+		if err != nil {
+			log.Fatalf("could not read SMTP password: %v", err)
+		}
+		smtpPassword = strings.TrimSpace(string(password))
+	}
+	store, err := db.Open(filepath.Join(*rootDir, *dbPath), *queryTimeout)
+	if err != nil {
+		log.Fatalf("could not open database: %v", err)
+	}
+	defer store.Close()
+	s, err := newServer(store, config{
+		rootDir:   *rootDir,
+		logDir:    *logDir,
+		templates: *templates,
+		resources: *resources,
+		static:    *static,
+		articles:  *articles,
+		adminUser:      *adminUser,
+		adminPassword:  adminPassword,
+		maxArticleSize: *maxArticleSize,
+		secureCookies:  *secureCookies,
+		pdftoppm:       *pdftoppm,
+		imageMemoryCache:  *imageMemoryCache,
+		imageCacheTTL:     *imageCacheTTL,
+		imageCacheDir:     *imageCacheDir,
+		imageDiskCache:    *imageDiskCache,
+		keepImageMetadata: *keepImageMetadata,
+		commentLimit:  *commentLimit,
+		commentWindow: *commentWindow,
+		trustedProxies: *trustedProxies,
+		webmentions:    *webmentions,
+		activityPubKey: *activityPubKey,
+		allowPrivateNetwork: *allowPrivateNetwork,
+		smtpAddr:       *smtpAddr,
+		smtpUser:       *smtpUser,
+		smtpPassword:   smtpPassword,
+		newsletterFrom: *newsletterFrom,
+		digestInterval: *digestInterval,
+		websubHub:        *websubHub,
+		websubBuiltinHub: *websubBuiltinHub,
+	})
+	if err != nil {
+		log.Fatalf("could not initialize server: %v", err)
+	}
 	
 	// TODO:
 	// 1) DONE -- Build converter package from DB to serving structs
@@ -398,41 +978,27 @@ func main() {
 	// 7) DONE -- DB Driver does this for me -- Check to see if I need to sanitize my URL vars before querying DB.
 	// 8) Backup all SD cards
 	// 9) Minimize all JPGs in shared folder.
-	// 9.5) Maybe cache to disk actually. Use imageproxy. Tier the cache. 100mb memory by 2hrs first. Disk cache next. Convert to png and 200px on the fly.
+	// 9.5) DONE -- Maybe cache to disk actually. Use imageproxy. Tier the cache. 100mb memory by 2hrs first. Disk cache next. Convert to png and 200px on the fly.
 	// 10) Conglomerate html files. They can have a common base.
-	// 11) I should probably write unit tests...
+	// 11) DONE -- I should probably write unit tests...
 	// 12) All nodes should bring servers up on startup. Head node should restart /mnt/usb sharing server on startup also.
 	// 13) Implement logging and debugging middleware and make it not terrible. This is halfway done. I'd like debug logs to be in combined logging format however.
 
-	router := mux.NewRouter()
-	router.HandleFunc("/", buildLandingPage).Methods("GET")
-	router.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, filepath.Join(*rootDir, "robots.txt"))})
-
-	// ChrisTheWizardProgrammer route.
-	router.HandleFunc("/wizardprogramming",func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, filepath.Join(*rootDir, *templates, wizardProgrammingPage))})
-
-
-	// Kcawd route.
-	router.HandleFunc("/kcawd", buildKCawdPage).Methods("GET")
-	router.HandleFunc("/kcawd/{id}", serveKCawdPDF).Methods("GET")
+	go s.runExtractor(context.Background())
+	if s.cfg.webmentions {
+		go s.runMentions(context.Background())
+	}
+	if s.federationEnabled() {
+		go s.runFederation(context.Background())
+	}
+	if s.newsletterEnabled() {
+		go s.runNewsletter(context.Background())
+	}
+	if s.websubEnabled() {
+		go s.runWebSub(context.Background())
+	}
 
-	// SCP route.
-	scp := router.PathPrefix("/scp").Subrouter()
-	scp.Handle("/static/{item}", http.StripPrefix("/scp/static", http.FileServer(http.Dir(filepath.Join(*rootDir, *static))))).Methods("GET")
-	scp.Handle("/images/{dir}/{item}", http.StripPrefix("/scp/images", http.FileServer(http.Dir(filepath.Join(*rootDir, *resources))))).Methods("GET")
-	scp.HandleFunc("", buildSCPHome).Methods("GET")
-	scp.HandleFunc("/{optional}", buildSCP).Methods("GET")
-	
-	// Christopher.cawdrey.name route.
-	router.HandleFunc("/history", buildNavPage).Methods("GET")
-	router.HandleFunc("/entry/{id}", buildPage).Methods("GET")
-	router.HandleFunc("/feeds/{type}", buildFeedPage).Methods("GET")
-	router.Handle("/static/{item}", http.StripPrefix("/static", http.FileServer(http.Dir(filepath.Join(*rootDir, *static))))).Methods("GET")
-	router.Handle("/images/{item}", http.StripPrefix("/images", http.FileServer(http.Dir(filepath.Join(*rootDir, *resources))))).Methods("GET")
-	router.Handle("/images/{dir}/{item}", http.StripPrefix("/images", http.FileServer(http.Dir(filepath.Join(*rootDir, *resources))))).Methods("GET")
-	router.HandleFunc("/{id}", buildLandingPage).Methods("GET")
-	router.Use(logger) 
+	router := s.routes()
+	router.Use(s.logger)
 	log.Fatal(http.ListenAndServe(*port, router))
 }
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/db/dbtest"
+)
+
+// newTestServer returns a server over the fixture database and testdata/.
+// opts can adjust the config first.
+func newTestServer(t *testing.T, opts ...func(*config)) *server {
+	t.Helper()
+	s, _ := newTestServerDB(t, opts...)
+	return s
+}
+
+// newTestServerDB is newTestServer that also returns a raw handle on its
+// database for further setup.
+func newTestServerDB(t *testing.T, opts ...func(*config)) (*server, *sql.DB) {
+	t.Helper()
+	store, raw := dbtest.Open(t)
+	cfg := config{
+		rootDir:   "testdata",
+		logDir:    "logs",
+		templates: "templates",
+		resources: "resources",
+		static:    "static",
+		articles:  "dir:testdata/articles",
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	s, err := newServer(store, cfg)
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+	return s, raw
+}
+
+func TestRoutes(t *testing.T) {
+	router := newTestServer(t).routes()
+
+	tests := []struct {
+		name         string
+		path         string
+		accept       string
+		wantStatus   int
+		wantBody     string
+		wantLocation string
+	}{
+		{name: "landing", path: "/", wantStatus: http.StatusOK, wantBody: "landing|Third Post||/entry/2017/second-post"},
+		{name: "robots", path: "/robots.txt", wantStatus: http.StatusOK, wantBody: "User-agent"},
+		{name: "wizard", path: "/wizardprogramming", wantStatus: http.StatusOK, wantBody: "wizard"},
+		{name: "kcawd", path: "/kcawd", wantStatus: http.StatusOK, wantBody: "kcawd||An Article|||A Stored Article|"},
+		{name: "kcawd search", path: "/kcawd?q=stored", wantStatus: http.StatusOK, wantBody: "kcawd|stored|A Stored Article|||\n"},
+		{name: "kcawd search no match", path: "/kcawd?q=nothing", wantStatus: http.StatusOK, wantBody: "kcawd|nothing|\n"},
+		{name: "kcawd no thumbnail", path: "/kcawd/1600000000/thumbnail.png", wantStatus: http.StatusNotFound},
+		{name: "kcawd pdf", path: "/kcawd/1600000000", wantStatus: http.StatusOK, wantBody: "%PDF-1.4 fixture"},
+		{name: "kcawd stored pdf", path: "/kcawd/1590000000", wantStatus: http.StatusOK, wantBody: "%PDF-1.4 stored"},
+		{name: "kcawd missing pdf", path: "/kcawd/1", wantStatus: http.StatusNotFound},
+		{name: "kcawd zero id", path: "/kcawd/0", wantStatus: http.StatusBadRequest, wantBody: "error|400|"},
+		{name: "kcawd non-numeric", path: "/kcawd/abc", wantStatus: http.StatusNotFound},
+		{name: "scp home", path: "/scp", wantStatus: http.StatusOK, wantBody: "scp|scp landing"},
+		{name: "scp page", path: "/scp/faqs", wantStatus: http.StatusOK, wantBody: "scp|scp faqs"},
+		{name: "scp page with digits", path: "/scp/trail-2", wantStatus: http.StatusOK, wantBody: "scp|scp trail 2"},
+		{name: "scp missing page", path: "/scp/missing", wantStatus: http.StatusNotFound},
+		{name: "scp static", path: "/scp/static/site.css", wantStatus: http.StatusOK, wantBody: "body {}"},
+		{name: "scp images", path: "/scp/images/photos/note.txt", wantStatus: http.StatusOK, wantBody: "photo"},
+		{name: "history", path: "/history", wantStatus: http.StatusOK, wantBody: "history|History|2018:1|Third Post2017:2|Second Post|First Post"},
+		{name: "history year", path: "/history/2017", wantStatus: http.StatusOK, wantBody: "history|2017|2017:2|Second Post|First Post"},
+		{name: "history month", path: "/history/2017/03", wantStatus: http.StatusOK, wantBody: "history|March 2017|2017:2|First Post"},
+		{name: "history empty year", path: "/history/2001", wantStatus: http.StatusNotFound},
+		{name: "history bad month", path: "/history/2017/13", wantStatus: http.StatusNotFound},
+		{name: "history bad page", path: "/history?page=x", wantStatus: http.StatusBadRequest},
+		{name: "history past last page", path: "/history?page=2", wantStatus: http.StatusNotFound},
+		{name: "entry by slug", path: "/entry/2017/second-post", wantStatus: http.StatusOK,
+			wantBody: "entry|Second Post|<p>Second</p>|/entry/2017/first-post|/entry/2018/third-post"},
+		{name: "entry slug wrong year", path: "/entry/2016/second-post", wantStatus: http.StatusMovedPermanently,
+			wantLocation: "/entry/2017/second-post"},
+		{name: "entry missing slug", path: "/entry/2017/missing", wantStatus: http.StatusNotFound},
+		{name: "entry draft slug", path: "/entry/2018/draft", wantStatus: http.StatusNotFound},
+		{name: "entry by id", path: "/entry/2", wantStatus: http.StatusMovedPermanently, wantLocation: "/entry/2017/second-post"},
+		{name: "entry by legacy timestamp", path: "/entry/1500000000", wantStatus: http.StatusMovedPermanently,
+			wantLocation: "/entry/2017/second-post"},
+		{name: "entry missing id", path: "/entry/99", wantStatus: http.StatusNotFound},
+		{name: "entry non-numeric id", path: "/entry/abc", wantStatus: http.StatusNotFound},
+		{name: "atom feed", path: "/feeds/atom.xml", wantStatus: http.StatusOK, wantBody: "<title>Third Post</title>"},
+		{name: "rss feed", path: "/feeds/rss.xml", wantStatus: http.StatusOK, wantBody: "<title>Second Post</title>"},
+		{name: "json feed", path: "/feeds/jsonfeed.json", wantStatus: http.StatusOK, wantBody: `"title": "First Post"`},
+		{name: "unknown feed", path: "/feeds/feed.txt", wantStatus: http.StatusNotFound},
+		{name: "static", path: "/static/site.css", wantStatus: http.StatusOK, wantBody: "body {}"},
+		{name: "image", path: "/images/top.txt", wantStatus: http.StatusOK, wantBody: "top"},
+		{name: "image in dir", path: "/images/photos/note.txt", wantStatus: http.StatusOK, wantBody: "photo"},
+		{name: "image missing", path: "/images/photos/missing.png", wantStatus: http.StatusNotFound},
+		{name: "image bad width", path: "/images/photos/gradient.png?width=0", wantStatus: http.StatusBadRequest},
+		{name: "image unoffered width", path: "/images/photos/gradient.png?width=10", wantStatus: http.StatusBadRequest},
+		{name: "image bad format", path: "/images/photos/gradient.png?format=bmp", wantStatus: http.StatusBadRequest},
+		{name: "resize non-image", path: "/images/photos/note.txt?width=320", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "oneoff", path: "/about", wantStatus: http.StatusOK, wantBody: "entry|about|<p>About this site</p>"},
+		{name: "oneoff image", path: "/about", wantStatus: http.StatusOK,
+			wantBody: `src="/images/photos/gradient.png" width="40" height="20" alt="A gradient" loading="lazy"`},
+		{name: "oneoff album", path: "/photos", wantStatus: http.StatusOK,
+			wantBody: `<div class="gallery" data-index="/gallery/photos/index.json"><figure class="image"><a href="/images/photos/dusk.jpg">`},
+		{name: "galleries", path: "/gallery", wantStatus: http.StatusOK,
+			wantBody: "galleries|photos|/gallery/photos|/images/photos/dusk.jpg?width=320|2|\n"},
+		{name: "gallery", path: "/gallery/photos", wantStatus: http.StatusOK,
+			wantBody: "gallery|photos|/gallery/photos/index.json|/images/photos/dusk.jpg|/images/photos/dusk.jpg?width=320|Dusk over the ridge|June 1, 2019|/images/photos/gradient.png|/images/photos/gradient.png?width=320|||"},
+		{name: "gallery index", path: "/gallery/photos/index.json", wantStatus: http.StatusOK,
+			wantBody: `{"src":"/images/photos/dusk.jpg","msrc":"/images/photos/dusk.jpg?width=320","w":40,"h":20,"title":"Dusk over the ridge","taken":"2019-06-01T18:30:00`},
+		{name: "gallery missing", path: "/gallery/missing", wantStatus: http.StatusNotFound, wantBody: "error|404|"},
+		{name: "gallery of a file", path: "/gallery/top.txt", wantStatus: http.StatusNotFound},
+		{name: "gallery index missing", path: "/gallery/missing/index.json", wantStatus: http.StatusNotFound},
+		{name: "unknown oneoff", path: "/missing", wantStatus: http.StatusNotFound, wantBody: "error|404|"},
+		{name: "unknown oneoff json", path: "/missing", accept: "application/json", wantStatus: http.StatusNotFound,
+			wantBody: `"status":404`},
+		{name: "unknown path", path: "/a/b/c/d", wantStatus: http.StatusNotFound, wantBody: "error|404|"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("GET %s status = %d, want %d", tc.path, rec.Code, tc.wantStatus)
+			}
+			if !strings.Contains(rec.Body.String(), tc.wantBody) {
+				t.Errorf("GET %s body = %q, want it to contain %q", tc.path, rec.Body.String(), tc.wantBody)
+			}
+			if location := rec.Header().Get("Location"); location != tc.wantLocation {
+				t.Errorf("GET %s Location = %q, want %q", tc.path, location, tc.wantLocation)
+			}
+		})
+	}
+}
+
+// TestStoredXSS writes script into the content columns of entries, as if
+// the database had been tampered with, and checks the pages escape it.
+func TestStoredXSS(t *testing.T) {
+	store, raw := dbtest.Open(t)
+	_, err := raw.Exec(`INSERT INTO entry (id, timestamp, title, slug, paragraph, image, blocks, published) VALUES
+		(10, 1600000000, 'Legacy', 'legacy', 'hi <script>alert(1)</script>\n<img src=x onerror=alert(2)>', 'javascript:alert(3)\n/images/a.jpg" onerror="alert(4)', '', 1600000000),
+		(11, 1600000100, 'Blocks', 'blocks', '', '', '[{"type": "paragraph", "text": "<script>alert(5)</script>"}, {"type": "image", "src": "data:text/html,<script>alert(6)</script>"}]', 1600000100)`)
+	if err != nil {
+		t.Fatalf("failed to insert entries: %v", err)
+	}
+	s, err := newServer(store, config{rootDir: "testdata", templates: "templates", resources: "resources", static: "static"})
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+	router := s.routes()
+
+	for _, path := range []string{"/entry/2020/legacy", "/entry/2020/blocks"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want %d", path, rec.Code, http.StatusOK)
+		}
+		body := rec.Body.String()
+		for _, bad := range []string{"<script", "<img src=x", " onerror=", `="javascript:`, `="data:`} {
+			if strings.Contains(body, bad) {
+				t.Errorf("GET %s body = %q, contains %q", path, body, bad)
+			}
+		}
+	}
+}
+
+func TestServeImage(t *testing.T) {
+	router := newTestServer(t, func(cfg *config) {
+		cfg.imageMemoryCache = 1 << 20
+		cfg.imageCacheDir = t.TempDir()
+		cfg.imageDiskCache = 1 << 20
+	}).routes()
+
+	for _, path := range []string{"/images/photos/gradient.png?width=320&format=jpeg", "/scp/images/photos/gradient.png?width=320&format=jpeg"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want %d", path, rec.Code, http.StatusOK)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "image/jpeg" {
+			t.Errorf("GET %s Content-Type = %q, want image/jpeg", path, ct)
+		}
+		img, err := jpeg.Decode(rec.Body)
+		if err != nil {
+			t.Fatalf("GET %s is not a JPEG: %v", path, err)
+		}
+		// Too small to shrink, so only converted.
+		if b := img.Bounds(); b.Dx() != 40 || b.Dy() != 20 {
+			t.Errorf("GET %s is %dx%d, want 40x20", path, b.Dx(), b.Dy())
+		}
+
+		req = httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("GET %s with its ETag status = %d, want %d", path, rec.Code, http.StatusNotModified)
+		}
+	}
+}
+
+// TestServeImageMetadata checks photos lose their camera details unless
+// the server is told to keep them.
+func TestServeImageMetadata(t *testing.T) {
+	// testdata/resources/photos/dusk.jpg has the camera's serial number in its EXIF.
+	const serial = "1234567"
+	for _, keep := range []bool{false, true} {
+		router := newTestServer(t, func(cfg *config) { cfg.keepImageMetadata = keep }).routes()
+		req := httptest.NewRequest(http.MethodGet, "/images/photos/dusk.jpg", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET with keepImageMetadata %t status = %d, want %d", keep, rec.Code, http.StatusOK)
+		}
+		if got := strings.Contains(rec.Body.String(), serial); got != keep {
+			t.Errorf("GET with keepImageMetadata %t served the serial number: %t", keep, got)
+		}
+	}
+}
+
+func TestServeKCawdPDF(t *testing.T) {
+	router := newTestServer(t).routes()
+	const etag = `"c5c2e8be6ad0825a56ded1f1a153ceaf11dc060ab44b120a94406a08207babc2"`
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "whole", wantStatus: http.StatusOK, wantBody: "%PDF-1.4 fixture"},
+		{name: "range", header: http.Header{"Range": {"bytes=5-7"}}, wantStatus: http.StatusPartialContent, wantBody: "1.4"},
+		{name: "etag match", header: http.Header{"If-None-Match": {etag}}, wantStatus: http.StatusNotModified},
+		{name: "not modified since", header: http.Header{"If-Modified-Since": {time.Unix(1600000100, 0).UTC().Format(http.TimeFormat)}},
+			wantStatus: http.StatusNotModified},
+		{name: "modified since", header: http.Header{"If-Modified-Since": {time.Unix(1600000000, 0).UTC().Format(http.TimeFormat)}},
+			wantStatus: http.StatusOK, wantBody: "%PDF-1.4 fixture"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/kcawd/1600000000", nil)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if body := rec.Body.String(); body != tc.wantBody {
+				t.Errorf("body = %q, want %q", body, tc.wantBody)
+			}
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %q, want %q", got, etag)
+			}
+		})
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"application/json, text/html;q=0.5", true},
+		{"text/html, application/json;q=0.5", false},
+		{"text/*;q=0.9, application/json;q=0.8", false},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", tc.accept)
+		if got := wantsJSON(req); got != tc.want {
+			t.Errorf("wantsJSON(%q) = %v, want %v", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantBody   string
+	}{
+		{"http error", statusError(http.StatusBadRequest, "bad input", errors.New("detail")), http.StatusBadRequest, "error|400|bad input"},
+		{"plain error", errors.New("secret detail"), http.StatusInternalServerError, "error|500|" + serverErrorMessage},
+		{"store timeout", storeError("lookup failed", fmt.Errorf("lookup: %w", db.ErrTimeout)), http.StatusGatewayTimeout, "error|504|"},
+		{"store busy", storeError("lookup failed", fmt.Errorf("lookup: %w", db.ErrUnavailable)), http.StatusServiceUnavailable, "error|503|"},
+		{"store not found", storeError("lookup failed", fmt.Errorf("lookup: %w", db.ErrNotFound)), http.StatusNotFound, "error|404|" + notFoundMessage},
+		{"store invalid id", storeError("lookup failed", fmt.Errorf("lookup: %w", db.ErrInvalidID)), http.StatusBadRequest, "error|400|invalid request"},
+		{"store failure", storeError("lookup failed", errors.New("secret detail")), http.StatusInternalServerError, "error|500|lookup failed"},
+	}
+	s := newTestServer(t)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := s.handle(func(w http.ResponseWriter, r *http.Request) error { return tc.err })
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tc.wantBody) || strings.Contains(body, "detail") {
+				t.Errorf("body = %q, want %q without internal details", body, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandleCanceled(t *testing.T) {
+	s := newTestServer(t)
+	h := s.handle(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := s.entryStore.GetEntry(r.Context(), 1)
+		return storeError("lookup failed", err)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+
+	if rec.Body.Len() != 0 {
+		t.Errorf("body = %q, want nothing written for a canceled request", rec.Body.String())
+	}
+}
+
+func TestRecoverer(t *testing.T) {
+	h := newTestServer(t).recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(rec.Body.String(), "error|500|") {
+		t.Errorf("body = %q, want the 500 page", rec.Body.String())
+	}
+}
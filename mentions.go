@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/serving"
+	"github.com/dubJay/webmention"
+)
+
+const (
+	webmentionPath = "/webmention"
+	pingbackPath   = "/pingback"
+
+	// How often to look for newly published entries to send mentions for.
+	// Mentions received are checked right away.
+	mentionInterval = 15 * time.Minute
+	// How long a source that can't be fetched is retried before the mention
+	// is dropped.
+	mentionRetry = 24 * time.Hour
+	// Mentions one address may send per hour.
+	mentionLimit = 30
+	// Largest Webmention form or Pingback call accepted.
+	maxMentionRequest = 64 << 10
+)
+
+var (
+	slugPathPattern = regexp.MustCompile(`^/entry/[0-9]{4}/([^/]+)$`)
+	idPathPattern   = regexp.MustCompile(`^/entry/([0-9]+)$`)
+)
+
+// runMentions checks received mentions and sends mentions for newly
+// published entries until ctx is done, once at start, then every
+// mentionInterval or when the mention worker is woken.
+func (s *server) runMentions(ctx context.Context) {
+	s.mentionWorker.run(ctx,
+		pass{"mention verification", s.verifyMentions},
+		pass{"sending mentions", s.sendMentions},
+	)
+}
+
+// verifyMentions fetches the source of every pending mention and keeps the
+// ones that link to their entry.
+func (s *server) verifyMentions(ctx context.Context) error {
+	mentions, err := s.mentionStore.GetPendingMentions(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list pending mentions: %w", err)
+	}
+	for _, m := range mentions {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		source, err := s.mentions.Verify(ctx, m.Source, m.Target)
+		switch {
+		case err == nil:
+			err = s.mentionStore.VerifyMention(ctx, m.Id, source.Title)
+			if err == nil {
+				log.Printf("verified mention of entry %d from %s", m.EntryId, m.Source)
+			}
+		case errors.Is(err, webmention.ErrNoLink), errors.Is(err, webmention.ErrGone), time.Since(m.Received) > mentionRetry:
+			log.Printf("dropping mention of entry %d from %s: %v", m.EntryId, m.Source, err)
+			err = s.mentionStore.DeleteMention(ctx, m.Id)
+		default:
+			// Most likely the source is down; try again next pass.
+			log.Printf("unable to verify mention of entry %d from %s: %v", m.EntryId, m.Source, err)
+			continue
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			// Deleted while we worked.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to save mention %d: %w", m.Id, err)
+		}
+	}
+	return nil
+}
+
+// sendMentions notifies every site linked from an entry published or edited
+// since mentions were last sent for it. Links to sites that take neither
+// Webmentions nor Pingbacks are skipped, and failures aren't retried.
+func (s *server) sendMentions(ctx context.Context) error {
+	entries, err := s.mentionStore.GetUnmentionedEntries(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list entries: %w", err)
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.sendEntryMentions(ctx, entry)
+		err := s.mentionStore.SetEntryMentioned(ctx, entry)
+		if err == db.ErrNotFound {
+			// Edited while we worked; the next pass has it.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to record mentions sent for entry %d: %w", entry.Id, err)
+		}
+	}
+	return nil
+}
+
+func (s *server) sendEntryMentions(ctx context.Context, entry db.Entry) {
+	content, err := serving.EntryToServing(entry, db.Navigation{}, s.site())
+	if err != nil {
+		// It can't be shown either, so there's nothing to mention.
+		log.Printf("unable to render entry %d to send mentions: %v", entry.Id, err)
+		return
+	}
+	source := siteURL + content.Path
+	base, err := url.Parse(source)
+	if err != nil {
+		log.Printf("invalid entry URL %q: %v", source, err)
+		return
+	}
+	for _, target := range webmention.Links(string(content.HTML), base) {
+		endpoint, err := s.mentions.Send(ctx, source, target)
+		switch {
+		case errors.Is(err, webmention.ErrNoEndpoint):
+		case err != nil:
+			log.Printf("unable to mention %s from entry %d: %v", target, entry.Id, err)
+		default:
+			log.Printf("mentioned %s from entry %d (pingback: %t)", target, entry.Id, endpoint.Pingback)
+		}
+	}
+}
+
+// mentionedEntry checks a mention received from source and returns the entry
+// target is. Errors are for the sender.
+func (s *server) mentionedEntry(ctx context.Context, source, target string) (db.Entry, error) {
+	src, err := url.Parse(source)
+	if err != nil || (src.Scheme != "http" && src.Scheme != "https") || src.Host == "" {
+		return db.Entry{}, statusError(http.StatusBadRequest, "the source must be an http or https URL",
+			fmt.Errorf("invalid source %q", source))
+	}
+	if source == target {
+		return db.Entry{}, statusError(http.StatusBadRequest, "the source and target must differ",
+			fmt.Errorf("source is target %q", source))
+	}
+	site, _ := url.Parse(siteURL)
+	dst, err := url.Parse(target)
+	if err != nil || (dst.Scheme != "http" && dst.Scheme != "https") || dst.Host != site.Host {
+		return db.Entry{}, statusError(http.StatusBadRequest, "the target must be on this site",
+			fmt.Errorf("invalid target %q", target))
+	}
+
+	var entry db.Entry
+	if m := slugPathPattern.FindStringSubmatch(dst.Path); m != nil {
+		entry, err = s.entryStore.GetEntryBySlug(ctx, m[1])
+	} else if m := idPathPattern.FindStringSubmatch(dst.Path); m != nil {
+		id, _ := strconv.Atoi(m[1])
+		entry, err = s.entryStore.GetEntry(ctx, id)
+		if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrInvalidID) {
+			entry, err = s.entryStore.GetEntryByTimestamp(ctx, id)
+		}
+	} else {
+		err = db.ErrNotFound
+	}
+	if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrInvalidID) {
+		return db.Entry{}, statusError(http.StatusBadRequest, "the target is not an entry on this site",
+			fmt.Errorf("no entry at target %q: %w", target, err))
+	}
+	if err != nil {
+		return db.Entry{}, storeError("failed to look up target", fmt.Errorf("unable to get entry for %q: %w", target, err))
+	}
+	return entry, nil
+}
+
+// receiveMention queues a mention for verification.
+func (s *server) receiveMention(r *http.Request, source, target string) error {
+	ip := s.clientIP(r)
+	if !s.mentionLimiter.allow(ip) {
+		return statusError(http.StatusTooManyRequests, "too many mentions, please try again later",
+			fmt.Errorf("too many mentions from %s", ip))
+	}
+	entry, err := s.mentionedEntry(r.Context(), source, target)
+	if err != nil {
+		return err
+	}
+	if err := s.mentionStore.AddMention(r.Context(), entry.Id, source, target); err != nil {
+		return storeError("failed to save mention", fmt.Errorf("unable to add mention of entry %d: %w", entry.Id, err))
+	}
+	log.Printf("received mention of entry %d from %s", entry.Id, source)
+	s.mentionWorker.request()
+	return nil
+}
+
+func (s *server) receiveWebmention(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxMentionRequest)
+	if err := r.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "the form could not be read", err)
+	}
+	if err := s.receiveMention(r, r.PostFormValue("source"), r.PostFormValue("target")); err != nil {
+		return err
+	}
+	// Verification happens later, so all there is to say is that it will.
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+func (s *server) receivePingback(w http.ResponseWriter, r *http.Request) {
+	source, target, err := webmention.ParsePing(http.MaxBytesReader(w, r.Body, maxMentionRequest))
+	if err == nil {
+		err = s.receiveMention(r, source, target)
+	}
+	if err == nil {
+		webmention.WritePingResult(w, "Pingback received and waiting to be checked")
+		return
+	}
+
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	var httpErr *httpError
+	if errors.As(err, &httpErr) {
+		// Pingback has its own codes for the ways a target can be wrong.
+		code := 0
+		switch httpErr.Status {
+		case http.StatusBadRequest:
+			code = webmention.FaultTargetInvalid
+		case http.StatusNotFound:
+			code = webmention.FaultTargetNotFound
+		}
+		err = &webmention.Fault{Code: code, Message: httpErr.Message}
+	}
+	webmention.WriteFault(w, err)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dubJay/webmention"
+)
+
+func withMentions(cfg *config) {
+	cfg.webmentions = true
+	cfg.allowPrivateNetwork = true
+}
+
+func postMention(router http.Handler, source, target string) *httptest.ResponseRecorder {
+	form := url.Values{"source": {source}, "target": {target}}
+	req := httptest.NewRequest(http.MethodPost, webmentionPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestReceiveWebmention(t *testing.T) {
+	const source = "https://blog.example.com/new"
+	tests := []struct {
+		name       string
+		source     string
+		target     string
+		wantStatus int
+	}{
+		{name: "slug", source: source, target: siteURL + "/entry/2017/second-post", wantStatus: http.StatusAccepted},
+		{name: "wrong year", source: source, target: siteURL + "/entry/2016/second-post", wantStatus: http.StatusAccepted},
+		{name: "id", source: source, target: siteURL + "/entry/2", wantStatus: http.StatusAccepted},
+		{name: "timestamp", source: source, target: siteURL + "/entry/1500000000", wantStatus: http.StatusAccepted},
+		{name: "http", source: "http://blog.example.com/new", target: "http://christopher.cawdrey.name/entry/2",
+			wantStatus: http.StatusAccepted},
+		{name: "other site", source: source, target: "https://example.com/entry/2", wantStatus: http.StatusBadRequest},
+		{name: "not an entry", source: source, target: siteURL + "/history", wantStatus: http.StatusBadRequest},
+		{name: "draft", source: source, target: siteURL + "/entry/4", wantStatus: http.StatusBadRequest},
+		{name: "missing entry", source: source, target: siteURL + "/entry/2017/missing", wantStatus: http.StatusBadRequest},
+		{name: "bad source", source: "file:///etc/passwd", target: siteURL + "/entry/2", wantStatus: http.StatusBadRequest},
+		{name: "source is target", source: siteURL + "/entry/2", target: siteURL + "/entry/2", wantStatus: http.StatusBadRequest},
+		{name: "empty", wantStatus: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, withMentions)
+			if rec := postMention(s.routes(), tc.source, tc.target); rec.Code != tc.wantStatus {
+				t.Fatalf("POST %s = %d, want %d", webmentionPath, rec.Code, tc.wantStatus)
+			}
+			pending, err := s.mentionStore.GetPendingMentions(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The fixtures have one pending already.
+			if want := map[bool]int{true: 2, false: 1}[tc.wantStatus == http.StatusAccepted]; len(pending) != want {
+				t.Errorf("%d pending mentions, want %d", len(pending), want)
+			}
+		})
+	}
+}
+
+func TestReceivePingback(t *testing.T) {
+	s := newTestServer(t, withMentions)
+	router := s.routes()
+
+	call := func(source, target string) string {
+		body := `<?xml version="1.0"?><methodCall><methodName>pingback.ping</methodName><params>` +
+			`<param><value><string>` + source + `</string></value></param>` +
+			`<param><value><string>` + target + `</string></value></param></params></methodCall>`
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, pingbackPath, strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d, want 200", pingbackPath, rec.Code)
+		}
+		return rec.Body.String()
+	}
+	if got := call("https://blog.example.com/ping", siteURL+"/entry/2018/third-post"); !strings.Contains(got, "Pingback received") {
+		t.Errorf("pingback = %q, want success", got)
+	}
+	if got := call("https://blog.example.com/ping", siteURL+"/history"); !strings.Contains(got, "<int>33</int>") {
+		t.Errorf("pingback of a non-entry = %q, want fault 33", got)
+	}
+	if pending, err := s.mentionStore.GetPendingMentions(context.Background()); err != nil || len(pending) != 2 {
+		t.Errorf("GetPendingMentions = %+v, %v, want the fixture's and the pingback", pending, err)
+	}
+}
+
+func TestMentionsDisabled(t *testing.T) {
+	router := newTestServer(t).routes()
+	if rec := postMention(router, "https://blog.example.com/new", siteURL+"/entry/2"); rec.Code == http.StatusAccepted {
+		t.Errorf("POST %s = %d with mentions off", webmentionPath, rec.Code)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, secondPostPath, nil))
+	if rec.Header().Get("Link") != "" || rec.Header().Get("X-Pingback") != "" {
+		t.Errorf("entry page advertises mention endpoints with mentions off: %v", rec.Header())
+	}
+}
+
+func TestVerifyMentions(t *testing.T) {
+	const target = siteURL + "/entry/2017/second-post"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reply", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<title>Re: Second</title><a href="`+target+`">second</a>`)
+	})
+	mux.HandleFunc("/nolink", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<title>Nothing</title>`)
+	})
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s, raw := newTestServerDB(t, withMentions)
+	router := s.routes()
+	// The fixture's pending mention has been failing for years.
+	if _, err := raw.Exec(`UPDATE mention SET source = ? WHERE id = 2`, srv.URL+"/down"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/reply", "/nolink", "/down?recent"} {
+		if rec := postMention(router, srv.URL+path, target); rec.Code != http.StatusAccepted {
+			t.Fatalf("POST %s = %d, want 202", path, rec.Code)
+		}
+	}
+
+	if err := s.verifyMentions(context.Background()); err != nil {
+		t.Fatalf("verifyMentions failed: %v", err)
+	}
+	pending, err := s.mentionStore.GetPendingMentions(context.Background())
+	if err != nil || len(pending) != 1 || pending[0].Source != srv.URL+"/down?recent" {
+		t.Errorf("GetPendingMentions = %+v, %v, want only the recent one that couldn't be fetched", pending, err)
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, secondPostPath, nil))
+	want := "|A reply:https://blog.example.com/reply|Re: Second:" + srv.URL + "/reply|\n"
+	if body := rec.Body.String(); !strings.HasSuffix(body, want) {
+		t.Errorf("entry page = %q, want mentions %q", body, want)
+	}
+	if got := rec.Header().Get("Link"); got != `<`+siteURL+`/webmention>; rel="webmention"` {
+		t.Errorf("Link = %q, want the webmention endpoint", got)
+	}
+	if got := rec.Header().Get("X-Pingback"); got != siteURL+"/pingback" {
+		t.Errorf("X-Pingback = %q, want the pingback server", got)
+	}
+}
+
+func TestSendMentions(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	record := func(kind, source, target string) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, kind+" "+source+" -> "+target)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/post", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</wm>; rel="webmention"`)
+	})
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Pingback", "/xmlrpc")
+	})
+	mux.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/wm", func(w http.ResponseWriter, r *http.Request) {
+		record("webmention", r.PostFormValue("source"), r.PostFormValue("target"))
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/xmlrpc", func(w http.ResponseWriter, r *http.Request) {
+		source, target, err := webmention.ParsePing(r.Body)
+		if err != nil {
+			webmention.WriteFault(w, err)
+			return
+		}
+		record("pingback", source, target)
+		webmention.WritePingResult(w, "ok")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s, raw := newTestServerDB(t, withMentions)
+	text := `See <a href="` + srv.URL + `/post">this</a>, <a href="` + srv.URL + `/old#top">that</a>, ` +
+		`<a href="` + srv.URL + `/plain">the other</a> and <a href="/entry/2017/first-post">mine</a>.`
+	blocks, _ := json.Marshal([]map[string]string{{"type": "paragraph", "text": text}})
+	if _, err := raw.Exec(`UPDATE entry SET blocks = ? WHERE id = 3`, string(blocks)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := s.sendMentions(ctx); err != nil {
+		t.Fatalf("sendMentions failed: %v", err)
+	}
+	source := siteURL + "/entry/2018/third-post"
+	want := []string{"webmention " + source + " -> " + srv.URL + "/post", "pingback " + source + " -> " + srv.URL + "/old"}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("received %q, want %q", received, want)
+	}
+	if entries, err := s.mentionStore.GetUnmentionedEntries(ctx); err != nil || len(entries) != 0 {
+		t.Errorf("GetUnmentionedEntries after sending = %d entries, %v, want none", len(entries), err)
+	}
+
+	received = nil
+	if err := s.sendMentions(ctx); err != nil || len(received) != 0 {
+		t.Errorf("second sendMentions sent %q, %v, want nothing", received, err)
+	}
+}
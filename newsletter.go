@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/newsletter"
+	"github.com/dubJay/serving"
+)
+
+const (
+	newsletterPage  = "newsletter.html"
+	newsletterPath  = "/newsletter"
+	confirmPath     = "/newsletter/confirm"
+	unsubscribePath = "/newsletter/unsubscribe"
+
+	// How often to look for new entries and digests to send. Confirmation
+	// links go out right away.
+	newsletterInterval = 15 * time.Minute
+	// How long a subscriber has to confirm before being forgotten.
+	confirmWindow = 7 * 24 * time.Hour
+	// Signups one address may make per hour.
+	subscribeLimit = 5
+	// Largest signup form accepted.
+	maxSubscribeForm = 4 << 10
+)
+
+// newsletterEnabled reports whether entries are emailed to subscribers,
+// which needs an SMTP server to send through.
+func (s *server) newsletterEnabled() bool {
+	return s.mailer != nil
+}
+
+// runNewsletter sends confirmation links, new entries and digests until ctx
+// is done, once at start, then every newsletterInterval or when the
+// newsletter worker is woken.
+func (s *server) runNewsletter(ctx context.Context) {
+	s.newsletterWorker.run(ctx,
+		pass{"sending newsletter confirmations", s.sendConfirmations},
+		pass{"mailing entries", s.mailEntries},
+		pass{"sending digests", func(ctx context.Context) error {
+			return s.sendDigests(ctx, time.Now())
+		}},
+	)
+}
+
+func unsubscribeURL(token string) string {
+	return siteURL + unsubscribePath + "?token=" + url.QueryEscape(token)
+}
+
+// sendConfirmations sends the confirmation link to everyone who has signed
+// up since the last pass, and forgets anyone who didn't confirm in time.
+func (s *server) sendConfirmations(ctx context.Context) error {
+	subscribers, err := s.subscriberStore.GetSubscribers(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list subscribers: %w", err)
+	}
+	for _, sub := range subscribers {
+		if !sub.Confirmed.IsZero() {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(sub.Created) > confirmWindow {
+			log.Printf("dropping unconfirmed subscriber %d", sub.Id)
+			err = s.subscriberStore.RemoveSubscriber(ctx, sub.Token)
+		} else if !sub.ConfirmationSent {
+			link := siteURL + confirmPath + "?token=" + url.QueryEscape(sub.Token)
+			err = s.mailer.Send(ctx, newsletter.Message{
+				From:    s.cfg.newsletterFrom,
+				To:      sub.Email,
+				Subject: "Confirm your subscription to " + siteTitle,
+				Text: "Someone, hopefully you, asked for new entries on " + siteTitle + " to be emailed to this address.\n\n" +
+					"To confirm, visit:\n\n" + link + "\n\n" +
+					"If it wasn't you, ignore this email and you won't get any more.\n",
+			})
+			if err != nil {
+				// Most likely the mail server is down; try again next pass.
+				log.Printf("unable to send confirmation to subscriber %d: %v", sub.Id, err)
+				continue
+			}
+			err = s.subscriberStore.SetConfirmationSent(ctx, sub.Id)
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			// Unsubscribed while we worked.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to save subscriber %d: %w", sub.Id, err)
+		}
+	}
+	return nil
+}
+
+// mailEntries sends each newly published entry to the subscribers who get
+// every entry. Failures aren't retried.
+func (s *server) mailEntries(ctx context.Context) error {
+	entries, err := s.subscriberStore.GetUnmailedEntries(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list entries: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	subscribers, err := s.subscriberStore.GetSubscribers(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list subscribers: %w", err)
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		post, err := s.newsletterPost(entry)
+		if err != nil {
+			// It can't be shown either, so there's nothing to send.
+			log.Printf("unable to render entry %d to mail: %v", entry.Id, err)
+		} else {
+			for _, sub := range subscribers {
+				if !sub.Confirmed.IsZero() && !sub.Digest {
+					s.sendIssue(ctx, sub, entry.Title, []newsletter.Post{post})
+				}
+			}
+		}
+		if err := s.subscriberStore.SetEntryMailed(ctx, entry.Id); err != nil && !errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("unable to record entry %d mailed: %w", entry.Id, err)
+		}
+	}
+	return nil
+}
+
+// sendDigests sends each digest subscriber whose last digest is at least
+// digestInterval old the entries published since, as of now.
+func (s *server) sendDigests(ctx context.Context, now time.Time) error {
+	subscribers, err := s.subscriberStore.GetSubscribers(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list subscribers: %w", err)
+	}
+	for _, sub := range subscribers {
+		if sub.Confirmed.IsZero() || !sub.Digest {
+			continue
+		}
+		last := sub.DigestSent
+		if last.IsZero() {
+			last = sub.Confirmed
+		}
+		if now.Sub(last) < s.cfg.digestInterval {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		entries, err := s.subscriberStore.GetEntriesPublished(ctx, last, now)
+		if err != nil {
+			return fmt.Errorf("unable to list entries for digest: %w", err)
+		}
+		var posts []newsletter.Post
+		for _, entry := range entries {
+			post, err := s.newsletterPost(entry)
+			if err != nil {
+				log.Printf("unable to render entry %d for digest: %v", entry.Id, err)
+				continue
+			}
+			posts = append(posts, post)
+		}
+		if len(posts) > 0 {
+			subject := fmt.Sprintf("%s: %d new entries", siteTitle, len(posts))
+			if len(posts) == 1 {
+				subject = siteTitle + ": " + posts[0].Title
+			}
+			if !s.sendIssue(ctx, sub, subject, posts) {
+				// Try again next pass.
+				continue
+			}
+		}
+		err = s.subscriberStore.SetDigestSent(ctx, sub.Id, now)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("unable to record digest sent to subscriber %d: %w", sub.Id, err)
+		}
+	}
+	return nil
+}
+
+// newsletterPost is entry as it goes out by email.
+func (s *server) newsletterPost(entry db.Entry) (newsletter.Post, error) {
+	content, err := serving.EntryToServing(entry, db.Navigation{}, s.site())
+	if err != nil {
+		return newsletter.Post{}, err
+	}
+	return newsletter.Post{
+		Title:     entry.Title,
+		URL:       siteURL + content.Path,
+		HTML:      content.HTML,
+		Published: entry.Published,
+	}, nil
+}
+
+// sendIssue emails posts to sub and reports whether it went.
+func (s *server) sendIssue(ctx context.Context, sub db.Subscriber, subject string, posts []newsletter.Post) bool {
+	issue := newsletter.Issue{Site: siteTitle, SiteURL: siteURL, Posts: posts, Unsubscribe: unsubscribeURL(sub.Token)}
+	htmlBody, textBody, err := issue.Render()
+	if err == nil {
+		err = s.mailer.Send(ctx, newsletter.Message{
+			From:        s.cfg.newsletterFrom,
+			To:          sub.Email,
+			Subject:     subject,
+			Text:        textBody,
+			HTML:        htmlBody,
+			Unsubscribe: issue.Unsubscribe,
+		})
+	}
+	if err != nil {
+		log.Printf("unable to mail subscriber %d: %v", sub.Id, err)
+		return false
+	}
+	return true
+}
+
+func (s *server) buildNewsletterPage(w http.ResponseWriter, r *http.Request) error {
+	page := serving.NewsletterServing{SubscribePath: newsletterPath}
+	if r.URL.Query().Get("status") == "pending" {
+		page.Status = "pending"
+	}
+	return s.render(w, newsletterPage, page)
+}
+
+func (s *server) postSubscribe(w http.ResponseWriter, r *http.Request) error {
+	ip := s.clientIP(r)
+	if !s.subscribeLimiter.allow(ip) {
+		return statusError(http.StatusTooManyRequests, "too many signups, please try again later",
+			fmt.Errorf("too many signups from %s", ip))
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSubscribeForm)
+	if err := r.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "the form could not be read", err)
+	}
+	pending := newsletterPath + "?status=pending"
+
+	// Look as though it worked so the bot doesn't try something else.
+	if r.PostFormValue(honeypotField) != "" {
+		log.Printf("dropped newsletter signup from %s: honeypot filled in", ip)
+		http.Redirect(w, r, pending, http.StatusSeeOther)
+		return nil
+	}
+	email, err := newsletter.ParseAddress(r.PostFormValue("email"))
+	if err != nil {
+		return statusError(http.StatusBadRequest, "a valid email address is required", err)
+	}
+	token, err := newsletter.Token()
+	if err != nil {
+		return serverError("failed to sign up", err)
+	}
+	err = s.subscriberStore.AddSubscriber(r.Context(), db.Subscriber{Email: email, Token: token, Digest: r.PostFormValue("digest") != ""})
+	// Already subscribed, or sent a confirmation link lately. Say the same
+	// as for a new address so the form can't be used to find out who reads
+	// the site.
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return storeError("failed to sign up", fmt.Errorf("unable to add subscriber: %w", err))
+	}
+	if err == nil {
+		log.Printf("newsletter signup from %s", ip)
+		s.newsletterWorker.request()
+	}
+	http.Redirect(w, r, pending, http.StatusSeeOther)
+	return nil
+}
+
+// buildConfirmPage asks before confirming, like buildUnsubscribePage, or
+// scanners opening the link would confirm addresses nobody signed up.
+func (s *server) buildConfirmPage(w http.ResponseWriter, r *http.Request) error {
+	return s.render(w, newsletterPage, serving.NewsletterServing{
+		SubscribePath: newsletterPath,
+		Status:        "confirm",
+		ConfirmPath:   confirmPath + "?token=" + url.QueryEscape(r.URL.Query().Get("token")),
+	})
+}
+
+func (s *server) confirmSubscription(w http.ResponseWriter, r *http.Request) error {
+	err := s.subscriberStore.ConfirmSubscriber(r.Context(), r.URL.Query().Get("token"))
+	// Unconfirmed signups are dropped after confirmWindow, and anyone
+	// who unsubscribed is gone too.
+	if errors.Is(err, db.ErrNotFound) {
+		return statusError(http.StatusNotFound, "that link is no longer valid, please sign up again", err)
+	}
+	if err != nil {
+		return storeError("failed to confirm subscription", fmt.Errorf("unable to confirm subscriber: %w", err))
+	}
+	return s.render(w, newsletterPage, serving.NewsletterServing{SubscribePath: newsletterPath, Status: "confirmed"})
+}
+
+// buildUnsubscribePage asks before unsubscribing, since mail scanners follow
+// links.
+func (s *server) buildUnsubscribePage(w http.ResponseWriter, r *http.Request) error {
+	return s.render(w, newsletterPage, serving.NewsletterServing{
+		SubscribePath:   newsletterPath,
+		Status:          "unsubscribe",
+		UnsubscribePath: unsubscribePath + "?token=" + url.QueryEscape(r.URL.Query().Get("token")),
+	})
+}
+
+// unsubscribe takes both the unsubscribe page's form and mail clients' one
+// click unsubscribes, which post to the link in the email's headers.
+func (s *server) unsubscribe(w http.ResponseWriter, r *http.Request) error {
+	err := s.subscriberStore.RemoveSubscriber(r.Context(), r.URL.Query().Get("token"))
+	// Unsubscribing twice is fine.
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return storeError("failed to unsubscribe", fmt.Errorf("unable to remove subscriber: %w", err))
+	}
+	return s.render(w, newsletterPage, serving.NewsletterServing{SubscribePath: newsletterPath, Status: "unsubscribed"})
+}
@@ -0,0 +1,212 @@
+package newsletter
+
+import (
+	"bytes"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var spaces = regexp.MustCompile(`\s+`)
+
+// Post is an entry as it goes out in an issue.
+type Post struct {
+	Title     string
+	URL       string
+	HTML      template.HTML
+	Published time.Time
+}
+
+// Issue is one email to a subscriber: a single new post, or a digest of
+// several.
+type Issue struct {
+	Site        string
+	SiteURL     string
+	Posts       []Post
+	Unsubscribe string
+}
+
+var issueTemplate = template.Must(template.New("issue").Parse(`<!DOCTYPE html>
+<html>
+  <body>
+    {{range .Posts}}
+    <article>
+      <h1><a href="{{.URL}}">{{.Title}}</a></h1>
+      <p><small>{{.Published.Format "January 2, 2006"}}</small></p>
+      {{.HTML}}
+    </article>
+    <hr>
+    {{end}}
+    <p><small>You are getting this because you subscribed to <a href="{{.SiteURL}}">{{.Site}}</a>.
+      <a href="{{.Unsubscribe}}">Unsubscribe</a>.</small></p>
+  </body>
+</html>
+`))
+
+// Render returns the issue's HTML and plain-text bodies. Links and images in
+// the posts are made absolute so they work from a mail client.
+func (i Issue) Render() (htmlBody, textBody string, err error) {
+	posts := make([]Post, len(i.Posts))
+	for n, p := range i.Posts {
+		base, err := url.Parse(p.URL)
+		if err != nil {
+			return "", "", err
+		}
+		content, err := absolute(string(p.HTML), base)
+		if err != nil {
+			return "", "", err
+		}
+		p.HTML = template.HTML(content)
+		posts[n] = p
+	}
+	i.Posts = posts
+
+	var buf bytes.Buffer
+	if err := issueTemplate.Execute(&buf, i); err != nil {
+		return "", "", err
+	}
+
+	var text strings.Builder
+	for _, p := range i.Posts {
+		body, err := Text(string(p.HTML))
+		if err != nil {
+			return "", "", err
+		}
+		text.WriteString(p.Title + "\n" + p.Published.Format("January 2, 2006") + "\n" + p.URL + "\n\n")
+		text.WriteString(body + "\n\n----\n\n")
+	}
+	text.WriteString("You are getting this because you subscribed to " + i.Site + " (" + i.SiteURL + ").\n")
+	text.WriteString("Unsubscribe: " + i.Unsubscribe + "\n")
+	return buf.String(), text.String(), nil
+}
+
+// absolute resolves the links and image sources in content against base.
+func absolute(content string, base *url.URL) (string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(content), &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"})
+	if err != nil {
+		return "", err
+	}
+	var resolve func(*html.Node)
+	resolve = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			for i, a := range n.Attr {
+				if a.Namespace != "" || (a.Key != "href" && a.Key != "src") {
+					continue
+				}
+				if u, err := base.Parse(strings.TrimSpace(a.Val)); err == nil {
+					n.Attr[i].Val = u.String()
+				}
+			}
+			// srcset would need each candidate resolved; mail clients
+			// mostly ignore it, so it goes.
+			attrs := n.Attr[:0]
+			for _, a := range n.Attr {
+				if a.Key != "srcset" {
+					attrs = append(attrs, a)
+				}
+			}
+			n.Attr = attrs
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			resolve(c)
+		}
+	}
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		resolve(n)
+		if err := html.Render(&buf, n); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// Text turns HTML into plain text for mail clients that don't show HTML:
+// blocks are separated by blank lines, list items get a dash and links keep
+// their URL after their text.
+func Text(content string) (string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(content), &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"})
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	// Line breaks are only written before more text, so there are never
+	// more than asked for in a row, or any at the end.
+	pending := ""
+	write := func(s string) {
+		if pending != "" || b.Len() == 0 || strings.HasSuffix(b.String(), " ") {
+			s = strings.TrimLeft(s, " ")
+		}
+		if s == "" {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString(pending)
+		}
+		pending = ""
+		b.WriteString(s)
+	}
+	breakLine := func(sep string) {
+		if len(sep) > len(pending) {
+			pending = sep
+		}
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			write(spaces.ReplaceAllString(n.Data, " "))
+			return
+		case html.ElementNode:
+			switch n.DataAtom {
+			case atom.Script, atom.Style, atom.Head:
+				return
+			case atom.Br:
+				breakLine("\n")
+				return
+			case atom.Img:
+				for _, a := range n.Attr {
+					if a.Key == "alt" && a.Val != "" {
+						write("[" + a.Val + "]")
+					}
+				}
+				return
+			case atom.P, atom.Div, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Ul, atom.Ol,
+				atom.Blockquote, atom.Pre, atom.Figure, atom.Table, atom.Hr:
+				breakLine("\n\n")
+				defer breakLine("\n\n")
+			case atom.Li, atom.Tr, atom.Figcaption:
+				breakLine("\n")
+				defer breakLine("\n")
+				if n.DataAtom == atom.Li {
+					write("- ")
+				}
+			case atom.A:
+				defer func() {
+					for _, a := range n.Attr {
+						if a.Key == "href" && a.Val != "" && !strings.HasPrefix(a.Val, "#") {
+							write(" (" + a.Val + ")")
+						}
+					}
+				}()
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	for _, n := range nodes {
+		walk(n)
+	}
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.Join(lines, "\n"), nil
+}
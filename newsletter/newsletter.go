@@ -0,0 +1,229 @@
+// Package newsletter builds the site's emails and sends them over SMTP.
+package newsletter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds sending one message unless Config says otherwise.
+const DefaultTimeout = 30 * time.Second
+
+// ErrInvalidAddress is returned for email addresses that can't be sent to.
+var ErrInvalidAddress = errors.New("newsletter: invalid email address")
+
+// Message is an email with a plain-text body, and optionally an HTML
+// alternative.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	// URL that unsubscribes the recipient, both on a visit and when posted
+	// to as in RFC 8058. Empty for mail that isn't part of a subscription.
+	Unsubscribe string
+	Date        time.Time
+}
+
+// Bytes encodes m for sending.
+func (m Message) Bytes() ([]byte, error) {
+	from, err := ParseAddress(m.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := ParseAddress(m.To)
+	if err != nil {
+		return nil, err
+	}
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	id, err := Token()
+	if err != nil {
+		return nil, err
+	}
+	_, domain, _ := strings.Cut(from, "@")
+
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", from)
+	header("To", to)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", date.Format(time.RFC1123Z))
+	header("Message-ID", "<"+id+"@"+domain+">")
+	header("MIME-Version", "1.0")
+	if m.Unsubscribe != "" {
+		if strings.ContainsAny(m.Unsubscribe, "\r\n<>") {
+			return nil, fmt.Errorf("newsletter: invalid unsubscribe URL %q", m.Unsubscribe)
+		}
+		header("List-Unsubscribe", "<"+m.Unsubscribe+">")
+		header("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+
+	if m.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQP(&buf, m.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buf.WriteString("\r\n")
+	// Clients show the last part they understand, so HTML goes last.
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQP(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeQP writes s quoted-printable, which also gives it CRLF line endings.
+func writeQP(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, s); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// ParseAddress checks that s is a bare email address, such as a reader
+// typed into a form, and returns it cleaned up.
+func ParseAddress(s string) (string, error) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || strings.ContainsAny(addr.Address, "\r\n<>") ||
+		!strings.Contains(addr.Address, "@") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidAddress, s)
+	}
+	return addr.Address, nil
+}
+
+// Token returns a random string that is hard to guess, for confirmation and
+// unsubscribe links.
+func Token() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Config says how to reach the SMTP server.
+type Config struct {
+	// Addr is the server's host:port.
+	Addr string
+	// Username and Password log in with PLAIN auth if Username is set. Go
+	// only sends them over TLS or to localhost.
+	Username string
+	Password string
+	// Timeout for sending each message. Zero means DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Sender delivers messages to an SMTP server, upgrading to TLS when the
+// server offers it.
+type Sender struct {
+	cfg  Config
+	host string
+}
+
+// NewSender returns a Sender for the server in cfg.
+func NewSender(cfg Config) (*Sender, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("newsletter: invalid SMTP address %q: %v", cfg.Addr, err)
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	return &Sender{cfg: cfg, host: host}, nil
+}
+
+// Send delivers m.
+func (s *Sender) Send(ctx context.Context, m Message) error {
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	from, _ := ParseAddress(m.From)
+	to, _ := ParseAddress(m.To)
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if s.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,228 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dubJay/newsletter/smtptest"
+)
+
+var ctx = context.Background()
+
+// parts returns the content type and decoded body of each part of a
+// message, or of the whole message if it has one part.
+func parts(t *testing.T, msg *mail.Message) map[string]string {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := func(r io.Reader) string {
+		body, err := io.ReadAll(quotedprintable.NewReader(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return map[string]string{mediaType: decode(msg.Body)}
+	}
+	got := map[string]string{}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextRawPart()
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		typ, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		got[typ] = decode(p)
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	m := Message{
+		From:        "news@example.com",
+		To:          "reader@example.org",
+		Subject:     "Café\r\nBcc: victim@example.net",
+		Text:        "Hello\nWorld, " + strings.Repeat("long ", 30),
+		HTML:        "<p>Hello</p>",
+		Unsubscribe: "https://example.com/unsubscribe?token=abc",
+		Date:        time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	data, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes failed: %v", err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("Bytes returned an unreadable message: %v", err)
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Errorf("subject injected a header: %v", msg.Header)
+	}
+	if subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil || subject != m.Subject {
+		t.Errorf("Subject = %q, %v, want %q", subject, err, m.Subject)
+	}
+	if got := msg.Header.Get("List-Unsubscribe"); got != "<"+m.Unsubscribe+">" {
+		t.Errorf("List-Unsubscribe = %q", got)
+	}
+	if got := msg.Header.Get("Message-Id"); !strings.HasSuffix(got, "@example.com>") {
+		t.Errorf("Message-ID = %q, want one at the sender's domain", got)
+	}
+	got := parts(t, msg)
+	if got["text/plain"] != strings.ReplaceAll(m.Text, "\n", "\r\n") || got["text/html"] != m.HTML {
+		t.Errorf("parts = %q, want the text and HTML bodies", got)
+	}
+
+	m.HTML, m.Unsubscribe = "", ""
+	data, err = m.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes of a plain message failed: %v", err)
+	}
+	msg, _ = mail.ReadMessage(strings.NewReader(string(data)))
+	if got := parts(t, msg); len(got) != 1 || got["text/plain"] == "" || msg.Header.Get("List-Unsubscribe") != "" {
+		t.Errorf("plain message = %v %q, want only text", msg.Header, got)
+	}
+
+	for _, bad := range []Message{
+		{From: "news@example.com", To: "Reader <reader@example.org>"},
+		{From: "news@example.com", To: "reader@example.org\r\nBcc: x@example.net"},
+		{From: "news@example.com", To: "reader@example.org", Unsubscribe: "https://example.com/>\r\nBcc: x@example.net"},
+	} {
+		if _, err := bad.Bytes(); err == nil {
+			t.Errorf("Bytes of %+v succeeded", bad)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	for in, want := range map[string]string{
+		"reader@example.org":           "reader@example.org",
+		" reader@example.org ":         "reader@example.org",
+		"Reader <r@example.org>":       "",
+		"reader":                       "",
+		"":                             "",
+		"a@example.org, b@example.org": "",
+	} {
+		got, err := ParseAddress(in)
+		if got != want || (want == "") != errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("ParseAddress(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+}
+
+func TestToken(t *testing.T) {
+	a, err := Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := Token()
+	if len(a) != 32 || a == b {
+		t.Errorf("Token = %q, %q, want two different 32 character tokens", a, b)
+	}
+}
+
+func TestSender(t *testing.T) {
+	srv := smtptest.NewServer(t)
+	srv.Reject("gone@example.org")
+	sender, err := NewSender(Config{Addr: srv.Addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Message{From: "news@example.com", To: "reader@example.org", Subject: "Hi", Text: "Hello\n.\nthere"}
+	if err := sender.Send(ctx, m); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	mails := srv.Mails()
+	if len(mails) != 1 || mails[0].From != "news@example.com" || len(mails[0].To) != 1 || mails[0].To[0] != "reader@example.org" {
+		t.Fatalf("server got %+v, want the message", mails)
+	}
+	msg, err := mails[0].Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server hands back lines ending in LF, with the newline DATA ends on.
+	if got := parts(t, msg)["text/plain"]; got != "Hello\n.\nthere\n" {
+		t.Errorf("body = %q, want the text with its lone dot", got)
+	}
+
+	m.To = "gone@example.org"
+	if err := sender.Send(ctx, m); err == nil {
+		t.Error("Send to a rejected address succeeded")
+	}
+	if _, err := NewSender(Config{Addr: "no port"}); err == nil {
+		t.Error("NewSender without a port succeeded")
+	}
+}
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{"<p>One</p><p>Two</p>", "One\n\nTwo"},
+		{"<p>  lots   of\n space </p>", "lots of space"},
+		{"<p>Line<br>break</p>", "Line\nbreak"},
+		{`<p>See <a href="https://example.com/">this</a>, and <a href="#top">that</a>.</p>`,
+			"See this (https://example.com/), and that."},
+		{"<ul><li>a</li><li><em>b</em> c</li></ul><p>after</p>", "- a\n- b c\n\nafter"},
+		{`<figure><img src="/x.jpg" alt="A cat"><figcaption>Mine</figcaption></figure>`, "[A cat]\nMine"},
+		{"<p>a<script>evil()</script>b</p>", "ab"},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		if got, err := Text(tc.html); err != nil || got != tc.want {
+			t.Errorf("Text(%q) = %q, %v, want %q", tc.html, got, err, tc.want)
+		}
+	}
+}
+
+func TestIssueRender(t *testing.T) {
+	issue := Issue{
+		Site:    "A Blog",
+		SiteURL: "https://example.com",
+		Posts: []Post{{
+			Title:     "First <Post>",
+			URL:       "https://example.com/entry/2024/first",
+			HTML:      template.HTML(`<p>Hi <a href="/entry/1">there</a></p><img src="/images/a.jpg" srcset="/images/a.jpg 2x" alt="A">`),
+			Published: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		}},
+		Unsubscribe: "https://example.com/newsletter/unsubscribe?token=abc",
+	}
+	htmlBody, text, err := issue.Render()
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	for _, want := range []string{
+		`<a href="https://example.com/entry/1">there</a>`,
+		`<img src="https://example.com/images/a.jpg" alt="A"/>`,
+		"First &lt;Post&gt;",
+		"May 1, 2024",
+		`href="https://example.com/newsletter/unsubscribe?token=abc"`,
+	} {
+		if !strings.Contains(htmlBody, want) {
+			t.Errorf("HTML = %q, want it to contain %q", htmlBody, want)
+		}
+	}
+	for _, want := range []string{
+		"First <Post>\nMay 1, 2024\nhttps://example.com/entry/2024/first\n\nHi there (https://example.com/entry/1)\n\n[A]",
+		"Unsubscribe: https://example.com/newsletter/unsubscribe?token=abc",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text = %q, want it to contain %q", text, want)
+		}
+	}
+}
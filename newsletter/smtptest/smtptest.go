@@ -0,0 +1,156 @@
+// Package smtptest runs a local SMTP server that keeps the mail it is sent,
+// for testing code that sends mail.
+package smtptest
+
+import (
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Mail is a message the server accepted.
+type Mail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// Message parses the mail's data.
+func (m Mail) Message() (*mail.Message, error) {
+	return mail.ReadMessage(strings.NewReader(m.Data))
+}
+
+// Server is a local SMTP server. It offers no extensions, so clients send
+// without TLS or authentication.
+type Server struct {
+	// Addr is the server's host:port.
+	Addr string
+	ln   net.Listener
+
+	mu       sync.Mutex
+	mails    []Mail
+	rejected map[string]bool
+}
+
+// NewServer starts a server on a loopback port. It stops when the test ends.
+func NewServer(tb testing.TB) *Server {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("smtptest: %v", err)
+	}
+	s := &Server{Addr: ln.Addr().String(), ln: ln, rejected: map[string]bool{}}
+	go s.serve()
+	tb.Cleanup(func() { ln.Close() })
+	return s
+}
+
+// Mails returns the messages accepted so far, oldest first.
+func (s *Server) Mails() []Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Mail(nil), s.mails...)
+}
+
+// Reset forgets the messages accepted so far.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mails = nil
+}
+
+// Reject makes the server refuse mail to addr.
+func (s *Server) Reject(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected[strings.ToLower(addr)] = true
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(textproto.NewConn(conn))
+	}
+}
+
+func (s *Server) session(c *textproto.Conn) {
+	defer c.Close()
+	reply := func(code int, msg string) bool {
+		return c.PrintfLine("%d %s", code, msg) == nil
+	}
+	if !reply(220, "smtptest ready") {
+		return
+	}
+	var current Mail
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		ok := true
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			ok = reply(250, "smtptest")
+		case "MAIL":
+			current = Mail{From: address(arg)}
+			ok = reply(250, "OK")
+		case "RCPT":
+			to := address(arg)
+			s.mu.Lock()
+			rejected := s.rejected[strings.ToLower(to)]
+			s.mu.Unlock()
+			if rejected {
+				ok = reply(550, "no such user")
+				continue
+			}
+			current.To = append(current.To, to)
+			ok = reply(250, "OK")
+		case "DATA":
+			if len(current.To) == 0 {
+				ok = reply(503, "no recipients")
+				continue
+			}
+			if !reply(354, "go ahead") {
+				return
+			}
+			data, err := io.ReadAll(c.DotReader())
+			if err != nil {
+				return
+			}
+			current.Data = string(data)
+			s.mu.Lock()
+			s.mails = append(s.mails, current)
+			s.mu.Unlock()
+			current = Mail{}
+			ok = reply(250, "OK")
+		case "RSET":
+			current = Mail{}
+			ok = reply(250, "OK")
+		case "NOOP":
+			ok = reply(250, "OK")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			ok = reply(502, "not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// address takes the address out of a MAIL FROM:<a> or RCPT TO:<a> argument.
+func address(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr, _, _ = strings.Cut(strings.TrimSpace(addr), " ")
+	return strings.Trim(addr, "<>")
+}
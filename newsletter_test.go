@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dubJay/newsletter/smtptest"
+)
+
+func withNewsletter(srv *smtptest.Server) func(*config) {
+	return func(cfg *config) {
+		cfg.smtpAddr = srv.Addr
+		cfg.newsletterFrom = "news@christopher.cawdrey.name"
+		cfg.digestInterval = 7 * 24 * time.Hour
+	}
+}
+
+// sentMail is a message the stand-in SMTP server got, decoded.
+type sentMail struct {
+	To          string
+	Subject     string
+	Unsubscribe string
+	Body        string
+}
+
+func sentMails(t *testing.T, srv *smtptest.Server) []sentMail {
+	t.Helper()
+	var mails []sentMail
+	for _, m := range srv.Mails() {
+		msg, err := m.Message()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		// Multipart bodies are left encoded, which is enough to look for
+		// the parts in.
+		body, err := io.ReadAll(msg.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Header.Get("Content-Transfer-Encoding") == "quoted-printable" {
+			body, _ = io.ReadAll(quotedprintable.NewReader(strings.NewReader(string(body))))
+		}
+		mails = append(mails, sentMail{
+			To:          strings.Join(m.To, ","),
+			Subject:     subject,
+			Unsubscribe: msg.Header.Get("List-Unsubscribe"),
+			Body:        string(body),
+		})
+	}
+	return mails
+}
+
+func postSubscribe(router http.Handler, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, newsletterPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewsletterDisabled(t *testing.T) {
+	router := newTestServer(t).routes()
+	if rec := postSubscribe(router, url.Values{"email": {"reader@example.org"}}); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST %s = %d with the newsletter off, want 405", newsletterPath, rec.Code)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	srv := smtptest.NewServer(t)
+	s := newTestServer(t, withNewsletter(srv))
+	router := s.routes()
+	ctx := context.Background()
+
+	rec := postSubscribe(router, url.Values{"email": {"reader@example.org"}, "digest": {"1"}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != newsletterPath+"?status=pending" {
+		t.Fatalf("POST %s = %d %q, want a redirect to the pending page", newsletterPath, rec.Code, rec.Header().Get("Location"))
+	}
+	// Signing up a confirmed address looks the same but changes nothing.
+	if rec := postSubscribe(router, url.Values{"email": {"post@example.org"}, "digest": {"1"}}); rec.Code != http.StatusSeeOther {
+		t.Errorf("POST %s of a subscribed address = %d, want 303", newsletterPath, rec.Code)
+	}
+	if rec := postSubscribe(router, url.Values{"email": {"bot@example.org"}, honeypotField: {"x"}}); rec.Code != http.StatusSeeOther {
+		t.Errorf("POST %s with the honeypot = %d, want 303", newsletterPath, rec.Code)
+	}
+	if rec := postSubscribe(router, url.Values{"email": {"Reader <r@example.org>"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST %s with a bad address = %d, want 400", newsletterPath, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, newsletterPath+"?status=pending", nil))
+	if want := "newsletter|pending|/newsletter||\n"; rec.Body.String() != want {
+		t.Errorf("GET %s = %q, want %q", newsletterPath, rec.Body.String(), want)
+	}
+
+	if err := s.sendConfirmations(ctx); err != nil {
+		t.Fatalf("sendConfirmations failed: %v", err)
+	}
+	mails := sentMails(t, srv)
+	if len(mails) != 2 || mails[0].To != "new@example.org" || mails[1].To != "reader@example.org" {
+		t.Fatalf("sent %+v, want confirmations to the fixture's and the new subscriber", mails)
+	}
+	link := regexp.MustCompile(`https://\S+`).FindString(mails[1].Body)
+	if !strings.HasPrefix(link, siteURL+confirmPath+"?token=") || mails[1].Unsubscribe != "" {
+		t.Fatalf("confirmation = %+v, want a confirmation link", mails[1])
+	}
+
+	// Opening the link only asks, since mail scanners open links too.
+	path := strings.TrimPrefix(link, siteURL)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if want := "newsletter|confirm|/newsletter||" + path + "\n"; rec.Body.String() != want {
+		t.Errorf("GET %s = %q, want %q", path, rec.Body.String(), want)
+	}
+	if subscribers, err := s.subscriberStore.GetSubscribers(ctx); err != nil || !subscribers[3].Confirmed.IsZero() {
+		t.Errorf("GetSubscribers after opening the link = %+v, %v, want the new one unconfirmed", subscribers, err)
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "newsletter|confirmed|") {
+		t.Errorf("POST %s = %d %q, want confirmed", path, rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, confirmPath+"?token=wrong", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("POST %s with a wrong token = %d, want 404", confirmPath, rec.Code)
+	}
+
+	subscribers, err := s.subscriberStore.GetSubscribers(ctx)
+	if err != nil || len(subscribers) != 4 {
+		t.Fatalf("GetSubscribers = %+v, %v, want the new one added", subscribers, err)
+	}
+	if sub := subscribers[3]; sub.Confirmed.IsZero() || !sub.Digest || subscribers[0].Digest {
+		t.Errorf("subscribers = %+v, want the new one confirmed to digests and the old one unchanged", subscribers)
+	}
+
+	srv.Reset()
+	if err := s.sendConfirmations(ctx); err != nil || len(srv.Mails()) != 0 {
+		t.Errorf("second sendConfirmations sent %d, %v, want nothing", len(srv.Mails()), err)
+	}
+}
+
+func TestUnconfirmedSubscribersDropped(t *testing.T) {
+	srv := smtptest.NewServer(t)
+	s, raw := newTestServerDB(t, withNewsletter(srv))
+	if _, err := raw.Exec(`UPDATE subscriber SET created = created - ? WHERE id = 3`, int64((confirmWindow + time.Hour).Seconds())); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := s.sendConfirmations(ctx); err != nil {
+		t.Fatalf("sendConfirmations failed: %v", err)
+	}
+	if subscribers, err := s.subscriberStore.GetSubscribers(ctx); err != nil || len(subscribers) != 2 || len(srv.Mails()) != 0 {
+		t.Errorf("after sendConfirmations: %d subscribers, %d mails, %v, want the unconfirmed one dropped",
+			len(subscribers), len(srv.Mails()), err)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	srv := smtptest.NewServer(t)
+	s := newTestServer(t, withNewsletter(srv))
+	router := s.routes()
+
+	path := unsubscribePath + "?token=post-token"
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if want := "newsletter|unsubscribe|/newsletter|" + path + "|\n"; rec.Body.String() != want {
+		t.Errorf("GET %s = %q, want %q", path, rec.Body.String(), want)
+	}
+	if subscribers, _ := s.subscriberStore.GetSubscribers(context.Background()); len(subscribers) != 3 {
+		t.Errorf("visiting the unsubscribe link left %d subscribers, want 3", len(subscribers))
+	}
+
+	// The second is a mail client unsubscribing again with one click.
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("List-Unsubscribe=One-Click"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "newsletter|unsubscribed|") {
+			t.Errorf("POST %s = %d %q, want unsubscribed", path, rec.Code, rec.Body.String())
+		}
+	}
+	if subscribers, _ := s.subscriberStore.GetSubscribers(context.Background()); len(subscribers) != 2 {
+		t.Errorf("unsubscribing left %d subscribers, want 2", len(subscribers))
+	}
+}
+
+func TestMailEntries(t *testing.T) {
+	srv := smtptest.NewServer(t)
+	s := newTestServer(t, withNewsletter(srv))
+	ctx := context.Background()
+
+	if err := s.mailEntries(ctx); err != nil {
+		t.Fatalf("mailEntries failed: %v", err)
+	}
+	mails := sentMails(t, srv)
+	if len(mails) != 1 {
+		t.Fatalf("sent %+v, want the third post to the one per-entry subscriber", mails)
+	}
+	m := mails[0]
+	if m.To != "post@example.org" || m.Subject != "Third Post" || m.Unsubscribe != "<"+unsubscribeURL("post-token")+">" {
+		t.Errorf("sent %+v", m)
+	}
+	for _, want := range []string{"text/plain", "text/html", "Third"} {
+		if !strings.Contains(m.Body, want) {
+			t.Errorf("body = %q, want it to contain %q", m.Body, want)
+		}
+	}
+
+	srv.Reset()
+	if err := s.mailEntries(ctx); err != nil || len(srv.Mails()) != 0 {
+		t.Errorf("second mailEntries sent %d, %v, want nothing", len(srv.Mails()), err)
+	}
+}
+
+func TestSendDigests(t *testing.T) {
+	srv := smtptest.NewServer(t)
+	s := newTestServer(t, withNewsletter(srv))
+	ctx := context.Background()
+
+	now := time.Now()
+	if err := s.sendDigests(ctx, now); err != nil {
+		t.Fatalf("sendDigests failed: %v", err)
+	}
+	mails := sentMails(t, srv)
+	if len(mails) != 1 || mails[0].To != "digest@example.org" || mails[0].Subject != siteTitle+": Third Post" {
+		t.Fatalf("sent %+v, want a digest of the third post", mails)
+	}
+
+	srv.Reset()
+	if err := s.sendDigests(ctx, now.Add(time.Hour)); err != nil || len(srv.Mails()) != 0 {
+		t.Errorf("sendDigests within the interval sent %d, %v, want nothing", len(srv.Mails()), err)
+	}
+	// Nothing new has been published since.
+	if err := s.sendDigests(ctx, now.Add(8*24*time.Hour)); err != nil || len(srv.Mails()) != 0 {
+		t.Errorf("sendDigests with nothing new sent %d, %v, want nothing", len(srv.Mails()), err)
+	}
+}
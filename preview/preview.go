@@ -0,0 +1,315 @@
+// Package preview pulls the text and a first page thumbnail out of kcawd PDFs.
+package preview
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/image/draw"
+)
+
+// ExcerptLength is the longest excerpt Excerpt returns, in runes.
+const ExcerptLength = 280
+
+// Text returns the plain text of every page of pdf.
+func Text(data []byte) (text string, err error) {
+	// The parser panics on some malformed files rather than returning an error.
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("preview: malformed pdf: %v", v)
+		}
+	}()
+
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("preview: %v", err)
+	}
+	plain, err := r.GetPlainText()
+	if err != nil {
+		return "", fmt.Errorf("preview: %v", err)
+	}
+	b, err := io.ReadAll(plain)
+	if err != nil {
+		return "", fmt.Errorf("preview: %v", err)
+	}
+	return strings.Join(strings.Fields(string(b)), " "), nil
+}
+
+// Excerpt shortens text to at most n runes, cutting at a word boundary and
+// marking the cut with an ellipsis.
+func Excerpt(text string, n int) string {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	cut := n - 1
+	for i := cut; i > n/2; i-- {
+		if unicode.IsSpace(runes[i]) {
+			cut = i
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(runes[:cut]), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}) + "…"
+}
+
+// Renderer draws the first page of a PDF as a PNG.
+type Renderer interface {
+	Thumbnail(ctx context.Context, pdf []byte) ([]byte, error)
+}
+
+// Raster renders thumbnails in pure Go. It is no PDF renderer: it draws the
+// largest image on the page stretched over it, which suits scanned articles,
+// then a grey bar for each run of text and the outline of each rectangle.
+// At thumbnail size that is usually enough to tell articles apart.
+type Raster struct {
+	// Width of the thumbnail in pixels. The height keeps the page's aspect.
+	Width int
+}
+
+const (
+	// Largest image Raster will decode, in pixels.
+	maxImagePixels = 50 << 20
+	// Tallest page Raster will draw, as a multiple of its width. Paper is
+	// well under 2; the limit keeps a page that is a sliver wide from
+	// becoming a thumbnail too big to allocate.
+	maxAspect = 4
+)
+
+var (
+	textColor = color.Gray{Y: 0x80}
+	lineColor = color.Gray{Y: 0x40}
+)
+
+func (p Raster) Thumbnail(ctx context.Context, data []byte) (thumb []byte, err error) {
+	// The parser panics on some malformed files rather than returning an error.
+	defer func() {
+		if v := recover(); v != nil {
+			thumb, err = nil, fmt.Errorf("preview: malformed pdf: %v", v)
+		}
+	}()
+
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("preview: %v", err)
+	}
+	if r.NumPage() < 1 {
+		return nil, fmt.Errorf("preview: pdf has no pages")
+	}
+	page := r.Page(1)
+
+	// US Letter if neither the page nor its parents say.
+	x0, y0, x1, y1 := 0.0, 0.0, 612.0, 792.0
+	for v := page.V; !v.IsNull(); v = v.Key("Parent") {
+		if box := v.Key("MediaBox"); box.Len() == 4 {
+			x0, y0, x1, y1 = box.Index(0).Float64(), box.Index(1).Float64(), box.Index(2).Float64(), box.Index(3).Float64()
+			break
+		}
+	}
+	if x1 <= x0 || y1 <= y0 {
+		return nil, fmt.Errorf("preview: bad page size %v×%v", x1-x0, y1-y0)
+	}
+	if (y1-y0)/(x1-x0) > maxAspect {
+		return nil, fmt.Errorf("preview: page is too tall at %v×%v", x1-x0, y1-y0)
+	}
+	scale := float64(p.Width) / (x1 - x0)
+	height := int(math.Round((y1 - y0) * scale))
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, p.Width, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+
+	if img := pageImage(page, data); img != nil {
+		draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// PDF coordinates are in points from the bottom left.
+	toPixels := func(x, y float64) (int, int) {
+		return int(math.Round((x - x0) * scale)), int(math.Round((y1 - y) * scale))
+	}
+	content := page.Content()
+	// Without widths for the font, as with the standard 14, the parser
+	// neither measures text nor moves past it, so guess.
+	var lastX, lastY, end float64
+	for _, t := range content.Text {
+		x, w := t.X, t.W
+		if w == 0 {
+			w = t.FontSize * 0.5 * float64(utf8.RuneCountInString(t.S))
+			if t.X == lastX && t.Y == lastY {
+				x = end
+			}
+		}
+		lastX, lastY, end = t.X, t.Y, x+w
+		if strings.TrimSpace(t.S) == "" {
+			continue
+		}
+		left, base := toPixels(x, t.Y)
+		right, top := toPixels(x+w, t.Y+t.FontSize*0.7)
+		if right <= left {
+			right = left + 1
+		}
+		if base <= top {
+			base = top + 1
+		}
+		draw.Draw(dst, image.Rect(left, top, right, base), image.NewUniform(textColor), image.Point{}, draw.Over)
+	}
+	for _, rect := range content.Rect {
+		left, bottom := toPixels(rect.Min.X, rect.Min.Y)
+		right, top := toPixels(rect.Max.X, rect.Max.Y)
+		outline(dst, image.Rect(left, top, right, bottom).Canon())
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// outline draws the edges of r onto dst.
+func outline(dst draw.Image, r image.Rectangle) {
+	src := image.NewUniform(lineColor)
+	for _, edge := range []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X+1, r.Min.Y+1),
+		image.Rect(r.Min.X, r.Max.Y, r.Max.X+1, r.Max.Y+1),
+		image.Rect(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y+1),
+		image.Rect(r.Max.X, r.Min.Y, r.Max.X+1, r.Max.Y+1),
+	} {
+		draw.Draw(dst, edge, src, image.Point{}, draw.Over)
+	}
+}
+
+// pageImage decodes the largest image that page draws directly, or returns
+// nil if there is none it understands: JPEGs, and 8 bit grey or RGB
+// images that are uncompressed or deflated.
+func pageImage(page pdf.Page, data []byte) image.Image {
+	xobjects := page.Resources().Key("XObject")
+	var best pdf.Value
+	area := int64(0)
+	for _, name := range xobjects.Keys() {
+		x := xobjects.Key(name)
+		if x.Key("Subtype").Name() != "Image" {
+			continue
+		}
+		if a := x.Key("Width").Int64() * x.Key("Height").Int64(); a > area {
+			best, area = x, a
+		}
+	}
+	if area == 0 || area > maxImagePixels {
+		return nil
+	}
+	width, height := int(best.Key("Width").Int64()), int(best.Key("Height").Int64())
+
+	filter := best.Key("Filter")
+	if filter.Kind() == pdf.Array && filter.Len() == 1 {
+		filter = filter.Index(0)
+	}
+	switch filter.Name() {
+	case "DCTDecode":
+		return findJPEG(data, width, height)
+	case "", "FlateDecode":
+		return rawImage(best, width, height)
+	}
+	return nil
+}
+
+// findJPEG returns the first JPEG stream in data that is width by height.
+// The parser can't hand back a stream it can't decode itself, so they are
+// looked for in the file directly.
+func findJPEG(data []byte, width, height int) image.Image {
+	for rest := data; ; {
+		i := bytes.Index(rest, []byte("stream"))
+		if i < 0 {
+			return nil
+		}
+		rest = rest[i+len("stream"):]
+		body := bytes.TrimPrefix(bytes.TrimPrefix(rest, []byte("\r")), []byte("\n"))
+		if !bytes.HasPrefix(body, []byte{0xff, 0xd8, 0xff}) {
+			continue
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(body))
+		if err != nil || cfg.Width != width || cfg.Height != height {
+			continue
+		}
+		if img, err := jpeg.Decode(bytes.NewReader(body)); err == nil {
+			return img
+		}
+	}
+}
+
+// rawImage decodes an 8 bit grey or RGB image stream.
+func rawImage(x pdf.Value, width, height int) image.Image {
+	if x.Key("BitsPerComponent").Int64() != 8 {
+		return nil
+	}
+	rd := x.Reader()
+	defer rd.Close()
+	switch x.Key("ColorSpace").Name() {
+	case "DeviceGray":
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		if _, err := io.ReadFull(rd, img.Pix); err != nil {
+			return nil
+		}
+		return img
+	case "DeviceRGB":
+		pix := make([]byte, width*height*3)
+		if _, err := io.ReadFull(rd, pix); err != nil {
+			return nil
+		}
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for i := 0; i < width*height; i++ {
+			copy(img.Pix[i*4:], pix[i*3:i*3+3])
+			img.Pix[i*4+3] = 0xff
+		}
+		return img
+	}
+	return nil
+}
+
+// Pdftoppm renders thumbnails with poppler's pdftoppm, found at Path. They
+// are sharper than Raster's but need poppler installed.
+type Pdftoppm struct {
+	Path string
+	// Width of the thumbnail in pixels. The height keeps the page's aspect.
+	Width int
+}
+
+func (p Pdftoppm) Thumbnail(ctx context.Context, data []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "thumbnail-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in.pdf")
+	if err := os.WriteFile(in, data, 0600); err != nil {
+		return nil, err
+	}
+	out := filepath.Join(dir, "thumbnail")
+	cmd := exec.CommandContext(ctx, p.Path,
+		"-png", "-f", "1", "-l", "1", "-singlefile", "-scale-to-x", strconv.Itoa(p.Width), "-scale-to-y", "-1", in, out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("preview: %s failed: %v: %s", p.Path, err, bytes.TrimSpace(output))
+	}
+	return os.ReadFile(out + ".png")
+}
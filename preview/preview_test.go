@@ -0,0 +1,190 @@
+package preview
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestText(t *testing.T) {
+	data, err := os.ReadFile("testdata/hello.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := Text(data)
+	if err != nil || !strings.Contains(text, "Hello kcawd readers") {
+		t.Errorf("Text = %q, %v, want it to contain the page text", text, err)
+	}
+
+	for _, bad := range []string{"", "%PDF-1.4 truncated", "not a pdf at all"} {
+		if text, err := Text([]byte(bad)); err == nil {
+			t.Errorf("Text(%q) = %q, want an error", bad, text)
+		}
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	tests := []struct {
+		text string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"  padded  ", 10, "padded"},
+		{"the quick brown fox jumps", 12, "the quick…"},
+		{"the quick, brown fox", 12, "the quick…"},
+		{"unbrokenwordthatislong", 10, "unbrokenw…"},
+	}
+	for _, tc := range tests {
+		got := Excerpt(tc.text, tc.n)
+		if got != tc.want {
+			t.Errorf("Excerpt(%q, %d) = %q, want %q", tc.text, tc.n, got, tc.want)
+		}
+		if utf8.RuneCountInString(got) > tc.n {
+			t.Errorf("Excerpt(%q, %d) is %d runes long", tc.text, tc.n, utf8.RuneCountInString(got))
+		}
+	}
+}
+
+// buildPDF lays out objects, numbered from 1, as a one page PDF whose
+// catalog is object 1.
+func buildPDF(objects ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func decodeThumbnail(t *testing.T, thumb []byte, err error) image.Image {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Thumbnail failed: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatalf("thumbnail is not a PNG: %v", err)
+	}
+	return img
+}
+
+func TestRaster(t *testing.T) {
+	data, err := os.ReadFile("testdata/hello.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thumb, err := Raster{Width: 120}.Thumbnail(context.Background(), data)
+	img := decodeThumbnail(t, thumb, err)
+	if b := img.Bounds(); b.Dx() != 120 || b.Dy() != 155 {
+		t.Fatalf("thumbnail is %v, want 120×155", b.Size())
+	}
+	// The text starts an inch in and an inch down.
+	if r, _, _, _ := img.At(20, 12).RGBA(); r == 0xffff {
+		t.Error("thumbnail has no text where the page does")
+	}
+	if r, _, _, _ := img.At(60, 120).RGBA(); r != 0xffff {
+		t.Error("thumbnail has something where the page is blank")
+	}
+
+	for _, bad := range []string{"", "%PDF-1.4 truncated", "not a pdf at all"} {
+		if _, err := (Raster{Width: 120}).Thumbnail(context.Background(), []byte(bad)); err == nil {
+			t.Errorf("Thumbnail(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestRasterScan(t *testing.T) {
+	scan := image.NewRGBA(image.Rect(0, 0, 40, 50))
+	for i := range scan.Pix {
+		scan.Pix[i] = []byte{0xc0, 0x20, 0x20, 0xff}[i%4]
+	}
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, scan, nil); err != nil {
+		t.Fatal(err)
+	}
+	content := "q 400 0 0 500 0 0 cm /Im1 Do Q"
+	data := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 /MediaBox [0 0 400 500] >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 4 0 R /Resources << /XObject << /Im1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width 40 /Height 50 /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n%s\nendstream", jpg.Len(), jpg.Bytes()),
+	)
+
+	thumb, err := Raster{Width: 80}.Thumbnail(context.Background(), data)
+	img := decodeThumbnail(t, thumb, err)
+	if b := img.Bounds(); b.Dx() != 80 || b.Dy() != 100 {
+		t.Fatalf("thumbnail is %v, want the inherited page size at 80×100", b.Size())
+	}
+	c := color.RGBAModel.Convert(img.At(40, 50)).(color.RGBA)
+	if c.R < 0xa0 || c.G > 0x50 || c.B > 0x50 {
+		t.Errorf("thumbnail middle is %v, want the scan's red", c)
+	}
+}
+
+func TestRasterPageSize(t *testing.T) {
+	page := func(box string) []byte {
+		return buildPDF(
+			"<< /Type /Catalog /Pages 2 0 R >>",
+			"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+			"<< /Type /Page /Parent 2 0 R /Contents 4 0 R /MediaBox "+box+" >>",
+			"<< /Length 0 >>\nstream\n\nendstream",
+		)
+	}
+	if _, err := (Raster{Width: 400}).Thumbnail(context.Background(), page("[0 0 1 100000]")); err == nil {
+		t.Error("Thumbnail of a 1×100000 page succeeded, want an error")
+	}
+	thumb, err := Raster{Width: 400}.Thumbnail(context.Background(), page("[0 0 100000 1]"))
+	if b := decodeThumbnail(t, thumb, err).Bounds(); b.Dx() != 400 || b.Dy() != 1 {
+		t.Errorf("thumbnail of a 100000×1 page is %v, want 400×1", b.Size())
+	}
+}
+
+func TestPdftoppm(t *testing.T) {
+	path, err := exec.LookPath("pdftoppm")
+	if err != nil {
+		t.Skip("pdftoppm is not installed")
+	}
+	data, err := os.ReadFile("testdata/hello.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thumb, err := Pdftoppm{Path: path, Width: 120}.Thumbnail(context.Background(), data)
+	if err != nil {
+		t.Fatalf("Thumbnail failed: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatalf("thumbnail is not a PNG: %v", err)
+	}
+	if w := img.Bounds().Dx(); w != 120 {
+		t.Errorf("thumbnail width = %d, want 120", w)
+	}
+}
+
+func TestPdftoppmMissing(t *testing.T) {
+	_, err := Pdftoppm{Path: "/nonexistent/pdftoppm", Width: 120}.Thumbnail(context.Background(), []byte("%PDF-1.4"))
+	if err == nil {
+		t.Error("Thumbnail with a missing binary succeeded")
+	}
+}
@@ -0,0 +1,67 @@
+// Package safehttp makes HTTP clients for fetching URLs that anyone can hand
+// the server, such as the source of a mention or a remote actor. They won't
+// connect to the network the server runs in.
+package safehttp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned for requests to loopback, private and
+// link-local addresses unless they are allowed.
+var ErrPrivateAddress = errors.New("safehttp: refusing to connect to a private address")
+
+// DefaultTimeout bounds each request unless Config says otherwise.
+const DefaultTimeout = 10 * time.Second
+
+// Config adjusts a client, and the clients of the packages that make their
+// requests with one. Requests to private addresses fail with
+// ErrPrivateAddress unless it allows them.
+type Config struct {
+	// Timeout for each request, including reading the response. Zero means
+	// DefaultTimeout.
+	Timeout time.Duration
+	// UserAgent is for the client's user to send with every request if set.
+	UserAgent string
+	// AllowPrivate lets requests reach loopback, private and link-local
+	// addresses. Anyone can hand the server a URL to fetch, so only turn it
+	// on for tests.
+	AllowPrivate bool
+}
+
+// NewClient returns a client configured by cfg. Unless cfg.AllowPrivate is
+// set it refuses to connect to loopback, private and link-local addresses.
+func NewClient(cfg Config) *http.Client {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if !cfg.AllowPrivate {
+		// Checked on the resolved address so DNS can't point around it.
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !public(ip) {
+				return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+func public(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsMulticast() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast()
+}
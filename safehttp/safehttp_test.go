@@ -0,0 +1,53 @@
+package safehttp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	if _, err := NewClient(Config{Timeout: time.Second}).Get(srv.URL); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("Get of a loopback address error = %v, want %v", err, ErrPrivateAddress)
+	}
+	resp, err := NewClient(Config{Timeout: time.Second, AllowPrivate: true}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get with private addresses allowed failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := NewClient(Config{}).Timeout; got != DefaultTimeout {
+		t.Errorf("Timeout = %v, want DefaultTimeout", got)
+	}
+}
+
+func TestPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+	}
+	for _, tc := range tests {
+		if got := public(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("public(%s) = %t, want %t", tc.ip, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package serving
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/gallery"
+)
+
+// BlockRenderer writes the HTML for a block of one type.
+type BlockRenderer func(buf *bytes.Buffer, b db.Block, site Site) error
+
+// Site is what block renderers can look up about the rest of the site.
+// Either field may be nil.
+type Site struct {
+	// ImageSize sizes images so their markup can carry dimensions and a srcset.
+	ImageSize ImageSizer
+	// Album returns the gallery album named name.
+	Album func(name string) (gallery.Album, error)
+}
+
+// imageSize is the size of the image at src, or zeros if it's unknown.
+func (s Site) imageSize(src string) (width, height int) {
+	if s.ImageSize == nil {
+		return 0, 0
+	}
+	width, height, _ = s.ImageSize(src)
+	return width, height
+}
+
+var blockRenderers = map[string]BlockRenderer{}
+
+// RegisterBlock makes blocks of type typ render with r. It is meant to be
+// called from init and panics if typ already has a renderer.
+func RegisterBlock(typ string, r BlockRenderer) {
+	if _, ok := blockRenderers[typ]; ok {
+		panic("serving: block type " + typ + " registered twice")
+	}
+	blockRenderers[typ] = r
+}
+
+func init() {
+	RegisterBlock("paragraph", renderParagraph)
+	RegisterBlock("heading", renderHeading)
+	RegisterBlock("quote", renderQuote)
+	RegisterBlock("code", renderCode)
+	RegisterBlock("image", renderImage)
+	RegisterBlock("gallery", renderGallery)
+	RegisterBlock("video", renderVideo)
+}
+
+// blocksHTML renders blocks in order.
+func blocksHTML(blocks []db.Block, site Site) (template.HTML, error) {
+	var buf bytes.Buffer
+	for i, b := range blocks {
+		render, ok := blockRenderers[b.Type]
+		if !ok {
+			return "", fmt.Errorf("block %d: unknown block type %q", i, b.Type)
+		}
+		if err := render(&buf, b, site); err != nil {
+			return "", fmt.Errorf("block %d: %v", i, err)
+		}
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// textBlock is the fields of blocks that are mostly text.
+type textBlock struct {
+	Text string `json:"text"`
+	// Heading level, from 2 to 6. The page title is the only h1.
+	Level int `json:"level"`
+	// Who a quote is from.
+	Cite string `json:"cite"`
+	// Language of code, for highlighting.
+	Language string `json:"language"`
+}
+
+var blockTmpl = template.Must(template.New("blocks").Parse(`
+{{- define "quote"}}<blockquote><p>{{.Text}}</p>{{with .Cite}}<footer><cite>{{.}}</cite></footer>{{end}}</blockquote>{{end}}
+{{- define "code"}}<pre><code{{with .Language}} class="language-{{.}}"{{end}}>{{.Text}}</code></pre>{{end}}
+{{- define "video"}}<div class="video"><iframe src="{{.Embed}}" title="{{.Title}}" loading="lazy" allow="fullscreen; picture-in-picture" allowfullscreen></iframe></div>{{end}}
+{{- define "link"}}<p><a href="{{.URL}}">{{or .Title .URL}}</a></p>{{end}}`))
+
+func renderParagraph(buf *bytes.Buffer, b db.Block, _ Site) error {
+	var p textBlock
+	if err := b.Decode(&p); err != nil {
+		return err
+	}
+	buf.WriteString("<p>" + paragraphHTML(p.Text) + "</p>")
+	return nil
+}
+
+func renderHeading(buf *bytes.Buffer, b db.Block, _ Site) error {
+	var h textBlock
+	if err := b.Decode(&h); err != nil {
+		return err
+	}
+	if h.Level < 2 {
+		h.Level = 2
+	}
+	if h.Level > 6 {
+		h.Level = 6
+	}
+	tag := "h" + strconv.Itoa(h.Level)
+	buf.WriteString("<" + tag + ">" + template.HTMLEscapeString(h.Text) + "</" + tag + ">")
+	return nil
+}
+
+func renderQuote(buf *bytes.Buffer, b db.Block, _ Site) error {
+	var q textBlock
+	if err := b.Decode(&q); err != nil {
+		return err
+	}
+	return blockTmpl.ExecuteTemplate(buf, "quote", struct {
+		Text template.HTML
+		Cite string
+	}{template.HTML(paragraphHTML(q.Text)), q.Cite})
+}
+
+func renderCode(buf *bytes.Buffer, b db.Block, _ Site) error {
+	var c textBlock
+	if err := b.Decode(&c); err != nil {
+		return err
+	}
+	return blockTmpl.ExecuteTemplate(buf, "code", c)
+}
+
+func renderImage(buf *bytes.Buffer, b db.Block, site Site) error {
+	var img Image
+	if err := b.Decode(&img); err != nil {
+		return err
+	}
+	if !validImageURL(img.Src) {
+		return nil
+	}
+	width, height := site.imageSize(img.Src)
+	return writeImage(buf, img, width, height)
+}
+
+// renderGallery shows either the images listed in the block or, if it names
+// an album, every photo in that album. An album that has since gone away
+// renders as nothing rather than breaking the entry.
+func renderGallery(buf *bytes.Buffer, b db.Block, site Site) error {
+	var g struct {
+		Images []Image `json:"images"`
+		Album  string  `json:"album"`
+	}
+	if err := b.Decode(&g); err != nil {
+		return err
+	}
+	if g.Album != "" {
+		return renderAlbum(buf, g.Album, site)
+	}
+
+	buf.WriteString(`<div class="gallery">`)
+	for _, img := range g.Images {
+		if !validImageURL(img.Src) {
+			continue
+		}
+		width, height := site.imageSize(img.Src)
+		if err := writeImage(buf, img, width, height); err != nil {
+			return err
+		}
+	}
+	buf.WriteString(`</div>`)
+	return nil
+}
+
+var albumTmpl = template.Must(template.New("album").Parse(
+	`<div class="gallery" data-index="{{.IndexPath}}">{{.Images}}<p class="gallery-link"><a href="{{.Path}}">{{.Title}}</a></p></div>`))
+
+func renderAlbum(buf *bytes.Buffer, name string, site Site) error {
+	if site.Album == nil {
+		return nil
+	}
+	album, err := site.Album(name)
+	if errors.Is(err, gallery.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var images bytes.Buffer
+	for _, p := range album.Photos {
+		img := Image{Src: PhotoPath(album.Name, p.Name), Alt: p.Caption, Caption: p.Caption}
+		if err := writeImage(&images, img, p.Width, p.Height); err != nil {
+			return err
+		}
+	}
+	return albumTmpl.Execute(buf, struct {
+		Images                 template.HTML
+		Path, IndexPath, Title string
+	}{template.HTML(images.String()), GalleryPath(album.Name), GalleryIndexPath(album.Name), album.Name})
+}
+
+var (
+	youTubeID = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+	vimeoID   = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// renderVideo embeds YouTube and Vimeo videos. Videos hosted anywhere else
+// are linked to instead, since embedding them would mean trusting their
+// pages.
+func renderVideo(buf *bytes.Buffer, b db.Block, _ Site) error {
+	var v struct {
+		URL   string `json:"url"`
+		Title string `json:"title"`
+	}
+	if err := b.Decode(&v); err != nil {
+		return err
+	}
+	if embed := videoEmbed(v.URL); embed != "" {
+		return blockTmpl.ExecuteTemplate(buf, "video", struct{ Embed, Title string }{embed, v.Title})
+	}
+	if u, err := url.Parse(v.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	return blockTmpl.ExecuteTemplate(buf, "link", v)
+}
+
+// videoEmbed returns the player URL for a YouTube or Vimeo video page, or ""
+// for anything else.
+func videoEmbed(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	host := strings.TrimPrefix(u.Hostname(), "www.")
+	var id string
+	switch host {
+	case "youtube.com", "m.youtube.com":
+		id = u.Query().Get("v")
+		if strings.HasPrefix(u.Path, "/embed/") {
+			id = strings.TrimPrefix(u.Path, "/embed/")
+		}
+	case "youtu.be":
+		id = strings.TrimPrefix(u.Path, "/")
+	case "vimeo.com", "player.vimeo.com":
+		id = u.Path[strings.LastIndex(u.Path, "/")+1:]
+		if vimeoID.MatchString(id) {
+			return "https://player.vimeo.com/video/" + id
+		}
+		return ""
+	default:
+		return ""
+	}
+	if !youTubeID.MatchString(id) {
+		return ""
+	}
+	return "https://www.youtube-nocookie.com/embed/" + id
+}
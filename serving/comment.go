@@ -0,0 +1,119 @@
+package serving
+
+import (
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dubJay/db"
+)
+
+type entryComment struct {
+	Author string
+	// The author's site. Empty unless it is an http(s) URL.
+	URL  string
+	HTML template.HTML
+	Date string
+}
+
+// CommentFormServing is the page for commenting on an entry.
+type CommentFormServing struct {
+	Title string
+	// The entry being commented on.
+	EntryPath string
+	// Where the form posts.
+	CommentPath string
+	// Hidden form field carrying the CSRF token. The form must include it.
+	CSRFField template.HTML
+}
+
+// CommentAdminServing is the comment moderation queue.
+type CommentAdminServing struct {
+	Comments []adminComment
+	// Hidden form field carrying the CSRF token. Every form must include it.
+	CSRFField template.HTML
+}
+
+type adminComment struct {
+	Id         int
+	EntryTitle string
+	EntryPath  string
+	Author     string
+	URL        string
+	Body       string
+	IP         string
+	Date       string
+}
+
+// CommentsPath is the comment form for the entry with id, and where it posts.
+func CommentsPath(id int) string {
+	return "/entry/" + strconv.Itoa(id) + "/comments"
+}
+
+func CommentsToServing(comments []db.Comment) []entryComment {
+	var out []entryComment
+	for _, c := range comments {
+		comment := entryComment{Author: c.Author, HTML: commentHTML(c.Body), Date: commentDate(c.Created)}
+		if authorURL(c.URL) {
+			comment.URL = c.URL
+		}
+		out = append(out, comment)
+	}
+	return out
+}
+
+func CommentFormToServing(entry db.Entry, csrfField template.HTML) CommentFormServing {
+	return CommentFormServing{
+		Title:       entry.Title,
+		EntryPath:   EntryPath(entry.Id, entry.Slug, entry.Published),
+		CommentPath: CommentsPath(entry.Id),
+		CSRFField:   csrfField,
+	}
+}
+
+func CommentAdminToServing(comments []db.Comment, csrfField template.HTML) CommentAdminServing {
+	serving := CommentAdminServing{CSRFField: csrfField}
+	for _, c := range comments {
+		serving.Comments = append(serving.Comments, adminComment{
+			Id:         c.Id,
+			EntryTitle: c.EntryTitle,
+			EntryPath:  EntryPath(c.EntryId, "", time.Time{}),
+			Author:     c.Author,
+			URL:        c.URL,
+			Body:       c.Body,
+			IP:         c.IP,
+			Date:       commentDate(c.Created),
+		})
+	}
+	return serving
+}
+
+func commentDate(t time.Time) string {
+	return t.Format("January 2, 2006")
+}
+
+// commentHTML escapes a comment's plain text body. Blank lines separate
+// paragraphs and other line breaks are kept.
+func commentHTML(body string) template.HTML {
+	body = strings.ReplaceAll(strings.TrimSpace(body), "\r\n", "\n")
+	var b strings.Builder
+	for _, p := range strings.Split(body, "\n\n") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		lines := strings.Split(p, "\n")
+		for i, line := range lines {
+			lines[i] = template.HTMLEscapeString(line)
+		}
+		b.WriteString("<p>" + strings.Join(lines, "<br>") + "</p>")
+	}
+	return template.HTML(b.String())
+}
+
+// authorURL reports whether u can be linked to from a comment.
+func authorURL(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
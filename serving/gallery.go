@@ -0,0 +1,129 @@
+package serving
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dubJay/gallery"
+	"github.com/dubJay/imageproxy"
+)
+
+// thumbnailWidth is the width gallery pages and indexes ask the image
+// resizer for when showing a photo small. It must be one the resizer makes.
+var thumbnailWidth = imageproxy.Widths[0]
+
+// GalleriesServing is the page listing every album.
+type GalleriesServing struct {
+	Albums []galleryAlbum
+}
+
+type galleryAlbum struct {
+	Title string
+	Path  string
+	// A thumbnail of the album's first photo.
+	CoverPath string
+	Count     int
+}
+
+// GalleryServing is the page of one album.
+type GalleryServing struct {
+	Title string
+	Path  string
+	// Where the album's JSON index is, for lightbox scripts.
+	IndexPath string
+	Photos    []galleryPhoto
+}
+
+type galleryPhoto struct {
+	Path          string
+	ThumbnailPath string
+	Width         int
+	Height        int
+	Caption       string
+	// Display date, and the same in RFC 3339 for a time element. Both are
+	// empty for photos without one.
+	Date  string
+	Taken string
+}
+
+// GalleryIndex is an album as JSON, in the shape lightbox scripts such as
+// PhotoSwipe take.
+type GalleryIndex struct {
+	Album string        `json:"album"`
+	Items []galleryItem `json:"items"`
+}
+
+type galleryItem struct {
+	Src       string `json:"src"`
+	Thumbnail string `json:"msrc"`
+	Width     int    `json:"w"`
+	Height    int    `json:"h"`
+	Title     string `json:"title,omitempty"`
+	Taken     string `json:"taken,omitempty"`
+}
+
+// GalleryPath is the URL path of an album's page.
+func GalleryPath(album string) string {
+	return "/gallery/" + url.PathEscape(album)
+}
+
+// GalleryIndexPath is the URL path of an album's JSON index.
+func GalleryIndexPath(album string) string {
+	return GalleryPath(album) + "/index.json"
+}
+
+// PhotoPath is where a photo in an album is served.
+func PhotoPath(album, name string) string {
+	return "/images/" + url.PathEscape(album) + "/" + url.PathEscape(name)
+}
+
+func thumbnailPath(album, name string) string {
+	return PhotoPath(album, name) + "?width=" + strconv.Itoa(thumbnailWidth)
+}
+
+func GalleriesToServing(albums []gallery.Album) GalleriesServing {
+	var serving GalleriesServing
+	for _, a := range albums {
+		album := galleryAlbum{Title: a.Name, Path: GalleryPath(a.Name), Count: len(a.Photos)}
+		if len(a.Photos) > 0 {
+			album.CoverPath = thumbnailPath(a.Name, a.Photos[0].Name)
+		}
+		serving.Albums = append(serving.Albums, album)
+	}
+	return serving
+}
+
+func GalleryToServing(a gallery.Album) GalleryServing {
+	serving := GalleryServing{Title: a.Name, Path: GalleryPath(a.Name), IndexPath: GalleryIndexPath(a.Name)}
+	for _, p := range a.Photos {
+		photo := galleryPhoto{
+			Path:          PhotoPath(a.Name, p.Name),
+			ThumbnailPath: thumbnailPath(a.Name, p.Name),
+			Width:         p.Width,
+			Height:        p.Height,
+			Caption:       p.Caption,
+		}
+		if !p.Taken.IsZero() {
+			photo.Date = p.Taken.Format("January 2, 2006")
+			photo.Taken = p.Taken.Format(time.RFC3339)
+		}
+		serving.Photos = append(serving.Photos, photo)
+	}
+	return serving
+}
+
+func GalleryIndexToServing(a gallery.Album) GalleryIndex {
+	index := GalleryIndex{Album: a.Name, Items: []galleryItem{}}
+	for _, p := range GalleryToServing(a).Photos {
+		index.Items = append(index.Items, galleryItem{
+			Src:       p.Path,
+			Thumbnail: p.ThumbnailPath,
+			Width:     p.Width,
+			Height:    p.Height,
+			Title:     p.Caption,
+			Taken:     p.Taken,
+		})
+	}
+	return index
+}
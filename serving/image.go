@@ -0,0 +1,73 @@
+package serving
+
+import (
+	"bytes"
+	"html/template"
+	"strconv"
+	"strings"
+
+	"github.com/dubJay/imageproxy"
+)
+
+// Image is the fields of an image block, and of each image in a gallery.
+type Image struct {
+	Src     string `json:"src"`
+	Alt     string `json:"alt,omitempty"`
+	Caption string `json:"caption,omitempty"`
+}
+
+// ImageSizer reports the size in pixels of the image at src. ok is false for
+// images it can't size, such as ones hosted elsewhere, which are then shown
+// without dimensions or a srcset.
+type ImageSizer func(src string) (width, height int, ok bool)
+
+// srcsetWidths are the narrower variants offered of each image: every width
+// the image resizer makes from ?width=.
+var srcsetWidths = imageproxy.Widths
+
+// imageSizes tells the browser how wide images are laid out, to pick from
+// the srcset.
+const imageSizes = "(max-width: 800px) 100vw, 800px"
+
+var imageTmpl = template.Must(template.New("image").Parse(
+	`{{if .Caption}}<figure class="image">{{end}}` +
+		`<a href="{{.Src}}"><img class="image" src="{{.Src}}"` +
+		`{{with .Srcset}} srcset="{{.}}" sizes="{{$.Sizes}}"{{end}}` +
+		`{{if .Width}} width="{{.Width}}" height="{{.Height}}"{{end}}` +
+		` alt="{{.Alt}}" loading="lazy" decoding="async"></a>` +
+		`{{with .Caption}}<figcaption>{{.}}</figcaption></figure>{{end}}`))
+
+type imageView struct {
+	Image
+	Width  int
+	Height int
+	Srcset string
+	Sizes  string
+}
+
+// writeImage writes the markup for img to buf. width and height are its
+// size in pixels, or zero if unknown.
+func writeImage(buf *bytes.Buffer, img Image, width, height int) error {
+	view := imageView{Image: img, Width: width, Height: height, Sizes: imageSizes}
+	// Variants are made with a query string so there can't be one already.
+	if view.Width > 0 && !strings.Contains(img.Src, "?") {
+		view.Srcset = srcset(img.Src, view.Width)
+	}
+	return imageTmpl.Execute(buf, view)
+}
+
+// srcset lists the variants of src narrower than its width, then src itself.
+// It is empty if there are none, as the original alone needs no srcset.
+func srcset(src string, width int) string {
+	var candidates []string
+	for _, w := range srcsetWidths {
+		if w >= width {
+			break
+		}
+		candidates = append(candidates, src+"?width="+strconv.Itoa(w)+" "+strconv.Itoa(w)+"w")
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return strings.Join(append(candidates, src+" "+strconv.Itoa(width)+"w"), ", ")
+}
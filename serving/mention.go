@@ -0,0 +1,29 @@
+package serving
+
+import (
+	"net/url"
+
+	"github.com/dubJay/db"
+)
+
+type entryMention struct {
+	// The source's title, or its host if it has none.
+	Title string
+	URL   string
+}
+
+func MentionsToServing(mentions []db.Mention) []entryMention {
+	var out []entryMention
+	for _, m := range mentions {
+		u, err := url.Parse(m.Source)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		mention := entryMention{Title: m.Title, URL: m.Source}
+		if mention.Title == "" {
+			mention.Title = u.Host
+		}
+		out = append(out, mention)
+	}
+	return out
+}
@@ -0,0 +1,18 @@
+package serving
+
+// NewsletterServing is the newsletter signup page, which also answers the
+// links in the newsletter's emails.
+type NewsletterServing struct {
+	// Where the signup form posts.
+	SubscribePath string
+	// What just happened: "pending" after signing up, "confirm" to ask
+	// before confirming, "confirmed", "unsubscribe" to ask before
+	// unsubscribing, or "unsubscribed". Empty for the plain signup page.
+	Status string
+	// Where the unsubscribe form posts, token included. Only set for
+	// "unsubscribe".
+	UnsubscribePath string
+	// Where the confirmation form posts, token included. Only set for
+	// "confirm".
+	ConfirmPath string
+}
@@ -0,0 +1,59 @@
+package serving
+
+import (
+	"html/template"
+	"net/url"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// paragraphPolicy keeps the inline markup entries are written with. Any other
+// element is dropped, and text, including stray < and &, is escaped.
+var paragraphPolicy = func() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowStandardURLs()
+	// Links in entries are the author's own.
+	p.RequireNoFollowOnLinks(false)
+	p.AllowAttrs("href", "title").OnElements("a")
+	p.AllowAttrs("title").OnElements("abbr")
+	p.AllowElements("b", "strong", "i", "em", "u", "s", "del", "ins", "mark",
+		"code", "kbd", "sub", "sup", "small", "q", "cite", "br", "span")
+	return p
+}()
+
+// pagePolicy is for whole SCP pages, which are laid out with ordinary
+// document markup and styled by class.
+var pagePolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.RequireNoFollowOnLinks(false)
+	p.AllowAttrs("class", "id").Globally()
+	return p
+}()
+
+// paragraphHTML sanitizes a paragraph of an entry.
+func paragraphHTML(s string) string {
+	return paragraphPolicy.Sanitize(s)
+}
+
+// pageHTML sanitizes a whole page of HTML.
+func pageHTML(b []byte) template.HTML {
+	return template.HTML(pagePolicy.SanitizeBytes(b))
+}
+
+// validImageURL reports whether src is somewhere an image may be loaded
+// from: a path on this site or an http(s) URL.
+func validImageURL(src string) bool {
+	u, err := url.Parse(src)
+	if err != nil {
+		return false
+	}
+	switch {
+	case u.Scheme == "" && u.Host == "":
+		// Only absolute paths; relative ones would resolve against the entry's URL.
+		return strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(src, "//")
+	case u.Scheme == "http" || u.Scheme == "https":
+		return u.Host != ""
+	}
+	return false
+}
@@ -1,15 +1,14 @@
 package serving
 
 import (
-	"bytes"
-	"errors"
+	"fmt"
 	"html/template"
-	"io"
 	"math/rand"
+	"net/http"
+	"net/url"
 	"path/filepath"
 	"sort"
 	"strconv"
-	"strings"
 	"time"
 	
 	"github.com/dubJay/db"
@@ -17,17 +16,35 @@ import (
 
 type EntryServing struct {
 	Title     string
+	Path      string
 	NextPath  string
+	NextTitle string
 	PrevPath  string
+	PrevTitle string
+	Tags      []string
+	// More from the year the entry was published in.
+	SameYear  []entryLink
+	// Entries sharing tags with this one.
+	Related   []entryLink
 	Month     string
 	Day       string
 	Year      string
 	HTML      template.HTML
+
+	// Approved comments, oldest first.
+	Comments       []entryComment
+	// The page with the comment form. Empty when comments are off.
+	CommentPath    string
+	// Set after a comment is posted, to say it is waiting for moderation.
+	CommentPending bool
+
+	// Other sites' posts that link here, by Webmention or Pingback.
+	Mentions []entryMention
 }
 
-type entryHTMLRaw struct {
-	Content []string
-	Image []string
+type entryLink struct {
+	Title string
+	Path  string
 }
 
 type historyMeta struct {
@@ -35,13 +52,76 @@ type historyMeta struct {
 	Path  string
 }
 
+type historyMonth struct {
+	Month    string
+	Path     string
+	Metadata []historyMeta
+}
+
 type historyEntry struct {
 	Year     int
+	Path     string
+	// Entries published this year across every page of the archive.
+	Count    int
+	Months   []historyMonth
 	Metadata []historyMeta
 }
 
 type HistoryServing []historyEntry
 
+// ArchiveServing is one page of the history archive.
+type ArchiveServing struct {
+	Title    string
+	History  HistoryServing
+	// Every year with entries, for navigating between archives.
+	Years    []historyEntry
+	Page     int
+	Pages    int
+	NextPath string
+	PrevPath string
+}
+
+// ErrorServing is rendered by the error page templates, or as JSON for
+// clients that prefer it.
+type ErrorServing struct {
+	Status  int    `json:"status"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+}
+
+// KCawdServing is the kcawd article listing, narrowed to articles matching
+// Query if it is set.
+type KCawdServing struct {
+	Query    string
+	Articles []kcawdArticle
+}
+
+type kcawdArticle struct {
+	Title         string
+	Organization  string
+	Hyperlink     string
+	PDFPath       string
+	// Empty until a thumbnail has been rendered.
+	ThumbnailPath string
+	Excerpt       string
+}
+
+// ArticleAdminServing is the kcawd upload and management page.
+type ArticleAdminServing struct {
+	Articles []adminArticle
+	// Hidden form field carrying the CSRF token. Every form must include it.
+	CSRFField template.HTML
+}
+
+type adminArticle struct {
+	Id           int
+	Title        string
+	Organization string
+	Hyperlink    string
+	// YYYY-MM-DD, as a date input expects.
+	Date         string
+}
+
 type SCPServing struct {
 	Content template.HTML
 	Quip string
@@ -58,32 +138,82 @@ var quips  = []string{
 	"SCP -- It's like Wyoming but without the tax incentives",
 	"Packrats, cows, and hunters...oh my!"}
 
-func splitTextBlob(s string) []string {
-	return strings.Split(s, `\n`)
+func ErrorToServing(status int, message string) ErrorServing {
+	return ErrorServing{
+		Status: status,
+		Title: http.StatusText(status),
+		Message: message,
+	}
+}
+
+// ArticlePath is where the PDF of the article with id is served.
+func ArticlePath(id int) string {
+	return fmt.Sprintf("/kcawd/%d", id)
 }
 
+func KCawdToServing(articles []db.ArticleMeta, query string) KCawdServing {
+	serving := KCawdServing{Query: query}
+	for _, a := range articles {
+		article := kcawdArticle{
+			Title: a.Title,
+			Organization: a.Organization,
+			Hyperlink: a.Hyperlink,
+			PDFPath: ArticlePath(a.EntryId),
+			Excerpt: a.Excerpt,
+		}
+		if a.HasThumbnail {
+			article.ThumbnailPath = ArticlePath(a.EntryId) + "/thumbnail.png"
+		}
+		serving.Articles = append(serving.Articles, article)
+	}
+	return serving
+}
+
+func ArticleAdminToServing(articles []db.ArticleMeta, csrfField template.HTML) ArticleAdminServing {
+	serving := ArticleAdminServing{CSRFField: csrfField}
+	for _, a := range articles {
+		serving.Articles = append(serving.Articles, adminArticle{
+			Id: a.EntryId,
+			Title: a.Title,
+			Organization: a.Organization,
+			Hyperlink: a.Hyperlink,
+			Date: time.Unix(int64(a.EntryId), 0).Format(ArticleDateLayout),
+		})
+	}
+	return serving
+}
+
+// ArticleDateLayout is how article dates are written in forms.
+const ArticleDateLayout = "2006-01-02"
+
 func SCPToServing(in []byte) SCPServing {
 	return SCPServing{
-		Content: template.HTML(string(in)),
+		Content: pageHTML(in),
 		Quip: quips[rand.Intn(len(quips))],
 	}
 }
 
+// ArchivePath is the URL path of the archive for a year, or a month of it.
+func ArchivePath(year int, month time.Month) string {
+	switch {
+	case year == 0:
+		return "/history"
+	case month == 0:
+		return filepath.Join("/history", strconv.Itoa(year))
+	default:
+		return filepath.Join("/history", strconv.Itoa(year), fmt.Sprintf("%02d", int(month)))
+	}
+}
+
 func HistoryToServing(h []db.History) HistoryServing {
-	m := make(map[int]map[int]string)
-	sk := make(map[int][]int)
+	sk := make(map[int][]db.History)
 	for _, entry := range h {
-		t := time.Unix(int64(entry.Entry_id), 0)
-		if _, ok := m[t.Year()]; !ok {
-			m[t.Year()] = make(map[int]string)
-			sk[t.Year()] = []int{}
-		}
-		m[t.Year()][entry.Entry_id] = entry.Title
-		sk[t.Year()] = append(sk[t.Year()], entry.Entry_id)
+		year := entry.Published.Year()
+		sk[year] = append(sk[year], entry)
 	}
 
-	mapKeys := make([]int, 0, len(m))
-	for k := range m {
+	mapKeys := make([]int, 0, len(sk))
+	for k := range sk {
 		mapKeys = append(mapKeys, k)
 	}
 	sort.Sort(sort.Reverse(sort.IntSlice(mapKeys)));
@@ -92,10 +222,23 @@ func HistoryToServing(h []db.History) HistoryServing {
 	for _, key := range mapKeys {
 		history := historyEntry{}
 		history.Year = key
-		sort.Sort(sort.Reverse(sort.IntSlice(sk[key])))
-		for _, entryId := range sk[key] {
-			history.Metadata = append(history.Metadata,
-				historyMeta{Title: m[key][entryId], Path: filepath.Join("/entry", strconv.Itoa(entryId))})
+		history.Path = ArchivePath(key, 0)
+		history.Count = len(sk[key])
+		entries := sk[key]
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Published.After(entries[j].Published)
+		})
+		for _, entry := range entries {
+			meta := historyMeta{Title: entry.Title, Path: EntryPath(entry.Id, entry.Slug, entry.Published)}
+			history.Metadata = append(history.Metadata, meta)
+
+			month := entry.Published.Month()
+			if n := len(history.Months); n == 0 || history.Months[n-1].Month != month.String() {
+				history.Months = append(history.Months,
+					historyMonth{Month: month.String(), Path: ArchivePath(key, month)})
+			}
+			last := &history.Months[len(history.Months)-1]
+			last.Metadata = append(last.Metadata, meta)
 		}
 		histServe = append(histServe, history)
 	}
@@ -103,28 +246,99 @@ func HistoryToServing(h []db.History) HistoryServing {
 
 }
 
-func EntryToServing(e db.Entry) (EntryServing, error) {
-	t := time.Unix(int64(e.Entry_id), 0)
-	nextStr, prevStr := "", ""
-	if e.Next != 0 {
-		nextStr = filepath.Join("/entry", strconv.Itoa(e.Next))
+// ArchiveToServing builds one page of the archive matching f. total is the
+// number of entries matching f across all pages and counts is every year's
+// entry count.
+func ArchiveToServing(h []db.History, f db.HistoryFilter, counts []db.YearCount, page, pageSize, total int) ArchiveServing {
+	history := HistoryToServing(h)
+	years := make([]historyEntry, 0, len(counts))
+	yearCounts := make(map[int]int)
+	for _, c := range counts {
+		yearCounts[c.Year] = c.Count
+		years = append(years, historyEntry{Year: c.Year, Path: ArchivePath(c.Year, 0), Count: c.Count})
+	}
+	// Only part of a year may be on this page so use the real totals.
+	for i := range history {
+		history[i].Count = yearCounts[history[i].Year]
+	}
+
+	archive := ArchiveServing{
+		Title: "History",
+		History: history,
+		Years: years,
+		Page: page,
+		Pages: (total + pageSize - 1) / pageSize,
+	}
+	switch {
+	case f.Month != 0:
+		archive.Title = fmt.Sprintf("%s %d", f.Month, f.Year)
+	case f.Year != 0:
+		archive.Title = strconv.Itoa(f.Year)
+	}
+
+	base := ArchivePath(f.Year, f.Month)
+	pagePath := func(p int) string {
+		if p == 1 {
+			return base
+		}
+		return base + "?page=" + strconv.Itoa(p)
+	}
+	if page > 1 {
+		archive.PrevPath = pagePath(page - 1)
+	}
+	if page < archive.Pages {
+		archive.NextPath = pagePath(page + 1)
+	}
+	return archive
+}
+
+// EntryPath is the canonical URL path of an entry. Entries that have not been
+// assigned a slug yet fall back to their numeric id.
+func EntryPath(id int, slug string, published time.Time) string {
+	if slug == "" {
+		return filepath.Join("/entry", strconv.Itoa(id))
+	}
+	// Slugs in other scripts than Latin keep their letters.
+	return filepath.Join("/entry", strconv.Itoa(published.Year()), url.PathEscape(slug))
+}
+
+func linksToServing(links []db.Link) []entryLink {
+	var out []entryLink
+	for _, l := range links {
+		out = append(out, entryLink{Title: l.Title, Path: EntryPath(l.Id, l.Slug, l.Published)})
+	}
+	return out
+}
+
+// EntryToServing converts e for the entry page, looking up what its blocks
+// refer to in site.
+func EntryToServing(e db.Entry, nav db.Navigation, site Site) (EntryServing, error) {
+	t := e.Published
+	nextStr, nextTitle, prevStr, prevTitle := "", "", "", ""
+	if nav.Next != nil {
+		nextStr = EntryPath(nav.Next.Id, nav.Next.Slug, nav.Next.Published)
+		nextTitle = nav.Next.Title
 	}
-	if e.Previous != 0 {
-		prevStr = filepath.Join("/entry", strconv.Itoa(e.Previous))
+	if nav.Previous != nil {
+		prevStr = EntryPath(nav.Previous.Id, nav.Previous.Slug, nav.Previous.Published)
+		prevTitle = nav.Previous.Title
 	}
 
-	rawHTML, err := entryHTMLFrom(entryHTMLRaw{
-		Content: splitTextBlob(e.Content),
-		Image: splitTextBlob(e.Image),
-	})
+	rawHTML, err := blocksHTML(e.Blocks, site)
 	if err != nil {
 		return EntryServing{}, err
 	}
 
 	return EntryServing{
 		Title: e.Title,
+		Path: EntryPath(e.Id, e.Slug, e.Published),
 		NextPath: nextStr,
+		NextTitle: nextTitle,
 		PrevPath: prevStr,
+		PrevTitle: prevTitle,
+		Tags: nav.Tags,
+		SameYear: linksToServing(nav.SameYear),
+		Related: linksToServing(nav.Related),
 		Month: t.Month().String(),
 		Day: strconv.Itoa(t.Day()),
 		Year: strconv.Itoa(t.Year()),
@@ -132,11 +346,8 @@ func EntryToServing(e db.Entry) (EntryServing, error) {
 	}, nil
 }
 
-func OneoffToServing(o db.Oneoff) (EntryServing, error) {
-	rawHTML, err := entryHTMLFrom(entryHTMLRaw{
-		Content: splitTextBlob(o.Paragraph),
-		Image: splitTextBlob(o.Image),
-	})
+func OneoffToServing(o db.Oneoff, site Site) (EntryServing, error) {
+	rawHTML, err := blocksHTML(o.Blocks, site)
 	if err != nil {
 		return EntryServing{}, err
 	}
@@ -146,27 +357,3 @@ func OneoffToServing(o db.Oneoff) (EntryServing, error) {
 		HTML: rawHTML,
 	}, nil
 }
-
-func StringToPDF(pdf string) io.ReadSeeker {
-	return bytes.NewReader([]byte(pdf))
-}
-
-func entryHTMLFrom(raw entryHTMLRaw) (template.HTML, error) {
-	if len(raw.Content) > len(raw.Image) {
-		return "", errors.New("Image and Content arrays are mismatched")
-	}
-	var htmlBuf bytes.Buffer
-	for i, item := range raw.Content {
-		htmlBuf.WriteString(strings.Join([]string{"<p>", item, "</p>"}, ""))
-		if len(raw.Image[i]) != 0 {
-			htmlBuf.WriteString(
-				strings.Join(
-					[]string{"<a href=",
-						raw.Image[i],
-						"><img class=image src=",
-						raw.Image[i],
-						"></a>"}, ""))
-		}
-	}
-	return template.HTML(htmlBuf.String()), nil	
-}
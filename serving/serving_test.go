@@ -0,0 +1,554 @@
+package serving
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/gallery"
+	"golang.org/x/net/html"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 12, 0, 0, 0, time.Local)
+}
+
+// testSizer knows the size of two images.
+func testSizer(src string) (int, int, bool) {
+	switch src {
+	case "/images/big.jpg":
+		return 800, 600, true
+	case "/images/small.jpg":
+		return 200, 100, true
+	}
+	return 0, 0, false
+}
+
+// testAlbum finds the album "trip"; "broken" can't be read.
+func testAlbum(name string) (gallery.Album, error) {
+	switch name {
+	case "trip":
+		return gallery.Album{Name: "trip", Photos: []gallery.Photo{
+			{Name: "ridge top.jpg", Width: 1200, Height: 800, Caption: "Dusk & rain", Taken: date(2019, time.June, 1)},
+			{Name: "b.png", Width: 300, Height: 200},
+		}}, nil
+	case "broken":
+		return gallery.Album{}, errors.New("permission denied")
+	}
+	return gallery.Album{}, gallery.ErrNotFound
+}
+
+var testSite = Site{ImageSize: testSizer, Album: testAlbum}
+
+// parseBlocks unmarshals a JSON array of blocks.
+func parseBlocks(t *testing.T, s string) []db.Block {
+	t.Helper()
+	var blocks []db.Block
+	if err := json.Unmarshal([]byte(s), &blocks); err != nil {
+		t.Fatalf("invalid blocks %s: %v", s, err)
+	}
+	return blocks
+}
+
+func TestBlocksHTML(t *testing.T) {
+	tests := []struct {
+		name    string
+		blocks  string
+		want    template.HTML
+		wantErr bool
+	}{
+		{
+			name:   "paragraphs",
+			blocks: `[{"type": "paragraph", "text": "one"}, {"type": "paragraph", "text": "two <em>2</em>"}]`,
+			want:   "<p>one</p><p>two <em>2</em></p>",
+		},
+		{
+			name:   "image",
+			blocks: `[{"type": "image", "src": "/images/a.jpg"}]`,
+			want:   `<a href="/images/a.jpg"><img class="image" src="/images/a.jpg" alt="" loading="lazy" decoding="async"></a>`,
+		},
+		{
+			name:   "sized with caption",
+			blocks: `[{"type": "image", "src": "/images/big.jpg", "alt": "A big <b>photo</b>", "caption": "Taken \"here\" & there"}]`,
+			want: `<figure class="image"><a href="/images/big.jpg"><img class="image" src="/images/big.jpg"` +
+				` srcset="/images/big.jpg?width=320 320w, /images/big.jpg?width=640 640w, /images/big.jpg 800w"` +
+				` sizes="(max-width: 800px) 100vw, 800px" width="800" height="600"` +
+				` alt="A big &lt;b&gt;photo&lt;/b&gt;" loading="lazy" decoding="async"></a>` +
+				`<figcaption>Taken &#34;here&#34; &amp; there</figcaption></figure>`,
+		},
+		{
+			name:   "too small for a srcset",
+			blocks: `[{"type": "image", "src": "/images/small.jpg"}]`,
+			want: `<a href="/images/small.jpg"><img class="image" src="/images/small.jpg" width="200" height="100"` +
+				` alt="" loading="lazy" decoding="async"></a>`,
+		},
+		{
+			name:   "unsafe image source",
+			blocks: `[{"type": "image", "src": "javascript:alert(1)\" onerror=\"x"}]`,
+			want:   "",
+		},
+		{
+			name: "gallery",
+			blocks: `[{"type": "gallery", "images": [{"src": "/images/small.jpg", "alt": "Small"},
+				{"src": "javascript:alert(1)"}, {"src": "https://example.com/b.png"}]}]`,
+			want: `<div class="gallery">` +
+				`<a href="/images/small.jpg"><img class="image" src="/images/small.jpg" width="200" height="100" alt="Small" loading="lazy" decoding="async"></a>` +
+				`<a href="https://example.com/b.png"><img class="image" src="https://example.com/b.png" alt="" loading="lazy" decoding="async"></a>` +
+				`</div>`,
+		},
+		{
+			name:   "album",
+			blocks: `[{"type": "gallery", "album": "trip"}]`,
+			want: `<div class="gallery" data-index="/gallery/trip/index.json">` +
+				`<figure class="image"><a href="/images/trip/ridge%20top.jpg"><img class="image" src="/images/trip/ridge%20top.jpg"` +
+				` srcset="/images/trip/ridge%20top.jpg?width=320 320w, /images/trip/ridge%20top.jpg?width=640 640w, /images/trip/ridge%20top.jpg?width=1024 1024w, /images/trip/ridge%20top.jpg 1200w"` +
+				` sizes="(max-width: 800px) 100vw, 800px" width="1200" height="800" alt="Dusk &amp; rain" loading="lazy" decoding="async"></a>` +
+				`<figcaption>Dusk &amp; rain</figcaption></figure>` +
+				`<a href="/images/trip/b.png"><img class="image" src="/images/trip/b.png" width="300" height="200" alt="" loading="lazy" decoding="async"></a>` +
+				`<p class="gallery-link"><a href="/gallery/trip">trip</a></p></div>`,
+		},
+		{
+			name:   "missing album",
+			blocks: `[{"type": "gallery", "album": "gone"}]`,
+			want:   "",
+		},
+		{
+			name:    "unreadable album",
+			blocks:  `[{"type": "gallery", "album": "broken"}]`,
+			wantErr: true,
+		},
+		{
+			name:   "headings",
+			blocks: `[{"type": "heading", "text": "Intro & <b>more</b>"}, {"type": "heading", "text": "Deep", "level": 9}, {"type": "heading", "text": "Top", "level": 1}]`,
+			want:   "<h2>Intro &amp; &lt;b&gt;more&lt;/b&gt;</h2><h6>Deep</h6><h2>Top</h2>",
+		},
+		{
+			name:   "quote",
+			blocks: `[{"type": "quote", "text": "To <em>be</em><script>x</script>", "cite": "<Hamlet>"}]`,
+			want:   "<blockquote><p>To <em>be</em></p><footer><cite>&lt;Hamlet&gt;</cite></footer></blockquote>",
+		},
+		{
+			name:   "code",
+			blocks: `[{"type": "code", "text": "if a < b {\n\treturn\n}", "language": "go"}]`,
+			want:   "<pre><code class=\"language-go\">if a &lt; b {\n\treturn\n}</code></pre>",
+		},
+		{
+			name:   "youtube",
+			blocks: `[{"type": "video", "url": "https://www.youtube.com/watch?v=dQw4w9WgXcQ", "title": "A video"}]`,
+			want: `<div class="video"><iframe src="https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ" title="A video"` +
+				` loading="lazy" allow="fullscreen; picture-in-picture" allowfullscreen></iframe></div>`,
+		},
+		{
+			name:   "vimeo",
+			blocks: `[{"type": "video", "url": "https://vimeo.com/76979871"}]`,
+			want: `<div class="video"><iframe src="https://player.vimeo.com/video/76979871" title=""` +
+				` loading="lazy" allow="fullscreen; picture-in-picture" allowfullscreen></iframe></div>`,
+		},
+		{
+			name:   "video elsewhere is linked",
+			blocks: `[{"type": "video", "url": "https://videos.example.com/v/1", "title": "Elsewhere"}]`,
+			want:   `<p><a href="https://videos.example.com/v/1">Elsewhere</a></p>`,
+		},
+		{
+			name:   "unsafe video",
+			blocks: `[{"type": "video", "url": "javascript:alert(1)"}]`,
+			want:   "",
+		},
+		{
+			name:    "unknown type",
+			blocks:  `[{"type": "carousel"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed fields",
+			blocks:  `[{"type": "paragraph", "text": 7}]`,
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := blocksHTML(parseBlocks(t, tc.blocks), testSite)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("blocksHTML() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("blocksHTML() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegisterBlock(t *testing.T) {
+	RegisterBlock("test-shout", func(buf *bytes.Buffer, b db.Block, _ Site) error {
+		var s struct {
+			Text string `json:"text"`
+		}
+		if err := b.Decode(&s); err != nil {
+			return err
+		}
+		buf.WriteString("<strong>" + template.HTMLEscapeString(strings.ToUpper(s.Text)) + "</strong>")
+		return nil
+	})
+	defer delete(blockRenderers, "test-shout")
+
+	got, err := blocksHTML(parseBlocks(t, `[{"type": "test-shout", "text": "hey"}]`), Site{})
+	if err != nil || got != "<strong>HEY</strong>" {
+		t.Errorf("blocksHTML() = %q, %v, want the registered renderer's output", got, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering paragraph twice did not panic")
+		}
+	}()
+	RegisterBlock("paragraph", renderParagraph)
+}
+
+func TestEntryToServing(t *testing.T) {
+	published := date(2017, time.March, 15)
+	entry := db.Entry{
+		Id:        1,
+		Slug:      "first-post",
+		Title:     "First Post",
+		Blocks:    parseBlocks(t, `[{"type": "paragraph", "text": "Hello"}, {"type": "paragraph", "text": "World"}, {"type": "image", "src": "/images/a.jpg"}]`),
+		Published: published,
+	}
+	nav := db.Navigation{
+		Next:     &db.Link{Id: 2, Slug: "second-post", Title: "Second Post", Published: date(2017, time.July, 14)},
+		Tags:     []string{"life"},
+		SameYear: []db.Link{{Id: 2, Slug: "second-post", Title: "Second Post", Published: date(2017, time.July, 14)}},
+	}
+
+	got, err := EntryToServing(entry, nav, Site{})
+	if err != nil {
+		t.Fatalf("EntryToServing failed: %v", err)
+	}
+	want := EntryServing{
+		Title:     "First Post",
+		Path:      "/entry/2017/first-post",
+		NextPath:  "/entry/2017/second-post",
+		NextTitle: "Second Post",
+		Tags:      []string{"life"},
+		SameYear:  []entryLink{{Title: "Second Post", Path: "/entry/2017/second-post"}},
+		Month:     "March",
+		Day:       "15",
+		Year:      "2017",
+		HTML: `<p>Hello</p><p>World</p><a href="/images/a.jpg"><img class="image" src="/images/a.jpg"` +
+			` alt="" loading="lazy" decoding="async"></a>`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EntryToServing() = %+v, want %+v", got, want)
+	}
+
+	entry.Blocks = parseBlocks(t, `[{"type": "mystery"}]`)
+	if _, err := EntryToServing(entry, nav, Site{}); err == nil {
+		t.Error("EntryToServing() with an unknown block type succeeded, want an error")
+	}
+}
+
+// TestEntryXSS stores script in each place an entry's content comes from and
+// checks none of it survives as markup.
+func TestEntryXSS(t *testing.T) {
+	tests := []struct {
+		name   string
+		blocks string
+		// Substrings that must appear, showing the payload was escaped
+		// rather than just cut out.
+		want []string
+	}{
+		{name: "script in paragraph", blocks: `[{"type": "paragraph", "text": "hi <script>alert(1)</script> there"}]`},
+		{name: "event handler in paragraph", blocks: `[{"type": "paragraph", "text": "<img src=x onerror=alert(1)>"}]`},
+		{name: "javascript link in paragraph", blocks: `[{"type": "paragraph", "text": "<a href=\"javascript:alert(1)\">click</a>"}]`,
+			want: []string{"click"}},
+		{name: "breaking out of the paragraph", blocks: `[{"type": "paragraph", "text": "</p><iframe src=\"//evil.example\"></iframe><p>"}]`},
+		{name: "svg in paragraph", blocks: `[{"type": "paragraph", "text": "<svg onload=alert(1)><use href=\"data:x\"/></svg>"}]`},
+		{name: "text with angle brackets", blocks: `[{"type": "paragraph", "text": "1 < 2 && \"quotes\" > 0"}]`,
+			want: []string{"1 &lt; 2 &amp;&amp; &#34;quotes&#34; &gt; 0"}},
+		{name: "javascript image", blocks: `[{"type": "image", "src": "javascript:alert(1)"}]`},
+		{name: "data image", blocks: `[{"type": "image", "src": "data:image/svg+xml,<svg onload=alert(1)>"}]`},
+		{name: "attribute breakout in image", blocks: `[{"type": "image", "src": "/images/a.jpg\" onerror=\"alert(1)"}]`,
+			want: []string{`src="/images/a.jpg%22%20onerror=%22alert%281%29"`}},
+		{name: "tag breakout in image", blocks: `[{"type": "image", "src": "/images/a.jpg><script>alert(1)</script>"}]`},
+		{name: "protocol relative image", blocks: `[{"type": "image", "src": "//evil.example/a.jpg"}]`},
+		{name: "script in alt and caption",
+			blocks: `[{"type": "image", "src": "/images/a.jpg", "alt": "\"><script>alert(1)</script>", "caption": "<img src=x onerror=alert(1)>"}]`,
+			want:   []string{`alt="&#34;&gt;&lt;script&gt;`, `<figcaption>&lt;img src=x`}},
+		{name: "script in heading", blocks: `[{"type": "heading", "text": "<script>alert(1)</script>"}]`},
+		{name: "script in code", blocks: `[{"type": "code", "text": "<script>alert(1)</script>", "language": "\"><script>"}]`},
+		{name: "script in quote", blocks: `[{"type": "quote", "text": "<script>alert(1)</script>", "cite": "<script>"}]`},
+		{name: "video breakout", blocks: `[{"type": "video", "url": "https://youtu.be/\"><script>alert(1)</script>", "title": "\"><script>"}]`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			entry := db.Entry{Id: 1, Title: "XSS", Blocks: parseBlocks(t, tc.blocks)}
+			got, err := EntryToServing(entry, db.Navigation{}, Site{})
+			if err != nil {
+				t.Fatalf("EntryToServing failed: %v", err)
+			}
+			if bad := unsafeMarkup(t, got.HTML); bad != "" {
+				t.Errorf("HTML = %q, has %s", got.HTML, bad)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(string(got.HTML), want) {
+					t.Errorf("HTML = %q, want it to contain %q", got.HTML, want)
+				}
+			}
+		})
+	}
+}
+
+// unsafeMarkup parses h and describes the first element or attribute in it
+// that could run script or load from somewhere unexpected.
+func unsafeMarkup(t *testing.T, h template.HTML) string {
+	t.Helper()
+	doc, err := html.Parse(strings.NewReader(string(h)))
+	if err != nil {
+		t.Fatalf("unable to parse %q: %v", h, err)
+	}
+	var bad string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "script", "iframe", "svg", "object", "embed", "style":
+				bad = "a " + n.Data + " element"
+			}
+			for _, a := range n.Attr {
+				v := strings.ToLower(strings.TrimSpace(a.Val))
+				switch {
+				case strings.HasPrefix(a.Key, "on"):
+					bad = "a " + a.Key + " attribute"
+				case (a.Key == "href" || a.Key == "src") &&
+					(strings.HasPrefix(v, "javascript:") || strings.HasPrefix(v, "data:") || strings.HasPrefix(v, "//")):
+					bad = a.Key + "=" + a.Val
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil && bad == ""; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return bad
+}
+
+func TestParagraphHTML(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "plain", want: "plain"},
+		{in: `some <em>emphasis</em> and <a href="/entry/2017/first-post">a link</a>`,
+			want: `some <em>emphasis</em> and <a href="/entry/2017/first-post">a link</a>`},
+		{in: `<div class="x">block</div>`, want: "block"},
+		{in: `<b onclick="alert(1)">bold</b>`, want: "<b>bold</b>"},
+	}
+	for _, tc := range tests {
+		if got := paragraphHTML(tc.in); got != tc.want {
+			t.Errorf("paragraphHTML(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSCPToServing(t *testing.T) {
+	got := SCPToServing([]byte(`<h2 class="title">Hunting</h2><p>Season <a href="/scp/faqs">dates</a></p><script>alert(1)</script><p onmouseover="alert(1)">x</p>`))
+	want := template.HTML(`<h2 class="title">Hunting</h2><p>Season <a href="/scp/faqs">dates</a></p><p>x</p>`)
+	if got.Content != want {
+		t.Errorf("SCPToServing().Content = %q, want %q", got.Content, want)
+	}
+	if got.Quip == "" {
+		t.Error("SCPToServing() has no quip")
+	}
+}
+
+func TestEntryPath(t *testing.T) {
+	if got := EntryPath(7, "", date(2019, time.May, 1)); got != "/entry/7" {
+		t.Errorf("EntryPath without slug = %q, want /entry/7", got)
+	}
+	if got := EntryPath(7, "seven", date(2019, time.May, 1)); got != "/entry/2019/seven" {
+		t.Errorf("EntryPath with slug = %q, want /entry/2019/seven", got)
+	}
+	if got := EntryPath(7, "привет", date(2019, time.May, 1)); got != "/entry/2019/%D0%BF%D1%80%D0%B8%D0%B2%D0%B5%D1%82" {
+		t.Errorf("EntryPath with a Cyrillic slug = %q, want it escaped", got)
+	}
+}
+
+func TestHistoryToServing(t *testing.T) {
+	history := []db.History{
+		{Id: 1, Slug: "a", Title: "A", Published: date(2017, time.March, 15)},
+		{Id: 3, Slug: "c", Title: "C", Published: date(2018, time.March, 2)},
+		{Id: 2, Slug: "b", Title: "B", Published: date(2017, time.July, 14)},
+		{Id: 4, Slug: "d", Title: "D", Published: date(2017, time.July, 20)},
+	}
+	want := HistoryServing{
+		{
+			Year:  2018,
+			Path:  "/history/2018",
+			Count: 1,
+			Months: []historyMonth{
+				{Month: "March", Path: "/history/2018/03", Metadata: []historyMeta{{Title: "C", Path: "/entry/2018/c"}}},
+			},
+			Metadata: []historyMeta{{Title: "C", Path: "/entry/2018/c"}},
+		},
+		{
+			Year:  2017,
+			Path:  "/history/2017",
+			Count: 3,
+			Months: []historyMonth{
+				{Month: "July", Path: "/history/2017/07", Metadata: []historyMeta{
+					{Title: "D", Path: "/entry/2017/d"},
+					{Title: "B", Path: "/entry/2017/b"},
+				}},
+				{Month: "March", Path: "/history/2017/03", Metadata: []historyMeta{{Title: "A", Path: "/entry/2017/a"}}},
+			},
+			Metadata: []historyMeta{
+				{Title: "D", Path: "/entry/2017/d"},
+				{Title: "B", Path: "/entry/2017/b"},
+				{Title: "A", Path: "/entry/2017/a"},
+			},
+		},
+	}
+	if got := HistoryToServing(history); !reflect.DeepEqual(got, want) {
+		t.Errorf("HistoryToServing() = %+v, want %+v", got, want)
+	}
+	if got := HistoryToServing(nil); len(got) != 0 {
+		t.Errorf("HistoryToServing(nil) = %+v, want empty", got)
+	}
+}
+
+func TestArchiveToServing(t *testing.T) {
+	history := []db.History{{Id: 2, Slug: "b", Title: "B", Published: date(2017, time.July, 14)}}
+	counts := []db.YearCount{{Year: 2018, Count: 1}, {Year: 2017, Count: 3}}
+	filter := db.HistoryFilter{Year: 2017, Month: time.July}
+
+	got := ArchiveToServing(history, filter, counts, 2, 1, 3)
+	if got.Title != "July 2017" {
+		t.Errorf("Title = %q, want July 2017", got.Title)
+	}
+	if got.Pages != 3 || got.PrevPath != "/history/2017/07" || got.NextPath != "/history/2017/07?page=3" {
+		t.Errorf("pagination = %d pages, prev %q, next %q", got.Pages, got.PrevPath, got.NextPath)
+	}
+	if len(got.History) != 1 || got.History[0].Count != 3 {
+		t.Errorf("History = %+v, want one year counting all 3 entries", got.History)
+	}
+	if len(got.Years) != 2 || got.Years[0].Path != "/history/2018" {
+		t.Errorf("Years = %+v, want 2018 then 2017", got.Years)
+	}
+}
+
+// The shipped history template has to keep up with ArchiveServing.
+func TestHistoryTemplate(t *testing.T) {
+	tmpl, err := template.New("history.html").Option("missingkey=error").ParseFiles("../templates/history.html")
+	if err != nil {
+		t.Fatalf("unable to parse history template: %v", err)
+	}
+	history := []db.History{{Id: 2, Slug: "b", Title: "B", Published: date(2017, time.July, 14)}}
+	counts := []db.YearCount{{Year: 2018, Count: 1}, {Year: 2017, Count: 3}}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, ArchiveToServing(history, db.HistoryFilter{Year: 2017}, counts, 2, 1, 3))
+	if err != nil {
+		t.Fatalf("unable to render history template: %v", err)
+	}
+	for _, want := range []string{`href="/entry/2017/b"`, `href="/history/2017/07"`, "Page 2 of 3", `href="/history/2018"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("history page lacks %s:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestGalleryToServing(t *testing.T) {
+	album, _ := testAlbum("trip")
+	taken := date(2019, time.June, 1).Format(time.RFC3339)
+
+	got := GalleryToServing(album)
+	want := GalleryServing{
+		Title:     "trip",
+		Path:      "/gallery/trip",
+		IndexPath: "/gallery/trip/index.json",
+		Photos: []galleryPhoto{
+			{Path: "/images/trip/ridge%20top.jpg", ThumbnailPath: "/images/trip/ridge%20top.jpg?width=320", Width: 1200, Height: 800,
+				Caption: "Dusk & rain", Date: "June 1, 2019", Taken: taken},
+			{Path: "/images/trip/b.png", ThumbnailPath: "/images/trip/b.png?width=320", Width: 300, Height: 200},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GalleryToServing() = %+v, want %+v", got, want)
+	}
+
+	index, err := json.Marshal(GalleryIndexToServing(album))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantIndex := `{"album":"trip","items":[` +
+		`{"src":"/images/trip/ridge%20top.jpg","msrc":"/images/trip/ridge%20top.jpg?width=320","w":1200,"h":800,"title":"Dusk \u0026 rain","taken":"` + taken + `"},` +
+		`{"src":"/images/trip/b.png","msrc":"/images/trip/b.png?width=320","w":300,"h":200}]}`
+	if string(index) != wantIndex {
+		t.Errorf("GalleryIndexToServing() = %s, want %s", index, wantIndex)
+	}
+
+	galleries := GalleriesToServing([]gallery.Album{album})
+	wantGalleries := GalleriesServing{Albums: []galleryAlbum{
+		{Title: "trip", Path: "/gallery/trip", CoverPath: "/images/trip/ridge%20top.jpg?width=320", Count: 2},
+	}}
+	if !reflect.DeepEqual(galleries, wantGalleries) {
+		t.Errorf("GalleriesToServing() = %+v, want %+v", galleries, wantGalleries)
+	}
+}
+
+func TestCommentsToServing(t *testing.T) {
+	comments := []db.Comment{
+		{Author: "Ann", URL: "https://ann.example.com", Body: "Nice <b>post</b>\r\nreally\n\n\n& more", Created: date(2017, time.July, 15)},
+		{Author: "<Bob>", URL: "javascript:alert(1)", Body: "  hi  ", Created: date(2017, time.July, 16)},
+	}
+	want := []entryComment{
+		{Author: "Ann", URL: "https://ann.example.com", HTML: "<p>Nice &lt;b&gt;post&lt;/b&gt;<br>really</p><p>&amp; more</p>", Date: "July 15, 2017"},
+		{Author: "<Bob>", HTML: "<p>hi</p>", Date: "July 16, 2017"},
+	}
+	if got := CommentsToServing(comments); !reflect.DeepEqual(got, want) {
+		t.Errorf("CommentsToServing() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCommentFormToServing(t *testing.T) {
+	entry := db.Entry{Id: 2, Slug: "second-post", Title: "Second Post", Published: date(2017, time.July, 15)}
+	want := CommentFormServing{Title: "Second Post", EntryPath: "/entry/2017/second-post", CommentPath: "/entry/2/comments",
+		CSRFField: "<input>"}
+	if got := CommentFormToServing(entry, "<input>"); got != want {
+		t.Errorf("CommentFormToServing() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCommentAdminToServing(t *testing.T) {
+	comments := []db.Comment{{Id: 2, EntryId: 5, EntryTitle: "Second Post", Author: "Bob", Body: "First!", IP: "192.0.2.2",
+		Created: date(2017, time.July, 16)}}
+	want := CommentAdminServing{
+		Comments: []adminComment{{Id: 2, EntryTitle: "Second Post", EntryPath: "/entry/5", Author: "Bob", Body: "First!",
+			IP: "192.0.2.2", Date: "July 16, 2017"}},
+		CSRFField: "<input>",
+	}
+	if got := CommentAdminToServing(comments, "<input>"); !reflect.DeepEqual(got, want) {
+		t.Errorf("CommentAdminToServing() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMentionsToServing(t *testing.T) {
+	mentions := []db.Mention{
+		{Source: "https://blog.example.com/reply", Title: "A reply"},
+		{Source: "https://other.example.com/post"},
+		{Source: "javascript:alert(1)", Title: "Bad"},
+	}
+	want := []entryMention{
+		{Title: "A reply", URL: "https://blog.example.com/reply"},
+		{Title: "other.example.com", URL: "https://other.example.com/post"},
+	}
+	if got := MentionsToServing(mentions); !reflect.DeepEqual(got, want) {
+		t.Errorf("MentionsToServing() = %+v, want %+v", got, want)
+	}
+}
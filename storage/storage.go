@@ -0,0 +1,129 @@
+// Package storage keeps kcawd PDFs as files outside the database.
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Store opens files by the key recorded as an article's location.
+type Store interface {
+	// Open returns the file stored under key. Missing files are reported
+	// with an error wrapping fs.ErrNotExist.
+	Open(key string) (*os.File, error)
+	// Put copies r into the store and returns the key to open it by and its
+	// size. Keys are derived from the contents, so storing the same file
+	// twice keeps one copy.
+	Put(r io.Reader) (string, int64, error)
+}
+
+var (
+	_ Store = Dir("")
+	_ Store = CAS("")
+)
+
+// Parse returns the Store described by spec, either "dir:PATH" or "cas:PATH".
+// An empty spec returns a nil Store.
+func Parse(spec string) (Store, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	kind, root, ok := strings.Cut(spec, ":")
+	if !ok || root == "" {
+		return nil, fmt.Errorf("storage: %q is not of the form kind:path", spec)
+	}
+	switch kind {
+	case "dir":
+		return Dir(root), nil
+	case "cas":
+		return CAS(root), nil
+	}
+	return nil, fmt.Errorf("storage: unknown kind %q in %q", kind, spec)
+}
+
+// Dir keeps files by name in a directory tree. Keys are slash separated paths
+// relative to the directory and cannot escape it.
+type Dir string
+
+func (d Dir) Open(key string) (*os.File, error) {
+	// Rooting the key before cleaning strips any leading "..".
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(path.Clean("/"+key))))
+}
+
+// Put names the file by the hex SHA-256 of its contents.
+func (d Dir) Put(r io.Reader) (string, int64, error) {
+	var key string
+	_, size, err := put(string(d), r, func(sum string) string {
+		key = sum + ".pdf"
+		return filepath.Join(string(d), key)
+	})
+	return key, size, err
+}
+
+// CAS keeps files in a directory under the hex SHA-256 of their contents,
+// sharded by the first two characters of the hash.
+type CAS string
+
+func (c CAS) path(key string) (string, error) {
+	if len(key) != sha256.Size*2 {
+		return "", fmt.Errorf("storage: %q is not a SHA-256: %w", key, os.ErrNotExist)
+	}
+	if _, err := hex.DecodeString(key); err != nil || strings.ToLower(key) != key {
+		return "", fmt.Errorf("storage: %q is not a SHA-256: %w", key, os.ErrNotExist)
+	}
+	return filepath.Join(string(c), key[:2], key), nil
+}
+
+func (c CAS) Open(key string) (*os.File, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (c CAS) Put(r io.Reader) (string, int64, error) {
+	return put(string(c), r, func(sum string) string {
+		p, _ := c.path(sum)
+		return p
+	})
+}
+
+// put copies r to a temporary file in root and then renames it to the path
+// dest returns for its hex SHA-256, which is also returned as the key.
+func put(root string, r io.Reader, dest func(sum string) string) (string, int64, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", 0, err
+	}
+	tmp, err := os.CreateTemp(root, ".put-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	p := dest(sum)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return "", 0, err
+	}
+	return sum, size, nil
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Store
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "dir:/srv/pdfs", want: Dir("/srv/pdfs")},
+		{spec: "cas:pdfs", want: CAS("pdfs")},
+		{spec: "s3:bucket", wantErr: true},
+		{spec: "dir:", wantErr: true},
+		{spec: "/srv/pdfs", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := Parse(tc.spec)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("Parse(%q) = %v, %v, want %v (error %t)", tc.spec, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.pdf"), []byte("pdf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := Dir(filepath.Join(root, "sub"))
+	if err := os.Mkdir(string(d), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(string(d), "b.pdf"), []byte("inner"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := d.Open("b.pdf")
+	if err != nil {
+		t.Fatalf("Open(b.pdf) failed: %v", err)
+	}
+	if b, _ := io.ReadAll(f); string(b) != "inner" {
+		t.Errorf("Open(b.pdf) read %q, want inner", b)
+	}
+	f.Close()
+
+	key, size, err := d.Put(strings.NewReader("%PDF-1.4 fixture"))
+	if want := "c5c2e8be6ad0825a56ded1f1a153ceaf11dc060ab44b120a94406a08207babc2.pdf"; err != nil || key != want || size != 16 {
+		t.Errorf("Put = %s, %d, %v, want %s, 16", key, size, err, want)
+	}
+	if f, err := d.Open(key); err != nil {
+		t.Errorf("Open(%s) failed: %v", key, err)
+	} else {
+		f.Close()
+	}
+
+	for _, key := range []string{"../a.pdf", "/../a.pdf", "missing.pdf"} {
+		if f, err := d.Open(key); !errors.Is(err, fs.ErrNotExist) {
+			if f != nil {
+				f.Close()
+			}
+			t.Errorf("Open(%q) error = %v, want %v", key, err, fs.ErrNotExist)
+		}
+	}
+}
+
+func TestCAS(t *testing.T) {
+	c := CAS(t.TempDir())
+
+	key, size, err := c.Put(strings.NewReader("%PDF-1.4 fixture"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if want := "c5c2e8be6ad0825a56ded1f1a153ceaf11dc060ab44b120a94406a08207babc2"; key != want || size != 16 {
+		t.Errorf("Put = %s, %d, want %s, 16", key, size, want)
+	}
+	if again, _, err := c.Put(strings.NewReader("%PDF-1.4 fixture")); err != nil || again != key {
+		t.Errorf("second Put = %s, %v, want %s", again, err, key)
+	}
+	if _, err := os.Stat(filepath.Join(string(c), key[:2], key)); err != nil {
+		t.Errorf("stored file missing: %v", err)
+	}
+
+	f, err := c.Open(key)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	if b, _ := io.ReadAll(f); string(b) != "%PDF-1.4 fixture" {
+		t.Errorf("Open read %q", b)
+	}
+
+	entries, _ := os.ReadDir(string(c))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".put-") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+	for _, key := range []string{"../etc/passwd", strings.Repeat("A", 64), strings.Repeat("0", 64)} {
+		if _, err := c.Open(key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%q) error = %v, want %v", key, err, fs.ErrNotExist)
+		}
+	}
+}
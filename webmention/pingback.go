@@ -0,0 +1,171 @@
+package webmention
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Pingback fault codes a server may answer with.
+const (
+	FaultSourceNoLink      = 17
+	FaultTargetNotFound    = 32
+	FaultTargetInvalid     = 33
+	FaultAlreadyRegistered = 48
+	// Standard XML-RPC codes for requests that can't be understood.
+	faultParse  = -32700
+	faultMethod = -32601
+	faultParams = -32602
+)
+
+// Fault is an XML-RPC fault, sent by a Pingback server that refuses a ping.
+type Fault struct {
+	Code    int
+	Message string
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("pingback fault %d: %s", f.Code, f.Message)
+}
+
+type methodCall struct {
+	XMLName    xml.Name `xml:"methodCall"`
+	MethodName string   `xml:"methodName"`
+	Params     []value  `xml:"params>param>value"`
+}
+
+type methodResponse struct {
+	XMLName xml.Name `xml:"methodResponse"`
+	Params  []value  `xml:"params>param>value"`
+	Fault   *struct {
+		Members []struct {
+			Name  string `xml:"name"`
+			Value value  `xml:"value"`
+		} `xml:"value>struct>member"`
+	} `xml:"fault"`
+}
+
+// value is an XML-RPC value. Only strings and integers are needed; an
+// untyped value is a string.
+type value struct {
+	String *string `xml:"string"`
+	Int    *string `xml:"int"`
+	I4     *string `xml:"i4"`
+	Text   string  `xml:",chardata"`
+}
+
+func (v value) str() string {
+	switch {
+	case v.String != nil:
+		return *v.String
+	case v.Int != nil:
+		return *v.Int
+	case v.I4 != nil:
+		return *v.I4
+	}
+	return strings.TrimSpace(v.Text)
+}
+
+// ping sends a Pingback to server. A server that already has it counts as
+// success.
+func (c *Client) ping(ctx context.Context, server, source, target string) error {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	body.WriteString("<methodCall><methodName>pingback.ping</methodName><params>")
+	for _, p := range []string{source, target} {
+		body.WriteString("<param><value><string>")
+		xml.EscapeText(&body, []byte(p))
+		body.WriteString("</string></value></param>")
+	}
+	body.WriteString("</params></methodCall>")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webmention: %s refused pingback of %s: %s", server, target, resp.Status)
+	}
+
+	var result methodResponse
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxBody)).Decode(&result); err != nil {
+		return fmt.Errorf("webmention: invalid pingback response from %s: %v", server, err)
+	}
+	if result.Fault == nil {
+		return nil
+	}
+	fault := &Fault{}
+	for _, m := range result.Fault.Members {
+		switch m.Name {
+		case "faultCode":
+			fault.Code, _ = strconv.Atoi(m.Value.str())
+		case "faultString":
+			fault.Message = m.Value.str()
+		}
+	}
+	if fault.Code == FaultAlreadyRegistered {
+		return nil
+	}
+	return fault
+}
+
+// ParsePing reads a pingback.ping call from r and returns its source and
+// target. The error is a *Fault to answer the caller with if it isn't one.
+func ParsePing(r io.Reader) (source, target string, err error) {
+	var call methodCall
+	if err := xml.NewDecoder(io.LimitReader(r, maxBody)).Decode(&call); err != nil {
+		return "", "", &Fault{Code: faultParse, Message: "invalid XML-RPC request"}
+	}
+	if call.MethodName != "pingback.ping" {
+		return "", "", &Fault{Code: faultMethod, Message: "unknown method " + call.MethodName}
+	}
+	if len(call.Params) != 2 {
+		return "", "", &Fault{Code: faultParams, Message: "pingback.ping takes a source and a target"}
+	}
+	return call.Params[0].str(), call.Params[1].str(), nil
+}
+
+// WritePingResult answers a pingback.ping call with message.
+func WritePingResult(w http.ResponseWriter, message string) {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	body.WriteString("<methodResponse><params><param><value><string>")
+	xml.EscapeText(&body, []byte(message))
+	body.WriteString("</string></value></param></params></methodResponse>")
+	writeXML(w, body.Bytes())
+}
+
+// WriteFault answers an XML-RPC call with the fault in err, or a generic one
+// if err isn't a *Fault.
+func WriteFault(w http.ResponseWriter, err error) {
+	var fault *Fault
+	if !errors.As(err, &fault) {
+		fault = &Fault{Code: 0, Message: err.Error()}
+	}
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	fmt.Fprintf(&body, "<methodResponse><fault><value><struct>"+
+		"<member><name>faultCode</name><value><int>%d</int></value></member>"+
+		"<member><name>faultString</name><value><string>", fault.Code)
+	xml.EscapeText(&body, []byte(fault.Message))
+	body.WriteString("</string></value></member></struct></value></fault></methodResponse>")
+	writeXML(w, body.Bytes())
+}
+
+// writeXML sends an XML-RPC response. Faults are sent with 200 OK too.
+func writeXML(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write(body)
+}
@@ -0,0 +1,382 @@
+// Package webmention sends Webmentions for the links in a page, falling back
+// to Pingback for sites that only take those, and checks that the sources of
+// mentions received really link to their targets.
+//
+// See https://www.w3.org/TR/webmention/ and
+// http://www.hixie.ch/specs/pingback/pingback.
+package webmention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dubJay/safehttp"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	// ErrNoEndpoint is returned when a target takes neither Webmentions nor
+	// Pingbacks.
+	ErrNoEndpoint = errors.New("webmention: no endpoint")
+	// ErrNoLink is returned when a source doesn't link to the target it
+	// claims to mention.
+	ErrNoLink = errors.New("webmention: source does not link to target")
+	// ErrGone is returned when a source has been deleted. Any mention it
+	// made should be too.
+	ErrGone = errors.New("webmention: source is gone")
+)
+
+const (
+	// Most of a response that is read. Links past it aren't found.
+	maxBody = 1 << 20
+	// Longest source title kept, in characters.
+	maxTitle = 200
+)
+
+// Config is safehttp.Config.
+type Config = safehttp.Config
+
+// Client sends and verifies mentions.
+type Client struct {
+	http      *http.Client
+	userAgent string
+}
+
+// New returns a Client configured by cfg.
+func New(cfg Config) *Client {
+	return &Client{http: safehttp.NewClient(cfg), userAgent: cfg.UserAgent}
+}
+
+// Endpoint is where a target takes mentions.
+type Endpoint struct {
+	URL string
+	// Pingback is set for an XML-RPC Pingback server rather than a
+	// Webmention endpoint.
+	Pingback bool
+}
+
+// Source is what verifying a mention found out about its source.
+type Source struct {
+	// URL after any redirects.
+	URL string
+	// Title of the page, or empty.
+	Title string
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	return c.http.Do(req)
+}
+
+func (c *Client) get(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html, */*;q=0.5")
+	return c.do(req)
+}
+
+// Discover finds where target takes mentions. A Webmention endpoint is
+// preferred to a Pingback server. It returns ErrNoEndpoint if there is
+// neither.
+func (c *Client) Discover(ctx context.Context, target string) (Endpoint, error) {
+	resp, err := c.get(ctx, target)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Endpoint{}, fmt.Errorf("webmention: fetching %s: %s", target, resp.Status)
+	}
+	base := resp.Request.URL
+
+	if href, ok := linkHeader(resp.Header.Values("Link"), "webmention"); ok {
+		return resolve(base, href, false)
+	}
+	var doc *html.Node
+	if isHTML(resp.Header) {
+		if doc, err = html.Parse(io.LimitReader(resp.Body, maxBody)); err != nil {
+			return Endpoint{}, fmt.Errorf("webmention: parsing %s: %v", target, err)
+		}
+		if href, ok := relLink(doc, "webmention", atom.Link, atom.A); ok {
+			return resolve(base, href, false)
+		}
+	}
+	if href := resp.Header.Get("X-Pingback"); href != "" {
+		return resolve(base, href, true)
+	}
+	if doc != nil {
+		if href, ok := relLink(doc, "pingback", atom.Link); ok && href != "" {
+			return resolve(base, href, true)
+		}
+	}
+	return Endpoint{}, ErrNoEndpoint
+}
+
+// resolve makes href absolute. An empty href is the page itself.
+func resolve(base *url.URL, href string, pingback bool) (Endpoint, error) {
+	u, err := base.Parse(href)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("webmention: invalid endpoint %q: %v", href, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return Endpoint{}, fmt.Errorf("webmention: invalid endpoint %q", href)
+	}
+	u.Fragment = ""
+	return Endpoint{URL: u.String(), Pingback: pingback}, nil
+}
+
+// Send tells target that source links to it, and returns the endpoint it was
+// told at.
+func (c *Client) Send(ctx context.Context, source, target string) (Endpoint, error) {
+	endpoint, err := c.Discover(ctx, target)
+	if err != nil {
+		return endpoint, err
+	}
+	if endpoint.Pingback {
+		return endpoint, c.ping(ctx, endpoint.URL, source, target)
+	}
+
+	form := url.Values{"source": {source}, "target": {target}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return endpoint, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.do(req)
+	if err != nil {
+		return endpoint, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxBody))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return endpoint, fmt.Errorf("webmention: %s refused mention of %s: %s", endpoint.URL, target, resp.Status)
+	}
+	return endpoint, nil
+}
+
+// Verify fetches source and checks that it links to target. It returns
+// ErrNoLink if it doesn't and ErrGone if source has been deleted.
+func (c *Client) Verify(ctx context.Context, source, target string) (Source, error) {
+	resp, err := c.get(ctx, source)
+	if err != nil {
+		return Source{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return Source{}, ErrGone
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return Source{}, fmt.Errorf("webmention: fetching %s: %s", source, resp.Status)
+	}
+	src := Source{URL: resp.Request.URL.String()}
+
+	if !isHTML(resp.Header) {
+		// Plain text, JSON and the like only have to mention the URL.
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+		if err != nil {
+			return Source{}, err
+		}
+		if !strings.Contains(string(body), target) {
+			return Source{}, ErrNoLink
+		}
+		return src, nil
+	}
+
+	doc, err := html.Parse(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return Source{}, fmt.Errorf("webmention: parsing %s: %v", source, err)
+	}
+	found := false
+	walk(doc, func(n *html.Node) bool {
+		switch n.DataAtom {
+		case atom.Title:
+			if src.Title == "" {
+				src.Title = truncate(strings.Join(strings.Fields(text(n)), " "), maxTitle)
+			}
+		case atom.A, atom.Link, atom.Area:
+			found = found || sameURL(resp.Request.URL, attr(n, "href"), target)
+		case atom.Img, atom.Video, atom.Audio, atom.Source:
+			found = found || sameURL(resp.Request.URL, attr(n, "src"), target)
+		}
+		return true
+	})
+	if !found {
+		return Source{}, ErrNoLink
+	}
+	return src, nil
+}
+
+// sameURL reports whether href, relative to base, is target.
+func sameURL(base *url.URL, href, target string) bool {
+	if href == "" {
+		return false
+	}
+	u, err := base.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return false
+	}
+	if u.String() == target {
+		return true
+	}
+	u.Fragment = ""
+	return u.String() == target
+}
+
+// Links returns the http(s) URLs content links to, other than ones on base's
+// host, each once and without fragments. Relative links are resolved
+// against base.
+func Links(content string, base *url.URL) []string {
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	var links []string
+	seen := map[string]bool{}
+	walk(doc, func(n *html.Node) bool {
+		if n.DataAtom != atom.A {
+			return true
+		}
+		u, err := base.Parse(strings.TrimSpace(attr(n, "href")))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Host == base.Host {
+			return true
+		}
+		u.Fragment = ""
+		if link := u.String(); !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+		return true
+	})
+	return links
+}
+
+func isHTML(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// linkHeader returns the URL of the first link in HTTP Link header values
+// with rel among its relations.
+func linkHeader(values []string, rel string) (string, bool) {
+	for _, v := range values {
+		for v != "" {
+			start := strings.IndexByte(v, '<')
+			end := strings.IndexByte(v, '>')
+			if start < 0 || end < start {
+				break
+			}
+			href := v[start+1 : end]
+			v = v[end+1:]
+			// Parameters run to the next link, which starts after a comma
+			// outside quotes.
+			params, rest := v, ""
+			quoted := false
+			for i, r := range v {
+				if r == '"' {
+					quoted = !quoted
+				}
+				if r == ',' && !quoted {
+					params, rest = v[:i], v[i+1:]
+					break
+				}
+			}
+			v = rest
+			for _, p := range strings.Split(params, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(p), "=")
+				if ok && strings.EqualFold(strings.TrimSpace(name), "rel") && hasRel(strings.Trim(strings.TrimSpace(value), `"`), rel) {
+					return href, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// relLink returns the href of the first element of one of kinds with rel
+// among its relations and an href, in document order.
+func relLink(doc *html.Node, rel string, kinds ...atom.Atom) (string, bool) {
+	var href string
+	found := false
+	walk(doc, func(n *html.Node) bool {
+		for _, k := range kinds {
+			if n.DataAtom != k || !hasRel(attr(n, "rel"), rel) {
+				continue
+			}
+			for _, a := range n.Attr {
+				if a.Namespace == "" && a.Key == "href" {
+					href, found = a.Val, true
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return href, found
+}
+
+func hasRel(rels, rel string) bool {
+	for _, r := range strings.Fields(rels) {
+		if strings.EqualFold(r, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// walk calls f for each element under n in document order until it returns
+// false.
+func walk(n *html.Node, f func(*html.Node) bool) bool {
+	if n.Type == html.ElementNode && !f(n) {
+		return false
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if !walk(c, f) {
+			return false
+		}
+	}
+	return true
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func text(n *html.Node) string {
+	var b strings.Builder
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			collect(c)
+		}
+	}
+	collect(n)
+	return b.String()
+}
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
@@ -0,0 +1,278 @@
+package webmention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dubJay/safehttp"
+)
+
+var ctx = context.Background()
+
+func testClient() *Client {
+	return New(Config{AllowPrivate: true, UserAgent: "test"})
+}
+
+// page serves body as HTML with the given headers.
+func page(body string, headers ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i+1 < len(headers); i += 2 {
+			w.Header().Add(headers[i], headers[i+1])
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		io.WriteString(w, body)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    Endpoint
+		wantErr error
+	}{
+		{name: "link header", handler: page(`<link rel="webmention" href="/html">`, "Link", `</header>; rel="webmention"`),
+			want: Endpoint{URL: "/header"}},
+		{name: "link header among others", handler: page("", "Link", `<https://a.example/x,y>; rel="other", </wm>; rel="me webmention"`),
+			want: Endpoint{URL: "/wm"}},
+		{name: "unquoted rel", handler: page("", "Link", `</wm>; rel=webmention`), want: Endpoint{URL: "/wm"}},
+		{name: "link element", handler: page(`<html><head><link rel="webmention" href="wm?x=1#frag"></head></html>`),
+			want: Endpoint{URL: "/post/wm?x=1"}},
+		{name: "a element first", handler: page(`<a rel="webmention" href="/a"></a><link rel="webmention" href="/link">`),
+			want: Endpoint{URL: "/a"}},
+		{name: "empty href is the page", handler: page(`<link rel="webmention" href="">`), want: Endpoint{URL: "/post/page"}},
+		{name: "rel without href skipped", handler: page(`<link rel="webmention"><link rel="webmention" href="/wm">`),
+			want: Endpoint{URL: "/wm"}},
+		{name: "webmention preferred", handler: page(`<link rel="webmention" href="/wm">`, "X-Pingback", "/xmlrpc"),
+			want: Endpoint{URL: "/wm"}},
+		{name: "pingback header", handler: page(`<p>hi</p>`, "X-Pingback", "/xmlrpc"), want: Endpoint{URL: "/xmlrpc", Pingback: true}},
+		{name: "pingback link", handler: page(`<link rel="pingback" href="/xmlrpc">`), want: Endpoint{URL: "/xmlrpc", Pingback: true}},
+		{name: "not html", handler: page(`<link rel="webmention" href="/wm">`, "Content-Type", "text/plain"), wantErr: ErrNoEndpoint},
+		{name: "none", handler: page(`<p>hi</p>`), wantErr: ErrNoEndpoint},
+		{name: "bad scheme", handler: page(`<link rel="webmention" href="javascript:alert(1)">`)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.handler)
+			defer srv.Close()
+
+			got, err := testClient().Discover(ctx, srv.URL+"/post/page")
+			if tc.want.URL == "" {
+				if err == nil || (tc.wantErr != nil && !errors.Is(err, tc.wantErr)) {
+					t.Fatalf("Discover() = %+v, %v, want error %v", got, err, tc.wantErr)
+				}
+				return
+			}
+			tc.want.URL = srv.URL + tc.want.URL
+			if err != nil || got != tc.want {
+				t.Errorf("Discover() = %+v, %v, want %+v", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverPrivate(t *testing.T) {
+	srv := httptest.NewServer(page(`<link rel="webmention" href="/wm">`))
+	defer srv.Close()
+
+	if _, err := New(Config{}).Discover(ctx, srv.URL); !errors.Is(err, safehttp.ErrPrivateAddress) {
+		t.Errorf("Discover() of a loopback address error = %v, want %v", err, safehttp.ErrPrivateAddress)
+	}
+}
+
+// receiver records the mentions sent to it.
+type receiver struct {
+	mu       sync.Mutex
+	mentions []string
+}
+
+func (rc *receiver) record(source, target string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.mentions = append(rc.mentions, source+" -> "+target)
+}
+
+func TestSend(t *testing.T) {
+	rc := &receiver{}
+	mux := http.NewServeMux()
+	mux.Handle("/webmention-post", page(`<link rel="webmention" href="/webmention">`))
+	mux.Handle("/pingback-post", page(``, "X-Pingback", "/xmlrpc"))
+	mux.Handle("/registered-post", page(``, "X-Pingback", "/registered"))
+	mux.Handle("/refusing-post", page(`<link rel="webmention" href="/refuse">`))
+	mux.Handle("/faulting-post", page(``, "X-Pingback", "/fault"))
+	mux.Handle("/plain-post", page(`<p>nothing</p>`))
+	mux.HandleFunc("/webmention", func(w http.ResponseWriter, r *http.Request) {
+		rc.record(r.PostFormValue("source"), r.PostFormValue("target"))
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/xmlrpc", func(w http.ResponseWriter, r *http.Request) {
+		source, target, err := ParsePing(r.Body)
+		if err != nil {
+			WriteFault(w, err)
+			return
+		}
+		rc.record(source, target)
+		WritePingResult(w, "thanks")
+	})
+	mux.HandleFunc("/registered", func(w http.ResponseWriter, r *http.Request) {
+		WriteFault(w, &Fault{Code: FaultAlreadyRegistered, Message: "already registered"})
+	})
+	mux.HandleFunc("/refuse", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusBadRequest)
+	})
+	mux.HandleFunc("/fault", func(w http.ResponseWriter, r *http.Request) {
+		WriteFault(w, &Fault{Code: FaultSourceNoLink, Message: "no <link>"})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	source := "https://example.com/entry/2017/a&b"
+	c := testClient()
+	tests := []struct {
+		path      string
+		wantErr   bool
+		wantFault int
+	}{
+		{path: "/webmention-post"},
+		{path: "/pingback-post"},
+		{path: "/registered-post"},
+		{path: "/refusing-post", wantErr: true},
+		{path: "/faulting-post", wantErr: true, wantFault: FaultSourceNoLink},
+		{path: "/plain-post", wantErr: true},
+	}
+	for _, tc := range tests {
+		_, err := c.Send(ctx, source, srv.URL+tc.path)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Send(%s) error = %v, want error %t", tc.path, err, tc.wantErr)
+		}
+		var fault *Fault
+		if tc.wantFault != 0 && (!errors.As(err, &fault) || fault.Code != tc.wantFault || fault.Message != "no <link>") {
+			t.Errorf("Send(%s) error = %v, want fault %d", tc.path, err, tc.wantFault)
+		}
+	}
+	if _, err := c.Send(ctx, source, srv.URL+"/plain-post"); err != ErrNoEndpoint {
+		t.Errorf("Send() without an endpoint error = %v, want %v", err, ErrNoEndpoint)
+	}
+
+	want := []string{source + " -> " + srv.URL + "/webmention-post", source + " -> " + srv.URL + "/pingback-post"}
+	if !reflect.DeepEqual(rc.mentions, want) {
+		t.Errorf("received %q, want %q", rc.mentions, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	const target = "https://example.com/entry/2017/second-post"
+	mux := http.NewServeMux()
+	mux.Handle("/a", page(`<title> A
+		reply </title><p>See <a href="`+target+`">this</a></p>`))
+	mux.Handle("/fragment", page(`<a href="`+target+`#comments">this</a>`))
+	mux.Handle("/img", page(`<img src="`+target+`">`))
+	mux.Handle("/text", page(`see `+target, "Content-Type", "text/plain"))
+	mux.Handle("/other", page(`<a href="https://example.com/entry/2017/other">other</a> `+target))
+	mux.Handle("/gone", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	mux.Handle("/missing", http.NotFoundHandler())
+	mux.Handle("/moved", http.RedirectHandler("/a", http.StatusFound))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		path      string
+		want      Source
+		wantErr   error
+		wantOther bool
+	}{
+		{path: "/a", want: Source{URL: "/a", Title: "A reply"}},
+		{path: "/moved", want: Source{URL: "/a", Title: "A reply"}},
+		{path: "/fragment", want: Source{URL: "/fragment"}},
+		{path: "/img", want: Source{URL: "/img"}},
+		{path: "/text", want: Source{URL: "/text"}},
+		{path: "/other", wantErr: ErrNoLink},
+		{path: "/gone", wantErr: ErrGone},
+		{path: "/missing", wantOther: true},
+	}
+	c := testClient()
+	for _, tc := range tests {
+		got, err := c.Verify(ctx, srv.URL+tc.path, target)
+		switch {
+		case tc.wantOther:
+			if err == nil || errors.Is(err, ErrNoLink) || errors.Is(err, ErrGone) {
+				t.Errorf("Verify(%s) error = %v, want a fetch error", tc.path, err)
+			}
+		case tc.wantErr != nil:
+			if err != tc.wantErr {
+				t.Errorf("Verify(%s) error = %v, want %v", tc.path, err, tc.wantErr)
+			}
+		default:
+			tc.want.URL = srv.URL + tc.want.URL
+			if err != nil || got != tc.want {
+				t.Errorf("Verify(%s) = %+v, %v, want %+v", tc.path, got, err, tc.want)
+			}
+		}
+	}
+}
+
+func TestLinks(t *testing.T) {
+	base, _ := url.Parse("https://example.com/entry/2017/a")
+	content := `<p><a href="https://other.example/x#y">x</a> <a href="https://other.example/x">again</a>
+		<a href="/entry/2017/b">own</a> <a href="mailto:a@b.c">mail</a> <a href="//third.example/z">z</a>
+		<a href=" http://fourth.example ">spaced</a> <a>none</a></p>`
+	want := []string{"https://other.example/x", "https://third.example/z", "http://fourth.example"}
+	if got := Links(content, base); !reflect.DeepEqual(got, want) {
+		t.Errorf("Links() = %q, want %q", got, want)
+	}
+}
+
+func TestParsePing(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		want      [2]string
+		wantFault int
+	}{
+		{name: "ok", body: `<?xml version="1.0"?><methodCall><methodName>pingback.ping</methodName><params>` +
+			`<param><value><string>https://a.example/?x=1&amp;y=2</string></value></param>` +
+			`<param><value>https://b.example/</value></param></params></methodCall>`,
+			want: [2]string{"https://a.example/?x=1&y=2", "https://b.example/"}},
+		{name: "not xml", body: `{}`, wantFault: faultParse},
+		{name: "other method", body: `<methodCall><methodName>system.listMethods</methodName></methodCall>`, wantFault: faultMethod},
+		{name: "one param", body: `<methodCall><methodName>pingback.ping</methodName><params>` +
+			`<param><value><string>a</string></value></param></params></methodCall>`, wantFault: faultParams},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			source, target, err := ParsePing(strings.NewReader(tc.body))
+			var fault *Fault
+			if tc.wantFault != 0 {
+				if !errors.As(err, &fault) || fault.Code != tc.wantFault {
+					t.Errorf("ParsePing() error = %v, want fault %d", err, tc.wantFault)
+				}
+				return
+			}
+			if err != nil || [2]string{source, target} != tc.want {
+				t.Errorf("ParsePing() = %q, %q, %v, want %q", source, target, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteFault(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteFault(rec, fmt.Errorf("wrapped: %w", &Fault{Code: FaultTargetNotFound, Message: "no such <entry>"}))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "<int>32</int>") || !strings.Contains(body, "no such &lt;entry&gt;") {
+		t.Errorf("WriteFault() = %d %q", rec.Code, body)
+	}
+}
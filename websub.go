@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/websub"
+	"github.com/gorilla/feeds"
+)
+
+const (
+	hubPath = "/websub"
+	// The built-in hub, which the feeds only advertise if websubHub doesn't
+	// name another.
+	builtinHubURL = siteURL + hubPath
+
+	// How often to look for edited entries to tell the hub about, and for
+	// subscriptions that have run out. Subscription requests are verified
+	// right away.
+	websubInterval = 15 * time.Minute
+	// Subscription requests one address may make per hour.
+	hubLimit = 60
+	// Largest subscription request accepted.
+	maxHubRequest = 4 << 10
+)
+
+// websubEnabled reports whether the feeds advertise a WebSub hub, and so
+// whether there's one to tell when entries change.
+func (s *server) websubEnabled() bool {
+	return s.hubURL() != ""
+}
+
+// hubURL is the WebSub hub the feeds advertise: the one named by websubHub,
+// else the built-in one if it runs, else none.
+func (s *server) hubURL() string {
+	if s.cfg.websubHub != "" {
+		return s.cfg.websubHub
+	}
+	if s.cfg.websubBuiltinHub {
+		return builtinHubURL
+	}
+	return ""
+}
+
+// runWebSub verifies subscription requests to the built-in hub and tells the
+// hubs about edited entries until ctx is done, once at start, then every
+// websubInterval or when the WebSub worker is woken.
+func (s *server) runWebSub(ctx context.Context) {
+	var passes []pass
+	if s.cfg.websubBuiltinHub {
+		passes = append(passes, pass{"verifying hub subscriptions", s.verifyHubRequests})
+	}
+	passes = append(passes,
+		pass{"notifying the hub", s.notifyHub},
+		pass{"pushing feeds", s.pushFeeds},
+	)
+	s.websubWorker.run(ctx, passes...)
+}
+
+// verifyHubRequests checks with everyone who asked the built-in hub to
+// subscribe or unsubscribe since the last pass that they meant it, and
+// forgets subscriptions that have run out. Failures aren't retried.
+func (s *server) verifyHubRequests(ctx context.Context) error {
+	subs, err := s.hubStore.GetHubSubscriptions(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list hub subscriptions: %w", err)
+	}
+	for _, sub := range subs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch {
+		case sub.Pending != "":
+			err = s.websub.Verify(ctx, websub.Request{
+				Mode:     sub.Pending,
+				Topic:    sub.Topic,
+				Callback: sub.Callback,
+				Secret:   sub.PendingSecret,
+				Lease:    sub.PendingLease,
+			})
+			switch {
+			case err != nil:
+				log.Printf("unable to verify %s of %s to %s: %v", sub.Pending, sub.Callback, sub.Topic, err)
+				if sub.Expires.IsZero() {
+					err = s.hubStore.RemoveHubSubscription(ctx, sub)
+				} else {
+					// Leave the subscription there was to run out.
+					err = s.hubStore.CancelHubRequest(ctx, sub)
+				}
+			case sub.Pending == websub.Unsubscribe:
+				log.Printf("unsubscribed %s from %s", sub.Callback, sub.Topic)
+				err = s.hubStore.RemoveHubSubscription(ctx, sub)
+			default:
+				log.Printf("subscribed %s to %s", sub.Callback, sub.Topic)
+				err = s.hubStore.ConfirmHubSubscription(ctx, sub)
+			}
+		case !sub.Expires.IsZero() && sub.Expires.Before(time.Now()):
+			log.Printf("subscription of %s to %s ran out", sub.Callback, sub.Topic)
+			err = s.hubStore.RemoveHubSubscription(ctx, sub)
+		default:
+			continue
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			// Asked again while we worked; that request gets its turn.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to save hub subscription %d: %w", sub.Id, err)
+		}
+	}
+	return nil
+}
+
+// notifyHub asks websubHub to fetch the feeds if an entry has been
+// published or edited since it was last asked.
+func (s *server) notifyHub(ctx context.Context) error {
+	return s.pushUnpushed(ctx, db.ExternalHub, func() error {
+		if s.cfg.websubHub == "" {
+			return nil
+		}
+		for _, name := range feedNames {
+			if err := s.websub.Publish(ctx, s.cfg.websubHub, feedURL(name)); err != nil {
+				// Most likely the hub is down; try again next pass.
+				return fmt.Errorf("unable to notify %s: %w", s.cfg.websubHub, err)
+			}
+		}
+		return nil
+	})
+}
+
+// pushFeeds has the built-in hub push the feeds to its subscribers if an
+// entry has been published or edited since it last did.
+func (s *server) pushFeeds(ctx context.Context) error {
+	return s.pushUnpushed(ctx, db.BuiltinHub, func() error {
+		if !s.cfg.websubBuiltinHub {
+			return nil
+		}
+		subs, err := s.hubStore.GetHubSubscriptions(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to list hub subscriptions: %w", err)
+		}
+		for _, name := range feedNames {
+			if err := s.distribute(ctx, name, subs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pushUnpushed calls push if an entry has been published or edited since
+// hub was last told, then records that hub has been told. Entries are
+// recorded even for a hub that isn't in use, so turning it on doesn't
+// announce old edits.
+func (s *server) pushUnpushed(ctx context.Context, hub db.Hub, push func() error) error {
+	entries, err := s.hubStore.GetUnpushedEntries(ctx, hub)
+	if err != nil {
+		return fmt.Errorf("unable to list entries: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := push(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.hubStore.SetEntryPushed(ctx, hub, entry); err != nil && !errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("unable to record entry %d pushed: %w", entry.Id, err)
+		}
+	}
+	return nil
+}
+
+// distribute pushes the feed called name to the subscribers to it among
+// subs. Failures aren't retried, but subscribers who say they're gone are
+// dropped.
+func (s *server) distribute(ctx context.Context, name string, subs []db.HubSubscription) error {
+	topic := feedURL(name)
+	var content *websub.Content
+	for _, sub := range subs {
+		if sub.Topic != topic || sub.Expires.Before(time.Now()) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if content == nil {
+			body, contentType, err := s.feed(ctx, name)
+			if err != nil {
+				return fmt.Errorf("unable to build %s: %w", name, err)
+			}
+			content = &websub.Content{Hub: builtinHubURL, Topic: topic, Type: contentType, Body: []byte(body)}
+		}
+		err := s.websub.Deliver(ctx, sub.Callback, sub.Secret, *content)
+		if errors.Is(err, websub.ErrGone) {
+			log.Printf("dropping subscription of %s to %s: %v", sub.Callback, topic, err)
+			err = s.hubStore.RemoveHubSubscription(ctx, sub)
+			if err != nil && !errors.Is(err, db.ErrNotFound) {
+				return fmt.Errorf("unable to remove hub subscription %d: %w", sub.Id, err)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("unable to push %s to %s: %v", name, sub.Callback, err)
+		}
+	}
+	return nil
+}
+
+// postHub takes requests to subscribe to and unsubscribe from the feeds.
+// They take effect once the subscriber has confirmed them.
+func (s *server) postHub(w http.ResponseWriter, r *http.Request) error {
+	ip := s.clientIP(r)
+	if !s.hubLimiter.allow(ip) {
+		return statusError(http.StatusTooManyRequests, "too many subscription requests, please try again later",
+			fmt.Errorf("too many hub requests from %s", ip))
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxHubRequest)
+	if err := r.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "the request could not be read", err)
+	}
+	req, err := websub.ParseRequest(r.PostForm)
+	if err != nil {
+		return statusError(http.StatusBadRequest, "invalid subscription request", err)
+	}
+	known := false
+	for _, name := range feedNames {
+		known = known || req.Topic == feedURL(name)
+	}
+	if !known {
+		return statusError(http.StatusBadRequest, "this hub only serves the site's own feeds",
+			fmt.Errorf("hub request for unknown topic %s", req.Topic))
+	}
+	err = s.hubStore.RequestHubSubscription(r.Context(), db.HubSubscription{
+		Topic:         req.Topic,
+		Callback:      req.Callback,
+		Pending:       req.Mode,
+		PendingSecret: req.Secret,
+		PendingLease:  req.Lease,
+	})
+	if err != nil {
+		return storeError("failed to save subscription request", fmt.Errorf("unable to add hub request: %w", err))
+	}
+	log.Printf("hub %s request for %s from %s", req.Mode, req.Callback, ip)
+	s.websubWorker.request()
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// atomHubFeed is an Atom feed that links to its hub and itself.
+type atomHubFeed struct {
+	*feeds.AtomFeed
+	Links []*feeds.AtomLink
+	// After the links, in place of the embedded feed's.
+	Entries []*feeds.AtomEntry `xml:"entry"`
+}
+
+func (f *atomHubFeed) FeedXml() interface{} {
+	return f
+}
+
+// rssHubFeed is an RSS feed that links to its hub and itself, in the Atom
+// namespace as RSS has no such links.
+type rssHubFeed struct {
+	XMLName          xml.Name `xml:"rss"`
+	Version          string   `xml:"version,attr"`
+	ContentNamespace string   `xml:"xmlns:content,attr"`
+	AtomNamespace    string   `xml:"xmlns:atom,attr"`
+	Channel          rssHubChannel
+}
+
+type rssHubChannel struct {
+	*feeds.RssFeed
+	Links []rssAtomLink
+	// After the links, in place of the embedded feed's.
+	Items []*feeds.RssItem `xml:"item"`
+}
+
+type rssAtomLink struct {
+	XMLName xml.Name `xml:"atom:link"`
+	Href    string   `xml:"href,attr"`
+	Rel     string   `xml:"rel,attr"`
+}
+
+func (f *rssHubFeed) FeedXml() interface{} {
+	return f
+}
+
+// atomWithHub renders feed as Atom, linking to hub and self unless hub is
+// empty.
+func atomWithHub(feed *feeds.Feed, hub, self string) (string, error) {
+	if hub == "" {
+		return feed.ToAtom()
+	}
+	f := (&feeds.Atom{Feed: feed}).AtomFeed()
+	return feeds.ToXML(&atomHubFeed{
+		AtomFeed: f,
+		Links:    []*feeds.AtomLink{{Href: hub, Rel: "hub"}, {Href: self, Rel: "self"}},
+		Entries:  f.Entries,
+	})
+}
+
+// rssWithHub renders feed as RSS, linking to hub and self unless hub is
+// empty.
+func rssWithHub(feed *feeds.Feed, hub, self string) (string, error) {
+	if hub == "" {
+		return feed.ToRss()
+	}
+	f := (&feeds.Rss{Feed: feed}).RssFeed()
+	return feeds.ToXML(&rssHubFeed{
+		Version:          "2.0",
+		ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
+		AtomNamespace:    "http://www.w3.org/2005/Atom",
+		Channel: rssHubChannel{
+			RssFeed: f,
+			Links:   []rssAtomLink{{Href: hub, Rel: "hub"}, {Href: self, Rel: "self"}},
+			Items:   f.Items,
+		},
+	})
+}
+
+// jsonWithHub renders feed as a JSON Feed, listing hub and linking to self
+// unless hub is empty.
+func jsonWithHub(feed *feeds.Feed, hub, self string) (string, error) {
+	if hub == "" {
+		return feed.ToJSON()
+	}
+	f := (&feeds.JSON{Feed: feed}).JSONFeed()
+	f.FeedUrl = self
+	f.Hubs = []*feeds.JSONHub{{Type: "WebSub", Url: hub}}
+	return f.ToJSON()
+}
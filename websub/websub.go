@@ -0,0 +1,248 @@
+// Package websub tells a WebSub hub when a feed changes, and does the hub's
+// side of the protocol for a site that runs its own: checking that
+// subscribers asked to subscribe, and pushing the feed to them.
+//
+// See https://www.w3.org/TR/websub/.
+package websub
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dubJay/safehttp"
+)
+
+// Modes a subscriber can ask for.
+const (
+	Subscribe   = "subscribe"
+	Unsubscribe = "unsubscribe"
+)
+
+const (
+	// DefaultLease is how long a subscription lasts if the subscriber
+	// doesn't say.
+	DefaultLease = 10 * 24 * time.Hour
+	// MaxLease is the longest a subscription lasts before it has to be
+	// renewed. Longer requests are cut down to it.
+	MaxLease = 30 * 24 * time.Hour
+	// Secrets must be shorter than this, in bytes.
+	maxSecret = 200
+	// Most of a verification response that is read.
+	maxChallenge = 1 << 10
+)
+
+var (
+	// ErrInvalidRequest is returned for subscription requests missing a
+	// field or with one that can't be used.
+	ErrInvalidRequest = errors.New("websub: invalid request")
+	// ErrNotVerified is returned when a callback doesn't confirm it asked
+	// for a subscription.
+	ErrNotVerified = errors.New("websub: subscriber did not verify")
+	// ErrGone is returned when a subscriber no longer wants content. Its
+	// subscription should be dropped.
+	ErrGone = errors.New("websub: subscriber is gone")
+)
+
+// Config is safehttp.Config.
+type Config = safehttp.Config
+
+// Client makes the requests of a publisher and a hub.
+type Client struct {
+	http      *http.Client
+	userAgent string
+}
+
+// New returns a Client configured by cfg.
+func New(cfg Config) *Client {
+	return &Client{http: safehttp.NewClient(cfg), userAgent: cfg.UserAgent}
+}
+
+// Request is a subscriber asking a hub to start or stop pushing a topic.
+type Request struct {
+	// Subscribe or Unsubscribe.
+	Mode     string
+	Topic    string
+	Callback string
+	// Signs content pushed to the callback, or empty to not sign it.
+	Secret string
+	// How long the subscription lasts. Unset for unsubscribing.
+	Lease time.Duration
+}
+
+// ParseRequest reads a subscription request from the form a subscriber
+// posted to the hub. It returns ErrInvalidRequest if the request can't be
+// used.
+func ParseRequest(form url.Values) (Request, error) {
+	req := Request{
+		Mode:     form.Get("hub.mode"),
+		Topic:    form.Get("hub.topic"),
+		Callback: form.Get("hub.callback"),
+		Secret:   form.Get("hub.secret"),
+	}
+	if req.Mode != Subscribe && req.Mode != Unsubscribe {
+		return Request{}, fmt.Errorf("%w: unknown mode %q", ErrInvalidRequest, req.Mode)
+	}
+	if req.Topic == "" {
+		return Request{}, fmt.Errorf("%w: no topic", ErrInvalidRequest)
+	}
+	u, err := url.Parse(req.Callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Request{}, fmt.Errorf("%w: callback %q is not an http URL", ErrInvalidRequest, req.Callback)
+	}
+	if len(req.Secret) >= maxSecret {
+		return Request{}, fmt.Errorf("%w: secret is too long", ErrInvalidRequest)
+	}
+	if req.Mode == Unsubscribe {
+		req.Secret = ""
+		return req, nil
+	}
+	req.Lease = DefaultLease
+	if s := form.Get("hub.lease_seconds"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			return Request{}, fmt.Errorf("%w: lease %q is not a number of seconds", ErrInvalidRequest, s)
+		}
+		if req.Lease = time.Duration(seconds) * time.Second; req.Lease > MaxLease {
+			req.Lease = MaxLease
+		}
+	}
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	return c.http.Do(req)
+}
+
+// Publish tells hub that topic has changed, for it to fetch and push to its
+// subscribers.
+func (c *Client) Publish(ctx context.Context, hub, topic string) error {
+	form := url.Values{"hub.mode": {"publish"}, "hub.url": {topic}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxChallenge))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("websub: publishing %s to %s: %s", topic, hub, resp.Status)
+	}
+	return nil
+}
+
+// Verify asks req.Callback to confirm that it made req, by echoing a random
+// challenge. It returns ErrNotVerified if it doesn't.
+func (c *Client) Verify(ctx context.Context, req Request) error {
+	challenge, err := newChallenge()
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(req.Callback)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	// The callback may carry a query of its own to keep.
+	q := u.Query()
+	q.Set("hub.mode", req.Mode)
+	q.Set("hub.topic", req.Topic)
+	q.Set("hub.challenge", challenge)
+	if req.Mode == Subscribe {
+		q.Set("hub.lease_seconds", strconv.Itoa(int(req.Lease/time.Second)))
+	}
+	u.RawQuery = q.Encode()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s answered %s", ErrNotVerified, req.Callback, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxChallenge))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != challenge {
+		return fmt.Errorf("%w: %s did not echo the challenge", ErrNotVerified, req.Callback)
+	}
+	return nil
+}
+
+// Content is a topic as it is pushed to subscribers.
+type Content struct {
+	// Hub and Topic are sent as links for the subscriber to tell where the
+	// content came from.
+	Hub   string
+	Topic string
+	// Type is the content type of Body.
+	Type string
+	Body []byte
+}
+
+// Deliver pushes content to callback, signed with secret unless it's empty.
+// It returns ErrGone if the subscriber doesn't want it any more.
+func (c *Client) Deliver(ctx context.Context, callback, secret string, content Content) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback, bytes.NewReader(content.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", content.Type)
+	req.Header.Add("Link", "<"+content.Hub+`>; rel="hub"`)
+	req.Header.Add("Link", "<"+content.Topic+`>; rel="self"`)
+	if secret != "" {
+		req.Header.Set("X-Hub-Signature", Signature(secret, content.Body))
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxChallenge))
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("%w: %s", ErrGone, callback)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("websub: delivering to %s: %s", callback, resp.Status)
+	}
+	return nil
+}
+
+// Signature is the X-Hub-Signature header of body pushed to a subscriber
+// with secret.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newChallenge() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,172 @@
+package websub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dubJay/safehttp"
+)
+
+var ctx = context.Background()
+
+func testClient() *Client {
+	return New(Config{AllowPrivate: true, UserAgent: "test"})
+}
+
+func TestParseRequest(t *testing.T) {
+	form := func(pairs ...string) url.Values {
+		v := url.Values{"hub.topic": {"https://example.com/feed"}, "hub.callback": {"https://reader.example/cb?id=1"}}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			v.Set(pairs[i], pairs[i+1])
+		}
+		return v
+	}
+	tests := []struct {
+		name string
+		form url.Values
+		want Request
+	}{
+		{"subscribe", form("hub.mode", "subscribe", "hub.secret", "s3cret"),
+			Request{Mode: Subscribe, Topic: "https://example.com/feed", Callback: "https://reader.example/cb?id=1", Secret: "s3cret", Lease: DefaultLease}},
+		{"lease", form("hub.mode", "subscribe", "hub.lease_seconds", "3600"),
+			Request{Mode: Subscribe, Topic: "https://example.com/feed", Callback: "https://reader.example/cb?id=1", Lease: time.Hour}},
+		{"long lease", form("hub.mode", "subscribe", "hub.lease_seconds", "999999999"),
+			Request{Mode: Subscribe, Topic: "https://example.com/feed", Callback: "https://reader.example/cb?id=1", Lease: MaxLease}},
+		{"unsubscribe", form("hub.mode", "unsubscribe", "hub.secret", "ignored"),
+			Request{Mode: Unsubscribe, Topic: "https://example.com/feed", Callback: "https://reader.example/cb?id=1"}},
+	}
+	for _, tc := range tests {
+		if got, err := ParseRequest(tc.form); err != nil || got != tc.want {
+			t.Errorf("%s: ParseRequest = %+v, %v, want %+v", tc.name, got, err, tc.want)
+		}
+	}
+
+	for name, bad := range map[string]url.Values{
+		"no mode":      form(),
+		"publish":      form("hub.mode", "publish"),
+		"no topic":     form("hub.mode", "subscribe", "hub.topic", ""),
+		"bad callback": form("hub.mode", "subscribe", "hub.callback", "ftp://reader.example/"),
+		"relative":     form("hub.mode", "subscribe", "hub.callback", "/cb"),
+		"long secret":  form("hub.mode", "subscribe", "hub.secret", strings.Repeat("x", maxSecret)),
+		"bad lease":    form("hub.mode", "subscribe", "hub.lease_seconds", "-1"),
+	} {
+		if _, err := ParseRequest(bad); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("%s: ParseRequest = %v, want ErrInvalidRequest", name, err)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	var got url.Values
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+		if got.Get("hub.url") == "https://example.com/broken" {
+			http.Error(w, "no", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hub.Close()
+
+	c := testClient()
+	if err := c.Publish(ctx, hub.URL, "https://example.com/feed"); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if got.Get("hub.mode") != "publish" || got.Get("hub.url") != "https://example.com/feed" {
+		t.Errorf("hub got %v, want a publish of the feed", got)
+	}
+	if err := c.Publish(ctx, hub.URL, "https://example.com/broken"); err == nil {
+		t.Error("Publish refused by the hub succeeded")
+	}
+	if err := New(Config{}).Publish(ctx, hub.URL, "https://example.com/feed"); !errors.Is(err, safehttp.ErrPrivateAddress) {
+		t.Errorf("Publish to a private hub = %v, want ErrPrivateAddress", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var query url.Values
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		switch r.URL.Path {
+		case "/echo":
+			io.WriteString(w, query.Get("hub.challenge"))
+		case "/wrong":
+			io.WriteString(w, "something else")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer subscriber.Close()
+
+	c := testClient()
+	req := Request{Mode: Subscribe, Topic: "https://example.com/feed", Callback: subscriber.URL + "/echo?id=1", Lease: time.Hour}
+	if err := c.Verify(ctx, req); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if query.Get("id") != "1" || query.Get("hub.mode") != Subscribe || query.Get("hub.topic") != req.Topic ||
+		query.Get("hub.lease_seconds") != "3600" || query.Get("hub.challenge") == "" {
+		t.Errorf("callback got %v", query)
+	}
+
+	req.Mode = Unsubscribe
+	if err := c.Verify(ctx, req); err != nil || query.Has("hub.lease_seconds") {
+		t.Errorf("Verify of an unsubscribe = %v with %v, want no lease", err, query)
+	}
+	for _, path := range []string{"/wrong", "/missing"} {
+		req.Callback = subscriber.URL + path
+		if err := c.Verify(ctx, req); !errors.Is(err, ErrNotVerified) {
+			t.Errorf("Verify with %s = %v, want ErrNotVerified", path, err)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer subscriber.Close()
+
+	c := testClient()
+	content := Content{Hub: "https://example.com/hub", Topic: "https://example.com/feed", Type: "application/atom+xml", Body: []byte("<feed/>")}
+	if err := c.Deliver(ctx, subscriber.URL+"/cb", "s3cret", content); err != nil {
+		t.Fatalf("Deliver failed: %v", err)
+	}
+	if string(body) != "<feed/>" || got.Header.Get("Content-Type") != content.Type {
+		t.Errorf("subscriber got %q as %q", body, got.Header.Get("Content-Type"))
+	}
+	links := strings.Join(got.Header.Values("Link"), ", ")
+	if links != `<https://example.com/hub>; rel="hub", <https://example.com/feed>; rel="self"` {
+		t.Errorf("Link = %q", links)
+	}
+	// Worked out separately with openssl dgst -sha256 -hmac s3cret.
+	if want := "sha256=1b9591b5322baa7463554820f41fe27e650c767e2fbc4a934c5aa90e9cc27c7c"; got.Header.Get("X-Hub-Signature") != want {
+		t.Errorf("X-Hub-Signature = %q, want %q", got.Header.Get("X-Hub-Signature"), want)
+	}
+
+	if err := c.Deliver(ctx, subscriber.URL+"/cb", "", content); err != nil || got.Header.Get("X-Hub-Signature") != "" {
+		t.Errorf("Deliver without a secret = %v, signed %q", err, got.Header.Get("X-Hub-Signature"))
+	}
+	if err := c.Deliver(ctx, subscriber.URL+"/gone", "", content); !errors.Is(err, ErrGone) {
+		t.Errorf("Deliver to a gone subscriber = %v, want ErrGone", err)
+	}
+	if err := c.Deliver(ctx, subscriber.URL+"/broken", "", content); err == nil || errors.Is(err, ErrGone) {
+		t.Errorf("Deliver to a broken subscriber = %v, want an error", err)
+	}
+}
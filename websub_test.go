@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dubJay/db"
+	"github.com/dubJay/websub"
+)
+
+func withBuiltinHub(cfg *config) {
+	cfg.websubBuiltinHub = true
+	cfg.allowPrivateNetwork = true
+}
+
+// hubSubscriber is a stub WebSub subscriber. It confirms every request and
+// records what is pushed to it.
+type hubSubscriber struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	verified []url.Values
+	pushed   []*http.Request
+	bodies   []string
+}
+
+func newHubSubscriber(t *testing.T) *hubSubscriber {
+	t.Helper()
+	sub := &hubSubscriber{}
+	sub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		if r.Method == http.MethodGet {
+			sub.verified = append(sub.verified, r.URL.Query())
+			io.WriteString(w, r.URL.Query().Get("hub.challenge"))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		sub.pushed = append(sub.pushed, r)
+		sub.bodies = append(sub.bodies, string(body))
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	t.Cleanup(sub.Close)
+	return sub
+}
+
+func postHub(router http.Handler, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, hubPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func getFeed(t *testing.T, router http.Handler, name string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/feeds/"+name, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /feeds/%s = %d", name, rec.Code)
+	}
+	return rec
+}
+
+func TestFeedsWithoutHub(t *testing.T) {
+	s := newTestServer(t)
+	router := s.routes()
+	for _, name := range feedNames {
+		rec := getFeed(t, router, name)
+		if rec.Header().Get("Link") != "" || strings.Contains(rec.Body.String(), "hub") {
+			t.Errorf("/feeds/%s advertises a hub with none configured: %v\n%s", name, rec.Header(), rec.Body)
+		}
+	}
+	if rec := postHub(router, url.Values{"hub.mode": {"subscribe"}}); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST %s = %d with the hub off, want 405", hubPath, rec.Code)
+	}
+	if s.websubEnabled() {
+		t.Error("websubEnabled with no hub")
+	}
+}
+
+func TestFeedContentTypes(t *testing.T) {
+	router := newTestServer(t).routes()
+	for name, want := range map[string]string{
+		"atom.xml":      "application/atom+xml",
+		"rss.xml":       "application/rss+xml",
+		"jsonfeed.json": "application/feed+json",
+	} {
+		if ct := getFeed(t, router, name).Header().Get("Content-Type"); ct != want {
+			t.Errorf("/feeds/%s Content-Type = %q, want %q", name, ct, want)
+		}
+	}
+}
+
+func TestFeedsAdvertiseHub(t *testing.T) {
+	const hub = "https://hub.example/"
+	router := newTestServer(t, func(cfg *config) { cfg.websubHub = hub }).routes()
+
+	for _, name := range feedNames {
+		rec := getFeed(t, router, name)
+		links := strings.Join(rec.Header().Values("Link"), ", ")
+		if want := "<" + hub + `>; rel="hub", <` + feedURL(name) + `>; rel="self"`; links != want {
+			t.Errorf("/feeds/%s Link = %q, want %q", name, links, want)
+		}
+	}
+
+	var atom struct {
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Entries []struct {
+			Title string `xml:"title"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(getFeed(t, router, "atom.xml").Body.Bytes(), &atom); err != nil {
+		t.Fatal(err)
+	}
+	rels := map[string]string{}
+	for _, l := range atom.Links {
+		rels[l.Rel] = l.Href
+	}
+	if rels["hub"] != hub || rels["self"] != feedURL("atom.xml") || rels[""] != siteURL || len(atom.Entries) != 3 {
+		t.Errorf("Atom feed links = %v with %d entries, want the site, hub and self and every entry", rels, len(atom.Entries))
+	}
+
+	var rss struct {
+		Channel struct {
+			Links []struct {
+				Href string `xml:"href,attr"`
+				Rel  string `xml:"rel,attr"`
+			} `xml:"http://www.w3.org/2005/Atom link"`
+			Items []struct {
+				Title string `xml:"title"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	body := getFeed(t, router, "rss.xml").Body.Bytes()
+	if err := xml.Unmarshal(body, &rss); err != nil {
+		t.Fatal(err)
+	}
+	if len(rss.Channel.Links) != 2 || rss.Channel.Links[0].Href != hub || rss.Channel.Links[0].Rel != "hub" ||
+		rss.Channel.Links[1].Href != feedURL("rss.xml") || len(rss.Channel.Items) != 3 {
+		t.Errorf("RSS feed = %+v, want Atom links to the hub and itself and every item\n%s", rss.Channel, body)
+	}
+
+	var jsonFeed struct {
+		FeedURL string `json:"feed_url"`
+		Hubs    []struct {
+			Type string `json:"type"`
+			URL  string `json:"url"`
+		} `json:"hubs"`
+	}
+	if err := json.Unmarshal(getFeed(t, router, "jsonfeed.json").Body.Bytes(), &jsonFeed); err != nil {
+		t.Fatal(err)
+	}
+	if jsonFeed.FeedURL != feedURL("jsonfeed.json") || len(jsonFeed.Hubs) != 1 || jsonFeed.Hubs[0].URL != hub ||
+		jsonFeed.Hubs[0].Type != "WebSub" {
+		t.Errorf("JSON feed = %+v, want the hub listed", jsonFeed)
+	}
+}
+
+func TestPushFeedsToHub(t *testing.T) {
+	var mu sync.Mutex
+	var published []string
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		published = append(published, r.PostForm.Get("hub.url"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hub.Close()
+	s := newTestServer(t, func(cfg *config) {
+		cfg.websubHub = hub.URL
+		cfg.allowPrivateNetwork = true
+	})
+	ctx := context.Background()
+
+	if err := s.notifyHub(ctx); err != nil {
+		t.Fatalf("notifyHub failed: %v", err)
+	}
+	if strings.Join(published, " ") != strings.Join([]string{feedURL("atom.xml"), feedURL("rss.xml"), feedURL("jsonfeed.json")}, " ") {
+		t.Errorf("hub was told about %v, want every feed", published)
+	}
+
+	published = nil
+	if err := s.notifyHub(ctx); err != nil || len(published) != 0 {
+		t.Errorf("second notifyHub told the hub about %v, %v, want nothing", published, err)
+	}
+
+	// The hub being down holds up neither the built-in hub nor itself.
+	hub.Close()
+	s, raw := newTestServerDB(t, withBuiltinHub, func(cfg *config) {
+		cfg.websubHub = hub.URL
+		cfg.allowPrivateNetwork = true
+	})
+	if _, err := raw.Exec(`DELETE FROM hub_subscription`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.notifyHub(ctx); err == nil {
+		t.Error("notifyHub with the hub down succeeded")
+	}
+	if err := s.pushFeeds(ctx); err != nil {
+		t.Errorf("pushFeeds with the other hub down failed: %v", err)
+	}
+	if entries, err := s.hubStore.GetUnpushedEntries(ctx, db.ExternalHub); err != nil || len(entries) == 0 {
+		t.Errorf("GetUnpushedEntries(ExternalHub) = %d entries, %v, want them tried again", len(entries), err)
+	}
+	if entries, err := s.hubStore.GetUnpushedEntries(ctx, db.BuiltinHub); err != nil || len(entries) != 0 {
+		t.Errorf("GetUnpushedEntries(BuiltinHub) = %d entries, %v, want them all pushed", len(entries), err)
+	}
+}
+
+func TestBuiltinHub(t *testing.T) {
+	s, raw := newTestServerDB(t, withBuiltinHub)
+	// The fixtures' subscribers can't be reached from here.
+	if _, err := raw.Exec(`DELETE FROM hub_subscription`); err != nil {
+		t.Fatal(err)
+	}
+	router := s.routes()
+	ctx := context.Background()
+	sub := newHubSubscriber(t)
+
+	rec := getFeed(t, router, "atom.xml")
+	if !strings.Contains(rec.Header().Get("Link"), "<"+builtinHubURL+">") {
+		t.Errorf("Link = %q, want the built-in hub", rec.Header().Get("Link"))
+	}
+
+	subscribe := url.Values{
+		"hub.mode":          {websub.Subscribe},
+		"hub.topic":         {feedURL("atom.xml")},
+		"hub.callback":      {sub.URL + "/atom"},
+		"hub.secret":        {"s3cret"},
+		"hub.lease_seconds": {"3600"},
+	}
+	if rec := postHub(router, subscribe); rec.Code != http.StatusAccepted {
+		t.Fatalf("POST %s = %d %q, want 202", hubPath, rec.Code, rec.Body)
+	}
+	gone := url.Values{"hub.mode": {websub.Subscribe}, "hub.topic": {feedURL("atom.xml")}, "hub.callback": {sub.URL + "/gone"}}
+	if rec := postHub(router, gone); rec.Code != http.StatusAccepted {
+		t.Fatalf("POST %s = %d %q, want 202", hubPath, rec.Code, rec.Body)
+	}
+	other := url.Values{"hub.mode": {websub.Subscribe}, "hub.topic": {"https://elsewhere.example/feed"}, "hub.callback": {sub.URL}}
+	if rec := postHub(router, other); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST %s for another site's feed = %d, want 400", hubPath, rec.Code)
+	}
+	if rec := postHub(router, url.Values{"hub.mode": {"publish"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST %s with a bad mode = %d, want 400", hubPath, rec.Code)
+	}
+
+	if err := s.verifyHubRequests(ctx); err != nil {
+		t.Fatalf("verifyHubRequests failed: %v", err)
+	}
+	if len(sub.verified) != 2 || sub.verified[0].Get("hub.topic") != feedURL("atom.xml") || sub.verified[0].Get("hub.lease_seconds") != "3600" {
+		t.Fatalf("subscriber was asked %v, want both subscriptions verified", sub.verified)
+	}
+	subs, _ := s.hubStore.GetHubSubscriptions(ctx)
+	if len(subs) != 2 || subs[0].Expires.IsZero() || subs[0].Secret != "s3cret" {
+		t.Fatalf("hub subscriptions = %+v, want them verified", subs)
+	}
+
+	if err := s.pushFeeds(ctx); err != nil {
+		t.Fatalf("pushFeeds failed: %v", err)
+	}
+	if len(sub.pushed) != 2 {
+		t.Fatalf("subscriber got %d pushes, want the Atom feed at each callback", len(sub.pushed))
+	}
+	push := sub.pushed[0]
+	if push.URL.Path != "/atom" || push.Header.Get("Content-Type") != "application/atom+xml" ||
+		!strings.Contains(sub.bodies[0], "<title>Third Post</title>") {
+		t.Errorf("push = %s %v %q, want the Atom feed", push.URL, push.Header, sub.bodies[0])
+	}
+	if got := push.Header.Get("X-Hub-Signature"); got != websub.Signature("s3cret", []byte(sub.bodies[0])) {
+		t.Errorf("X-Hub-Signature = %q, want the body signed with the secret", got)
+	}
+	if subs, _ := s.hubStore.GetHubSubscriptions(ctx); len(subs) != 1 {
+		t.Errorf("hub subscriptions after pushing = %+v, want the gone one dropped", subs)
+	}
+
+	subscribe.Set("hub.mode", websub.Unsubscribe)
+	if rec := postHub(router, subscribe); rec.Code != http.StatusAccepted {
+		t.Fatalf("POST %s to unsubscribe = %d, want 202", hubPath, rec.Code)
+	}
+	if err := s.verifyHubRequests(ctx); err != nil {
+		t.Fatalf("verifyHubRequests failed: %v", err)
+	}
+	if subs, _ := s.hubStore.GetHubSubscriptions(ctx); len(subs) != 0 || sub.verified[2].Get("hub.mode") != websub.Unsubscribe {
+		t.Errorf("hub subscriptions after unsubscribing = %+v, want none", subs)
+	}
+}
+
+func TestHubDropsExpired(t *testing.T) {
+	s, raw := newTestServerDB(t, withBuiltinHub)
+	// Leave the fixtures' expired subscription and one that won't verify.
+	if _, err := raw.Exec(`DELETE FROM hub_subscription WHERE id = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Exec(`UPDATE hub_subscription SET callback = 'http://127.0.0.1:1/' WHERE id = 3`); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := s.verifyHubRequests(ctx); err != nil {
+		t.Fatalf("verifyHubRequests failed: %v", err)
+	}
+	if subs, err := s.hubStore.GetHubSubscriptions(ctx); err != nil || len(subs) != 0 {
+		t.Errorf("hub subscriptions = %+v, %v, want the expired and unverified ones dropped", subs, err)
+	}
+}
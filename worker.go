@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// worker runs passes of background work until its context is done, once at
+// start, then every interval or when request is called.
+type worker struct {
+	interval time.Duration
+	wake     chan struct{}
+}
+
+func newWorker(interval time.Duration) *worker {
+	return &worker{interval: interval, wake: make(chan struct{}, 1)}
+}
+
+// pass is one step of a worker's pass. name is what failures are logged as.
+type pass struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// request wakes the worker without waiting for it.
+func (w *worker) request() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+		// A pass is already pending.
+	}
+}
+
+// run runs passes in order each time the worker wakes. A failed pass is
+// logged and doesn't stop the ones after it.
+func (w *worker) run(ctx context.Context, passes ...pass) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		for _, p := range passes {
+			if err := p.run(ctx); err != nil {
+				log.Printf("%s failed: %v", p.name, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
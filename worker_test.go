@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWorkerRequest(t *testing.T) {
+	w := newWorker(time.Hour)
+	// Never blocks, even with nobody listening.
+	w.request()
+	w.request()
+	if len(w.wake) != 1 {
+		t.Errorf("%d pending requests, want 1", len(w.wake))
+	}
+}
+
+func TestWorkerRun(t *testing.T) {
+	w := newWorker(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	passes := make(chan string, 10)
+	go func() {
+		defer close(done)
+		w.run(ctx,
+			pass{"failing", func(context.Context) error {
+				passes <- "failing"
+				return errors.New("boom")
+			}},
+			pass{"next", func(context.Context) error {
+				passes <- "next"
+				return nil
+			}},
+		)
+	}()
+
+	// Once at start, and again when woken, each time carrying on past
+	// the failure.
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			w.request()
+		}
+		for _, want := range []string{"failing", "next"} {
+			if got := <-passes; got != want {
+				t.Fatalf("pass %d ran %q, want %q", i, got, want)
+			}
+		}
+	}
+	cancel()
+	<-done
+}